@@ -0,0 +1,144 @@
+package cloudlus
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ArchiveJobFile is the name of the file holding a job's json data inside
+// its directory in a job archive.
+const ArchiveJobFile = "job.json"
+
+// ArchiveJobs writes jobs as a gzipped tar archive to w.  Each job is stored
+// in a directory named by its id containing the json encoded job in
+// ArchiveJobFile along with all of the job's output files.
+func ArchiveJobs(w io.Writer, jobs ...*Job) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, j := range jobs {
+		if err := archiveJob(tw, j); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func archiveJob(tw *tar.Writer, j *Job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	dir := j.Id.String()
+	if err := writeTarFile(tw, path.Join(dir, ArchiveJobFile), j.Finished, data); err != nil {
+		return err
+	}
+
+	r, err := zip.OpenReader(outfileName(j.Id))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, path.Join(dir, f.Name), j.Finished, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, modtime time.Time, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: modtime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// ExtractJobs reads a job archive created by ArchiveJobs from r and writes
+// the jobs with the given ids (or all jobs if no ids are given) into
+// id-named directories inside dir.  The ids of extracted jobs are returned.
+func ExtractJobs(r io.Reader, dir string, ids ...JobId) ([]JobId, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	want := map[string]bool{}
+	for _, id := range ids {
+		want[id.String()] = true
+	}
+
+	extracted := []JobId{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(hdr.Name)
+		idstr := strings.SplitN(name, "/", 2)[0]
+		if len(want) > 0 && !want[idstr] {
+			continue
+		} else if strings.HasPrefix(name, "..") || path.IsAbs(name) {
+			return nil, fmt.Errorf("invalid archive file path '%v'", hdr.Name)
+		}
+
+		if path.Base(name) == ArchiveJobFile && path.Dir(name) == idstr {
+			id, err := DecodeJobId(idstr)
+			if err != nil {
+				return nil, err
+			}
+			extracted = append(extracted, id)
+		}
+
+		fpath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.Create(fpath)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return extracted, nil
+}
@@ -0,0 +1,56 @@
+package cloudlus
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// TarGzBackend returns a Server.JobNotFoundHandler that looks up jobs in the
+// gzipped tar job archive created by ArchiveJobs at the file path.  Only the
+// job's json data is restored - output files remain in the archive and can
+// be recovered with ExtractJobs.
+func TarGzBackend(path string) func(JobId) (*Job, error) {
+	return func(id JobId) (*Job, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readArchivedJob(f, id)
+	}
+}
+
+// readArchivedJob returns the job with the given id from the job archive
+// read from r.
+func readArchivedJob(r io.Reader, id JobId) (*Job, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	want := path.Join(id.String(), ArchiveJobFile)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("job %v not in archive", id)
+		} else if err != nil {
+			return nil, err
+		}
+		if path.Clean(hdr.Name) != want {
+			continue
+		}
+
+		j := &Job{}
+		if err := json.NewDecoder(tr).Decode(j); err != nil {
+			return nil, err
+		}
+		return j, nil
+	}
+}
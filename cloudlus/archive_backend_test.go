@@ -0,0 +1,64 @@
+package cloudlus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTarGzBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-archive-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "jobs.tar.gz")
+
+	db, _ := NewDB("", dblimit)
+	s, _ := NewTestServer(t, db, func(s *Server) {
+		s.JobNotFoundHandler = TarGzBackend(archive)
+	})
+
+	j := NewJobCmd("echo", "hello")
+	j.AddInfile("in.txt", []byte("input data"))
+	j.Status = StatusComplete
+	j.Stdout = "hello\n"
+	j.Finished = time.Now()
+	if err := db.Put(j); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ArchiveJobs(f, j)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Remove(j); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Get(j.Id)
+	if err != nil {
+		t.Fatalf("purged job not retrieved from archive: %v", err)
+	} else if got.Stdout != j.Stdout || got.Status != j.Status {
+		t.Errorf("got job %+v, want %+v", got, j)
+	}
+
+	// the job is back in the db without infiles
+	got, err = db.Get(j.Id)
+	if err != nil {
+		t.Fatalf("restored job not re-inserted into db: %v", err)
+	} else if len(got.Infiles) != 0 {
+		t.Errorf("restored job has %v infiles, want none", len(got.Infiles))
+	}
+
+	if _, err := s.Get(NewJob().Id); err == nil {
+		t.Errorf("expected error for job missing from db and archive")
+	}
+}
@@ -0,0 +1,83 @@
+package cloudlus
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveExtract(t *testing.T) {
+	j := NewJobCmd("echo", "hello")
+	j.AddOutfile("out.txt")
+	j.Status = StatusComplete
+	j.Stdout = "hello\n"
+	j.Submitted = time.Now().Add(-time.Minute)
+	j.Finished = time.Now()
+
+	outdata := []byte("some output data")
+	f, err := os.Create(outfileName(j.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outfileName(j.Id))
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(outdata)
+	zw.Close()
+	f.Close()
+
+	// a second job to make sure only requested jobs are extracted
+	other := NewJobCmd("echo", "other")
+	other.Status = StatusComplete
+
+	var buf bytes.Buffer
+	if err := ArchiveJobs(&buf, j, other); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "cloudlus-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ids, err := ExtractJobs(&buf, dir, j.Id)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ids) != 1 || ids[0] != j.Id {
+		t.Fatalf("extracted jobs %v, want [%v]", ids, j.Id)
+	}
+	if _, err := os.Stat(filepath.Join(dir, other.Id.String())); !os.IsNotExist(err) {
+		t.Errorf("unrequested job %v was extracted", other.Id)
+	}
+
+	jobdir := filepath.Join(dir, j.Id.String())
+	data, err := ioutil.ReadFile(filepath.Join(jobdir, ArchiveJobFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &Job{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	gotjson, _ := json.Marshal(got)
+	wantjson, _ := json.Marshal(j)
+	if !bytes.Equal(gotjson, wantjson) {
+		t.Errorf("extracted job:\n%s\nwant:\n%s", gotjson, wantjson)
+	}
+
+	gotout, err := ioutil.ReadFile(filepath.Join(jobdir, "out.txt"))
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(gotout, outdata) {
+		t.Errorf("extracted outfile: got %q, want %q", gotout, outdata)
+	}
+}
@@ -1,12 +1,19 @@
 package cloudlus
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/rpc"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,6 +22,9 @@ type Client struct {
 	client *rpc.Client
 	err    error
 	addr   string
+	httpc  *http.Client
+	// tr is the client's own http transport if it has one (see DialTLS).
+	tr *http.Transport
 }
 
 func Dial(addr string) (*Client, error) {
@@ -28,7 +38,35 @@ func Dial(addr string) (*Client, error) {
 	if !strings.HasPrefix(addr, "http://") {
 		addr = "http://" + addr
 	}
-	return &Client{client: client, addr: addr}, nil
+	return &Client{client: client, addr: addr, httpc: http.DefaultClient}, nil
+}
+
+// DialTLS is like Dial except the connection to the server is encrypted
+// using TLS with the given config.  The server must have been created
+// with a matching TLS config (see WithTLS).
+func DialTLS(addr string, config *tls.Config) (*Client, error) {
+	if !strings.Contains(addr, ":") {
+		addr += ":443"
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// perform the same CONNECT handshake as rpc.DialHTTP
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("rpc handshake with %v failed: %v", addr, err)
+	}
+
+	tr := &http.Transport{TLSClientConfig: config, IdleConnTimeout: 90 * time.Second}
+	httpc := &http.Client{Transport: tr}
+	return &Client{client: rpc.NewClient(conn), addr: "https://" + addr, httpc: httpc, tr: tr}, nil
 }
 
 func (c *Client) Heartbeat(w WorkerId, j JobId, done chan struct{}) (kill chan bool) {
@@ -36,11 +74,14 @@ func (c *Client) Heartbeat(w WorkerId, j JobId, done chan struct{}) (kill chan b
 	go func() {
 		tick := time.NewTicker(beatInterval)
 		defer tick.Stop()
+		usage := newUsageSampler()
 		for {
 			select {
 			case <-tick.C:
 				var killval bool
-				err := c.client.Call("RPC.Heartbeat", NewBeat(w, j), &killval)
+				b := NewBeat(w, j)
+				b.Usage = usage.Sample()
+				err := c.client.Call("RPC.Heartbeat", b, &killval)
 				if err != nil {
 					log.Print(err)
 					return
@@ -73,7 +114,7 @@ func (c *Client) PushOutfile(j JobId, r io.Reader) error {
 		return err
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpc.Do(req)
 	if err != nil {
 		return err
 	}
@@ -82,16 +123,118 @@ func (c *Client) PushOutfile(j JobId, r io.Reader) error {
 
 func (c *Client) RetrieveOutfile(j JobId) (io.ReadCloser, error) {
 	path := "/api/v1/job-outfiles/" + j.String()
-	resp, err := http.Get(c.addr + path)
+	resp, err := c.httpc.Get(c.addr + path)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// RetrieveProfile returns the worker CPU profile for job j.  The job must
+// have been run by a worker with tracing enabled.
+func (c *Client) RetrieveProfile(j JobId) (io.ReadCloser, error) {
+	path := "/api/v1/job-profile/" + j.String()
+	resp, err := c.httpc.Get(c.addr + path)
 	if err != nil {
 		return nil, err
+	} else if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("profile retrieval for job %v failed: %s", j, bytes.TrimSpace(msg))
 	}
 	return resp.Body, nil
 }
 
+// ListJobs returns the status of jobs on the server from most to least
+// recently submitted (see Server.ListJobs).  If status or tag are
+// non-empty, only jobs with that status and tag are returned.
+func (c *Client) ListJobs(status, tag string, limit, offset int) ([]*JobStat, error) {
+	q := url.Values{}
+	if status != "" {
+		q.Set("status", status)
+	}
+	if tag != "" {
+		q.Set("tag", tag)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	if offset > 0 {
+		q.Set("offset", strconv.Itoa(offset))
+	}
+
+	resp, err := c.httpc.Get(c.addr + "/api/v1/jobs?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("job listing failed: %s", bytes.TrimSpace(msg))
+	}
+
+	stats := []*JobStat{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// JobStat returns the current status of job jid.
+func (c *Client) JobStat(jid JobId) (*JobStat, error) {
+	resp, err := c.httpc.Get(c.addr + "/api/v1/job-stat/" + jid.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status retrieval for job %v failed: %s", jid, bytes.TrimSpace(msg))
+	}
+
+	stat := &JobStat{}
+	if err := json.NewDecoder(resp.Body).Decode(stat); err != nil {
+		return nil, err
+	}
+	return stat, nil
+}
+
+// WatchJob polls the status of job jid every interval in a separate
+// goroutine.  The job's status is sent on the returned channel initially and
+// every time it changes.  The channel is closed after the job completes or
+// fails.  If polling fails, the channel is closed early and the error is
+// sent on errc.  errc is closed after the status channel, so receiving from
+// it once the status channel is closed yields nil if polling succeeded.
+func (c *Client) WatchJob(jid JobId, interval time.Duration) (stats <-chan *JobStat, errc <-chan error, err error) {
+	stat, err := c.JobStat(jid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch := make(chan *JobStat, 1)
+	ech := make(chan error, 1)
+	go func() {
+		defer close(ech)
+		defer close(ch)
+		ch <- stat
+		for !stat.Done() {
+			time.Sleep(interval)
+			next, err := c.JobStat(jid)
+			if err != nil {
+				ech <- err
+				return
+			} else if next.Status != stat.Status {
+				ch <- next
+			}
+			stat = next
+		}
+	}()
+	return ch, ech, nil
+}
+
 func (c *Client) RetrieveOutfileData(j *Job, fname string) ([]byte, error) {
 	path := "/api/v1/job-outfiles/" + j.Id.String()
-	resp, err := http.Get(c.addr + path)
+	resp, err := c.httpc.Get(c.addr + path)
 	if err != nil {
 		return nil, err
 	}
@@ -116,6 +259,29 @@ func (c *Client) Submit(j *Job) error {
 	return c.client.Call("RPC.SubmitAsync", j, &unused)
 }
 
+// BatchSubmit asynchronously submits all jobs to the server in a single
+// call.  The returned ids can be used to retrieve the jobs once they are
+// complete.  If some jobs are rejected by the server, a *BatchError reporting
+// them is returned along with the ids - the other jobs were submitted.  If
+// any other error is returned, none of the jobs were submitted.
+func (c *Client) BatchSubmit(jobs []*Job) ([]JobId, error) {
+	reply := &BatchReply{}
+	err := c.client.Call("RPC.BatchSubmit", jobs, reply)
+	if err != nil {
+		return nil, err
+	} else if len(reply.Errs) == 0 {
+		return reply.Ids, nil
+	}
+
+	berr := &BatchError{Errs: make([]error, len(reply.Errs))}
+	for i, msg := range reply.Errs {
+		if msg != "" {
+			berr.Errs[i] = errors.New(msg)
+		}
+	}
+	return reply.Ids, berr
+}
+
 func (c *Client) Run(j *Job) (*Job, error) {
 	ch := c.Start(j, nil)
 	result := <-ch
@@ -130,11 +296,13 @@ func (c *Client) Err() error { return c.err }
 // Start submits j and returns a channel where the completed job can be
 // retrieved from.  If the the program doesn't block on the channel, there is
 // no guarantee that the job will be submitted.  For asynchronous submission,
-// use the Submit method.
-func (c *Client) Start(j *Job, ch chan *Job) chan *Job {
+// use the Submit method.  j will not be run until the jobs with the given
+// dependency ids complete successfully (see Job.DependsOn).
+func (c *Client) Start(j *Job, ch chan *Job, deps ...JobId) chan *Job {
 	if ch == nil {
 		ch = make(chan *Job, 1)
 	}
+	j.DependsOn = append(j.DependsOn, deps...)
 
 	go func() {
 		result := &Job{}
@@ -151,15 +319,54 @@ func (c *Client) Start(j *Job, ch chan *Job) chan *Job {
 func (c *Client) Fetch(w *Worker) (*Job, error) {
 	j := &Job{}
 	err := c.client.Call("RPC.Fetch", w.Id, &j)
-	if err != nil {
+	if serr, ok := err.(rpc.ServerError); ok && string(serr) == nojoberr.Error() {
+		// net/rpc doesn't preserve error values
+		return nil, nojoberr
+	} else if err != nil {
 		return nil, err
 	}
 	return j, nil
 }
 
+// Register sends w's command whitelist to the server so it only dispatches
+// jobs to w that it will run.
+func (c *Client) Register(w *Worker) error {
+	var unused int
+	return c.client.Call("RPC.Register", Registration{WorkerId: w.Id, Whitelist: w.Whitelist}, &unused)
+}
+
+// AppendLog sends data to the server as the next piece of the running job
+// jid's stdout.
+func (c *Client) AppendLog(jid JobId, data []byte) error {
+	var unused int
+	return c.client.Call("RPC.AppendLog", LogChunk{Id: jid, Data: data}, &unused)
+}
+
+// CancelJob cancels the queued or running job jid on the server.
+func (c *Client) CancelJob(jid JobId) error {
+	var unused int
+	return c.client.Call("RPC.CancelJob", jid, &unused)
+}
+
+// ResubmitFailed requeues all failed jobs on the server that match q and
+// returns their ids.
+func (c *Client) ResubmitFailed(q ResubmitQuery) ([]JobId, error) {
+	var ids []JobId
+	err := c.client.Call("RPC.ResubmitFailed", q, &ids)
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
 func (c *Client) Push(w *Worker, j *Job) error {
 	var unused int
 	return c.client.Call("RPC.Push", j, &unused)
 }
 
-func (c *Client) Close() error { return c.client.Close() }
+func (c *Client) Close() error {
+	if c.tr != nil {
+		c.tr.CloseIdleConnections()
+	}
+	return c.client.Close()
+}
@@ -1,7 +1,9 @@
 package cloudlus
 
 import (
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"html/template"
 	"net/http"
 	"sort"
@@ -13,13 +15,19 @@ var dashtmplstr = `
     <tr><th>Job ID</th><th>Status</th><th>Output</th></tr>
 
     {{ range $job := .}}
-    <tr class="status-{{$job.Status}}">
-        <td><a href="{{$job.Host}}/dashboard/infile/{{$job.Id}}">{{$job.Id}}</a></td>
+    <tr id="job-{{$job.Id}}" class="status-{{$job.Status}}">
+        <td><a href="{{$job.Host}}/dashboard/infile/{{$job.Id}}">{{$job.Id}}</a>
+            {{range $job.Tags}}<span class="tag tag-{{.Color}}">{{.Name}}</span>{{end}}
+        </td>
 
         {{if eq $job.Status "complete"}}
         <td><a href="{{$job.Host}}/dashboard/output/{{$job.Id}}">{{$job.Status}}</a></td>
         {{else if eq $job.Status "failed"}}
         <td><a href="{{$job.Host}}/dashboard/output/{{$job.Id}}">{{$job.Status}}</a></td>
+        {{else if eq $job.Status "cancelled"}}
+        <td><a href="{{$job.Host}}/dashboard/output/{{$job.Id}}">{{$job.Status}}</a></td>
+        {{else if eq $job.Status "running"}}
+        <td><a href="{{$job.Host}}/dashboard/log/{{$job.Id}}">{{$job.Status}}</a></td>
 		{{else}}
         <td>{{$job.Status}}</td>
         {{end}}
@@ -36,16 +44,68 @@ var dashtmplstr = `
 var tmpl = template.Must(template.New("dashtable").Parse(dashtmplstr))
 var hometmpl = template.Must(template.New("home").Parse(home))
 var resettmpl = template.Must(template.New("reset").Parse(resetPage))
+var logtmpl = template.Must(template.New("log").Parse(logPage))
 
 const ncompleted = 100
 
+// statusCancelled is the status shown on the dashboard for cancelled jobs
+// (which otherwise have StatusFailed).
+const statusCancelled = "cancelled"
+
+// ntagcolors is the number of distinct tag badge colors (tag-N css classes)
+// on the dashboard.
+const ntagcolors = 6
+
 type JobData struct {
 	Id        string
 	Status    string
 	Submitted time.Time
 	Host      string
+	Tags      []TagBadge
+}
+
+// TagBadge is a job tag shown on the dashboard.  Color selects one of the
+// badge colors and is the same for every job with the tag.
+type TagBadge struct {
+	Name  string
+	Color int
+}
+
+func newTagBadge(tag string) TagBadge {
+	h := fnv.New32a()
+	h.Write([]byte(tag))
+	return TagBadge{Name: tag, Color: int(h.Sum32() % ntagcolors)}
+}
+
+// DashUpdate is sent to dashboard websocket subscribers whenever a job
+// changes status (see Server.dashboardWS).
+type DashUpdate struct {
+	Id     string
+	Status string
+	Tags   []TagBadge
+}
+
+func newDashUpdate(j *Job) DashUpdate {
+	u := DashUpdate{Id: j.Id.String(), Status: dashStatus(j)}
+	for _, tag := range j.Tags {
+		u.Tags = append(u.Tags, newTagBadge(tag))
+	}
+	return u
+}
+
+// dashStatus returns the status shown on the dashboard for j.
+func dashStatus(j *Job) string {
+	if j.Cancelled {
+		return statusCancelled
+	}
+	return j.Status
 }
 
+// dashBacklog is the number of dashboard updates buffered for each
+// websocket subscriber.  Updates for subscribers that fall further behind
+// are dropped.
+const dashBacklog = 256
+
 type JobList []*Job
 
 func (s JobList) Len() int      { return len(s) }
@@ -65,10 +125,13 @@ func (s *Server) dashboard(w http.ResponseWriter, r *http.Request) {
 	for _, j := range jobs {
 		jd := JobData{
 			Id:        fmt.Sprintf("%v", j.Id),
-			Status:    j.Status,
+			Status:    dashStatus(j),
 			Submitted: j.Submitted,
 			Host:      s.Host,
 		}
+		for _, tag := range j.Tags {
+			jd.Tags = append(jd.Tags, newTagBadge(tag))
+		}
 		jds = append(jds, jd)
 	}
 
@@ -79,6 +142,57 @@ func (s *Server) dashboard(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// dashboardWS serves a websocket that receives a JSON encoded DashUpdate
+// every time a job is submitted, started, requeued or finished.
+func (s *Server) dashboardWS(w http.ResponseWriter, r *http.Request) {
+	// subscribe before the handshake completes so the client sees every
+	// update after it is connected.
+	ch := make(chan DashUpdate, dashBacklog)
+	select {
+	case s.subscribe <- ch:
+	case <-s.kill:
+		httperror(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer func() {
+		select {
+		case s.unsubscribe <- ch:
+		case <-s.kill:
+		}
+	}()
+
+	conn, br, err := upgradeWebSocket(w, r)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		discardWS(conn, br)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case u := <-ch:
+			data, err := json.Marshal(u)
+			if err != nil {
+				s.log.Error("dashboard update encoding failed", "job_id", u.Id, "err", err)
+				continue
+			}
+			if err := writeWSFrame(conn, wsOpText, data); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-s.kill:
+			return
+		}
+	}
+}
+
 func (s *Server) dashmain(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Access-Control-Allow-Origin", "*")
 	err := hometmpl.Execute(w, s)
@@ -135,6 +249,26 @@ func (s *Server) dashboardOutput(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// dashboardLog serves a page showing a job's stdout that updates live while
+// the job runs.
+func (s *Server) dashboardLog(w http.ResponseWriter, r *http.Request) {
+	idstr := r.URL.Path[len("/dashboard/log/"):]
+	jid, err := DecodeJobId(idstr)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	data := struct {
+		Host string
+		Id   string
+	}{s.Host, jid.String()}
+	if err := logtmpl.Execute(w, data); err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (s *Server) dashboardDefaultInfile(w http.ResponseWriter, r *http.Request) {
 	// allow cross-domain ajax requests for the dashboard content
 	w.Header().Add("Access-Control-Allow-Origin", "*")
@@ -258,6 +392,22 @@ const home = `
 		#dashboard tr.status-failed {
 			background-color:#F0C2B2;
 		}
+		#dashboard tr.status-cancelled {
+			background-color:#E0E0E0;
+		}
+		#dashboard span.tag {
+			padding:1px 6px;
+			margin-left:4px;
+			border-radius:8px;
+			font-size:80%;
+			color:#ffffff;
+		}
+		#dashboard span.tag-0 { background-color:#1f77b4; }
+		#dashboard span.tag-1 { background-color:#ff7f0e; }
+		#dashboard span.tag-2 { background-color:#2ca02c; }
+		#dashboard span.tag-3 { background-color:#d62728; }
+		#dashboard span.tag-4 { background-color:#9467bd; }
+		#dashboard span.tag-5 { background-color:#8c564b; }
 
 		#stats,#since {
 			width:80%;
@@ -326,6 +476,28 @@ const home = `
 				{{.Stats.MaxJobTime}} longest single job run time.
 			</li>
 		</ul>
+		<ul>
+			<li>
+				{{.Stats.TotCmdTime}} cumulative job command time.
+			</li>
+			<li>
+				{{.Stats.AvgCmdTime}} average job command time.
+			</li>
+			<li>
+				{{.Stats.MinCmdTime}} shortest single job command time.
+			</li>
+			<li>
+				{{.Stats.MaxCmdTime}} longest single job command time.
+			</li>
+		</ul>
+		<ul>
+			<li>
+				{{.Stats.AvgQueueTime}} average job queue time.
+			</li>
+			<li>
+				{{.Stats.MaxQueueTime}} longest single job queue time.
+			</li>
+		</ul>
 	</div>
 
     <br>
@@ -348,9 +520,51 @@ const home = `
             })
         }
         function loadDash() {
-            $('#dashboard').load(server + "/dashboard", function() {
-                setTimeout("loadDash()", 30000)
-            });
+            $('#dashboard').load(server + "/dashboard");
+        }
+
+        // job status changes are pushed over a websocket and applied to the
+        // job's table row in place.
+        function connectDash() {
+            var base = server;
+            if (base == "") {
+                base = location.protocol + "//" + location.host;
+            }
+            var ws = new WebSocket(base.replace(/^http/, "ws") + "/ws/dashboard");
+            ws.onopen = function() { loadDash(); };
+            ws.onmessage = function(ev) { updateRow(JSON.parse(ev.data)); };
+            ws.onclose = function() { setTimeout("connectDash()", 5000); };
+        }
+        function statusCell(u) {
+            var pages = {complete: "output", failed: "output", cancelled: "output", running: "log"};
+            var td = $('<td>');
+            if (u.Status in pages) {
+                td.append($('<a>').attr('href', server + "/dashboard/" + pages[u.Status] + "/" + u.Id).text(u.Status));
+            } else {
+                td.text(u.Status);
+            }
+            return td;
+        }
+        function resultsCell(u) {
+            var td = $('<td>');
+            if (u.Status == "complete") {
+                td.append($('<a>').attr('href', server + "/api/v1/job-outfiles/" + u.Id).text("Results"));
+            }
+            return td;
+        }
+        function updateRow(u) {
+            var row = $('#job-' + u.Id);
+            if (row.length == 0) {
+                var idcell = $('<td>').append($('<a>').attr('href', server + "/dashboard/infile/" + u.Id).text(u.Id));
+                $.each(u.Tags || [], function(i, tag) {
+                    idcell.append(" ", $('<span>').addClass("tag tag-" + tag.Color).text(tag.Name));
+                });
+                row = $('<tr>').attr('id', 'job-' + u.Id).append(idcell, $('<td>'), $('<td>'));
+                $('#dashboard tr:first').after(row);
+            }
+            row.attr('class', 'status-' + u.Status);
+            row.children().eq(1).replaceWith(statusCell(u));
+            row.children().eq(2).replaceWith(resultsCell(u));
         }
         function loadDefaultInfile() {
             $.get(server + "/dashboard/default-infile", function( data ) {
@@ -360,6 +574,7 @@ const home = `
 
         loadDefaultInfile();
         loadDash();
+        connectDash();
     </script>
 
 </body>
@@ -390,3 +605,52 @@ var resetPage = `
 </body>
 </html>
 `
+
+var logPage = `
+<!DOCTYPE html>
+<html class="no-js" lang="en-US">
+<head>
+    <title> Job {{.Id}} Output </title>
+    <script src="http://ajax.googleapis.com/ajax/libs/jquery/1.11.1/jquery.min.js"></script>
+</head>
+<body lang="en">
+
+    <h3>Job {{.Id}} output</h3>
+    <pre id="log"></pre>
+
+    <script> 
+        var server = "{{.Host}}"
+        var offset = 0
+
+        // the log endpoint streams new output until the job finishes - the
+        // received output is appended as it arrives and the log is polled
+        // again from the new offset while the job is still unfinished.
+        function pollLog() {
+            var xhr = new XMLHttpRequest();
+            var seen = 0;
+            function appendNew() {
+                var text = xhr.responseText.substring(seen);
+                seen = xhr.responseText.length;
+                offset += new TextEncoder().encode(text).length; // in bytes
+                $('#log').append(document.createTextNode(text));
+            }
+            xhr.onprogress = appendNew;
+            xhr.onload = function() {
+                appendNew();
+                $.getJSON(server + "/api/v1/job-stat/{{.Id}}", function(stat) {
+                    if (stat.Status == "queued" || stat.Status == "running") {
+                        setTimeout("pollLog()", 2000);
+                    }
+                });
+            };
+            xhr.onerror = function() { setTimeout("pollLog()", 5000); };
+            xhr.open("GET", server + "/api/v1/job-log/{{.Id}}?offset=" + offset);
+            xhr.send();
+        }
+
+        pollLog();
+    </script>
+
+</body>
+</html>
+`
@@ -3,6 +3,8 @@ package cloudlus
 import (
 	"io/ioutil"
 	"log"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -11,20 +13,55 @@ import (
 
 const workerpoll = 1 * time.Second
 
+// NewTestServer starts a server using db, or an in-memory db if db is nil,
+// listening on a free local port.  Logging is disabled unless opts set a
+// logger.  It returns the server and its address.  The server is closed when
+// the test finishes.
+func NewTestServer(t *testing.T, db *DB, opts ...ServerOption) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	if db == nil {
+		// empty path for in-memory db
+		db, err = NewDB("", dblimit)
+		if err != nil {
+			l.Close()
+			t.Fatal(err)
+		}
+	}
+	log.SetOutput(devnull)
+	opts = append([]ServerOption{WithLogger(NewJSONLogger(devnull))}, opts...)
+	s := NewServer(addr, addr, db, opts...)
+	go s.Serve(l)
+	t.Cleanup(func() {
+		s.Close()
+		l.Close()
+	})
+	return s, addr
+}
+
+var fastBeats sync.Once
+
+// useFastBeats shortens the heartbeat timings shared by all servers and
+// workers.  They are only set once so parallel tests don't race on them.
+func useFastBeats() {
+	fastBeats.Do(func() {
+		beatInterval = 2 * time.Second
+		beatLimit = 2 * beatInterval
+		beatCheckFreq = beatInterval / 2
+	})
+}
+
 // TestRemoteKill checks that the server will force-terminate jobs that exceed
 // their job timeout - guarding against workers that aren't killing the jobs
 // themselves past the job timeout.
 func TestRemoteKill(t *testing.T) {
-	testaddr := "127.0.0.1:45687"
-	beatInterval = 2 * time.Second
-	beatLimit = 2 * beatInterval
-	beatCheckFreq = beatInterval / 2
-
-	// empty path for in-memory db
-	db, _ := NewDB("", dblimit)
-	s := NewServer(testaddr, testaddr, db)
-	go s.ListenAndServe()
-	defer s.Close()
+	t.Parallel()
+	useFastBeats()
+	s, testaddr := NewTestServer(t, nil)
 
 	// submit job
 	j := NewJobCmd("sleep", "100")
@@ -53,18 +90,9 @@ func TestRemoteKill(t *testing.T) {
 // TestRequeue checks that jobs are successfully requeued and completed
 // after the job's original worker stops beating.
 func TestRequeue(t *testing.T) {
-	testaddr := "127.0.0.1:45689"
-	beatInterval = 2 * time.Second
-	beatLimit = 2 * beatInterval
-	beatCheckFreq = beatInterval / 2
-
-	// empty path for in-memory db
-	db, err := NewDB("", dblimit)
-	s := NewServer(testaddr, testaddr, db)
-	go func() {
-		t.Fatal(s.ListenAndServe())
-	}()
-	defer s.Close()
+	t.Parallel()
+	useFastBeats()
+	s, testaddr := NewTestServer(t, nil)
 
 	// submit job
 	j := NewJobCmd("date")
@@ -3,12 +3,19 @@ package cloudlus
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,8 +31,21 @@ const (
 
 const DefaultInfile = "input.xml"
 
+// ProfileOutfile is the name of the output file holding the worker's CPU
+// profile for jobs run with tracing enabled.  The profile is of the worker
+// process itself (e.g. infile handling and output collection) - not of the
+// job's command, which runs in a separate process.
+const ProfileOutfile = "cloudlus-cpu.pprof"
+
 var DefaultTimeout = 600 * time.Second
 
+// progressFreq is the interval at which running jobs send new stdout to
+// their progress channel (see Job.progressOut).
+var progressFreq = 2 * time.Second
+
+// infileClient is used by AddInfileFromURL to download input files.
+var infileClient = &http.Client{Timeout: 5 * time.Minute}
+
 type Job struct {
 	Id        JobId
 	Cmd       []string
@@ -37,15 +57,56 @@ type Job struct {
 	Timeout   time.Duration
 	Submitted time.Time
 	Fetched   time.Time
+	// QueueTime is the time the job spent waiting in the server queue before
+	// being fetched by a worker.  It is set by the server.
+	QueueTime time.Duration
 	Started   time.Time
-	CmdDur    time.Duration
-	Finished  time.Time
-	WorkerId  WorkerId
-	Note      string
-	dir       string
-	wd        string
-	whitelist []string
-	log       io.Writer
+	// CmdDur is the time spent running the job's command only - i.e.
+	// excluding infile setup and outfile collection.  It is set by Execute.
+	CmdDur   time.Duration
+	Finished time.Time
+	WorkerId WorkerId
+	Note     string
+	// Priority determines the order in which queued jobs are handed out to
+	// workers - higher priority jobs are run first.  Zero is normal
+	// priority.
+	Priority int
+	// DependsOn holds the ids of jobs that must complete successfully before
+	// the job is run.  If any of them fail, the job fails too.
+	DependsOn []JobId
+	// Cancelled is true if the job failed because it was cancelled (see
+	// Server.CancelJob).
+	Cancelled bool
+	// OutfileErrors holds a message for each error that occurred while
+	// collecting the job's output files.
+	OutfileErrors []string
+	// MaxInfileSize is the maximum size in bytes of each of the job's
+	// infiles.  Zero means infiles can be any size.
+	MaxInfileSize int64
+	dir           string
+	wd            string
+	whitelist     []string
+	log           io.Writer
+	// tracedir, if non-empty, is the directory where a CPU profile of the
+	// worker process taken while the job runs is written (see startProfile).
+	tracedir string
+	// progressOut, if non-nil, receives the job's new stdout periodically
+	// while it executes.  It is closed when Execute returns.
+	progressOut chan []byte
+	// MaxRetries is the number of times the server automatically requeues
+	// the job after it fails.  Retries is the number of times it has been
+	// requeued so far.
+	MaxRetries int
+	Retries    int
+	// EarliestRetry is the time before which an automatically retried job
+	// is not handed out to workers.  The delay doubles with every retry.
+	EarliestRetry time.Time
+	// TTL, if non-zero, is the minimum age at which the completed job becomes
+	// eligible for removal from the database, overriding DB.PurgeAge.
+	TTL time.Duration
+	// Tags holds labels (e.g. the experiment name) for grouping jobs.  Jobs
+	// can be retrieved by tag (see DB.ByTag).
+	Tags []string
 }
 
 type File struct {
@@ -53,6 +114,9 @@ type File struct {
 	Data  []byte
 	Size  int
 	Cache bool
+	// Hash is the sha256 hash of Data for cached files.  Workers only
+	// replace their cached copy of a file when its hash changes.
+	Hash []byte
 }
 
 func NewJob() *Job {
@@ -74,7 +138,7 @@ func NewJobCmd(cmd string, args ...string) *Job {
 func NewJobDefault(data []byte) *Job {
 	j := NewJobCmd("cyclus", DefaultInfile)
 	j.AddOutfile("cyclus.sqlite")
-	j.AddInfile(DefaultInfile, data)
+	j.AddInfile(DefaultInfile, data) // new jobs have no size limit
 	return j
 }
 
@@ -86,24 +150,237 @@ func NewJobDefaultFile(fname string) (*Job, error) {
 	return NewJobDefault(data), nil
 }
 
+// DirOption configures how NewJobFromDir builds a job.
+type DirOption func(*dirConfig)
+
+type dirConfig struct {
+	recursive bool
+	ignore    []string
+}
+
+// WithRecursive makes NewJobFromDir also add the files in subdirectories as
+// infiles named by their slash separated paths relative to the directory.
+func WithRecursive() DirOption {
+	return func(c *dirConfig) { c.recursive = true }
+}
+
+// WithIgnorePattern makes NewJobFromDir skip files whose relative path or
+// base name matches glob (see filepath.Match).
+func WithIgnorePattern(glob string) DirOption {
+	return func(c *dirConfig) { c.ignore = append(c.ignore, glob) }
+}
+
+// NewJobFromDir creates a job from the files in dir.  The job's command is
+// read from a JSON array of strings in cmd.txt and the names of its output
+// files from a JSON array in want.txt (if present).  All other files are
+// added as infiles.
+func NewJobFromDir(dir string, opts ...DirOption) (*Job, error) {
+	cfg := &dirConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	for _, glob := range cfg.ignore {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern '%v': %v", glob, err)
+		}
+	}
+
+	j := NewJob()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			if rel != "." && !cfg.recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		for _, glob := range cfg.ignore {
+			inrel, _ := filepath.Match(glob, rel)
+			inbase, _ := filepath.Match(glob, info.Name())
+			if inrel || inbase {
+				return nil
+			}
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if rel == "cmd.txt" {
+			return json.Unmarshal(data, &j.Cmd)
+		} else if rel == "want.txt" {
+			list := []string{}
+			if err := json.Unmarshal(data, &list); err != nil {
+				return err
+			}
+			for _, name := range list {
+				j.AddOutfile(name)
+			}
+			return nil
+		}
+		return j.AddInfile(filepath.ToSlash(rel), data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
 func (j *Job) Whitelist(cmds ...string) {
 	j.whitelist = append(j.whitelist, cmds...)
 }
 
+// HasTag returns true if tag is one of j's tags.
+func (j *Job) HasTag(tag string) bool {
+	for _, t := range j.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
 func (j *Job) Done() bool {
 	return j.Status == StatusComplete || j.Status == StatusFailed
 }
 
+// sendProgress sends new data written to stdout on j.progressOut every
+// progressFreq until stop is closed.  All remaining data is sent before
+// progressOut and then done are closed.
+func (j *Job) sendProgress(stdout *syncBuffer, stop, done chan struct{}) {
+	defer close(done)
+	defer close(j.progressOut)
+
+	tick := time.NewTicker(progressFreq)
+	defer tick.Stop()
+	n := 0
+	for {
+		select {
+		case <-tick.C:
+		case <-stop:
+			if data := stdout.Since(n); len(data) > 0 {
+				j.progressOut <- data
+			}
+			return
+		}
+		if data := stdout.Since(n); len(data) > 0 {
+			j.progressOut <- data
+			n += len(data)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Since returns a copy of the buffer's contents after the first n bytes.
+func (b *syncBuffer) Since(n int) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n >= b.buf.Len() {
+		return nil
+	}
+	return append([]byte{}, b.buf.Bytes()[n:]...)
+}
+
 func (j *Job) AddOutfile(fname string) {
-	j.Outfiles = append(j.Outfiles, File{fname, nil, 0, false})
+	j.Outfiles = append(j.Outfiles, File{fname, nil, 0, false, nil})
 }
 
-func (j *Job) AddInfile(fname string, data []byte) {
-	j.Infiles = append(j.Infiles, File{fname, data, len(data), false})
+// AddInfile adds an input file named fname with the given data to the job.
+// An error is returned and the file is not added if data is larger than
+// j.MaxInfileSize.
+func (j *Job) AddInfile(fname string, data []byte) error {
+	if err := j.checkInfileSize(fname, len(data)); err != nil {
+		return err
+	}
+	j.Infiles = append(j.Infiles, File{fname, data, len(data), false, nil})
+	return nil
+}
+
+// ValidateInfiles returns an error if any of the job's infiles are larger
+// than j.MaxInfileSize.
+func (j *Job) ValidateInfiles() error {
+	for _, f := range j.Infiles {
+		if err := j.checkInfileSize(f.Name, len(f.Data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *Job) checkInfileSize(fname string, size int) error {
+	if j.MaxInfileSize > 0 && int64(size) > j.MaxInfileSize {
+		return fmt.Errorf("infile '%v' is %v bytes which exceeds the limit of %v bytes", fname, size, j.MaxInfileSize)
+	}
+	return nil
 }
 
 func (j *Job) AddInfileCached(fname string, data []byte) {
-	j.Infiles = append(j.Infiles, File{fname, data, len(data), true})
+	sum := sha256.Sum256(data)
+	j.Infiles = append(j.Infiles, File{fname, data, len(data), true, sum[:]})
+}
+
+// AddInfileFromURL downloads the file at url and adds it to the job as a
+// cached input file named fname (see AddInfileCached).  This is useful for
+// large reference data files shared by many jobs.  An error is returned and
+// the file is not added if the download fails or times out, or the file is
+// larger than j.MaxInfileSize.
+func (j *Job) AddInfileFromURL(fname, url string) error {
+	resp, err := infileClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download infile '%v' from %v: %v", fname, url, resp.Status)
+	}
+
+	// read one byte past the limit so oversized files are detected without
+	// downloading all of them.
+	var r io.Reader = resp.Body
+	if j.MaxInfileSize > 0 {
+		r = io.LimitReader(resp.Body, j.MaxInfileSize+1)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	} else if err := j.checkInfileSize(fname, len(data)); err != nil {
+		return err
+	}
+	j.AddInfileCached(fname, data)
+	return nil
+}
+
+// hasInfile returns true if the job has an input file named fname.
+func (j *Job) hasInfile(fname string) bool {
+	for _, f := range j.Infiles {
+		if f.Name == fname {
+			return true
+		}
+	}
+	return false
 }
 
 func (j *Job) Size() int64 {
@@ -128,13 +405,23 @@ func (j *Job) Execute(kill chan bool, outbuf io.Writer) {
 	defer func() { j.Finished = time.Now() }()
 
 	// set up stderr/stdout tee's and exec command
-	var stdout bytes.Buffer
+	var stdout syncBuffer
 	var stderr bytes.Buffer
 	multiout := io.MultiWriter(j.log, &stdout)
 	multierr := io.MultiWriter(j.log, &stderr)
 	defer func() { j.Stdout += stdout.String() }()
 	defer func() { j.Stderr += stderr.String() }()
 
+	if j.progressOut != nil {
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go j.sendProgress(&stdout, stop, done)
+		defer func() {
+			close(stop)
+			<-done
+		}()
+	}
+
 	// make sure job is valid/acceptable
 	if len(j.Cmd) == 0 {
 		j.Status = StatusFailed
@@ -155,22 +442,24 @@ func (j *Job) Execute(kill chan bool, outbuf io.Writer) {
 		}
 	}
 
-	if err := j.setup(); err != nil {
+	err := j.setup()
+	defer j.teardown()
+	if err != nil {
 		j.Status = StatusFailed
 		fmt.Fprint(multierr, err)
 		return
 	}
-	defer j.teardown()
-
-	var err error
 
 	cmd := exec.Command(j.Cmd[0], j.Cmd[1:]...)
+	cmd.Dir = j.dir
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} // required to kill all child processes together with parent
 	fmt.Fprintf(j.log, "running job %v command: %v\n", j.Id, cmd.Args)
 
 	cmd.Stderr = multierr
 	cmd.Stdout = multiout
 
+	stopprof := j.startProfile(multierr)
+
 	// launch job process
 	done := make(chan string)
 	cmdstart := time.Now()
@@ -210,44 +499,94 @@ func (j *Job) Execute(kill chan bool, outbuf io.Writer) {
 	}
 
 	j.CmdDur = time.Now().Sub(cmdstart)
+	stopprof()
 	if j.Status == StatusFailed {
 		return
 	}
 
-	// collect output data
+	// collect output data - stop at the first failure to avoid packaging
+	// a partial set of outfiles.
 	zw := zip.NewWriter(outbuf)
 	for i, f := range j.Outfiles {
-		w, err := zw.Create(f.Name)
+		n, err := zipFile(zw, j.dir, f.Name)
 		if err != nil {
-			j.Status = StatusFailed
-			fmt.Fprintf(multierr, "%v\n", err)
+			j.OutfileErrors = append(j.OutfileErrors, fmt.Sprintf("failed to collect outfile '%v': %v", f.Name, err))
 			break
 		}
+		j.Outfiles[i].Size = int(n)
+	}
 
-		func() {
-			r, err := os.Open(f.Name)
-			if err != nil {
-				j.Status = StatusFailed
-				fmt.Fprintf(multierr, "%v\n", err)
-				return
-			}
-			defer r.Close()
+	if err := zw.Close(); err != nil {
+		j.OutfileErrors = append(j.OutfileErrors, fmt.Sprintf("failed to write outfile zip: %v", err))
+	}
 
-			n, err := io.Copy(w, r)
-			if err != nil {
-				j.Status = StatusFailed
-				fmt.Fprintf(multierr, "%v\n", err)
-				return
-			}
+	for _, msg := range j.OutfileErrors {
+		fmt.Fprintf(multierr, "%v\n", msg)
+	}
+	if len(j.OutfileErrors) > 0 {
+		j.Status = StatusFailed
+	} else {
+		j.Status = StatusComplete
+	}
+}
 
-			j.Outfiles[i].Size = int(n)
-		}()
+// zipFile copies the file fname in directory dir into a new entry of the
+// same name in zw and returns the number of bytes copied.
+func zipFile(zw *zip.Writer, dir, fname string) (int64, error) {
+	r, err := os.Open(filepath.Join(dir, fname))
+	if err != nil {
+		return 0, err
 	}
+	defer r.Close()
 
-	err = zw.Close()
+	w, err := zw.Create(fname)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, r)
+}
+
+// startProfile starts CPU profiling for the job if it has a trace directory
+// set.  The returned function stops profiling and copies the profile into
+// the job's working directory as an outfile named ProfileOutfile.
+//
+// The profile is taken with runtime/pprof, so it only samples the current
+// (worker) Go process and not the job's command, which runs as a child
+// process.  CPU profiling is also process wide: only one job per process can
+// be profiled at a time, and jobs that start while another is being
+// profiled get an error on their stderr and no profile.
+func (j *Job) startProfile(multierr io.Writer) (stop func()) {
+	if j.tracedir == "" {
+		return func() {}
+	}
+
+	path := filepath.Join(j.tracedir, j.Id.String()+".pprof")
+	f, err := os.Create(path)
 	if err != nil {
-		j.Status = StatusFailed
 		fmt.Fprintf(multierr, "%v\n", err)
+		return func() {}
+	}
+
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		fmt.Fprintf(multierr, "%v\n", err)
+		return func() {}
+	}
+
+	return func() {
+		pprof.StopCPUProfile()
+		f.Close()
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(multierr, "%v\n", err)
+			return
+		}
+		if err := ioutil.WriteFile(filepath.Join(j.dir, ProfileOutfile), data, 0644); err != nil {
+			fmt.Fprintf(multierr, "%v\n", err)
+			return
+		}
+		j.AddOutfile(ProfileOutfile)
 	}
 }
 
@@ -276,18 +615,34 @@ func (j *Job) setup() error {
 			return err
 		}
 	}
-	j.dir = uuid.NewRandom().String()
-	err = os.MkdirAll(j.dir, 0755)
-	if err != nil {
-		return err
+
+	// infile names may contain slash separated subdirectories (e.g. from
+	// "pack -recursive") which must stay inside the job directory.  They are
+	// all checked before anything is written so rejected jobs leave nothing
+	// behind.
+	names := make([]string, len(j.Infiles))
+	for i, f := range j.Infiles {
+		name := filepath.Clean(filepath.FromSlash(f.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("infile '%v' is outside of the job directory", f.Name)
+		}
+		names[i] = name
 	}
 
-	if err := os.Chdir(j.dir); err != nil {
+	// the process working directory is left alone so several jobs can run
+	// concurrently in their own directories.
+	j.dir = filepath.Join(j.wd, uuid.NewRandom().String())
+	err = os.MkdirAll(j.dir, 0755)
+	if err != nil {
 		return err
 	}
 
-	for _, f := range j.Infiles {
-		err := ioutil.WriteFile(f.Name, f.Data, 0755)
+	for i, f := range j.Infiles {
+		path := filepath.Join(j.dir, names[i])
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		err := ioutil.WriteFile(path, f.Data, 0755)
 		if err != nil {
 			return err
 		}
@@ -296,15 +651,13 @@ func (j *Job) setup() error {
 }
 
 func (j *Job) teardown() error {
+	if j.dir == "" {
+		return nil
+	}
 	defer func() {
 		j.dir = ""
 	}()
 
-	if err := os.Chdir(j.wd); err != nil {
-		log.Print(err)
-		return err
-	}
-
 	if err := os.RemoveAll(j.dir); err != nil {
 		log.Print(err)
 		return err
@@ -325,20 +678,43 @@ type JobStat struct {
 	Submitted time.Time
 	Started   time.Time
 	Finished  time.Time
+	QueueTime time.Duration
+	// WorkerSetupTime is the time between the job being fetched from the
+	// server and the worker starting to run it.
+	WorkerSetupTime time.Duration
+	Tags            []string
+}
+
+// Done returns true if the job has completed or failed.
+func (s *JobStat) Done() bool {
+	return s.Status == StatusComplete || s.Status == StatusFailed
 }
 
 func NewJobStat(j *Job) *JobStat {
 	return &JobStat{
-		Id:        j.Id,
-		Cmd:       j.Cmd,
-		Status:    j.Status,
-		Size:      j.Size(),
-		Stdout:    j.Stdout,
-		Stderr:    j.Stderr,
-		Submitted: j.Submitted,
-		Started:   j.Started,
-		Finished:  j.Finished,
+		Id:              j.Id,
+		Cmd:             j.Cmd,
+		Status:          j.Status,
+		Size:            j.Size(),
+		Stdout:          j.Stdout,
+		Stderr:          j.Stderr,
+		Submitted:       j.Submitted,
+		Started:         j.Started,
+		Finished:        j.Finished,
+		QueueTime:       j.QueueTime,
+		WorkerSetupTime: j.WorkerSetupTime(),
+		Tags:            j.Tags,
+	}
+}
+
+// WorkerSetupTime returns the time between the job being fetched from the
+// server and the worker starting to run it.  Zero is returned if the job
+// hasn't been fetched and started yet.
+func (j *Job) WorkerSetupTime() time.Duration {
+	if j.Fetched.IsZero() || j.Started.IsZero() {
+		return 0
 	}
+	return j.Started.Sub(j.Fetched)
 }
 
 func killall(multierr io.Writer, cmd *exec.Cmd) {
@@ -350,9 +726,10 @@ func killall(multierr io.Writer, cmd *exec.Cmd) {
 		return
 	}
 
+	// callers wait for the command's exit through the goroutine already
+	// blocked in cmd.Wait - concurrent Wait calls can hang.
 	if err == nil {
 		syscall.Kill(-pgid, 15) // note the minus sign
-		cmd.Wait()
 	} else {
 		fmt.Fprintf(multierr, "\n%v\n", err)
 	}
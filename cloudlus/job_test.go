@@ -1,9 +1,15 @@
 package cloudlus
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -49,3 +55,263 @@ func TestJobKill(t *testing.T) {
 	}
 	fmt.Fprintf(os.Stderr, "\n")
 }
+
+func TestJobCmdDur(t *testing.T) {
+	j := NewJobCmd("sleep", "0.2")
+	j.log = ioutil.Discard
+	j.Execute(nil, ioutil.Discard)
+
+	if j.Status != StatusComplete {
+		t.Fatalf("job failed: %v", j.Stderr)
+	}
+	if tot := j.Finished.Sub(j.Started); j.CmdDur < 200*time.Millisecond || j.CmdDur > tot {
+		t.Errorf("got command duration %v, want at least 200ms and at most the total job time %v", j.CmdDur, tot)
+	}
+}
+
+func TestJobTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j := NewJobCmd("sleep", "1")
+	j.tracedir = dir
+	j.log = ioutil.Discard
+	j.Execute(nil, ioutil.Discard)
+
+	if j.Status != StatusComplete {
+		t.Fatalf("job failed: %v", j.Stderr)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, j.Id.String()+".pprof"))
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Size() == 0 {
+		t.Errorf("job CPU profile is empty")
+	}
+
+	found := false
+	for _, f := range j.Outfiles {
+		if f.Name == ProfileOutfile && f.Size > 0 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("job CPU profile not added to outfiles")
+	}
+}
+
+func TestJobOutfileErrors(t *testing.T) {
+	j := NewJobCmd("touch", "second.txt")
+	j.AddOutfile("first.txt")
+	j.AddOutfile("second.txt")
+	j.log = ioutil.Discard
+	j.Execute(nil, ioutil.Discard)
+
+	if j.Status != StatusFailed {
+		t.Errorf("got status %v, want %v", j.Status, StatusFailed)
+	}
+	if len(j.OutfileErrors) != 1 {
+		t.Fatalf("got %v outfile errors, want 1: %v", len(j.OutfileErrors), j.OutfileErrors)
+	}
+	if msg := j.OutfileErrors[0]; !strings.Contains(msg, "first.txt") {
+		t.Errorf("outfile error doesn't name the missing file: %v", msg)
+	}
+	if !strings.Contains(j.Stderr, j.OutfileErrors[0]) {
+		t.Errorf("outfile error not reported in job stderr")
+	}
+}
+
+func TestAddInfileMaxSize(t *testing.T) {
+	j := NewJobCmd("cat", "small.txt")
+	j.MaxInfileSize = 5
+
+	if err := j.AddInfile("small.txt", []byte("12345")); err != nil {
+		t.Errorf("infile at size limit rejected: %v", err)
+	}
+	if err := j.AddInfile("big.txt", []byte("123456")); err == nil {
+		t.Errorf("infile over size limit accepted")
+	} else if !strings.Contains(err.Error(), "big.txt") {
+		t.Errorf("size limit error doesn't name the infile: %v", err)
+	}
+	if len(j.Infiles) != 1 {
+		t.Errorf("got %v infiles, want 1", len(j.Infiles))
+	}
+
+	j.MaxInfileSize = 4
+	if err := j.ValidateInfiles(); err == nil {
+		t.Errorf("ValidateInfiles accepted infile over size limit")
+	}
+}
+
+func TestJobNestedInfiles(t *testing.T) {
+	j := NewJobCmd("cat", "sub/dir/recipe.xml")
+	j.AddInfile("sub/dir/recipe.xml", []byte("recipe"))
+	j.log = ioutil.Discard
+	j.Execute(nil, ioutil.Discard)
+
+	if j.Status != StatusComplete {
+		t.Fatalf("job failed: %v", j.Stderr)
+	} else if j.Stdout != "recipe" {
+		t.Errorf("got stdout %q, want %q", j.Stdout, "recipe")
+	}
+
+	wd, err := ioutil.TempDir("", "cloudlus-nested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wd)
+
+	for _, name := range []string{"../escape.txt", "/abs.txt"} {
+		j := NewJobCmd("true")
+		j.AddInfile(name, []byte("x"))
+		j.log = ioutil.Discard
+		j.wd = wd
+		j.Execute(nil, ioutil.Discard)
+		if j.Status != StatusFailed {
+			t.Errorf("job with infile %v got status %v, want %v", name, j.Status, StatusFailed)
+		}
+	}
+	if fis, _ := ioutil.ReadDir(wd); len(fis) > 0 {
+		t.Errorf("rejected jobs left %v entries in the working dir", len(fis))
+	}
+}
+
+func TestJobProgress(t *testing.T) {
+	origFreq := progressFreq
+	progressFreq = 50 * time.Millisecond
+	defer func() { progressFreq = origFreq }()
+
+	j := NewJobCmd("sh", "-c", "echo first; sleep 0.5; echo second")
+	j.log = ioutil.Discard
+	j.progressOut = make(chan []byte)
+
+	chunks := make(chan [][]byte)
+	go func() {
+		var got [][]byte
+		for data := range j.progressOut {
+			got = append(got, data)
+		}
+		chunks <- got
+	}()
+	j.Execute(nil, ioutil.Discard)
+	got := <-chunks
+
+	if len(got) < 2 {
+		t.Errorf("got %v progress chunks, want output sent while running", len(got))
+	}
+	if all := string(bytes.Join(got, nil)); all != j.Stdout {
+		t.Errorf("progress output %q doesn't match final stdout %q", all, j.Stdout)
+	}
+}
+
+func TestAddInfileFromURL(t *testing.T) {
+	data := []byte("reference data")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ref.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	j := NewJob()
+	if err := j.AddInfileFromURL("ref.txt", ts.URL+"/ref.txt"); err != nil {
+		t.Fatal(err)
+	} else if len(j.Infiles) != 1 {
+		t.Fatalf("job has %v infiles, want 1", len(j.Infiles))
+	}
+
+	f := j.Infiles[0]
+	sum := sha256.Sum256(data)
+	if f.Name != "ref.txt" || !bytes.Equal(f.Data, data) || f.Size != len(data) {
+		t.Errorf("got infile %v (%q, %v bytes), want ref.txt (%q, %v bytes)", f.Name, f.Data, f.Size, data, len(data))
+	} else if !f.Cache {
+		t.Errorf("infile from url is not cached")
+	} else if !bytes.Equal(f.Hash, sum[:]) {
+		t.Errorf("infile hash is %x, want %x", f.Hash, sum)
+	}
+
+	if err := j.AddInfileFromURL("missing.txt", ts.URL+"/missing.txt"); err == nil {
+		t.Errorf("missing url infile added without error")
+	}
+
+	j.MaxInfileSize = int64(len(data) - 1)
+	if err := j.AddInfileFromURL("big.txt", ts.URL+"/ref.txt"); err == nil {
+		t.Errorf("infile larger than MaxInfileSize added without error")
+	} else if len(j.Infiles) != 1 {
+		t.Errorf("job has %v infiles after failed additions, want 1", len(j.Infiles))
+	}
+
+	j.MaxInfileSize = int64(len(data))
+	if err := j.AddInfileFromURL("exact.txt", ts.URL+"/ref.txt"); err != nil {
+		t.Errorf("infile of exactly MaxInfileSize rejected: %v", err)
+	}
+}
+
+func TestNewJobFromDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudlus-jobdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"cmd.txt":          `["cyclus", "input.xml"]`,
+		"want.txt":         `["cyclus.sqlite"]`,
+		"input.xml":        "<simulation/>",
+		"run.log":          "old log",
+		"data/recipes.xml": "<recipes/>",
+		"data/old.log":     "old log",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		Opts    []DirOption
+		Infiles []string
+	}{
+		{nil, []string{"input.xml", "run.log"}},
+		{[]DirOption{WithRecursive()}, []string{"data/old.log", "data/recipes.xml", "input.xml", "run.log"}},
+		{[]DirOption{WithRecursive(), WithIgnorePattern("*.log")}, []string{"data/recipes.xml", "input.xml"}},
+		{[]DirOption{WithRecursive(), WithIgnorePattern("data/*")}, []string{"input.xml", "run.log"}},
+	}
+
+	for i, test := range tests {
+		j, err := NewJobFromDir(dir, test.Opts...)
+		if err != nil {
+			t.Fatalf("case %v: %v", i, err)
+		}
+		if got := strings.Join(j.Cmd, " "); got != "cyclus input.xml" {
+			t.Errorf("case %v: got command %q, want %q", i, got, "cyclus input.xml")
+		}
+		if len(j.Outfiles) != 1 || j.Outfiles[0].Name != "cyclus.sqlite" {
+			t.Errorf("case %v: got outfiles %v, want [cyclus.sqlite]", i, j.Outfiles)
+		}
+
+		got := []string{}
+		for _, f := range j.Infiles {
+			got = append(got, f.Name)
+			if string(f.Data) != files[f.Name] {
+				t.Errorf("case %v: infile %v has data %q, want %q", i, f.Name, f.Data, files[f.Name])
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.Infiles) {
+			t.Errorf("case %v: got infiles %v, want %v", i, got, test.Infiles)
+		}
+	}
+
+	if _, err := NewJobFromDir(dir, WithIgnorePattern("[")); err == nil {
+		t.Errorf("invalid ignore pattern didn't cause an error")
+	}
+}
@@ -0,0 +1,35 @@
+package cloudlus
+
+import (
+	"crypto/tls"
+	"io"
+	"log/slog"
+)
+
+// Logger receives the server's structured log records.  Fields are
+// alternating key/value pairs (e.g. "job_id", j.Id).
+type Logger interface {
+	Info(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// NewJSONLogger returns a Logger that writes each record to w as a single
+// line JSON object.
+func NewJSONLogger(w io.Writer) Logger {
+	return slog.New(slog.NewJSONHandler(w, nil))
+}
+
+// ServerOption configures optional server behavior in NewServer.
+type ServerOption func(*Server)
+
+// WithTLS makes the server wrap both of its listeners in TLS using config.
+// Clients must then connect using DialTLS.
+func WithTLS(config *tls.Config) ServerOption {
+	return func(s *Server) { s.tlsConfig = config }
+}
+
+// WithLogger makes the server send its log records to l instead of writing
+// them as JSON to stdout.
+func WithLogger(l Logger) ServerOption {
+	return func(s *Server) { s.log = l }
+}
@@ -0,0 +1,88 @@
+package cloudlus
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	j := NewJob()
+	NewJSONLogger(&buf).Info("job submitted", "job_id", j.Id, "duration", time.Second)
+
+	rec := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("log record %q is not json: %v", buf.Bytes(), err)
+	}
+	if rec["msg"] != "job submitted" || rec["level"] != "INFO" {
+		t.Errorf("got msg %v and level %v, want 'job submitted' and INFO", rec["msg"], rec["level"])
+	}
+	if rec["job_id"] != j.Id.String() {
+		t.Errorf("got job_id %v, want %v", rec["job_id"], j.Id)
+	}
+}
+
+// recordLogger records the messages and fields of all log records.
+type recordLogger struct {
+	mu      sync.Mutex
+	records []map[string]interface{}
+}
+
+func (l *recordLogger) Info(msg string, fields ...interface{})  { l.record(msg, fields) }
+func (l *recordLogger) Error(msg string, fields ...interface{}) { l.record(msg, fields) }
+
+func (l *recordLogger) record(msg string, fields []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rec := map[string]interface{}{"msg": msg}
+	for i := 0; i+1 < len(fields); i += 2 {
+		rec[fields[i].(string)] = fields[i+1]
+	}
+	l.records = append(l.records, rec)
+}
+
+func (l *recordLogger) find(msg string) map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, rec := range l.records {
+		if rec["msg"] == msg {
+			return rec
+		}
+	}
+	return nil
+}
+
+func TestServerWithLogger(t *testing.T) {
+	l := &recordLogger{}
+	s, testaddr := NewTestServer(t, nil, WithLogger(l))
+
+	j := NewJobCmd("echo", "hello")
+	ch, err := s.Start(j, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(outfileName(j.Id))
+
+	w := &Worker{MaxJobsTotal: 1, Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	go w.Run()
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("job never completed")
+	case <-ch:
+	}
+
+	if rec := l.find("job submitted"); rec == nil {
+		t.Error("no log record for job submission")
+	} else if rec["job_id"] != j.Id {
+		t.Errorf("submit record has job_id %v, want %v", rec["job_id"], j.Id)
+	}
+	if rec := l.find("job pushed"); rec == nil {
+		t.Error("no log record for pushed job")
+	} else if rec["status"] != StatusComplete || rec["worker_id"] != w.Id {
+		t.Errorf("push record has status %v and worker_id %v, want %v and %v", rec["status"], rec["worker_id"], StatusComplete, w.Id)
+	}
+}
@@ -0,0 +1,80 @@
+package cloudlus
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// jobDurationBuckets holds the upper bounds in seconds of the
+// cloudlus_job_duration_seconds and cloudlus_job_cmd_duration_seconds
+// histogram buckets.
+var jobDurationBuckets = []float64{1, 10, 60, 300, 600, 1800, 3600, 7200, 21600}
+
+// histogram is a minimal prometheus style histogram of observed values.
+type histogram struct {
+	bounds []float64
+	// counts holds the number of observations in each bucket (not
+	// cumulative) with a final bucket for values above the last bound.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) Observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// writeMetrics writes the server's metrics in the prometheus text exposition
+// format.  It must only be called by the dispatcher.
+func (s *Server) writeMetrics(w io.Writer) {
+	metric := func(name, typ, help string, v int) {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v %v\n", name, help, name, typ, name, v)
+	}
+	metric("cloudlus_jobs_submitted_total", "counter", "Number of jobs submitted to the server.", s.Stats.NSubmitted)
+	metric("cloudlus_jobs_completed_total", "counter", "Number of jobs that completed successfully.", s.Stats.NCompleted)
+	metric("cloudlus_jobs_failed_total", "counter", "Number of jobs that failed.", s.Stats.NFailed)
+	metric("cloudlus_queue_depth", "gauge", "Number of jobs waiting in the queue.", len(s.queue))
+	metric("cloudlus_running_jobs", "gauge", "Number of jobs currently running on workers.", len(s.jobinfo))
+	metric("cloudlus_workers_banned_total", "counter", "Number of workers permanently banned for failing jobs.", s.nBannedWorkers())
+
+	writeHistogram(w, "cloudlus_job_duration_seconds", "Run time of completed jobs.", s.jobdurations)
+	writeHistogram(w, "cloudlus_job_cmd_duration_seconds", "Command execution time of completed jobs excluding setup and teardown.", s.cmddurations)
+}
+
+func writeHistogram(w io.Writer, name, help string, h *histogram) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", name, help, name)
+	var cum uint64
+	for i, bound := range h.bounds {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%v_bucket{le=\"%v\"} %v\n", name, formatFloat(bound), cum)
+	}
+	fmt.Fprintf(w, "%v_bucket{le=\"+Inf\"} %v\n", name, h.count)
+	fmt.Fprintf(w, "%v_sum %v\n%v_count %v\n", name, formatFloat(h.sum), name, h.count)
+}
+
+func formatFloat(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+
+// Metrics returns the server's metrics in the prometheus text exposition
+// format.
+func (s *Server) Metrics() []byte {
+	ch := make(chan []byte, 1)
+	s.metrics <- ch
+	return <-ch
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(s.Metrics())
+}
@@ -0,0 +1,93 @@
+package cloudlus
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{1, 10})
+	for _, v := range []float64{0.5, 1, 5, 20} {
+		h.Observe(v)
+	}
+
+	want := []uint64{2, 1, 1}
+	for i, n := range want {
+		if h.counts[i] != n {
+			t.Errorf("bucket %v has %v observations, want %v", i, h.counts[i], n)
+		}
+	}
+	if h.count != 4 || h.sum != 26.5 {
+		t.Errorf("got count %v and sum %v, want 4 and 26.5", h.count, h.sum)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	s, testaddr := NewTestServer(t, nil)
+
+	good := NewJobCmd("echo", "1")
+	bad := NewJobCmd("false")
+	for _, j := range []*Job{good, bad} {
+		s.Start(j, nil)
+		defer os.Remove(outfileName(j.Id))
+	}
+	queued := NewJobCmd("echo", "1")
+	queued.DependsOn = []JobId{NewJob().Id} // never ready to run
+	s.Start(queued, nil)
+
+	w := &Worker{MaxJobsTotal: 2, Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	done := make(chan struct{})
+	go func() {
+		w.Run()
+		close(done)
+	}()
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("worker failed to run jobs")
+	case <-done:
+	}
+
+	resp, err := http.Get("http://" + testaddr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"# TYPE cloudlus_jobs_submitted_total counter",
+		"cloudlus_jobs_submitted_total 3",
+		"cloudlus_jobs_completed_total 1",
+		"cloudlus_jobs_failed_total 1",
+		"cloudlus_queue_depth 1",
+		"cloudlus_running_jobs 0",
+		"cloudlus_workers_banned_total 0",
+		"# TYPE cloudlus_job_duration_seconds histogram",
+		`cloudlus_job_duration_seconds_bucket{le="1"} 1`,
+		`cloudlus_job_duration_seconds_bucket{le="+Inf"} 1`,
+		"cloudlus_job_duration_seconds_count 1",
+		"# TYPE cloudlus_job_cmd_duration_seconds histogram",
+		`cloudlus_job_cmd_duration_seconds_bucket{le="1"} 1`,
+		"cloudlus_job_cmd_duration_seconds_count 1",
+	}
+	lines := strings.Split(string(data), "\n")
+	for _, w := range want {
+		found := false
+		for _, line := range lines {
+			if line == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("metrics missing line %q:\n%s", w, data)
+		}
+	}
+}
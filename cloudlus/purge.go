@@ -0,0 +1,97 @@
+package cloudlus
+
+import (
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// PurgePolicy decides which jobs are removed from the database during
+// garbage collection (see DB.GC).  dbsize is the cumulative size in bytes of
+// all jobs in the database before any purging.
+type PurgePolicy interface {
+	ShouldPurge(j *Job, dbsize int64) bool
+}
+
+// gcPreparer is implemented by purge policies that need to examine the
+// whole database before GC asks them about individual jobs.
+type gcPreparer interface {
+	prepareGC(d *DB) error
+}
+
+// AgePurgePolicy purges completed (successful and failed) jobs that finished
+// more than Age ago.  Jobs with a non-zero TTL use their TTL instead of Age.
+type AgePurgePolicy struct {
+	Age time.Duration
+}
+
+func (p AgePurgePolicy) ShouldPurge(j *Job, dbsize int64) bool {
+	age := p.Age
+	if j.TTL > 0 {
+		age = j.TTL
+	}
+	return j.Done() && time.Since(j.Finished) > age
+}
+
+// CountPurgePolicy purges all completed jobs except the MaxJobs most
+// recently finished ones regardless of their age.  It must be used as a
+// pointer (i.e. &CountPurgePolicy{...}) because it records the jobs to keep
+// at the start of each GC.
+type CountPurgePolicy struct {
+	MaxJobs int
+	keep    map[JobId]bool
+}
+
+func (p *CountPurgePolicy) prepareGC(d *DB) error {
+	it := d.db.NewIterator(util.BytesPrefix([]byte(finishPrefix)), nil)
+	defer it.Release()
+
+	// the last iterated over jobs are the most recent
+	ids := []JobId{}
+	for it.Next() {
+		var id JobId
+		copy(id[:], it.Value())
+		ids = append(ids, id)
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	if len(ids) > p.MaxJobs {
+		ids = ids[len(ids)-p.MaxJobs:]
+	}
+	p.keep = make(map[JobId]bool, len(ids))
+	for _, id := range ids {
+		p.keep[id] = true
+	}
+	return nil
+}
+
+func (p *CountPurgePolicy) ShouldPurge(j *Job, dbsize int64) bool {
+	return j.Done() && !p.keep[j.Id]
+}
+
+// CompositePurgePolicy purges a job if any of its Policies would purge it.
+type CompositePurgePolicy struct {
+	Policies []PurgePolicy
+}
+
+func (p CompositePurgePolicy) prepareGC(d *DB) error {
+	for _, sub := range p.Policies {
+		if prep, ok := sub.(gcPreparer); ok {
+			if err := prep.prepareGC(d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p CompositePurgePolicy) ShouldPurge(j *Job, dbsize int64) bool {
+	for _, sub := range p.Policies {
+		if sub.ShouldPurge(j, dbsize) {
+			return true
+		}
+	}
+	return false
+}
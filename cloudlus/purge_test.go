@@ -0,0 +1,71 @@
+package cloudlus
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCountPurgePolicy(t *testing.T) {
+	db, _ := NewDB("", 1) // always over the limit
+	db.PurgePolicy = &CountPurgePolicy{MaxJobs: 2}
+
+	// jobs finished from oldest to newest plus one still running
+	jobs := []*Job{}
+	for i := 0; i < 4; i++ {
+		j := NewJobCmd("echo", "1")
+		j.Status = StatusComplete
+		j.Finished = time.Now().Add(time.Duration(i-10) * time.Second)
+		jobs = append(jobs, j)
+	}
+	running := NewJobCmd("echo", "1")
+	running.Status = StatusRunning
+	jobs = append(jobs, running)
+	if err := db.PutBatch(jobs); err != nil {
+		t.Fatal(err)
+	}
+
+	npurged, nremain, err := db.GC()
+	if err != nil {
+		t.Fatal(err)
+	} else if npurged != 2 || nremain != 3 {
+		t.Fatalf("GC purged %v and kept %v jobs, want 2 and 3", npurged, nremain)
+	}
+	for _, j := range jobs[2:] {
+		if _, err := db.Get(j.Id); err != nil {
+			t.Errorf("recent or running job %v was purged: %v", j.Id, err)
+		}
+	}
+}
+
+func TestCompositePurgePolicy(t *testing.T) {
+	old := NewJobCmd("echo", "1")
+	old.Status = StatusComplete
+	old.Finished = time.Now().Add(-time.Hour)
+	recent := NewJobCmd("echo", "1")
+	recent.Status = StatusFailed
+	recent.Finished = time.Now()
+
+	age := AgePurgePolicy{Age: time.Minute}
+	if !age.ShouldPurge(old, 0) || age.ShouldPurge(recent, 0) {
+		t.Errorf("age policy should only purge the old job")
+	}
+
+	keepall := &CountPurgePolicy{MaxJobs: 10, keep: map[JobId]bool{old.Id: true, recent.Id: true}}
+	keepnone := &CountPurgePolicy{MaxJobs: 0, keep: map[JobId]bool{}}
+	tests := []struct {
+		Policy      CompositePurgePolicy
+		Old, Recent bool
+	}{
+		{CompositePurgePolicy{}, false, false},
+		{CompositePurgePolicy{[]PurgePolicy{age, keepall}}, true, false},
+		{CompositePurgePolicy{[]PurgePolicy{age, keepnone}}, true, true},
+	}
+	for i, test := range tests {
+		if got := test.Policy.ShouldPurge(old, 0); got != test.Old {
+			t.Errorf("case %v: purge old job = %v, want %v", i, got, test.Old)
+		}
+		if got := test.Policy.ShouldPurge(recent, 0); got != test.Recent {
+			t.Errorf("case %v: purge recent job = %v, want %v", i, got, test.Recent)
+		}
+	}
+}
@@ -1,12 +1,20 @@
 package cloudlus
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/rpc"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,6 +24,11 @@ const dblimit = 7000 * MB
 
 var nojoberr = errors.New("no jobs available to run")
 
+var (
+	errQueueFull   = errors.New("job queue is full")
+	errClientLimit = errors.New("too many unfinished jobs submitted from this address")
+)
+
 const defaultdbpath = "./jobdb"
 
 // defaultCollectFreq if the duration between old job purging from db.
@@ -25,16 +38,32 @@ var beatInterval = 30 * time.Second
 var beatLimit = 3 * beatInterval
 var beatCheckFreq = beatInterval / 3
 
+// workerStatTTL is how long a worker's stats are kept after its last
+// heartbeat.
+var workerStatTTL = 1 * time.Hour
+
+// defaultSubmitchansTTL is the default interval between checks for
+// submitters waiting on jobs that no longer exist in the db.
+var defaultSubmitchansTTL = 10 * time.Minute
+
+// retryBackoff is the unit of the exponential delay before automatically
+// retried jobs are run again - the n'th retry waits 2^n units.
+var retryBackoff = 1 * time.Second
+
+// maxRetryShift caps the exponent of the retry delay.
+const maxRetryShift = 16
+
 // nfailban is the number of consecutive jobs after which a worker is
 // permanently banned from receiving more jobs
 var nfailban = 4
 
 type Server struct {
-	log          *log.Logger
+	log          Logger
 	serv         *http.Server
 	Host         string
 	CollectFreq  time.Duration
 	submitjobs   chan jobSubmit
+	submitbatch  chan []jobSubmit
 	submitchans  map[[16]byte]chan *Job
 	retrievejobs chan jobRequest
 	pushjobs     chan *Job
@@ -48,10 +77,93 @@ type Server struct {
 	beat         chan Beat
 	rpcaddr      string
 	kill         chan struct{}
-	Stats        *Stats
-	rpcserv      *rpc.Server
+	// Stats must only be accessed by the dispatcher - use ServerStats
+	// elsewhere.
+	Stats    *Stats
+	statsreq chan chan Stats
+	purged   chan int
+	// submitchansTTL is the interval at which submitchans are checked for
+	// waiting on jobs that have been deleted from the db.
+	submitchansTTL time.Duration
+	// AllowedWorkerIPs holds the ip addresses and/or CIDR notation networks
+	// (e.g. "10.0.0.0/8") of hosts allowed to fetch jobs.  If empty, all
+	// hosts are allowed.
+	AllowedWorkerIPs []string
+	// MaxJobSize is the maximum size in bytes (see Job.Size) of jobs that can
+	// be submitted via the REST api.  Zero means jobs can be any size.
+	MaxJobSize int64
+	// MaxQueueDepth, if nonzero, is the queue length at which jobs submitted
+	// via the REST api are rejected.
+	MaxQueueDepth int
+	// MaxJobsPerClient, if nonzero, is the maximum number of queued and
+	// running jobs submitted via the REST api from a single ip address.
+	MaxJobsPerClient int
+	// clientjobs holds the number of unfinished jobs submitted from each
+	// client ip address and submitters the address each of those jobs came
+	// from.
+	clientjobs map[string]int
+	submitters map[JobId]string
+	// JobNotFoundHandler, if non-nil, is called by Get for jobs that are not
+	// in the database (e.g. because they were purged) to look them up in
+	// external storage (see TarGzBackend).  Jobs it finds are re-inserted
+	// into the database without their infiles.
+	JobNotFoundHandler func(id JobId) (*Job, error)
+	// PriorityLevels, if nonzero, is the number of job priority levels.  Job
+	// priorities are clamped to the range [0, PriorityLevels-1].
+	PriorityLevels int
+	setpriority    chan priorityRequest
+	canceljobs     chan cancelRequest
+	resubmit       chan resubmitRequest
+	// joblogs holds the stdout streamed so far by workers for each running
+	// job.
+	joblogs map[JobId]*bytes.Buffer
+	logmu   sync.Mutex
 	// workerFailures tracks consecutive failed jobs from workers
 	workerFailures map[WorkerId]int
+	// workers holds the most recent activity of each worker that has sent a
+	// heartbeat.
+	workers     map[WorkerId]WorkerStat
+	workerstats chan chan []WorkerStat
+	// tlsConfig, if non-nil, is used to serve all connections over TLS.
+	tlsConfig *tls.Config
+	// ResultCache, if true, makes the server complete submitted jobs that
+	// are identical (see resultKey) to a previously completed job
+	// immediately with a copy of its results instead of running them.
+	ResultCache bool
+	results     map[[32]byte]*Job
+	// cachecopying holds the jobs whose cached outfiles are being copied
+	// before completing them from the result cache.
+	cachecopying map[JobId]bool
+	cachecopied  chan cacheCopy
+	// jobdurations is the histogram of completed job run times reported
+	// as a prometheus metric (see Metrics).
+	jobdurations *histogram
+	// cmddurations is the histogram of completed job command execution
+	// times (see Job.CmdDur).
+	cmddurations *histogram
+	metrics      chan chan []byte
+	// whitelists holds the command whitelist registered by each worker (see
+	// RPC.Register).  Workers are only sent jobs their whitelist allows.
+	whitelists map[WorkerId][]string
+	register   chan Registration
+	// subscribers receive a DashUpdate every time a job changes status (see
+	// broadcast).
+	subscribers []chan<- DashUpdate
+	subscribe   chan chan<- DashUpdate
+	unsubscribe chan chan<- DashUpdate
+}
+
+// WorkerStat summarizes the recent activity of a worker as seen by the
+// server.
+type WorkerStat struct {
+	WorkerId WorkerId
+	// CurrentJobId is the job the worker sent its last heartbeat for.  It
+	// is zero once the worker pushes that job back.
+	CurrentJobId        JobId
+	LastBeat            time.Time
+	ConsecutiveFailures int
+	// Usage is the worker's most recently reported resource usage.
+	Usage ResourceUsage
 }
 
 type Stats struct {
@@ -74,28 +186,66 @@ type Stats struct {
 	AvgCmdTime  time.Duration
 	MinCmdTime  time.Duration
 	MaxCmdTime  time.Duration
+	// queue times are tracked for every job fetched by a worker.
+	NFetched     int
+	TotQueueTime time.Duration
+	AvgQueueTime time.Duration
+	MaxQueueTime time.Duration
+	// NAutoRetried is the number of times failed jobs have been
+	// automatically requeued (see Job.MaxRetries).
+	NAutoRetried int
+	// NCacheHits is the number of submitted jobs completed from the result
+	// cache (see Server.ResultCache).
+	NCacheHits int
 }
 
 // TODO: Make worker RPC serving separate from submitter RPC interface serving
 // to allow for local listening only for job submission for more security.
 
-func NewServer(httpaddr, rpcaddr string, db *DB) *Server {
+// NewServer creates a server listening for http requests on httpaddr and for
+// worker rpc connections on rpcaddr.
+func NewServer(httpaddr, rpcaddr string, db *DB, opts ...ServerOption) *Server {
 	s := &Server{
 		submitjobs:     make(chan jobSubmit),
+		submitbatch:    make(chan []jobSubmit),
 		submitchans:    map[[16]byte]chan *Job{},
+		submitchansTTL: defaultSubmitchansTTL,
 		retrievejobs:   make(chan jobRequest),
 		pushjobs:       make(chan *Job),
 		fetchjobs:      make(chan workRequest),
+		setpriority:    make(chan priorityRequest),
+		canceljobs:     make(chan cancelRequest),
+		resubmit:       make(chan resubmitRequest),
+		joblogs:        map[JobId]*bytes.Buffer{},
 		jobinfo:        map[JobId]Beat{},
 		running:        map[JobId]*Job{},
 		beat:           make(chan Beat),
 		reset:          make(chan struct{}),
 		rpcaddr:        rpcaddr,
-		log:            log.New(os.Stdout, "", log.LstdFlags),
+		log:            NewJSONLogger(os.Stdout),
 		kill:           make(chan struct{}),
 		CollectFreq:    defaultCollectFreq,
 		Stats:          &Stats{},
+		statsreq:       make(chan chan Stats),
+		purged:         make(chan int),
 		workerFailures: map[WorkerId]int{},
+		workers:        map[WorkerId]WorkerStat{},
+		workerstats:    make(chan chan []WorkerStat),
+		results:        map[[32]byte]*Job{},
+		cachecopying:   map[JobId]bool{},
+		cachecopied:    make(chan cacheCopy),
+		jobdurations:   newHistogram(jobDurationBuckets),
+		cmddurations:   newHistogram(jobDurationBuckets),
+		metrics:        make(chan chan []byte),
+		whitelists:     map[WorkerId][]string{},
+		register:       make(chan Registration),
+		clientjobs:     map[string]int{},
+		submitters:     map[JobId]string{},
+		subscribe:      make(chan chan<- DashUpdate),
+		unsubscribe:    make(chan chan<- DashUpdate),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 
 	var err error
@@ -120,25 +270,31 @@ func NewServer(httpaddr, rpcaddr string, db *DB) *Server {
 	mux.HandleFunc("/reset/", s.dashreset)
 	mux.HandleFunc("/api/v1/reset-queue", s.handleReset)
 	mux.HandleFunc("/api/v1/job", s.handleJob)
+	mux.HandleFunc("/api/v1/jobs", s.handleJobs)
 	mux.HandleFunc("/api/v1/job/", s.handleJob)
 	mux.HandleFunc("/api/v1/job-stat/", s.handleJobStat)
+	mux.HandleFunc("/api/v1/job-priority/", s.handleJobPriority)
+	mux.HandleFunc("/api/v1/job-log/", s.handleJobLog)
 	mux.HandleFunc("/api/v1/job-infile", s.handleSubmitInfile)
 	mux.HandleFunc("/api/v1/job-outfiles/", s.handleOutfiles)
+	mux.HandleFunc("/api/v1/job-profile/", s.handleJobProfile)
 	mux.HandleFunc("/api/v1/server-stats/", s.handleServerStats)
+	mux.HandleFunc("/api/v1/worker-stats", s.handleWorkerStats)
+	mux.HandleFunc("/api/v1/worker-stats/", s.handleWorkerStats)
+	mux.HandleFunc("/metrics", s.handleMetrics)
 	mux.HandleFunc("/dashboard", s.dashboard)
 	mux.HandleFunc("/dashboard/", s.dashboard)
 	mux.HandleFunc("/dashboard/infile/", s.dashboardInfile)
 	mux.HandleFunc("/dashboard/output/", s.dashboardOutput)
+	mux.HandleFunc("/dashboard/log/", s.dashboardLog)
 	mux.HandleFunc("/dashboard/default-infile", s.dashboardDefaultInfile)
+	mux.HandleFunc("/ws/dashboard", s.dashboardWS)
 
-	s.rpc = &RPC{s}
-	s.rpcserv = rpc.NewServer()
-	s.rpcserv.Register(s.rpc)
-
+	s.rpc = &RPC{s: s}
 	if httpaddr == rpcaddr {
-		mux.Handle(rpc.DefaultRPCPath, s.rpcserv)
+		mux.Handle(rpc.DefaultRPCPath, rpcConnHandler{s})
 	} else {
-		s.rpcserv.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
+		http.Handle(rpc.DefaultRPCPath, rpcConnHandler{s})
 	}
 
 	s.serv = &http.Server{Addr: httpaddr, Handler: mux}
@@ -146,6 +302,20 @@ func NewServer(httpaddr, rpcaddr string, db *DB) *Server {
 }
 
 func (s *Server) ListenAndServe() error {
+	s.start()
+	return s.listenAndServe(s.serv)
+}
+
+// Serve is like ListenAndServe except that http connections are accepted on
+// l instead of on the server's http address.
+func (s *Server) Serve(l net.Listener) error {
+	s.start()
+	return s.serve(s.serv, l)
+}
+
+// start launches the dispatcher, the db garbage collector and (if it is
+// separate from the http address) the worker rpc listener.
+func (s *Server) start() {
 	s.Stats.Started = time.Now()
 	go s.dispatcher()
 	go func() {
@@ -155,11 +325,15 @@ func (s *Server) ListenAndServe() error {
 				return
 			default:
 				npurged, nremain, err := s.alljobs.GC()
-				s.Stats.NPurged += npurged
+				select {
+				case s.purged <- npurged:
+				case <-s.kill:
+					return
+				}
 				if err != nil {
-					s.log.Print(err)
+					s.log.Error("db garbage collection failed", "err", err)
 				}
-				s.log.Printf("[INFO] purged %v old jobs from db, %v remain\n", npurged, nremain)
+				s.log.Info("purged old jobs from db", "purged", npurged, "remaining", nremain)
 			}
 			<-time.After(s.CollectFreq)
 		}
@@ -167,12 +341,32 @@ func (s *Server) ListenAndServe() error {
 
 	if s.rpcaddr != s.serv.Addr {
 		go func() {
-			if err := http.ListenAndServe(s.rpcaddr, nil); err != nil {
+			if err := s.listenAndServe(&http.Server{Addr: s.rpcaddr}); err != nil {
 				log.Fatal(err)
 			}
 		}()
 	}
-	return s.serv.ListenAndServe()
+}
+
+// listenAndServe runs serv on its address, serving over TLS if the server
+// has a TLS config.
+func (s *Server) listenAndServe(serv *http.Server) error {
+	if s.tlsConfig == nil {
+		return serv.ListenAndServe()
+	}
+	l, err := net.Listen("tcp", serv.Addr)
+	if err != nil {
+		return err
+	}
+	return s.serve(serv, l)
+}
+
+// serve runs serv on l, serving over TLS if the server has a TLS config.
+func (s *Server) serve(serv *http.Server, l net.Listener) error {
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
+	return serv.Serve(l)
 }
 
 func (s *Server) Close() error {
@@ -180,34 +374,454 @@ func (s *Server) Close() error {
 	return s.alljobs.Close()
 }
 
-func (s *Server) Run(j *Job) *Job {
-	ch := s.Start(j, nil)
-	return <-ch
+func (s *Server) Run(j *Job) (*Job, error) {
+	ch, err := s.Start(j, nil)
+	if err != nil {
+		return nil, err
+	}
+	return <-ch, nil
 }
 
-func (s *Server) Start(j *Job, ch chan *Job) chan *Job {
-	j.Status = StatusQueued
-	j.Submitted = time.Now()
+// Start queues j to be run and returns a channel where the completed job is
+// sent.  An error is returned if j's dependencies (see Job.DependsOn) form a
+// cycle.
+func (s *Server) Start(j *Job, ch chan *Job) (chan *Job, error) {
+	if err := s.checkCycle(j); err != nil {
+		return nil, err
+	}
+
+	s.initSubmitted(j)
 	s.alljobs.Put(j)
-	s.log.Printf("[SUBMIT] job %v\n", j.Id)
+	s.log.Info("job submitted", "job_id", j.Id, "priority", j.Priority)
 
 	if ch == nil {
 		ch = make(chan *Job, 1)
 	}
-	s.submitjobs <- jobSubmit{j, ch}
-	return ch
+	s.submitjobs <- jobSubmit{J: j, Result: ch}
+	return ch, nil
+}
+
+// BatchError reports the jobs of a batch that were rejected (see
+// StartBatch).  The other jobs of the batch were submitted.
+type BatchError struct {
+	// Errs holds one entry per job in the batch - nil for submitted jobs.
+	Errs []error
+}
+
+func (e *BatchError) Error() string {
+	n := 0
+	msgs := []string{}
+	for i, err := range e.Errs {
+		if err != nil {
+			n++
+			msgs = append(msgs, fmt.Sprintf("job %v: %v", i, err))
+		}
+	}
+	return fmt.Sprintf("%v of %v jobs in batch rejected: %v", n, len(e.Errs), strings.Join(msgs, "; "))
+}
+
+// StartBatch submits all jobs at once and returns their ids.  The jobs are
+// queued together by the dispatcher so no worker can fetch any of them
+// before all are queued.  Jobs that fail validation are not submitted and
+// are reported in a *BatchError - their ids are left zero.  The rest of the
+// batch is submitted regardless.  Unlike Start, there is no way to wait on
+// the jobs' completion - use Get to retrieve them.
+func (s *Server) StartBatch(jobs []*Job) ([]JobId, error) {
+	ids := make([]JobId, len(jobs))
+	valid := make([]*Job, 0, len(jobs))
+	var berr *BatchError
+	for i, j := range jobs {
+		if err := s.checkCycle(j); err != nil {
+			if berr == nil {
+				berr = &BatchError{Errs: make([]error, len(jobs))}
+			}
+			berr.Errs[i] = err
+			continue
+		}
+		s.initSubmitted(j)
+		ids[i] = j.Id
+		valid = append(valid, j)
+	}
+
+	if len(valid) > 0 {
+		if err := s.alljobs.PutBatch(valid); err != nil {
+			return nil, err
+		}
+		s.log.Info("job batch submitted", "njobs", len(valid))
+
+		batch := make([]jobSubmit, len(valid))
+		for i, j := range valid {
+			batch[i] = jobSubmit{J: j}
+		}
+		s.submitbatch <- batch
+	}
+
+	if berr != nil {
+		return ids, berr
+	}
+	return ids, nil
+}
+
+// startFrom is the same as Start except the job is rejected with
+// errQueueFull or errClientLimit if accepting it would exceed MaxQueueDepth
+// or MaxJobsPerClient for the client at ip.
+func (s *Server) startFrom(j *Job, ip string) error {
+	if err := s.checkCycle(j); err != nil {
+		return err
+	}
+
+	s.initSubmitted(j)
+	admit := make(chan error, 1)
+	s.submitjobs <- jobSubmit{J: j, ClientIP: ip, Admit: admit}
+	if err := <-admit; err != nil {
+		return err
+	}
+	s.log.Info("job submitted", "job_id", j.Id, "priority", j.Priority, "remote_ip", ip)
+	return nil
+}
+
+// initSubmitted sets the fields of a newly submitted job j.
+func (s *Server) initSubmitted(j *Job) {
+	j.Status = StatusQueued
+	j.Priority = s.clampPriority(j.Priority)
+	j.Submitted = time.Now()
+}
+
+// checkCycle returns an error if j depends on itself directly or through
+// the dependencies of jobs in the database.
+func (s *Server) checkCycle(j *Job) error {
+	seen := map[JobId]bool{}
+	deps := append([]JobId{}, j.DependsOn...)
+	for len(deps) > 0 {
+		id := deps[len(deps)-1]
+		deps = deps[:len(deps)-1]
+		if id == j.Id {
+			return fmt.Errorf("job %v has a dependency cycle", j.Id)
+		} else if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		if dep, err := s.alljobs.Get(id); err == nil {
+			deps = append(deps, dep.DependsOn...)
+		}
+	}
+	return nil
+}
+
+// checkDeps returns true if all of j's dependencies have completed.  An
+// error is returned if any of them failed.  Dependencies that are not in the
+// database (e.g. not submitted yet) are waited for.
+func (s *Server) checkDeps(j *Job) (ready bool, err error) {
+	ready = true
+	for _, id := range j.DependsOn {
+		dep, err := s.alljobs.Get(id)
+		if err != nil {
+			ready = false
+		} else if dep.Status == StatusFailed {
+			return false, fmt.Errorf("dependency %v failed", id)
+		} else if dep.Status != StatusComplete {
+			ready = false
+		}
+	}
+	return ready, nil
+}
+
+// failBrokenDeps fails all queued jobs with failed dependencies.
+func (s *Server) failBrokenDeps() {
+	for {
+		failed := []*Job{}
+		for _, j := range s.queue {
+			if _, err := s.checkDeps(j); err != nil {
+				j.Status = StatusFailed
+				j.Stderr += fmt.Sprintf("\n%v\n", err)
+				j.MaxRetries = j.Retries // retries can't fix dependencies
+				failed = append(failed, j)
+			}
+		}
+		if len(failed) == 0 {
+			return
+		}
+
+		for _, j := range failed {
+			s.log.Info("job dependencies failed", "job_id", j.Id, "reason", strings.TrimSpace(j.Stderr))
+			s.finnishJob(j)
+		}
+	}
 }
 
 func (s *Server) Get(jid JobId) (*Job, error) {
 	ch := make(chan *Job, 1)
 	s.retrievejobs <- jobRequest{Id: jid, Resp: ch}
 	j := <-ch
-	if j == nil {
+	if j == nil && s.JobNotFoundHandler != nil {
+		return s.lookupMissing(jid)
+	} else if j == nil {
 		return nil, fmt.Errorf("unknown job id %v", jid)
 	}
 	return j, nil
 }
 
+// lookupMissing retrieves the job jid missing from the database using the
+// JobNotFoundHandler and stores it back in the database.
+func (s *Server) lookupMissing(jid JobId) (*Job, error) {
+	j, err := s.JobNotFoundHandler(jid)
+	if err != nil {
+		return nil, fmt.Errorf("unknown job id %v: %v", jid, err)
+	} else if j == nil {
+		return nil, fmt.Errorf("unknown job id %v", jid)
+	}
+
+	s.log.Info("restored job from external storage", "job_id", jid)
+	j.Infiles = nil
+	if err := s.alljobs.Put(j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// startLog begins a new stdout log for the running job jid.
+func (s *Server) startLog(jid JobId) {
+	s.logmu.Lock()
+	defer s.logmu.Unlock()
+	s.joblogs[jid] = &bytes.Buffer{}
+}
+
+// endLog discards the stdout log for job jid.
+func (s *Server) endLog(jid JobId) {
+	s.logmu.Lock()
+	defer s.logmu.Unlock()
+	delete(s.joblogs, jid)
+}
+
+// AppendLog adds data to the stdout log of the running job jid.  Data for
+// jobs that aren't running is discarded.
+func (s *Server) AppendLog(jid JobId, data []byte) {
+	s.logmu.Lock()
+	defer s.logmu.Unlock()
+	if buf, ok := s.joblogs[jid]; ok {
+		buf.Write(data)
+	}
+}
+
+// JobLog returns a copy of the stdout logged so far for the running job jid
+// after the first offset bytes.  ok is false if the job isn't running.
+func (s *Server) JobLog(jid JobId, offset int) (data []byte, ok bool) {
+	s.logmu.Lock()
+	defer s.logmu.Unlock()
+	buf, ok := s.joblogs[jid]
+	if !ok || offset >= buf.Len() {
+		return nil, ok
+	}
+	return append([]byte{}, buf.Bytes()[offset:]...), true
+}
+
+// CancelJob cancels the queued or running job jid.  The job is marked as
+// failed and cancelled.  Workers running the job are told to kill it on
+// their next heartbeat.
+func (s *Server) CancelJob(jid JobId) error {
+	req := cancelRequest{Id: jid, Resp: make(chan error, 1)}
+	s.canceljobs <- req
+	return <-req.Resp
+}
+
+func (s *Server) cancelJob(jid JobId) error {
+	j, ok := s.running[jid]
+	if !ok {
+		for _, qj := range s.queue {
+			if qj.Id == jid {
+				j = qj
+				break
+			}
+		}
+	}
+	if j == nil {
+		return fmt.Errorf("job %v is not queued or running", jid)
+	}
+
+	s.log.Info("job cancelled", "job_id", jid, "status", j.Status)
+	j.Status = StatusFailed
+	j.Cancelled = true
+	j.Finished = time.Now()
+	j.Stderr += "\ncancelled by server\n"
+	j.MaxRetries = j.Retries // cancelled jobs must not be retried
+	s.finnishJob(j)
+	s.failBrokenDeps()
+	return nil
+}
+
+// SetPriority changes the priority of the queued job jid.  An error is
+// returned if the job is not currently queued.
+func (s *Server) SetPriority(jid JobId, priority int) error {
+	req := priorityRequest{Id: jid, Priority: s.clampPriority(priority), Resp: make(chan error, 1)}
+	s.setpriority <- req
+	return <-req.Resp
+}
+
+func (s *Server) clampPriority(priority int) int {
+	if priority < 0 {
+		return 0
+	} else if s.PriorityLevels > 0 && priority >= s.PriorityLevels {
+		return s.PriorityLevels - 1
+	}
+	return priority
+}
+
+// popQueue removes and returns the highest priority job from the queue whose
+// dependencies have all completed and that worker wid's whitelist allows.
+// Jobs of equal priority are returned in queue order.  Nil is returned if no
+// queued jobs are ready to run.
+func (s *Server) popQueue(wid WorkerId) *Job {
+	next := -1
+	for i, j := range s.queue {
+		if ready, _ := s.checkDeps(j); !ready {
+			continue
+		} else if time.Now().Before(j.EarliestRetry) {
+			continue
+		} else if !s.whitelisted(wid, j) {
+			continue
+		} else if next < 0 || j.Priority > s.queue[next].Priority {
+			next = i
+		}
+	}
+	if next < 0 {
+		return nil
+	}
+
+	j := s.queue[next]
+	s.queue = append(append([]*Job{}, s.queue[:next]...), s.queue[next+1:]...)
+	return j
+}
+
+// ListJobs returns the jobs in the database with the given status and tag
+// (empty status or tag matches all jobs) from most to least recently
+// submitted.  The first offset jobs are skipped and at most limit jobs are
+// returned - a zero limit returns all remaining jobs.
+func (s *Server) ListJobs(status, tag string, limit, offset int) ([]*Job, error) {
+	var jobs []*Job
+	var err error
+	if tag != "" {
+		jobs, err = s.alljobs.ByTag(tag)
+	} else if status == "" {
+		jobs, err = s.alljobs.All()
+	} else {
+		jobs, err = s.alljobs.QueryByStatus(status)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tag != "" && status != "" {
+		matched := []*Job{}
+		for _, j := range jobs {
+			if j.Status == status {
+				matched = append(matched, j)
+			}
+		}
+		jobs = matched
+	}
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Submitted.After(jobs[j].Submitted) })
+	if offset >= len(jobs) {
+		return []*Job{}, nil
+	}
+	jobs = jobs[offset:]
+	if limit > 0 && limit < len(jobs) {
+		jobs = jobs[:limit]
+	}
+	return jobs, nil
+}
+
+// ResubmitQuery selects failed jobs for resubmission.
+type ResubmitQuery struct {
+	// Tag, if non-empty, restricts resubmission to jobs tagged with Tag.
+	Tag string
+	// Since, if non-zero, restricts resubmission to jobs that finished at or
+	// after Since.
+	Since time.Time
+	// DryRun is true to only report which jobs would be resubmitted.
+	DryRun bool
+}
+
+// ResubmitFailed requeues all failed jobs matching q with cleared output and
+// timing information.  The ids of the selected jobs are returned.
+func (s *Server) ResubmitFailed(q ResubmitQuery) ([]JobId, error) {
+	req := resubmitRequest{Query: q, Resp: make(chan resubmitResult, 1)}
+	s.resubmit <- req
+	resp := <-req.Resp
+	return resp.Ids, resp.Err
+}
+
+// resubmitFailed does the work for ResubmitFailed.  It must only be called
+// from the dispatcher.
+func (s *Server) resubmitFailed(q ResubmitQuery) ([]JobId, error) {
+	jobs, err := s.alljobs.QueryByStatus(StatusFailed)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []JobId{}
+	for _, j := range jobs {
+		if j.Cancelled {
+			continue
+		} else if q.Tag != "" && !j.HasTag(q.Tag) {
+			continue
+		} else if !q.Since.IsZero() && j.Finished.Before(q.Since) {
+			continue
+		}
+		ids = append(ids, j.Id)
+		if q.DryRun {
+			continue
+		}
+
+		if err := s.checkCycle(j); err != nil {
+			return ids, err
+		} else if err := s.alljobs.removeFinishIndex(j); err != nil {
+			return ids, err
+		}
+		j.Stdout = ""
+		j.Stderr = ""
+		j.OutfileErrors = nil
+		j.Fetched = time.Time{}
+		j.QueueTime = 0
+		j.Started = time.Time{}
+		j.CmdDur = 0
+		j.Finished = time.Time{}
+		j.WorkerId = WorkerId{}
+		s.initSubmitted(j)
+		s.alljobs.Put(j)
+		s.log.Info("job resubmitted", "job_id", j.Id)
+		s.enqueue(jobSubmit{J: j})
+	}
+	return ids, nil
+}
+
+// WorkerResources returns the most recently reported resource usage for
+// each worker that has sent a heartbeat.
+func (s *Server) WorkerResources() map[WorkerId]ResourceUsage {
+	stats := s.WorkerStats()
+	usage := make(map[WorkerId]ResourceUsage, len(stats))
+	for _, ws := range stats {
+		usage[ws.WorkerId] = ws.Usage
+	}
+	return usage
+}
+
+// WorkerStats returns the recent activity of every worker that has sent a
+// heartbeat within workerStatTTL ordered by worker id.
+func (s *Server) WorkerStats() []WorkerStat {
+	ch := make(chan []WorkerStat, 1)
+	s.workerstats <- ch
+	return <-ch
+}
+
+// ServerStats returns a snapshot of the server's job statistics.
+func (s *Server) ServerStats() Stats {
+	ch := make(chan Stats, 1)
+	s.statsreq <- ch
+	return <-ch
+}
+
 // ResetQueue removes all jobs from the queue permanently.
 func (s *Server) ResetQueue() {
 	s.reset <- struct{}{}
@@ -221,7 +835,7 @@ func (s *Server) cleanQueue(delids ...JobId) {
 		if j.Status == StatusQueued {
 			newqueue = append(newqueue, j)
 		} else {
-			s.log.Printf("[GC] removed job with status %v from queue (id %v)\n", j.Status, j.Id)
+			s.log.Info("removed non-queued job from queue", "job_id", j.Id, "status", j.Status)
 		}
 	}
 	s.queue = newqueue
@@ -233,7 +847,7 @@ func (s *Server) cleanQueue(delids ...JobId) {
 		for _, delid := range delids {
 			if j.Id == delid {
 				skip = true
-				s.log.Printf("[GC] removed completed job from queue (id %v)\n", delid)
+				s.log.Info("removed completed job from queue", "job_id", delid)
 				break
 			}
 		}
@@ -257,11 +871,19 @@ func (s *Server) checkbeat() {
 
 			delete(s.jobinfo, jid)
 			delete(s.running, jid)
-			s.log.Printf("[REQUEUE] job %v\n", jid)
+			s.endLog(jid)
+			s.log.Info("job requeued", "job_id", jid, "worker_id", b.WorkerId)
 			s.Stats.NRequeued++
 			j.Status = StatusQueued
 			s.queue = append([]*Job{j}, s.queue...)
 			s.alljobs.Put(j)
+			s.broadcast(j)
+		}
+	}
+
+	for wid, ws := range s.workers {
+		if now.Sub(ws.LastBeat) > workerStatTTL {
+			delete(s.workers, wid)
 		}
 	}
 
@@ -269,7 +891,7 @@ func (s *Server) checkbeat() {
 	// that we don't have record of them running in jobinfo
 	for jid, ch := range s.submitchans {
 		_, ok := s.jobinfo[jid]
-		if !ok {
+		if !ok && !s.cachecopying[jid] {
 			// job is not currently running
 			inqueue := false
 			for _, qj := range s.queue {
@@ -281,7 +903,7 @@ func (s *Server) checkbeat() {
 
 			if !inqueue {
 				// job is also not queued
-				s.log.Printf("[GC] removed conn waiting for dropped job %v\n", JobId(jid))
+				s.log.Info("removed conn waiting for dropped job", "job_id", JobId(jid))
 				s.Stats.NFailed++
 				j, _ := s.alljobs.Get(jid)
 				ch <- j
@@ -292,6 +914,63 @@ func (s *Server) checkbeat() {
 	}
 }
 
+// checkSubmitchans releases submitters waiting on jobs that have been
+// deleted from the db by sending them a nil job.
+func (s *Server) checkSubmitchans() {
+	for jid, ch := range s.submitchans {
+		if _, err := s.alljobs.Get(jid); err == nil {
+			continue
+		}
+		s.log.Info("removed conn waiting for deleted job", "job_id", JobId(jid))
+		ch <- nil
+		close(ch)
+		delete(s.submitchans, jid)
+		delete(s.jobinfo, jid)
+		delete(s.running, jid)
+		s.cleanQueue(jid)
+		s.releaseClient(jid)
+	}
+}
+
+// whitelisted returns true if worker wid registered a whitelist containing
+// j's command or no whitelist at all.  Jobs without a command are allowed
+// so workers report them as failed.
+func (s *Server) whitelisted(wid WorkerId, j *Job) bool {
+	wl := s.whitelists[wid]
+	if len(wl) == 0 || len(j.Cmd) == 0 {
+		return true
+	}
+	for _, cmd := range wl {
+		if cmd == j.Cmd[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// workerIPAllowed returns true if workers at the given ip address may fetch
+// jobs according to s.AllowedWorkerIPs.
+func (s *Server) workerIPAllowed(ipstr string) bool {
+	if len(s.AllowedWorkerIPs) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(ipstr)
+	if ip == nil {
+		return false
+	}
+	for _, allowed := range s.AllowedWorkerIPs {
+		if _, ipnet, err := net.ParseCIDR(allowed); err == nil {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		} else if aip := net.ParseIP(allowed); aip != nil && aip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Server) isBanned(wid WorkerId) bool {
 	return s.workerFailures[wid] >= nfailban
 }
@@ -306,9 +985,77 @@ func (s *Server) nBannedWorkers() int {
 	return n
 }
 
+// admit checks whether js can be accepted under the submission limits and
+// if so, stores the job and counts it against its client.  The result is
+// sent on js.Admit.  It must only be called from the dispatcher.
+func (s *Server) admit(js jobSubmit) bool {
+	var err error
+	if s.MaxQueueDepth > 0 && len(s.queue) >= s.MaxQueueDepth {
+		err = errQueueFull
+	} else if s.MaxJobsPerClient > 0 && s.clientjobs[js.ClientIP] >= s.MaxJobsPerClient {
+		err = errClientLimit
+	}
+	if err != nil {
+		s.log.Info("job submission rejected", "job_id", js.J.Id, "remote_ip", js.ClientIP, "err", err)
+		js.Admit <- err
+		return false
+	}
+
+	s.alljobs.Put(js.J)
+	s.clientjobs[js.ClientIP]++
+	s.submitters[js.J.Id] = js.ClientIP
+	js.Admit <- nil
+	return true
+}
+
+// releaseClient stops counting the finished job id against the client that
+// submitted it.
+func (s *Server) releaseClient(id JobId) {
+	ip, ok := s.submitters[id]
+	if !ok {
+		return
+	}
+	delete(s.submitters, id)
+	if s.clientjobs[ip]--; s.clientjobs[ip] <= 0 {
+		delete(s.clientjobs, ip)
+	}
+}
+
+// enqueue adds a submitted job to the queue unless it can be completed from
+// the result cache.  It must only be called from the dispatcher.
+func (s *Server) enqueue(js jobSubmit) {
+	s.Stats.NSubmitted++
+	if js.Result != nil {
+		s.submitchans[js.J.Id] = js.Result
+	}
+	if s.completeCached(js.J) {
+		return
+	}
+	s.queue = append(s.queue, js.J)
+	s.broadcast(js.J)
+}
+
+// broadcast sends the dashboard status of j to all subscribers.  Updates
+// are dropped for subscribers whose buffer is full so a slow client can
+// never stall the dispatcher.  It must only be called from the dispatcher.
+func (s *Server) broadcast(j *Job) {
+	if len(s.subscribers) == 0 {
+		return
+	}
+	u := newDashUpdate(j)
+	for _, ch := range s.subscribers {
+		select {
+		case ch <- u:
+		default:
+		}
+	}
+}
+
 func (s *Server) dispatcher() {
 	beatcheck := time.NewTicker(beatCheckFreq)
 	defer beatcheck.Stop()
+	chancheck := time.NewTicker(s.submitchansTTL)
+	defer chancheck.Stop()
 
 	for {
 		s.Stats.CurrQueued = len(s.queue)
@@ -318,80 +1065,190 @@ func (s *Server) dispatcher() {
 		select {
 		case <-beatcheck.C:
 			s.checkbeat()
+		case <-chancheck.C:
+			s.checkSubmitchans()
 		case <-s.reset:
-			s.log.Printf("[RESET] removed %v queued jobs\n", len(s.queue))
+			s.log.Info("server reset", "queue_depth", len(s.queue))
 			for _, j := range s.queue {
 				j.Status = StatusFailed
 				j.Stderr += "\nkilled by server reset\n"
+				j.MaxRetries = j.Retries // reset jobs must not be retried
 				s.finnishJob(j)
 			}
 			s.queue = s.queue[:0]
 		case <-s.kill:
 			return
 		case js := <-s.submitjobs:
-			s.queue = append(s.queue, js.J)
-			s.Stats.NSubmitted++
-			if js.Result != nil {
-				s.submitchans[js.J.Id] = js.Result
+			if js.Admit != nil && !s.admit(js) {
+				continue
 			}
+			s.enqueue(js)
+		case batch := <-s.submitbatch:
+			for _, js := range batch {
+				s.enqueue(js)
+			}
+		case req := <-s.canceljobs:
+			req.Resp <- s.cancelJob(req.Id)
+		case cc := <-s.cachecopied:
+			s.finishCached(cc)
+		case req := <-s.resubmit:
+			ids, err := s.resubmitFailed(req.Query)
+			req.Resp <- resubmitResult{Ids: ids, Err: err}
+		case req := <-s.setpriority:
+			var j *Job
+			for _, qj := range s.queue {
+				if qj.Id == req.Id {
+					j = qj
+					break
+				}
+			}
+			if j == nil {
+				req.Resp <- fmt.Errorf("job %v is not queued", req.Id)
+				continue
+			}
+			s.log.Info("job priority changed", "job_id", j.Id, "old_priority", j.Priority, "priority", req.Priority)
+			j.Priority = req.Priority
+			s.alljobs.Put(j)
+			req.Resp <- nil
 		case req := <-s.retrievejobs:
 			if j, ok := s.running[req.Id]; ok {
-				s.log.Printf("[RETRIEVE] from run list job %v\n", j.Id)
+				s.log.Info("retrieved running job", "job_id", j.Id, "status", j.Status)
 				req.Resp <- j
 			} else if j, err := s.alljobs.Get(req.Id); err == nil {
-				s.log.Printf("[RETRIEVE] from db job %v\n", j.Id)
+				s.log.Info("retrieved job from db", "job_id", j.Id, "status", j.Status)
 				req.Resp <- j
 			} else {
-				s.log.Printf("[RETRIEVE] error: job %v not found\n", req.Id)
+				s.log.Error("retrieved job not found", "job_id", req.Id)
 				req.Resp <- nil
 			}
 		case j := <-s.pushjobs:
+			jj, running := s.running[j.Id]
+			if !running {
+				if dbj, err := s.alljobs.Get(j.Id); err == nil && dbj.Cancelled {
+					s.log.Info("ignoring push for cancelled job", "job_id", j.Id, "worker_id", j.WorkerId)
+					continue
+				} else if j.Status != StatusComplete {
+					// the job was already requeued or retried - e.g. after
+					// its heartbeats timed out.
+					s.log.Error("dropping failed push for job not running", "job_id", j.Id, "worker_id", j.WorkerId)
+					continue
+				}
+			}
+
 			if j.Status == StatusComplete {
 				s.workerFailures[j.WorkerId] = 0
 			} else if j.Status == StatusFailed {
 				s.workerFailures[j.WorkerId]++
 			}
+			if ws, ok := s.workers[j.WorkerId]; ok {
+				if ws.CurrentJobId == j.Id {
+					ws.CurrentJobId = JobId{}
+				}
+				ws.ConsecutiveFailures = s.workerFailures[j.WorkerId]
+				s.workers[j.WorkerId] = ws
+			}
 
-			s.log.Printf("[PUSH] job %v\n", j.Id)
-			if jj, ok := s.running[j.Id]; ok {
+			s.log.Info("job pushed", "job_id", j.Id, "worker_id", j.WorkerId, "status", j.Status, "duration", j.CmdDur)
+			if running && j.Status == StatusFailed && j.Retries < j.MaxRetries {
+				// retry the server's own copy of the job which still has
+				// its infiles.
+				jj.Status = StatusFailed
+				jj.WorkerId = j.WorkerId
+				s.retryJob(jj)
+				s.failBrokenDeps()
+				continue
+			} else if running {
 				// workers nilify the Infiles to reduce network traffic
 				// we want to re-add the locally stored infiles back to keep
 				// job data complete.
 				j.Infiles = jj.Infiles
 			} else {
-				s.log.Printf("[PUSH] error: push for job not running (id=%v)\n", j.Id)
+				s.log.Error("push for job not running", "job_id", j.Id, "worker_id", j.WorkerId)
 			}
 			s.finnishJob(j)
+			if running {
+				s.cacheResult(j)
+			}
+			s.failBrokenDeps()
 		case req := <-s.fetchjobs:
-			if s.isBanned(req.WorkerId) {
-				s.log.Printf("[FETCH] no work for banned worker %v)\n", req.WorkerId)
+			if !s.workerIPAllowed(req.RemoteIP) {
+				s.log.Info("no work for worker from disallowed address", "worker_id", req.WorkerId, "remote_ip", req.RemoteIP)
 				req.Ch <- nil
 				continue
-			} else if len(s.queue) == 0 {
-				s.log.Printf("[FETCH] no work in queue (worker %v)\n", req.WorkerId)
+			} else if s.isBanned(req.WorkerId) {
+				s.log.Info("no work for banned worker", "worker_id", req.WorkerId)
 				req.Ch <- nil
 				continue
 			}
 
-			j := s.queue[0]
-			s.queue = append([]*Job{}, s.queue[1:]...)
-			s.log.Printf("[FETCH] job %v (worker %v)\n", j.Id, req.WorkerId)
+			s.failBrokenDeps()
+			j := s.popQueue(req.WorkerId)
+			if j == nil {
+				s.log.Info("no work ready in queue", "worker_id", req.WorkerId, "queue_depth", len(s.queue))
+				req.Ch <- nil
+				continue
+			}
+			s.log.Info("job fetched", "job_id", j.Id, "worker_id", req.WorkerId, "queue_depth", len(s.queue))
 			s.jobinfo[j.Id] = NewBeat(req.WorkerId, j.Id)
 			s.running[j.Id] = j
 			j.Fetched = time.Now()
+			j.QueueTime = j.Fetched.Sub(j.Submitted)
+			s.Stats.NFetched++
+			s.Stats.TotQueueTime += j.QueueTime
+			s.Stats.AvgQueueTime = s.Stats.TotQueueTime / time.Duration(s.Stats.NFetched)
+			if j.QueueTime > s.Stats.MaxQueueTime {
+				s.Stats.MaxQueueTime = j.QueueTime
+			}
 			j.Status = StatusRunning
 			s.alljobs.Put(j)
+			s.startLog(j.Id)
+			s.broadcast(j)
 			req.Ch <- j
+		case ch := <-s.statsreq:
+			ch <- *s.Stats
+		case n := <-s.purged:
+			s.Stats.NPurged += n
+		case ch := <-s.workerstats:
+			stats := make([]WorkerStat, 0, len(s.workers))
+			for _, ws := range s.workers {
+				stats = append(stats, ws)
+			}
+			sort.Slice(stats, func(i, j int) bool {
+				return bytes.Compare(stats[i].WorkerId[:], stats[j].WorkerId[:]) < 0
+			})
+			ch <- stats
+		case reg := <-s.register:
+			s.whitelists[reg.WorkerId] = reg.Whitelist
+		case ch := <-s.subscribe:
+			s.subscribers = append(s.subscribers, ch)
+		case ch := <-s.unsubscribe:
+			for i, sub := range s.subscribers {
+				if sub == ch {
+					s.subscribers = append(s.subscribers[:i], s.subscribers[i+1:]...)
+					break
+				}
+			}
+		case ch := <-s.metrics:
+			var buf bytes.Buffer
+			s.writeMetrics(&buf)
+			ch <- buf.Bytes()
 		case b := <-s.beat:
+			s.workers[b.WorkerId] = WorkerStat{
+				WorkerId:            b.WorkerId,
+				CurrentJobId:        b.JobId,
+				LastBeat:            b.Time,
+				ConsecutiveFailures: s.workerFailures[b.WorkerId],
+				Usage:               b.Usage,
+			}
 			oldb, ok := s.jobinfo[b.JobId]
 			if !ok {
 				// job was completed by another worker already
-				s.log.Printf("[BEAT] sending kill signal: job %v already completed by another worker\n", b.JobId)
+				s.log.Info("killing job already completed by another worker", "job_id", b.JobId, "worker_id", b.WorkerId)
 				b.kill <- true
 				continue
 			} else if oldb.WorkerId != b.WorkerId {
 				// job has been reassigned to another worker
-				s.log.Printf("[BEAT] sending kill signal: job %v was rescheduled to another worker\n", b.JobId)
+				s.log.Info("killing job rescheduled to another worker", "job_id", b.JobId, "worker_id", b.WorkerId)
 				b.kill <- true
 				continue
 			}
@@ -403,20 +1260,20 @@ func (s *Server) dispatcher() {
 				// don't kill the job because maybe the db just hasn't synced
 				// fully yet.
 				b.kill <- true
-				s.log.Printf("[BEAT] sending kill signal: job %v not listed as running\n", b.JobId)
+				s.log.Info("killing job not listed as running", "job_id", b.JobId, "worker_id", b.WorkerId)
 				continue
 			}
 
 			if j.Fetched.IsZero() {
-				s.log.Printf("[BEAT] job %v (worker %v), ??? left of %v\n", b.JobId, b.WorkerId, j.Timeout)
+				s.log.Info("heartbeat", "job_id", b.JobId, "worker_id", b.WorkerId, "timeout", j.Timeout)
 			} else {
-				s.log.Printf("[BEAT] job %v (worker %v), %v left of %v\n", b.JobId, b.WorkerId, j.Timeout-time.Now().Sub(j.Fetched), j.Timeout)
+				s.log.Info("heartbeat", "job_id", b.JobId, "worker_id", b.WorkerId, "duration", time.Now().Sub(j.Fetched), "timeout", j.Timeout)
 			}
 
 			if time.Now().Sub(j.Fetched) > j.Timeout && j.Timeout > 0 && !j.Fetched.IsZero() {
 				j.Status = StatusFailed
 				s.finnishJob(j)
-				s.log.Printf("[BEAT] sending kill signal: job %v timed out (worker %v)\n", b.JobId, b.WorkerId)
+				s.log.Info("killing timed out job", "job_id", b.JobId, "worker_id", b.WorkerId, "timeout", j.Timeout)
 				b.kill <- true
 			}
 			b.kill <- false
@@ -429,8 +1286,14 @@ func (s *Server) finnishJob(j *Job) {
 		return
 	}
 
+	if j.Status == StatusFailed && j.Retries < j.MaxRetries {
+		s.retryJob(j)
+		return
+	}
+
 	// put this first to get data in db as soon as possible.
 	s.alljobs.Put(j)
+	s.broadcast(j)
 
 	if j.Status == StatusFailed {
 		s.Stats.NFailed++
@@ -438,6 +1301,7 @@ func (s *Server) finnishJob(j *Job) {
 		s.Stats.NCompleted++
 
 		jobtime := j.Finished.Sub(j.Started)
+		s.jobdurations.Observe(jobtime.Seconds())
 		s.Stats.TotJobTime += jobtime
 		s.Stats.AvgJobTime = s.Stats.TotJobTime / time.Duration(s.Stats.NCompleted)
 		if s.Stats.MinJobTime == 0 || jobtime < s.Stats.MinJobTime {
@@ -447,6 +1311,7 @@ func (s *Server) finnishJob(j *Job) {
 			s.Stats.MaxJobTime = jobtime
 		}
 
+		s.cmddurations.Observe(j.CmdDur.Seconds())
 		s.Stats.TotCmdTime += j.CmdDur
 		s.Stats.AvgCmdTime = s.Stats.TotCmdTime / time.Duration(s.Stats.NCompleted)
 		if s.Stats.MinCmdTime == 0 || j.CmdDur < s.Stats.MinCmdTime {
@@ -465,20 +1330,219 @@ func (s *Server) finnishJob(j *Job) {
 
 	delete(s.jobinfo, j.Id)
 	delete(s.running, j.Id)
+	s.releaseClient(j.Id)
+	s.endLog(j.Id)
 	s.cleanQueue(j.Id)
 }
 
+// retryJob requeues the failed job j at the front of the queue with cleared
+// output for another attempt after an exponentially growing delay (see
+// retryBackoff).
+func (s *Server) retryJob(j *Job) {
+	j.Retries++
+	s.Stats.NAutoRetried++
+	shift := j.Retries
+	if shift > maxRetryShift {
+		shift = maxRetryShift
+	}
+	delay := retryBackoff << uint(shift)
+	j.EarliestRetry = time.Now().Add(delay)
+	s.log.Info("job retry scheduled", "job_id", j.Id, "worker_id", j.WorkerId, "retry", j.Retries, "max_retries", j.MaxRetries, "delay", delay)
+
+	delete(s.jobinfo, j.Id)
+	delete(s.running, j.Id)
+	s.endLog(j.Id)
+	j.Status = StatusQueued
+	j.Stdout = ""
+	j.Stderr = ""
+	j.OutfileErrors = nil
+	j.Started = time.Time{}
+	j.CmdDur = 0
+	j.Finished = time.Time{}
+	j.WorkerId = WorkerId{}
+	s.cleanQueue(j.Id)
+	s.queue = append([]*Job{j}, s.queue...)
+	s.alljobs.Put(j)
+	s.broadcast(j)
+}
+
+// resultKey returns a hash identifying the results of running j - i.e. of
+// its command, infiles and requested outfiles.
+func resultKey(j *Job) [32]byte {
+	infiles := make([]string, 0, len(j.Infiles))
+	for _, f := range j.Infiles {
+		infiles = append(infiles, fmt.Sprintf("%q %x", f.Name, sha256.Sum256(f.Data)))
+	}
+	sort.Strings(infiles)
+	outfiles := make([]string, 0, len(j.Outfiles))
+	for _, f := range j.Outfiles {
+		outfiles = append(outfiles, f.Name)
+	}
+	sort.Strings(outfiles)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "cmd %q\ninfiles %q\noutfiles %q\n", j.Cmd, infiles, outfiles)
+	var key [32]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// resultCacheSize is the maximum number of job results held in the result
+// cache.  The results of the jobs that finished earliest are evicted first.
+var resultCacheSize = 1000
+
+// cacheResult adds the results of the just finished job j to the result
+// cache if it completed successfully.
+func (s *Server) cacheResult(j *Job) {
+	if !s.ResultCache || j.Status != StatusComplete {
+		return
+	}
+	cached := *j
+	cached.Infiles = nil
+	s.results[resultKey(j)] = &cached
+
+	if len(s.results) > resultCacheSize {
+		var oldest [32]byte
+		var finished time.Time
+		for key, r := range s.results {
+			if finished.IsZero() || r.Finished.Before(finished) {
+				oldest, finished = key, r.Finished
+			}
+		}
+		delete(s.results, oldest)
+	}
+}
+
+type cacheCopy struct {
+	J      *Job
+	Cached *Job
+	Key    [32]byte
+	Err    error
+}
+
+// completeCached starts completing the newly submitted job j with a copy of
+// the results of an identical job from the result cache.  The cached job's
+// outfiles are copied in a separate goroutine which sends the outcome to
+// the dispatcher (see finishCached).  It returns false if there is no cached
+// result.  Jobs with dependencies are never completed from the cache.
+func (s *Server) completeCached(j *Job) bool {
+	if !s.ResultCache || len(j.DependsOn) > 0 {
+		return false
+	}
+	key := resultKey(j)
+	cached, ok := s.results[key]
+	if !ok {
+		return false
+	}
+
+	s.cachecopying[j.Id] = true
+	dst, src := j.Id, cached.Id
+	go func() {
+		err := copyOutfiles(dst, src)
+		select {
+		case s.cachecopied <- cacheCopy{J: j, Cached: cached, Key: key, Err: err}:
+		case <-s.kill:
+		}
+	}()
+	return true
+}
+
+// finishCached completes or, if its outfiles couldn't be copied, queues the
+// job in cc.  It must only be called from the dispatcher.
+func (s *Server) finishCached(cc cacheCopy) {
+	j, cached := cc.J, cc.Cached
+	delete(s.cachecopying, j.Id)
+	if cc.Err != nil {
+		// the cached job's output was probably purged
+		s.log.Error("dropping cached job result", "job_id", cached.Id, "err", cc.Err)
+		if s.results[cc.Key] == cached {
+			delete(s.results, cc.Key)
+		}
+		s.queue = append(s.queue, j)
+		s.broadcast(j)
+		return
+	}
+
+	s.log.Info("job completed from result cache", "job_id", j.Id, "cached_job_id", cached.Id)
+	s.Stats.NCacheHits++
+	now := time.Now()
+	j.Status = StatusComplete
+	j.Stdout = cached.Stdout
+	j.Stderr = cached.Stderr
+	j.Outfiles = cached.Outfiles
+	j.OutfileErrors = cached.OutfileErrors
+	j.CmdDur = cached.CmdDur
+	j.WorkerId = cached.WorkerId
+	j.Fetched, j.Started, j.Finished = now, now, now
+	s.releaseClient(j.Id)
+	s.alljobs.Put(j)
+	s.broadcast(j)
+
+	if ch, ok := s.submitchans[j.Id]; ok {
+		ch <- j
+		close(ch)
+		delete(s.submitchans, j.Id)
+	}
+}
+
+// copyOutfiles copies the output files pushed for job src to job dst.
+func copyOutfiles(dst, src JobId) error {
+	in, err := os.Open(outfileName(src))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(outfileName(dst))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(outfileName(dst))
+		return err
+	}
+	return out.Close()
+}
+
 type jobRequest struct {
 	Id   JobId
 	Resp chan *Job
 }
 
+type cancelRequest struct {
+	Id   JobId
+	Resp chan error
+}
+
+type resubmitRequest struct {
+	Query ResubmitQuery
+	Resp  chan resubmitResult
+}
+
+type resubmitResult struct {
+	Ids []JobId
+	Err error
+}
+
+type priorityRequest struct {
+	Id       JobId
+	Priority int
+	Resp     chan error
+}
+
 type jobSubmit struct {
 	J      *Job
 	Result chan *Job
+	// ClientIP is the address the job was submitted from.  If Admit is
+	// non-nil, the submission limits are checked (see Server.admit).
+	ClientIP string
+	Admit    chan error
 }
 
 type workRequest struct {
 	WorkerId WorkerId
 	Ch       chan *Job
+	// RemoteIP is the ip address the request came from.
+	RemoteIP string
 }
@@ -7,12 +7,20 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"time"
 )
 
+// logPollFreq is the interval at which job logs are checked for new output
+// while streaming them.
+var logPollFreq = 500 * time.Millisecond
+
 func httperror(w http.ResponseWriter, msg string, code int) {
-	http.Error(w, msg, http.StatusBadRequest)
+	http.Error(w, msg, code)
 	log.Print(msg)
 }
 
@@ -67,6 +75,60 @@ func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
 	s.ResetQueue()
 }
 
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	status := q.Get("status")
+	switch status {
+	case "", StatusQueued, StatusRunning, StatusComplete, StatusFailed:
+	default:
+		httperror(w, fmt.Sprintf("invalid job status '%v'", status), http.StatusBadRequest)
+		return
+	}
+
+	limit, err := queryCount(q, "limit")
+	if err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, err := queryCount(q, "offset")
+	if err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jobs, err := s.ListJobs(status, q.Get("tag"), limit, offset)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stats := make([]*JobStat, len(jobs))
+	for i, j := range jobs {
+		stats[i] = NewJobStat(j)
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(data)
+}
+
+// queryCount returns the non-negative integer query parameter name from q or
+// zero if it isn't set.
+func queryCount(q url.Values, name string) (int, error) {
+	str := q.Get(name)
+	if str == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %v '%v'", name, str)
+	}
+	return n, nil
+}
+
 func (s *Server) handleJobStat(w http.ResponseWriter, r *http.Request) {
 	idstr := r.URL.Path[len("/api/v1/job-stat/"):]
 
@@ -91,9 +153,87 @@ func (s *Server) handleJobStat(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+func (s *Server) handleJobPriority(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		httperror(w, "job priority can only be set via POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idstr := r.URL.Path[len("/api/v1/job-priority/"):]
+	jid, err := DecodeJobId(idstr)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var priority int
+	if err := json.NewDecoder(r.Body).Decode(&priority); err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.SetPriority(jid, priority); err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// handleJobLog streams a job's stdout starting at the byte offset given by
+// the optional "offset" query parameter.  Output of running jobs is streamed
+// as workers report it until the job finishes.
+func (s *Server) handleJobLog(w http.ResponseWriter, r *http.Request) {
+	idstr := r.URL.Path[len("/api/v1/job-log/"):]
+	jid, err := DecodeJobId(idstr)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	offset := 0
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			httperror(w, fmt.Sprintf("invalid log offset '%v'", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	j, err := s.Get(jid)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	flusher, _ := w.(http.Flusher)
+	for {
+		if data, running := s.JobLog(jid, offset); running {
+			if len(data) > 0 {
+				w.Write(data)
+				offset += len(data)
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		} else if j, err = s.Get(jid); err != nil || j.Done() {
+			// the finished job holds any output not streamed yet
+			if err == nil && offset < len(j.Stdout) {
+				w.Write([]byte(j.Stdout[offset:]))
+			}
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(logPollFreq):
+		}
+	}
+}
+
 func (s *Server) handleServerStats(w http.ResponseWriter, r *http.Request) {
 
-  data, err := json.Marshal(s.Stats)
+	data, err := json.Marshal(s.ServerStats())
 	if err != nil {
 		httperror(w, err.Error(), http.StatusBadRequest)
 		return
@@ -103,10 +243,36 @@ func (s *Server) handleServerStats(w http.ResponseWriter, r *http.Request) {
 }
 
 
+func (s *Server) handleWorkerStats(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(s.WorkerStats())
+	if err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Write(data)
+}
+
 func (s *Server) createJob(r *http.Request, w http.ResponseWriter, j *Job) {
-	s.Start(j, nil)
+	if size := j.Size(); s.MaxJobSize > 0 && size > s.MaxJobSize {
+		msg := fmt.Sprintf("job size %v bytes exceeds the limit of %v bytes", size, s.MaxJobSize)
+		httperror(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
 
-	j, err := s.Get(j.Id)
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if err := s.startFrom(j, ip); err == errQueueFull || err == errClientLimit {
+		httperror(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	j, err = s.Get(j.Id)
 	if err != nil {
 		httperror(w, err.Error(), http.StatusBadRequest)
 		return
@@ -164,9 +330,9 @@ func (s *Server) handleOutfiles(w http.ResponseWriter, r *http.Request) {
 		}
 	} else if r.Method == "GET" {
 		if j, err := s.Get(jid); err != nil {
-			s.log.Printf("[REST] warning: /api/v1/job-outfiles/ request for job not in db (id=%v)\n", jid)
+			s.log.Error("outfiles requested for job not in db", "job_id", jid)
 		} else if j.Status != StatusComplete {
-			s.log.Printf("[REST] warning: /api/v1/job-outfiles/ request for potentially incomplete job")
+			s.log.Info("outfiles requested for potentially incomplete job", "job_id", jid, "status", j.Status)
 		}
 
 		w.Header().Add("Content-Disposition", fmt.Sprintf("filename=\"results-%v.zip\"", jid))
@@ -187,6 +353,49 @@ func (s *Server) handleOutfiles(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) handleJobProfile(w http.ResponseWriter, r *http.Request) {
+	idstr := r.URL.Path[len("/api/v1/job-profile/"):]
+	jid, err := DecodeJobId(idstr)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	j, err := s.Get(jid)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.Open(outfileName(jid))
+	if err != nil {
+		msg := fmt.Sprintf("[REST] error: job %v output files not found", jid)
+		httperror(w, msg, http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rc, err := j.GetOutfile(f, int(info.Size()), ProfileOutfile)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Add("Content-Disposition", fmt.Sprintf("filename=\"profile-%v.pprof\"", jid))
+	_, err = io.Copy(w, rc)
+	if err != nil {
+		httperror(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 func (s *Server) getjob(idstr string) (*Job, error) {
 	uid, err := hex.DecodeString(idstr)
 	if err != nil {
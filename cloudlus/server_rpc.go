@@ -2,11 +2,46 @@ package cloudlus
 
 import (
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
 	"time"
 )
 
 type RPC struct {
 	s *Server
+	// remoteIP is the ip address of the client connected to this receiver.
+	remoteIP string
+}
+
+// rpcConnHandler serves rpc connections over http.  Each connection is
+// served by its own RPC receiver so rpc methods know the client's address.
+type rpcConnHandler struct {
+	s *Server
+}
+
+func (h rpcConnHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		h.s.log.Error("rpc connection hijack failed", "remote_addr", req.RemoteAddr, "err", err)
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	serv := rpc.NewServer()
+	serv.Register(&RPC{s: h.s, remoteIP: ip})
+	serv.ServeConn(conn)
 }
 
 func (r *RPC) Heartbeat(b Beat, kill *bool) error {
@@ -19,7 +54,10 @@ func (r *RPC) Heartbeat(b Beat, kill *bool) error {
 
 // Submit j via rpc and block until complete returning the result job.
 func (r *RPC) Submit(j *Job, result **Job) error {
-	gotj := r.s.Run(j)
+	gotj, err := r.s.Run(j)
+	if err != nil {
+		return err
+	}
 	*result = gotj
 	if gotj == nil {
 		return fmt.Errorf("server: unknown job id %v", j.Id)
@@ -29,10 +67,80 @@ func (r *RPC) Submit(j *Job, result **Job) error {
 
 // Submit j via rpc asynchronously.
 func (r *RPC) SubmitAsync(j *Job, unused *int) error {
-	r.s.Start(j, nil)
+	_, err := r.s.Start(j, nil)
+	return err
+}
+
+// BatchReply reports the outcome of RPC.BatchSubmit.  Ids and Errs hold one
+// entry per submitted job.  Errs is empty if all jobs were submitted -
+// otherwise it holds the reasons rejected jobs failed and empty strings for
+// the rest.
+type BatchReply struct {
+	Ids  []JobId
+	Errs []string
+}
+
+// BatchSubmit submits all jobs asynchronously in a single call and reports
+// their ids.  Rejected jobs are reported individually in reply.Errs while
+// the rest of the batch is submitted.
+func (r *RPC) BatchSubmit(jobs []*Job, reply *BatchReply) error {
+	ids, err := r.s.StartBatch(jobs)
+	berr, ok := err.(*BatchError)
+	if err != nil && !ok {
+		return err
+	}
+
+	reply.Ids = ids
+	if ok {
+		reply.Errs = make([]string, len(berr.Errs))
+		for i, err := range berr.Errs {
+			if err != nil {
+				reply.Errs[i] = err.Error()
+			}
+		}
+	}
+	return nil
+}
+
+// Registration describes the jobs a worker is willing to run.
+type Registration struct {
+	WorkerId WorkerId
+	// Whitelist holds the commands the worker runs.  An empty whitelist
+	// allows all commands.
+	Whitelist []string
+}
+
+// Register records the whitelist of a worker so the server only dispatches
+// jobs to it that it will run.
+func (r *RPC) Register(reg Registration, unused *int) error {
+	r.s.register <- reg
+	return nil
+}
+
+// LogChunk is a piece of a running job's stdout sent by workers.
+type LogChunk struct {
+	Id   JobId
+	Data []byte
+}
+
+// AppendLog adds a chunk of stdout to a running job's log.
+func (r *RPC) AppendLog(c LogChunk, unused *int) error {
+	r.s.AppendLog(c.Id, c.Data)
 	return nil
 }
 
+// CancelJob cancels the queued or running job jid.
+func (r *RPC) CancelJob(jid JobId, unused *int) error {
+	return r.s.CancelJob(jid)
+}
+
+// ResubmitFailed requeues failed jobs selected by q and reports their ids.
+func (r *RPC) ResubmitFailed(q ResubmitQuery, ids *[]JobId) error {
+	var err error
+	*ids, err = r.s.ResubmitFailed(q)
+	return err
+}
+
 func (r *RPC) Retrieve(j JobId, result **Job) error {
 	var err error
 	*result, err = r.s.Get(j)
@@ -43,7 +151,7 @@ func (r *RPC) Retrieve(j JobId, result **Job) error {
 }
 
 func (r *RPC) Fetch(wid WorkerId, j **Job) error {
-	req := workRequest{wid, make(chan *Job, 1)}
+	req := workRequest{WorkerId: wid, Ch: make(chan *Job, 1), RemoteIP: r.remoteIP}
 	r.s.fetchjobs <- req
 	*j = <-req.Ch
 	if *j == nil {
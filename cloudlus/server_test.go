@@ -1,12 +1,27 @@
 package cloudlus
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
 func TestServerJobGC(t *testing.T) {
-	const testaddr = "127.0.0.1:45687"
 	dblimit := 10000
 	j := NewJobCmd("echo", "1")
 	jsize := int(j.Size())
@@ -29,10 +44,7 @@ func TestServerJobGC(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	s := NewServer(testaddr, testaddr, db)
-	s.CollectFreq = 1 * time.Second
-	go s.ListenAndServe()
-	defer s.Close()
+	NewTestServer(t, db, func(s *Server) { s.CollectFreq = 1 * time.Second })
 
 	<-time.After(2 * time.Second)
 
@@ -45,3 +57,1181 @@ func TestServerJobGC(t *testing.T) {
 		t.Errorf("server failed to run job GC")
 	}
 }
+
+func TestServerQueueTime(t *testing.T) {
+	s, _ := NewTestServer(t, nil)
+
+	j := NewJobCmd("echo", "1")
+	s.Start(j, nil)
+
+	queuetime := 1 * time.Second
+	<-time.After(queuetime)
+
+	var fetched *Job
+	if err := s.rpc.Fetch(WorkerId{}, &fetched); err != nil {
+		t.Fatal(err)
+	}
+
+	if fetched.QueueTime < queuetime {
+		t.Errorf("job queue time too short: got %v, want >= %v", fetched.QueueTime, queuetime)
+	}
+	if got := NewJobStat(fetched).QueueTime; got != fetched.QueueTime {
+		t.Errorf("job stat queue time: got %v, want %v", got, fetched.QueueTime)
+	}
+	if stats := s.ServerStats(); stats.MaxQueueTime < queuetime {
+		t.Errorf("server max queue time too short: got %v, want >= %v", stats.MaxQueueTime, queuetime)
+	}
+}
+
+func TestResubmitFailed(t *testing.T) {
+	s, testaddr := NewTestServer(t, nil)
+
+	// jobs fail until the marker file exists
+	marker := filepath.Join(os.TempDir(), fmt.Sprintf("cloudlus-resubmit-%v", NewJob().Id))
+	defer os.Remove(marker)
+
+	const tag = "batch"
+	nbatch := 3
+	jobs := []*Job{}
+	for i := 0; i < nbatch+1; i++ {
+		j := NewJobCmd("test", "-e", marker)
+		// notes aren't tags - the last job must not be selected
+		j.Note = tag
+		j.Tags = []string{tag}
+		if i == nbatch {
+			j.Tags = []string{"other"}
+		}
+		s.Start(j, nil)
+		jobs = append(jobs, j)
+		defer os.Remove(outfileName(j.Id))
+	}
+
+	bad := &Worker{MaxJobsTotal: len(jobs), Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	bad.Run()
+
+	c, err := Dial(testaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ids, err := c.ResubmitFailed(ResubmitQuery{Tag: tag, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ids) != nbatch {
+		t.Fatalf("dry run selected %v jobs, want %v", len(ids), nbatch)
+	}
+	for _, id := range ids {
+		if j, err := s.Get(id); err != nil {
+			t.Fatal(err)
+		} else if j.Status != StatusFailed {
+			t.Fatalf("dry run changed job %v status to %v", id, j.Status)
+		}
+	}
+
+	ids, err = c.ResubmitFailed(ResubmitQuery{Tag: tag})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ids) != nbatch {
+		t.Fatalf("resubmitted %v jobs, want %v", len(ids), nbatch)
+	}
+
+	if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	good := &Worker{MaxJobsTotal: nbatch, Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	done := make(chan struct{})
+	go func() {
+		good.Run()
+		close(done)
+	}()
+
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatalf("worker failed to run %v resubmitted jobs", nbatch)
+	case <-done:
+	}
+
+	for _, j := range jobs {
+		j, err := s.Get(j.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := StatusComplete
+		if !j.HasTag(tag) {
+			want = StatusFailed
+		}
+		if j.Status != want {
+			t.Errorf("job %v (tags %q): got status %v, want %v", j.Id, j.Tags, j.Status, want)
+		}
+	}
+}
+
+func TestServerWorkerStats(t *testing.T) {
+	s, testaddr := NewTestServer(t, nil)
+
+	var wid WorkerId
+	wid[0] = 42
+	want := ResourceUsage{CPUPercent: 87.5, MemRSS: 1 << 20}
+
+	j := NewJobCmd("echo", "1")
+	s.Start(j, nil)
+	var fetched *Job
+	if err := s.rpc.Fetch(wid, &fetched); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBeat(wid, j.Id)
+	b.Usage = want
+	var kill bool
+	if err := s.rpc.Heartbeat(b, &kill); err != nil {
+		t.Fatal(err)
+	}
+
+	getStats := func() []WorkerStat {
+		resp, err := http.Get("http://" + testaddr + "/api/v1/worker-stats")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stats := []WorkerStat{}
+		if err := json.Unmarshal(data, &stats); err != nil {
+			t.Fatalf("%v: %s", err, data)
+		}
+		if len(stats) != 1 || stats[0].WorkerId != wid {
+			t.Fatalf("got stats %s, want stats for worker %v only", data, wid)
+		}
+		return stats
+	}
+
+	got := getStats()[0]
+	if got.Usage != want {
+		t.Errorf("worker %v: got usage %+v, want %+v", wid, got.Usage, want)
+	}
+	if got.CurrentJobId != j.Id {
+		t.Errorf("worker %v: got current job %v, want %v", wid, got.CurrentJobId, j.Id)
+	}
+	if got.LastBeat.Before(b.Time) {
+		t.Errorf("worker %v: got last beat %v, want at or after %v", wid, got.LastBeat, b.Time)
+	}
+
+	pushed := *fetched
+	pushed.WorkerId = wid
+	pushed.Status = StatusFailed
+	var unused int
+	if err := s.rpc.Push(&pushed, &unused); err != nil {
+		t.Fatal(err)
+	}
+	got = getStats()[0]
+	if got.CurrentJobId != (JobId{}) || got.ConsecutiveFailures != 1 {
+		t.Errorf("after failed push: got current job %v with %v failures, want none and 1", got.CurrentJobId, got.ConsecutiveFailures)
+	}
+}
+
+func TestServerWorkerStatTTL(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer("", "", db)
+	nolog(s)
+	defer db.Close()
+
+	var old, recent WorkerId
+	old[0], recent[0] = 1, 2
+	s.workers[old] = WorkerStat{WorkerId: old, LastBeat: time.Now().Add(-2 * workerStatTTL)}
+	s.workers[recent] = WorkerStat{WorkerId: recent, LastBeat: time.Now()}
+	s.checkbeat()
+
+	if _, ok := s.workers[old]; ok {
+		t.Errorf("stats for worker without a recent heartbeat were not removed")
+	}
+	if _, ok := s.workers[recent]; !ok {
+		t.Errorf("stats for worker with a recent heartbeat were removed")
+	}
+}
+
+func TestServerSubmitchansReleaseClient(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s := NewServer("", "", db)
+	nolog(s)
+	defer db.Close()
+
+	const ip = "10.0.0.1"
+	j := NewJobCmd("echo", "1")
+	s.submitchans[j.Id] = make(chan *Job, 1)
+	s.submitters[j.Id] = ip
+	s.clientjobs[ip] = 1
+	s.checkSubmitchans()
+
+	if n, ok := s.clientjobs[ip]; ok {
+		t.Errorf("deleted job still counted against its client (%v jobs)", n)
+	}
+}
+
+func TestServerSubmitchansTTL(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s, _ := NewTestServer(t, db, func(s *Server) {
+		s.submitchansTTL = 500 * time.Millisecond
+	})
+
+	j := NewJobCmd("echo", "1")
+	ch, err := s.Start(j, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Remove(j); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got, ok := <-ch:
+		if !ok {
+			t.Errorf("submit chan closed without receiving")
+		} else if got != nil {
+			t.Errorf("got job %v for deleted job, want nil", got.Id)
+		}
+	case <-time.After(s.submitchansTTL + 500*time.Millisecond):
+		t.Fatalf("no result received for deleted job")
+	}
+
+	if _, ok := <-ch; ok {
+		t.Errorf("submit chan not closed")
+	}
+}
+
+func TestServerMaxJobSize(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	s, testaddr := NewTestServer(t, db, func(s *Server) {
+		s.MaxJobSize = 1000
+	})
+
+	j := NewJobCmd("cat", "big.txt")
+	j.AddInfile("big.txt", make([]byte, 2000))
+	data, err := json.Marshal(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post("http://"+testaddr+"/api/v1/job/", "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %v, want %v", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	if _, err := s.Get(j.Id); err == nil {
+		t.Errorf("oversized job was enqueued")
+	}
+	if n, err := db.Count(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Errorf("got %v jobs in db, want 0", n)
+	}
+}
+
+func TestServerAllowedWorkerIPs(t *testing.T) {
+	s, testaddr := NewTestServer(t, nil, func(s *Server) {
+		s.AllowedWorkerIPs = []string{"127.0.0.0/8"}
+	})
+
+	for i := 0; i < 2; i++ {
+		s.Start(NewJobCmd("echo", "1"), nil)
+	}
+
+	var j *Job
+	remote := &RPC{s: s, remoteIP: "10.0.0.1"}
+	if err := remote.Fetch(WorkerId{}, &j); err != nojoberr {
+		t.Errorf("worker from 10.0.0.1: got err %v, want %v", err, nojoberr)
+	}
+
+	client, err := Dial(testaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Fetch(&Worker{}); err != nil {
+		t.Errorf("worker from 127.0.0.1 was refused a job: %v", err)
+	}
+
+	s.AllowedWorkerIPs = []string{"10.0.0.1"}
+	if err := remote.Fetch(WorkerId{}, &j); err != nil {
+		t.Errorf("whitelisted worker from 10.0.0.1 was refused a job: %v", err)
+	}
+}
+
+func TestServerAutoRetry(t *testing.T) {
+	origBackoff := retryBackoff
+	retryBackoff = 100 * time.Millisecond
+	defer func() { retryBackoff = origBackoff }()
+
+	s, testaddr := NewTestServer(t, nil)
+
+	dir, err := ioutil.TempDir("", "cloudlus-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	counter := filepath.Join(dir, "count")
+
+	// the job fails on its first two runs and succeeds on the third
+	script := fmt.Sprintf("n=$(cat %[1]v 2>/dev/null || echo 0); n=$((n+1)); echo $n > %[1]v; [ $n -ge 3 ]", counter)
+	j := NewJobCmd("sh", "-c", script)
+	j.MaxRetries = 2
+	defer os.Remove(outfileName(j.Id))
+	ch := make(chan *Job, 1)
+	s.Start(j, ch)
+
+	w := &Worker{MaxJobsTotal: 3, Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	start := time.Now()
+	go w.Run()
+
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("retried job never finished")
+	case j = <-ch:
+	}
+
+	// retries wait 2 and then 4 backoff units
+	if elapsed, min := time.Now().Sub(start), 6*retryBackoff; elapsed < min {
+		t.Errorf("retries finished after %v, want backoff of at least %v", elapsed, min)
+	}
+
+	if j.Status != StatusComplete {
+		t.Errorf("got status %v, want %v", j.Status, StatusComplete)
+	}
+	if j.Retries != 2 {
+		t.Errorf("got %v retries, want 2", j.Retries)
+	}
+	if stats := s.ServerStats(); stats.NAutoRetried != 2 {
+		t.Errorf("got %v auto retries in stats, want 2", stats.NAutoRetried)
+	}
+}
+
+// TestServerStalePush checks that a failed push for a job that was requeued
+// after its heartbeats timed out doesn't retry or requeue the job again.
+func TestServerStalePush(t *testing.T) {
+	origLimit, origFreq := beatLimit, beatCheckFreq
+	beatLimit, beatCheckFreq = 100*time.Millisecond, 50*time.Millisecond
+	t.Cleanup(func() { beatLimit, beatCheckFreq = origLimit, origFreq })
+
+	s, _ := NewTestServer(t, nil)
+
+	j := NewJobCmd("false")
+	j.AddInfile("in.txt", []byte("data"))
+	j.MaxRetries = 1
+	s.Start(j, nil)
+
+	wid := WorkerId(NewJob().Id)
+	// fetch returns a copy of the next job like a worker receives - the
+	// stats request orders the copy before any later dispatcher changes.
+	fetch := func() *Job {
+		ch := make(chan *Job, 1)
+		s.fetchjobs <- workRequest{WorkerId: wid, Ch: ch}
+		j := <-ch
+		if j == nil {
+			return nil
+		}
+		cp := *j
+		s.ServerStats()
+		return &cp
+	}
+	pushed := fetch()
+	if pushed == nil {
+		t.Fatal("job not fetched")
+	}
+	pushed.Infiles = nil
+	pushed.Status = StatusFailed
+	pushed.WorkerId = wid
+
+	// wait for the job to be requeued without heartbeats
+	time.Sleep(beatLimit + 3*beatCheckFreq)
+	s.pushjobs <- pushed
+
+	stats := s.ServerStats()
+	if stats.NRequeued != 1 || stats.NAutoRetried != 0 {
+		t.Errorf("got %v requeues and %v retries, want 1 and 0", stats.NRequeued, stats.NAutoRetried)
+	}
+	if stats.CurrQueued != 1 {
+		t.Errorf("got %v queued jobs, want 1", stats.CurrQueued)
+	}
+	if refetched := fetch(); refetched == nil {
+		t.Fatal("requeued job not fetched")
+	} else if len(refetched.Infiles) != 1 {
+		t.Errorf("requeued job has %v infiles, want 1", len(refetched.Infiles))
+	}
+	if extra := fetch(); extra != nil {
+		t.Errorf("job %v queued twice", extra.Id)
+	}
+}
+
+func TestServerPriority(t *testing.T) {
+	s, testaddr := NewTestServer(t, nil, func(s *Server) {
+		s.PriorityLevels = 3
+	})
+
+	// priority 5 is clamped to the highest level (2)
+	jobs := []*Job{}
+	for _, p := range []int{0, 1, 5, 0} {
+		j := NewJobCmd("echo", "1")
+		j.Priority = p
+		s.Start(j, nil)
+		jobs = append(jobs, j)
+	}
+	if jobs[2].Priority != 2 {
+		t.Errorf("priority 5 clamped to %v, want 2", jobs[2].Priority)
+	}
+
+	// bump the last job ahead of the others
+	url := "http://" + testaddr + "/api/v1/job-priority/" + jobs[3].Id.String()
+	resp, err := http.Post(url, "application/json", bytes.NewReader([]byte("2")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("priority bump failed with status %v", resp.Status)
+	}
+
+	client, err := Dial(testaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	want := []JobId{jobs[2].Id, jobs[3].Id, jobs[1].Id, jobs[0].Id}
+	for i, id := range want {
+		j, err := client.Fetch(&Worker{})
+		if err != nil {
+			t.Fatal(err)
+		} else if j.Id != id {
+			t.Errorf("fetch %v: got job %v (priority %v), want %v", i, j.Id, j.Priority, id)
+		}
+	}
+
+	if err := s.SetPriority(jobs[0].Id, 1); err == nil {
+		t.Errorf("expected error setting priority of a running job")
+	}
+}
+
+func TestServerDependencies(t *testing.T) {
+	s, testaddr := NewTestServer(t, nil)
+
+	// b runs after a; d fails because c fails because f fails.  b is
+	// submitted first to make sure dependencies are waited for.
+	a := NewJobCmd("echo", "a")
+	b := NewJobCmd("echo", "b")
+	b.DependsOn = []JobId{a.Id}
+	f := NewJobCmd("false")
+	c := NewJobCmd("echo", "c")
+	c.DependsOn = []JobId{f.Id}
+	d := NewJobCmd("echo", "d")
+	d.DependsOn = []JobId{c.Id, a.Id}
+
+	chans := map[JobId]chan *Job{}
+	for _, j := range []*Job{b, a, d, c, f} {
+		defer os.Remove(outfileName(j.Id))
+		ch, err := s.Start(j, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chans[j.Id] = ch
+	}
+
+	w := &Worker{MaxJobsTotal: 3, Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	go w.Run()
+
+	results := map[JobId]*Job{}
+	for id, ch := range chans {
+		select {
+		case <-time.After(10 * time.Second):
+			t.Fatalf("job %v never finished", id)
+		case results[id] = <-ch:
+		}
+	}
+
+	want := map[*Job]string{a: StatusComplete, b: StatusComplete, f: StatusFailed, c: StatusFailed, d: StatusFailed}
+	for j, status := range want {
+		if got := results[j.Id].Status; got != status {
+			t.Errorf("job %v %v: got status %v, want %v", j.Id, j.Cmd, got, status)
+		}
+	}
+	if results[b.Id].Started.Before(results[a.Id].Finished) {
+		t.Errorf("job b started before its dependency a finished")
+	}
+}
+
+func TestServerDependencyCycle(t *testing.T) {
+	s, _ := NewTestServer(t, nil)
+
+	self := NewJobCmd("echo", "1")
+	self.DependsOn = []JobId{self.Id}
+	if _, err := s.Start(self, nil); err == nil {
+		t.Errorf("expected error for job depending on itself")
+	}
+
+	// x waits on y which hasn't been submitted yet
+	x := NewJobCmd("echo", "x")
+	y := NewJobCmd("echo", "y")
+	z := NewJobCmd("echo", "z")
+	x.DependsOn = []JobId{y.Id}
+	y.DependsOn = []JobId{z.Id}
+	z.DependsOn = []JobId{x.Id}
+	if _, err := s.Start(x, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Start(y, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Start(z, nil); err == nil {
+		t.Errorf("expected error for dependency cycle x -> y -> z -> x")
+	}
+}
+
+func TestServerCancelJob(t *testing.T) {
+	origInterval := beatInterval
+	beatInterval = 200 * time.Millisecond
+	defer func() { beatInterval = origInterval }()
+
+	s, testaddr := NewTestServer(t, nil)
+
+	client, err := Dial(testaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// cancel a queued job
+	queued := NewJobCmd("echo", "1")
+	ch, err := s.Start(queued, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CancelJob(queued.Id); err != nil {
+		t.Fatal(err)
+	}
+	if j := <-ch; j.Status != StatusFailed || !j.Cancelled {
+		t.Errorf("cancelled queued job: got status %v (cancelled=%v)", j.Status, j.Cancelled)
+	}
+	if err := client.CancelJob(queued.Id); err == nil {
+		t.Errorf("expected error cancelling an already cancelled job")
+	}
+
+	// cancel a running job
+	running := NewJobCmd("sleep", "30")
+	defer os.Remove(outfileName(running.Id))
+	ch, err = s.Start(running, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Worker{MaxJobsTotal: 1, Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	done := make(chan struct{})
+	go func() {
+		w.Run()
+		close(done)
+	}()
+
+	for {
+		j, err := s.Get(running.Id)
+		if err != nil {
+			t.Fatal(err)
+		} else if j.Status == StatusRunning {
+			break
+		}
+		<-time.After(50 * time.Millisecond)
+	}
+	if err := client.CancelJob(running.Id); err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("worker never killed the cancelled job")
+	case <-done:
+	}
+
+	// the worker's push of the killed job must not clobber the cancellation
+	<-time.After(100 * time.Millisecond)
+	j, err := s.Get(running.Id)
+	if err != nil {
+		t.Fatal(err)
+	} else if j.Status != StatusFailed || !j.Cancelled {
+		t.Errorf("cancelled running job: got status %v (cancelled=%v)", j.Status, j.Cancelled)
+	}
+
+	resp, err := http.Get("http://" + testaddr + "/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if !bytes.Contains(data, []byte("status-cancelled")) {
+		t.Errorf("dashboard doesn't show cancelled jobs:\n%s", data)
+	}
+}
+
+func TestServerJobLog(t *testing.T) {
+	origFreq, origPoll := progressFreq, logPollFreq
+	progressFreq, logPollFreq = 50*time.Millisecond, 50*time.Millisecond
+	defer func() { progressFreq, logPollFreq = origFreq, origPoll }()
+
+	s, testaddr := NewTestServer(t, nil)
+
+	j := NewJobCmd("sh", "-c", "echo line1; sleep 1; echo line2")
+	defer os.Remove(outfileName(j.Id))
+	if _, err := s.Start(j, nil); err != nil {
+		t.Fatal(err)
+	}
+	w := &Worker{MaxJobsTotal: 1, Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	go w.Run()
+
+	resp, err := http.Get("http://" + testaddr + "/api/v1/job-log/" + j.Id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	r := bufio.NewReader(resp.Body)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	} else if line != "line1\n" {
+		t.Errorf("got first log line %q, want %q", line, "line1\n")
+	}
+	if got, err := s.Get(j.Id); err != nil {
+		t.Fatal(err)
+	} else if got.Status != StatusRunning {
+		t.Errorf("first log line streamed with job status %v, want %v", got.Status, StatusRunning)
+	}
+
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(rest) != "line2\n" {
+		t.Errorf("got rest of log %q, want %q", rest, "line2\n")
+	}
+
+	// finished jobs serve their full stdout from any offset
+	resp2, err := http.Get("http://" + testaddr + "/api/v1/job-log/" + j.Id.String() + "?offset=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+	if data, _ := ioutil.ReadAll(resp2.Body); string(data) != "e1\nline2\n" {
+		t.Errorf("got finished job log %q, want %q", data, "e1\nline2\n")
+	}
+}
+
+// testTLSConfigs returns server and client TLS configs using a freshly
+// generated self-signed certificate for 127.0.0.1.
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"cloudlus test"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: pool}
+}
+
+func TestServerTLS(t *testing.T) {
+	servconf, clientconf := testTLSConfigs(t)
+
+	s, testaddr := NewTestServer(t, nil, WithTLS(servconf))
+
+	if c, err := Dial(testaddr); err == nil {
+		c.Close()
+		t.Errorf("plain connection to TLS server succeeded")
+	}
+
+	j := NewJobCmd("sh", "-c", "echo hello > out.txt")
+	j.AddOutfile("out.txt")
+	defer os.Remove(outfileName(j.Id))
+	if _, err := s.Start(j, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Worker{MaxJobsTotal: 1, Wait: 100 * time.Millisecond, ServerAddr: testaddr, TLSConfig: clientconf, nolog: true}
+	done := make(chan struct{})
+	go func() {
+		w.Run()
+		close(done)
+	}()
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("worker failed to run job over TLS")
+	case <-done:
+	}
+
+	c, err := DialTLS(testaddr, clientconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	got, err := c.Retrieve(j.Id)
+	if err != nil {
+		t.Fatal(err)
+	} else if got.Status != StatusComplete {
+		t.Fatalf("job status is %v, want %v (stderr: %v)", got.Status, StatusComplete, got.Stderr)
+	}
+
+	data, err := c.RetrieveOutfileData(got, "out.txt")
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello\n" {
+		t.Errorf("got outfile %q, want %q", data, "hello\n")
+	}
+}
+
+func TestServerResultCache(t *testing.T) {
+	s, testaddr := NewTestServer(t, nil, func(s *Server) {
+		s.ResultCache = true
+	})
+
+	newjob := func(input string) *Job {
+		j := NewJobCmd("sh", "-c", "cat in.txt > out.txt; echo ran")
+		j.AddInfile("in.txt", []byte(input))
+		j.AddOutfile("out.txt")
+		return j
+	}
+
+	j1 := newjob("hello")
+	defer os.Remove(outfileName(j1.Id))
+	ch, err := s.Start(j1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Worker{MaxJobsTotal: 1, Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	go w.Run()
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatal("worker failed to run job")
+	case j1 = <-ch:
+	}
+
+	// no workers are left, so only cache hits can complete
+	j2 := newjob("hello")
+	defer os.Remove(outfileName(j2.Id))
+	j3 := newjob("changed input")
+	ch2, err := s.Start(j2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch3, err := s.Start(j3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("identical job was not completed from the result cache")
+	case j2 = <-ch2:
+	}
+	if j2.Status != StatusComplete || j2.Stdout != j1.Stdout {
+		t.Errorf("cached job has status %v and stdout %q, want %v and %q", j2.Status, j2.Stdout, StatusComplete, j1.Stdout)
+	}
+	if _, err := os.Stat(outfileName(j2.Id)); err != nil {
+		t.Errorf("cached job has no output files: %v", err)
+	}
+
+	select {
+	case <-ch3:
+		t.Errorf("job with different infiles was completed from the result cache")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if stats := s.ServerStats(); stats.NCacheHits != 1 {
+		t.Errorf("got %v cache hits, want 1", stats.NCacheHits)
+	}
+}
+
+func TestServerResultCacheSize(t *testing.T) {
+	origSize := resultCacheSize
+	resultCacheSize = 2
+	defer func() { resultCacheSize = origSize }()
+
+	db, _ := NewDB("", dblimit)
+	defer db.Close()
+	s := NewServer("", "", db)
+	s.ResultCache = true
+	nolog(s)
+
+	jobs := []*Job{}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		j := NewJobCmd("echo", fmt.Sprint(i))
+		j.Status = StatusComplete
+		j.Finished = start.Add(time.Duration(i) * time.Second)
+		s.cacheResult(j)
+		jobs = append(jobs, j)
+	}
+
+	if len(s.results) != resultCacheSize {
+		t.Errorf("got %v cached results, want %v", len(s.results), resultCacheSize)
+	}
+	if _, ok := s.results[resultKey(jobs[0])]; ok {
+		t.Errorf("result of earliest finished job was not evicted")
+	}
+}
+
+func TestServerListJobs(t *testing.T) {
+	s, testaddr := NewTestServer(t, nil)
+
+	done := NewJobCmd("echo", "done")
+	defer os.Remove(outfileName(done.Id))
+	ch, err := s.Start(done, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Worker{MaxJobsTotal: 1, Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	go w.Run()
+	<-ch
+
+	queued := []*Job{}
+	for i := 0; i < 3; i++ {
+		j := NewJobCmd("echo", fmt.Sprint(i))
+		j.DependsOn = []JobId{NewJob().Id} // never ready to run
+		if i == 2 {
+			j.Tags = []string{"experiment"}
+		}
+		if _, err := s.Start(j, nil); err != nil {
+			t.Fatal(err)
+		}
+		queued = append(queued, j)
+		<-time.After(10 * time.Millisecond)
+	}
+
+	c, err := Dial(testaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if all, err := c.ListJobs("", "", 0, 0); err != nil {
+		t.Fatal(err)
+	} else if len(all) != 4 {
+		t.Errorf("listed %v jobs, want 4", len(all))
+	}
+
+	// most recently submitted first
+	page, err := c.ListJobs(StatusQueued, "", 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(page) != 2 {
+		t.Fatalf("listed %v queued jobs, want 2", len(page))
+	} else if page[0].Id != queued[1].Id || page[1].Id != queued[0].Id {
+		t.Errorf("got jobs %v and %v, want %v and %v", page[0].Id, page[1].Id, queued[1].Id, queued[0].Id)
+	}
+
+	if complete, err := c.ListJobs(StatusComplete, "", 0, 0); err != nil {
+		t.Fatal(err)
+	} else if len(complete) != 1 || complete[0].Id != done.Id {
+		t.Errorf("got complete jobs %v, want only %v", complete, done.Id)
+	}
+
+	if past, err := c.ListJobs("", "", 0, 10); err != nil {
+		t.Fatal(err)
+	} else if len(past) != 0 {
+		t.Errorf("listed %v jobs past the end, want 0", len(past))
+	}
+
+	if tagged, err := c.ListJobs("", "experiment", 0, 0); err != nil {
+		t.Fatal(err)
+	} else if len(tagged) != 1 || tagged[0].Id != queued[2].Id {
+		t.Errorf("got tagged jobs %v, want only %v", tagged, queued[2].Id)
+	}
+	if tagged, err := c.ListJobs(StatusComplete, "experiment", 0, 0); err != nil {
+		t.Fatal(err)
+	} else if len(tagged) != 0 {
+		t.Errorf("listed %v complete tagged jobs, want 0", len(tagged))
+	}
+
+	if _, err := c.ListJobs("bogus", "", 0, 0); err == nil {
+		t.Errorf("listing jobs with an invalid status succeeded")
+	}
+}
+
+func TestServerWorkerWhitelist(t *testing.T) {
+	s, testaddr := NewTestServer(t, nil)
+
+	// queued first but not on the worker's whitelist
+	other := NewJobCmd("true")
+	if _, err := s.Start(other, nil); err != nil {
+		t.Fatal(err)
+	}
+	allowed := NewJobCmd("echo", "hello")
+	defer os.Remove(outfileName(allowed.Id))
+	ch, err := s.Start(allowed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Worker{MaxJobsTotal: 1, Wait: 100 * time.Millisecond, ServerAddr: testaddr, Whitelist: []string{"echo"}, nolog: true}
+	go w.Run()
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatal("whitelisted job was never run")
+	case j := <-ch:
+		if j.Status != StatusComplete {
+			t.Errorf("whitelisted job has status %v, want %v", j.Status, StatusComplete)
+		}
+	}
+
+	if j, err := s.Get(other.Id); err != nil {
+		t.Fatal(err)
+	} else if j.Status != StatusQueued {
+		t.Errorf("non-whitelisted job has status %v, want %v", j.Status, StatusQueued)
+	}
+}
+
+func TestClientWatchJob(t *testing.T) {
+	_, testaddr := NewTestServer(t, nil)
+
+	c, err := Dial(testaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, _, err := c.WatchJob(NewJob().Id, time.Second); err == nil {
+		t.Error("watching an unknown job succeeded")
+	}
+
+	j := NewJobCmd("sleep", ".2")
+	defer os.Remove(outfileName(j.Id))
+	if err := c.Submit(j); err != nil {
+		t.Fatal(err)
+	}
+	stats, errc, err := c.WatchJob(j.Id, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &Worker{MaxJobsTotal: 1, Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	go w.Run()
+
+	statuses := []string{}
+	timeout := time.After(10 * time.Second)
+	for stats != nil {
+		select {
+		case <-timeout:
+			t.Fatalf("job watch didn't finish, got statuses %v", statuses)
+		case stat, ok := <-stats:
+			if !ok {
+				stats = nil
+				continue
+			}
+			statuses = append(statuses, stat.Status)
+		}
+	}
+
+	if err := <-errc; err != nil {
+		t.Errorf("polling failed: %v", err)
+	}
+	if len(statuses) < 2 || statuses[0] != StatusQueued || statuses[len(statuses)-1] != StatusComplete {
+		t.Errorf("got statuses %v, want queued first and complete last", statuses)
+	}
+	for i := 1; i < len(statuses); i++ {
+		if statuses[i] == statuses[i-1] {
+			t.Errorf("unchanged status %v sent twice", statuses[i])
+		}
+	}
+}
+
+func TestClientBatchSubmit(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	_, testaddr := NewTestServer(t, db)
+
+	c, err := Dial(testaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// invalid jobs are rejected individually and the rest are submitted
+	ok := NewJobCmd("echo", "ok")
+	ok.DependsOn = []JobId{NewJob().Id} // never ready to run
+	bad := NewJobCmd("echo", "bad")
+	bad.DependsOn = []JobId{bad.Id}
+	ids, err := c.BatchSubmit([]*Job{ok, bad})
+	if berr, isbatch := err.(*BatchError); !isbatch {
+		t.Errorf("batch with a self-dependent job: got error %v, want a *BatchError", err)
+	} else if len(berr.Errs) != 2 || berr.Errs[0] != nil || berr.Errs[1] == nil {
+		t.Errorf("got per-job errors %v, want only the second job rejected", berr.Errs)
+	}
+	if len(ids) != 2 || ids[0] != ok.Id || ids[1] != (JobId{}) {
+		t.Errorf("got ids %v, want [%v, zero]", ids, ok.Id)
+	}
+	if _, err := db.Get(ok.Id); err != nil {
+		t.Errorf("valid job from partially rejected batch not submitted: %v", err)
+	}
+	if _, err := db.Get(bad.Id); err == nil {
+		t.Error("rejected job was submitted")
+	}
+
+	jobs := []*Job{NewJobCmd("echo", "1"), NewJobCmd("echo", "2"), NewJobCmd("echo", "3")}
+	for _, j := range jobs {
+		defer os.Remove(outfileName(j.Id))
+	}
+	ids, err = c.BatchSubmit(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(jobs) {
+		t.Fatalf("got %v ids, want %v", len(ids), len(jobs))
+	}
+	for i, id := range ids {
+		if id != jobs[i].Id {
+			t.Errorf("id %v: got %v, want %v", i, id, jobs[i].Id)
+		}
+	}
+
+	w := &Worker{MaxJobsTotal: len(jobs), Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	go w.Run()
+
+	for _, id := range ids {
+		stats, _, err := c.WatchJob(id, 50*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var stat *JobStat
+		timeout := time.After(10 * time.Second)
+	watch:
+		for {
+			select {
+			case <-timeout:
+				t.Fatalf("job %v never finished", id)
+			case st, ok := <-stats:
+				if !ok {
+					break watch
+				}
+				stat = st
+			}
+		}
+		if stat.Status != StatusComplete {
+			t.Errorf("job %v: got status %v, want %v", id, stat.Status, StatusComplete)
+		}
+	}
+}
+
+func TestServerSubmissionLimits(t *testing.T) {
+	s, testaddr := NewTestServer(t, nil)
+
+	post := func() (*Job, int) {
+		j := NewJobCmd("echo", "1")
+		data, err := json.Marshal(j)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post("http://"+testaddr+"/api/v1/job/", "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return j, resp.StatusCode
+	}
+
+	s.MaxQueueDepth = 2
+	for i := 0; i < 2; i++ {
+		if _, code := post(); code != http.StatusCreated {
+			t.Fatalf("job %v: got status %v, want %v", i, code, http.StatusCreated)
+		}
+	}
+	j, code := post()
+	if code != http.StatusTooManyRequests {
+		t.Errorf("submission to full queue: got status %v, want %v", code, http.StatusTooManyRequests)
+	}
+	if _, err := s.Get(j.Id); err == nil {
+		t.Errorf("job rejected for full queue was stored")
+	}
+
+	s.ResetQueue()
+	s.MaxQueueDepth = 0
+	s.MaxJobsPerClient = 1
+	if _, code := post(); code != http.StatusCreated {
+		t.Fatalf("first client job: got status %v, want %v", code, http.StatusCreated)
+	}
+	if _, code := post(); code != http.StatusTooManyRequests {
+		t.Errorf("job over client limit: got status %v, want %v", code, http.StatusTooManyRequests)
+	}
+}
+
+func TestDashboardWebSocket(t *testing.T) {
+	s, testaddr := NewTestServer(t, nil)
+
+	conn, err := net.Dial("tcp", testaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /ws/dashboard HTTP/1.1\r\nHost: %v\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %v\r\nSec-WebSocket-Version: 13\r\n\r\n", testaddr, key)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got handshake status %v, want %v", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	// accept value for the sample key from RFC 6455
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("got Sec-WebSocket-Accept %v, want %v", got, want)
+	}
+
+	j := NewJobCmd("echo", "1")
+	j.Tags = []string{"ws"}
+	if _, err := s.Start(j, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CancelJob(j.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{StatusQueued, statusCancelled} {
+		opcode, payload, err := readWSFrame(br)
+		if err != nil {
+			t.Fatal(err)
+		} else if opcode != wsOpText {
+			t.Fatalf("got frame opcode %v, want %v", opcode, wsOpText)
+		}
+
+		var u DashUpdate
+		if err := json.Unmarshal(payload, &u); err != nil {
+			t.Fatalf("%v: %s", err, payload)
+		}
+		if u.Id != j.Id.String() || u.Status != want {
+			t.Errorf("got update for job %v with status %v, want job %v with status %v", u.Id, u.Status, j.Id, want)
+		}
+		if len(u.Tags) != 1 || u.Tags[0].Name != "ws" {
+			t.Errorf("got update tags %+v, want tag 'ws'", u.Tags)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package cloudlus
+
+import (
+	"os"
+	"time"
+)
+
+// ResourceUsage reports a worker's resource consumption.  This includes the
+// worker process and all of its descendants (i.e. the job commands it runs).
+// Fields are zero on platforms where usage sampling is unsupported.
+type ResourceUsage struct {
+	// CPUPercent is the CPU utilization (100 per fully used core) since the
+	// previous sample.
+	CPUPercent float64
+	// MemRSS is the total resident set size in bytes.
+	MemRSS int64
+}
+
+// usageSampler computes resource usage for a process tree between
+// successive calls to Sample.
+type usageSampler struct {
+	pid     int
+	cputime time.Duration
+	last    time.Time
+}
+
+func newUsageSampler() *usageSampler {
+	s := &usageSampler{pid: os.Getpid()}
+	s.cputime, _, _ = treeUsage(s.pid)
+	s.last = time.Now()
+	return s
+}
+
+// Sample returns the current resource usage with CPUPercent averaged over the
+// time since the previous sample.
+func (s *usageSampler) Sample() ResourceUsage {
+	u := ResourceUsage{}
+	now := time.Now()
+	cputime, rss, err := treeUsage(s.pid)
+	if err != nil {
+		return u
+	}
+	u.MemRSS = rss
+	if now.After(s.last) && cputime > s.cputime {
+		u.CPUPercent = 100 * float64(cputime-s.cputime) / float64(now.Sub(s.last))
+	}
+	s.cputime, s.last = cputime, now
+	return u
+}
+
+// treeUsage returns the total cpu time and resident set size of process pid
+// and all of its descendants.  Processes that exit while being sampled are
+// skipped.
+func treeUsage(pid int) (cputime time.Duration, rss int64, err error) {
+	pids, err := procTree(pid)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, p := range pids {
+		t, err := procCPUTime(p)
+		if err != nil {
+			continue
+		}
+		cputime += t
+		if n, err := procMemRSS(p); err == nil {
+			rss += n
+		}
+	}
+	return cputime, rss, nil
+}
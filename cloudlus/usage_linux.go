@@ -0,0 +1,116 @@
+package cloudlus
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is the kernel's USER_HZ which is used as the unit for cpu times
+// in /proc/[pid]/stat.  It is 100 on all mainstream linux platforms.
+const clockTicks = 100
+
+// procStat returns the fields of /proc/[pid]/stat following the command name.
+// The process state is element 0.
+func procStat(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	// skip past the command name which may contain spaces
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return nil, fmt.Errorf("malformed /proc/%v/stat", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 15 {
+		return nil, fmt.Errorf("malformed /proc/%v/stat", pid)
+	}
+	return fields, nil
+}
+
+// procCPUTime returns the total user+system cpu time used by process pid and
+// its children that have exited and been waited for.  Counting the waited
+// for children keeps the total for a process tree from dropping when a
+// process in it exits.
+func procCPUTime(pid int) (time.Duration, error) {
+	fields, err := procStat(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	// utime, stime, cutime and cstime are the 14th through 17th fields of
+	// the whole file
+	var ticks int64
+	for _, f := range fields[11:15] {
+		n, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		ticks += n
+	}
+	return time.Duration(ticks) * time.Second / clockTicks, nil
+}
+
+// procTree returns pid followed by the pids of all of its descendant
+// processes.
+func procTree(pid int) ([]int, error) {
+	fis, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	children := map[int][]int{}
+	for _, fi := range fis {
+		child, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue
+		}
+		fields, err := procStat(child)
+		if err != nil {
+			continue // process exited
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], child)
+	}
+
+	pids := []int{pid}
+	for i := 0; i < len(pids); i++ {
+		pids = append(pids, children[pids[i]]...)
+	}
+	return pids, nil
+}
+
+// procMemRSS returns the resident set size in bytes of process pid.
+func procMemRSS(pid int) (int64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%v/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "VmRSS:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kb * 1024, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no VmRSS entry in /proc/%v/status", pid)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package cloudlus
+
+import (
+	"errors"
+	"time"
+)
+
+var errNoUsage = errors.New("resource usage sampling is not supported on this platform")
+
+func procCPUTime(pid int) (time.Duration, error) { return 0, errNoUsage }
+
+func procMemRSS(pid int) (int64, error) { return 0, errNoUsage }
+
+func procTree(pid int) ([]int, error) { return nil, errNoUsage }
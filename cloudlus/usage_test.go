@@ -0,0 +1,70 @@
+package cloudlus
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestUsageSampler(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("resource usage sampling is only supported on linux")
+	}
+
+	s := newUsageSampler()
+
+	done := make(chan struct{})
+	go func() {
+		x := 0
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				x++
+			}
+		}
+	}()
+	<-time.After(500 * time.Millisecond)
+	close(done)
+
+	u := s.Sample()
+	if u.CPUPercent <= 0 {
+		t.Errorf("got CPUPercent %v, want > 0", u.CPUPercent)
+	}
+	if u.MemRSS <= 0 {
+		t.Errorf("got MemRSS %v, want > 0", u.MemRSS)
+	}
+}
+
+func TestProcTree(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("resource usage sampling is only supported on linux")
+	}
+
+	cmd := exec.Command("sleep", "5")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	pids, err := procTree(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pids[0] != os.Getpid() {
+		t.Errorf("got root pid %v, want %v", pids[0], os.Getpid())
+	}
+	found := false
+	for _, pid := range pids {
+		if pid == cmd.Process.Pid {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("child pid %v not in process tree %v", cmd.Process.Pid, pids)
+	}
+}
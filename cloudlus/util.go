@@ -19,7 +19,9 @@ type Beat struct {
 	Time     time.Time
 	WorkerId WorkerId
 	JobId    JobId
-	kill     chan bool
+	// Usage is the worker's resource usage at the time of the beat.
+	Usage ResourceUsage
+	kill  chan bool
 }
 
 func NewBeat(w WorkerId, j JobId) Beat {
@@ -88,6 +90,9 @@ type DB struct {
 	// PurgeAge is the minimum age at which completed (successful and failed) jobs
 	// become elegible for removal from the database during GC.
 	PurgeAge time.Duration
+	// PurgePolicy decides which jobs GC removes.  If nil, an AgePurgePolicy
+	// using PurgeAge is used.
+	PurgePolicy PurgePolicy
 }
 
 // NewDB returns a new database with a
@@ -111,11 +116,13 @@ func NewDB(path string, dblimit int) (*DB, error) {
 }
 
 // GC runs garbage collection if the database is larger than the specified
-// DB.Limit.  Jobs older than DB.PurgeAge are removed if they have been
-// completed.  The number of removed jobs and the number of jobs still in the
+// DB.Limit.  Jobs are removed if DB.PurgePolicy says they should be - by
+// default, completed jobs older than DB.PurgeAge (or their own Job.TTL if
+// set).  The number of removed jobs and the number of jobs still in the
 // database is returned along with any error that occured.  sometimes, -1 may
 // be returned for nremain - this means that the jobs count is unknown because
-// GC didn't occur.
+// GC didn't occur.  All purged jobs are deleted from the database in a single
+// batch.
 func (d *DB) GC() (npurged, nremain int, err error) {
 	size, err := d.Size()
 	if err != nil {
@@ -124,10 +131,21 @@ func (d *DB) GC() (npurged, nremain int, err error) {
 		return 0, -1, nil
 	}
 
+	policy := d.PurgePolicy
+	if policy == nil {
+		policy = AgePurgePolicy{Age: d.PurgeAge}
+	}
+	if prep, ok := policy.(gcPreparer); ok {
+		if err := prep.prepareGC(d); err != nil {
+			return 0, -1, err
+		}
+	}
+
 	it := d.db.NewIterator(nil, nil)
 	defer it.Release()
 
-	now := time.Now()
+	batch := new(leveldb.Batch)
+	purged := []JobId{}
 	for it.Next() {
 		if notjob(it.Key()) {
 			// TODO: test that non-job key entries are properly skipped
@@ -138,23 +156,27 @@ func (d *DB) GC() (npurged, nremain int, err error) {
 		data := it.Value()
 		err := json.Unmarshal(data, &j)
 		if err != nil {
-			return npurged, -1, err
+			return 0, -1, err
 		}
 
-		if j.Done() && now.Sub(j.Finished) > d.PurgeAge {
-			os.Remove(outfileName(j.Id))
-			d.db.Delete(it.Key(), nil)
-			d.db.Delete(finishKey(j), nil)
-			d.db.Delete(currentKey(j), nil)
+		if policy.ShouldPurge(j, size) {
+			removeBatch(batch, j)
+			purged = append(purged, j.Id)
 			npurged++
 		} else {
 			nremain++
 		}
 	}
 	if err := it.Error(); err != nil {
-		return npurged, nremain, err
+		return 0, nremain + npurged, err
 	}
 
+	if err := d.db.Write(batch, nil); err != nil {
+		return 0, nremain + npurged, err
+	}
+	for _, id := range purged {
+		os.Remove(outfileName(id))
+	}
 	return npurged, nremain, nil
 }
 
@@ -194,19 +216,163 @@ func (d *DB) Count() (int, error) {
 
 func (d *DB) Close() error { return d.db.Close() }
 
+// Remove deletes j and its output files from the database.
+func (d *DB) Remove(j *Job) error {
+	batch := new(leveldb.Batch)
+	removeBatch(batch, j)
+	if err := d.db.Write(batch, nil); err != nil {
+		return err
+	}
+	os.Remove(outfileName(j.Id))
+	return nil
+}
+
+// removeFinishIndex deletes j's entry from the time finished index.  This
+// must be done before changing j.Finished on a job that has finished.
+func (d *DB) removeFinishIndex(j *Job) error {
+	return d.db.Delete(finishKey(j), nil)
+}
+
+// removeBatch adds deletion of j and its index entries to batch.  j's output
+// files must be removed separately once the batch has been written.
+func removeBatch(batch *leveldb.Batch, j *Job) {
+	batch.Delete(finishKey(j))
+	batch.Delete(currentKey(j))
+	for _, tag := range j.Tags {
+		batch.Delete(tagKey(tag, j.Id))
+	}
+	batch.Delete(j.Id[:])
+}
+
+// ListKeys returns every key in the database hex encoded and prefixed by its
+// kind: "job:" for job entries, "curr:", "finish:" and "tag:" for the
+// current, finished and tag index entries (with the index prefix stripped),
+// and "other:" for anything else.  This is intended for diagnosing database problems.
+func (d *DB) ListKeys() ([]string, error) {
+	it := d.db.NewIterator(nil, nil)
+	defer it.Release()
+
+	keys := []string{}
+	for it.Next() {
+		key := it.Key()
+		var kind string
+		switch {
+		case bytes.HasPrefix(key, []byte(currPrefix)):
+			kind, key = "curr:", key[len(currPrefix):]
+		case bytes.HasPrefix(key, []byte(finishPrefix)):
+			kind, key = "finish:", key[len(finishPrefix):]
+		case bytes.HasPrefix(key, []byte(tagPrefix)):
+			kind, key = "tag:", key[len(tagPrefix):]
+		case len(key) == len(JobId{}):
+			kind = "job:"
+		default:
+			kind = "other:"
+		}
+		keys = append(keys, kind+hex.EncodeToString(key))
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// OrphanError lists index entries that refer to jobs missing from the
+// database.
+type OrphanError struct {
+	// Keys holds the hex encoded orphaned index keys.
+	Keys []string
+}
+
+func (e *OrphanError) Error() string {
+	return fmt.Sprintf("%v orphaned index entries: %v", len(e.Keys), strings.Join(e.Keys, ", "))
+}
+
+// Verify checks that every current, finished and tag index entry refers to a
+// job present in the database.  If any don't, an *OrphanError is returned.
+func (d *DB) Verify() error {
+	orphans, err := d.orphans()
+	if err != nil {
+		return err
+	} else if len(orphans) == 0 {
+		return nil
+	}
+
+	e := &OrphanError{}
+	for _, key := range orphans {
+		e.Keys = append(e.Keys, hex.EncodeToString(key))
+	}
+	return e
+}
+
+// Repair deletes all index entries that refer to jobs missing from the
+// database.
+func (d *DB) Repair() error {
+	orphans, err := d.orphans()
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	for _, key := range orphans {
+		batch.Delete(key)
+	}
+	return d.db.Write(batch, nil)
+}
+
+// orphans returns the keys of all index entries referring to jobs missing
+// from the database.
+func (d *DB) orphans() ([][]byte, error) {
+	orphans := [][]byte{}
+	for _, pfx := range []string{currPrefix, finishPrefix, tagPrefix} {
+		it := d.db.NewIterator(util.BytesPrefix([]byte(pfx)), nil)
+		for it.Next() {
+			has, err := d.db.Has(it.Value(), nil)
+			if err != nil {
+				it.Release()
+				return nil, err
+			} else if !has {
+				key := make([]byte, len(it.Key()))
+				copy(key, it.Key())
+				orphans = append(orphans, key)
+			}
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return nil, err
+		}
+	}
+	return orphans, nil
+}
+
 func notjob(key []byte) bool {
 	pfx1 := []byte(finishPrefix)
 	pfx2 := []byte(currPrefix)
+	pfx3 := []byte(tagPrefix)
 	if bytes.Equal(key[:len(pfx1)], pfx1) {
 		return true
 	} else if bytes.Equal(key[:len(pfx2)], pfx2) {
 		return true
+	} else if bytes.Equal(key[:len(pfx3)], pfx3) {
+		return true
 	}
 	return false
 }
 
 // Failed returns the all jobs from the database that failed.
-func (d *DB) Failed() ([]*Job, error) {
+func (d *DB) Failed() ([]*Job, error) { return d.QueryByStatus(StatusFailed) }
+
+// QueryByStatus returns all jobs from the database with the given status.
+func (d *DB) QueryByStatus(status string) ([]*Job, error) {
+	return d.query(func(j *Job) bool { return j.Status == status })
+}
+
+// All returns all jobs in the database.
+func (d *DB) All() ([]*Job, error) {
+	return d.query(func(j *Job) bool { return true })
+}
+
+// query returns all jobs from the database for which match returns true.
+func (d *DB) query(match func(j *Job) bool) ([]*Job, error) {
 	it := d.db.NewIterator(nil, nil)
 	defer it.Release()
 
@@ -221,8 +387,9 @@ func (d *DB) Failed() ([]*Job, error) {
 		err := json.Unmarshal(it.Value(), &j)
 		if err != nil {
 			return nil, err
+		} else if match(j) {
+			jobs = append(jobs, j)
 		}
-		jobs = append(jobs, j)
 	}
 	if err := it.Error(); err != nil {
 		return nil, err
@@ -230,6 +397,35 @@ func (d *DB) Failed() ([]*Job, error) {
 	return jobs, nil
 }
 
+// ByTag returns all jobs in the database with the given tag.
+func (d *DB) ByTag(tag string) ([]*Job, error) {
+	it := d.db.NewIterator(util.BytesPrefix([]byte(tagPrefix+tag+"-")), nil)
+	defer it.Release()
+
+	ids := []JobId{}
+	for it.Next() {
+		var id JobId
+		copy(id[:], it.Value())
+		ids = append(ids, id)
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+
+	jobs := []*Job{}
+	for _, id := range ids {
+		j, err := d.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		// the prefix also matches longer tags starting with "<tag>-"
+		if j.HasTag(tag) {
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, nil
+}
+
 // Current returns the all jobs from the database that aren't completed - e.g.
 // queued or running.
 func (d *DB) Current() ([]*Job, error) {
@@ -306,6 +502,7 @@ func (d *DB) Get(id JobId) (*Job, error) {
 
 const finishPrefix = "finish-"
 const currPrefix = "curr-"
+const tagPrefix = "tag-"
 
 func finishKey(j *Job) []byte {
 	data := make([]byte, 8)
@@ -319,7 +516,34 @@ func currentKey(j *Job) []byte {
 	return append([]byte(currPrefix), j.Id[:]...)
 }
 
+func tagKey(tag string, id JobId) []byte {
+	return append([]byte(tagPrefix+tag+"-"), id[:]...)
+}
+
+// Put stores j in the database.  The job and its index entries are written
+// atomically in a single batch.
 func (d *DB) Put(j *Job) error {
+	batch := new(leveldb.Batch)
+	if err := putBatch(batch, j); err != nil {
+		return err
+	}
+	return d.db.Write(batch, nil)
+}
+
+// PutBatch stores all jobs in the database atomically in a single batch.
+// This is much faster than calling Put for each job.
+func (d *DB) PutBatch(jobs []*Job) error {
+	batch := new(leveldb.Batch)
+	for _, j := range jobs {
+		if err := putBatch(batch, j); err != nil {
+			return err
+		}
+	}
+	return d.db.Write(batch, nil)
+}
+
+// putBatch adds writing j and updating its index entries to batch.
+func putBatch(batch *leveldb.Batch, j *Job) error {
 	data, err := json.Marshal(j)
 	if err != nil {
 		return err
@@ -327,25 +551,24 @@ func (d *DB) Put(j *Job) error {
 
 	// current index
 	if j.Done() {
-		d.db.Delete(currentKey(j), nil)
+		batch.Delete(currentKey(j))
 	} else {
-		err = d.db.Put(currentKey(j), j.Id[:], nil)
-		if err != nil {
-			return err
-		}
+		batch.Put(currentKey(j), j.Id[:])
 	}
 
 	// time finished index
 	if j.Done() && j.Finished.Unix() >= 0 {
 		// TODO: test that we don't add entries for unfinished jobs - they have a
 		// negative unix time and mess up the iteration order.
-		err = d.db.Put(finishKey(j), j.Id[:], nil)
-		if err != nil {
-			return err
-		}
+		batch.Put(finishKey(j), j.Id[:])
 	}
 
-	return d.db.Put(j.Id[:], data, nil)
+	for _, tag := range j.Tags {
+		batch.Put(tagKey(tag, j.Id), j.Id[:])
+	}
+
+	batch.Put(j.Id[:], data)
+	return nil
 }
 
 func outfileName(id JobId) string {
@@ -1,14 +1,25 @@
 package cloudlus
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func nolog(s *Server) {
 	log.SetOutput(devnull)
-	s.log = log.New(devnull, "", 0)
+	s.log = NewJSONLogger(devnull)
 }
 
 const (
@@ -51,6 +62,60 @@ func TestDB_Count(t *testing.T) {
 	}
 }
 
+func TestDB_VerifyRepair(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	defer db.Close()
+
+	running := NewJobCmd("echo", "1")
+	running.Status = StatusRunning
+	done := NewJobCmd("echo", "1")
+	done.Status = StatusComplete
+	done.Finished = time.Now()
+	orphan := NewJobCmd("echo", "1")
+	orphan.Status = StatusComplete
+	orphan.Finished = time.Now()
+	for _, j := range []*Job{running, done, orphan} {
+		if err := db.Put(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatalf("consistent db failed verification: %v", err)
+	}
+
+	// orphan the finished index entry by deleting only the job itself
+	if err := db.db.Delete(orphan.Id[:], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := db.ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, k := range keys {
+		counts[k[:strings.Index(k, ":")]]++
+	}
+	if want := map[string]int{"job": 2, "curr": 1, "finish": 2}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got key counts %v, want %v", counts, want)
+	}
+
+	err = db.Verify()
+	if oerr, ok := err.(*OrphanError); !ok || len(oerr.Keys) != 1 {
+		t.Fatalf("got verify error %v, want one orphaned entry", err)
+	}
+
+	if err := db.Repair(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Errorf("repaired db failed verification: %v", err)
+	}
+	if jobs, err := db.Recent(10); err != nil || len(jobs) != 1 {
+		t.Errorf("got %v recent jobs after repair (err=%v), want 1", len(jobs), err)
+	}
+}
+
 func TestGC(t *testing.T) {
 	tests := []test{
 		{[]string{StatusComplete}, full},
@@ -119,3 +184,321 @@ func TestGC(t *testing.T) {
 		}
 	}
 }
+
+func TestGC_TTL(t *testing.T) {
+	db, _ := NewDB("", 1) // always over the limit
+	db.PurgeAge = 0 * time.Second
+
+	short := NewJobCmd("echo", "1")
+	long := NewJobCmd("echo", "1")
+	long.TTL = time.Hour
+	for _, j := range []*Job{short, long} {
+		j.Status = StatusComplete
+		j.Finished = time.Now().Add(-time.Minute)
+		if err := db.Put(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	npurged, nremain, err := db.GC()
+	if err != nil {
+		t.Fatal(err)
+	} else if npurged != 1 || nremain != 1 {
+		t.Fatalf("GC purged %v and kept %v jobs, want 1 and 1", npurged, nremain)
+	}
+	if _, err := db.Get(long.Id); err != nil {
+		t.Errorf("job with unexpired TTL was purged: %v", err)
+	}
+}
+
+// crashPutEnv names the environment variable holding the db path that
+// TestDB_PutCrash's child process writes to before exiting abruptly.
+const crashPutEnv = "CLOUDLUS_CRASH_PUT_DB"
+
+func TestDB_PutCrash(t *testing.T) {
+	if path := os.Getenv(crashPutEnv); path != "" {
+		// child process: write jobs and die without closing the db
+		db, err := NewDB(path, dblimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Exit(0)
+		for i := 0; i < 100; i++ {
+			j := NewJobCmd("echo", "1")
+			j.Status = StatusQueued
+			if err := db.Put(j); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "cloudlus-crashput")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobdb")
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestDB_PutCrash")
+	cmd.Env = append(os.Environ(), crashPutEnv+"="+path)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("crash process failed: %v\n%s", err, out)
+	}
+
+	db, err := NewDB(path, dblimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// every job must have its current index entry and vice versa
+	n, err := db.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	curr, err := db.Current()
+	if err != nil {
+		t.Fatalf("db left with dangling index entries: %v", err)
+	}
+	if n != 100 {
+		t.Errorf("got %v jobs after crash, want 100", n)
+	}
+	if len(curr) != n {
+		t.Errorf("got %v indexed current jobs, want %v", len(curr), n)
+	}
+}
+
+// putUnbatched is the equivalent of DB.Put using separate writes for the job
+// and each of its index entries.
+func putUnbatched(d *DB, j *Job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if j.Done() {
+		d.db.Delete(currentKey(j), nil)
+	} else if err := d.db.Put(currentKey(j), j.Id[:], nil); err != nil {
+		return err
+	}
+	if j.Done() && j.Finished.Unix() >= 0 {
+		if err := d.db.Put(finishKey(j), j.Id[:], nil); err != nil {
+			return err
+		}
+	}
+	return d.db.Put(j.Id[:], data, nil)
+}
+
+func benchmarkPut(b *testing.B, put func(*DB, *Job) error) {
+	const nsubmit = 1000
+
+	dir, err := ioutil.TempDir("", "cloudlus-benchput")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDB(filepath.Join(dir, "jobdb"), dblimit)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	jobs := make([]*Job, nsubmit)
+	for i := range jobs {
+		jobs[i] = NewJobCmd("echo", "1")
+		jobs[i].Status = StatusComplete
+		jobs[i].Finished = time.Now()
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+	for n := 0; n < b.N; n++ {
+		var wg sync.WaitGroup
+		wg.Add(len(jobs))
+		for _, j := range jobs {
+			go func(j *Job) {
+				defer wg.Done()
+				if err := put(db, j); err != nil {
+					b.Error(err)
+				}
+			}(j)
+		}
+		wg.Wait()
+	}
+	b.ReportMetric(float64(b.N*nsubmit)/time.Since(start).Seconds(), "jobs/s")
+}
+
+func BenchmarkDB_PutBatch(b *testing.B)     { benchmarkPut(b, (*DB).Put) }
+func BenchmarkDB_PutUnbatched(b *testing.B) { benchmarkPut(b, putUnbatched) }
+
+func TestDB_ByTag(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	defer db.Close()
+
+	tagged := NewJobCmd("echo", "1")
+	tagged.Tags = []string{"exp", "other"}
+	prefixed := NewJobCmd("echo", "2")
+	prefixed.Tags = []string{"exp-2"}
+	untagged := NewJobCmd("echo", "3")
+	if err := db.PutBatch([]*Job{tagged, prefixed, untagged}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.Count(); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Errorf("tag index entries counted as jobs: got %v jobs, want 3", n)
+	}
+
+	jobs, err := db.ByTag("exp")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(jobs) != 1 || jobs[0].Id != tagged.Id {
+		t.Errorf("got %v jobs tagged exp, want only %v", len(jobs), tagged.Id)
+	}
+
+	if err := db.Remove(tagged); err != nil {
+		t.Fatal(err)
+	}
+	if jobs, err := db.ByTag("other"); err != nil {
+		t.Fatal(err)
+	} else if len(jobs) != 0 {
+		t.Errorf("removed job still found by tag")
+	}
+	if err := db.Verify(); err != nil {
+		t.Errorf("removing a tagged job left orphaned index entries: %v", err)
+	}
+}
+
+func TestDB_PutBatch(t *testing.T) {
+	db, _ := NewDB("", dblimit)
+	defer db.Close()
+
+	jobs := make([]*Job, 100)
+	for i := range jobs {
+		jobs[i] = NewJobCmd("echo", "1")
+		jobs[i].Status = StatusQueued
+		if i%2 == 0 {
+			jobs[i].Status = StatusComplete
+			jobs[i].Finished = time.Now()
+		}
+	}
+	if err := db.PutBatch(jobs); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, j := range jobs {
+		got, err := db.Get(j.Id)
+		if err != nil {
+			t.Fatalf("job %v not readable after batch write: %v", j.Id, err)
+		} else if got.Status != j.Status {
+			t.Errorf("job %v: got status %v, want %v", j.Id, got.Status, j.Status)
+		}
+	}
+	if curr, err := db.Current(); err != nil || len(curr) != 50 {
+		t.Errorf("got %v current jobs (err=%v), want 50", len(curr), err)
+	}
+	if recent, err := db.Recent(100); err != nil || len(recent) != 50 {
+		t.Errorf("got %v recent jobs (err=%v), want 50", len(recent), err)
+	}
+}
+
+// benchDB creates an on-disk database in a temporary directory and n
+// completed jobs to store in it.  The returned function cleans up the db.
+func benchDB(b *testing.B, n int) (db *DB, jobs []*Job, cleanup func()) {
+	dir, err := ioutil.TempDir("", "cloudlus-benchdb")
+	if err != nil {
+		b.Fatal(err)
+	}
+	db, err = NewDB(filepath.Join(dir, "jobdb"), dblimit)
+	if err != nil {
+		os.RemoveAll(dir)
+		b.Fatal(err)
+	}
+
+	jobs = make([]*Job, n)
+	for i := range jobs {
+		jobs[i] = NewJobCmd("echo", "1")
+		jobs[i].Status = StatusComplete
+		jobs[i].Finished = time.Now()
+	}
+	return db, jobs, func() { db.Close(); os.RemoveAll(dir) }
+}
+
+// reportPutStats reports throughput and latency percentiles for njobs jobs
+// written in elapsed time with the given per-write latencies.
+func reportPutStats(b *testing.B, njobs int, elapsed time.Duration, lats []time.Duration) {
+	b.ReportMetric(float64(njobs)/elapsed.Seconds(), "jobs/s")
+	if len(lats) == 0 {
+		return
+	}
+	sort.Slice(lats, func(i, j int) bool { return lats[i] < lats[j] })
+	b.ReportMetric(float64(lats[len(lats)/2].Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(lats[len(lats)*99/100].Nanoseconds()), "p99-ns")
+}
+
+// BenchmarkDBPut measures sequential single job Put calls.
+func BenchmarkDBPut(b *testing.B) {
+	db, jobs, cleanup := benchDB(b, b.N)
+	defer cleanup()
+
+	lats := make([]time.Duration, b.N)
+	b.ResetTimer()
+	start := time.Now()
+	for i, j := range jobs {
+		t0 := time.Now()
+		if err := db.Put(j); err != nil {
+			b.Fatal(err)
+		}
+		lats[i] = time.Since(t0)
+	}
+	reportPutStats(b, b.N, time.Since(start), lats)
+}
+
+// BenchmarkDBPutConcurrent measures single job Put calls from several
+// concurrent callers.
+func BenchmarkDBPutConcurrent(b *testing.B) {
+	for _, ncallers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("callers=%v", ncallers), func(b *testing.B) {
+			db, jobs, cleanup := benchDB(b, b.N)
+			defer cleanup()
+
+			lats := make([]time.Duration, b.N)
+			next := int64(-1)
+			b.SetParallelism(ncallers)
+			b.ResetTimer()
+			start := time.Now()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&next, 1)
+					t0 := time.Now()
+					if err := db.Put(jobs[i]); err != nil {
+						b.Error(err)
+					}
+					lats[i] = time.Since(t0)
+				}
+			})
+			reportPutStats(b, b.N, time.Since(start), lats)
+		})
+	}
+}
+
+// BenchmarkDBPutBatch measures writing jobs in batches of 100 with PutBatch.
+func BenchmarkDBPutBatch(b *testing.B) {
+	const batchsize = 100
+	db, jobs, cleanup := benchDB(b, b.N*batchsize)
+	defer cleanup()
+
+	lats := make([]time.Duration, b.N)
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		t0 := time.Now()
+		if err := db.PutBatch(jobs[i*batchsize : (i+1)*batchsize]); err != nil {
+			b.Fatal(err)
+		}
+		lats[i] = time.Since(t0)
+	}
+	reportPutStats(b, b.N*batchsize, time.Since(start), lats)
+}
@@ -1,20 +1,26 @@
 package cloudlus
 
 import (
+	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
 )
 
+// devnull discards job and server logs (e.g. for workers with nolog set).
+// It must be opened for writing - writes to a read-only file fail.
 var devnull *os.File
 
 func init() {
 	var err error
-	devnull, err = os.Open(os.DevNull)
+	devnull, err = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
 	if err != nil {
 		panic(err.Error())
 	}
@@ -29,13 +35,51 @@ type Worker struct {
 	FileCache  map[string][]byte
 	Wait       time.Duration
 	Whitelist  []string
-	// lastjob is last time a job was completed.
+	// lastjob is last time a job was fetched or completed.
 	lastjob time.Time
 	// MaxIdle is the length of time a worker will wait without receiving a
 	// job before it shuts itself down.  If MaxIdle is zero, the worker runs
 	// forever.
 	MaxIdle time.Duration
-	nolog   bool
+	// ConsecutiveIdle is the number of polls for work in a row that
+	// received no job.
+	ConsecutiveIdle int
+	// TraceDir, if non-empty, is a directory where a CPU profile named
+	// [jobid].pprof is written for each job run.  Profiles are also sent
+	// back to the server as an outfile named ProfileOutfile.  They profile
+	// the worker process, not the job commands it runs (see
+	// ProfileOutfile).
+	TraceDir string
+	// MaxJobsTotal is the number of jobs (successful or failed) after which
+	// the worker shuts itself down.  If MaxJobsTotal is zero, the worker
+	// runs any number of jobs.
+	MaxJobsTotal int
+	// MaxInfileSize, if nonzero, is the maximum size in bytes of each job
+	// infile that overrides any limit specified on each job.  Jobs with
+	// larger infiles fail without being run.
+	MaxInfileSize int64
+	// JobsProcessed is the number of jobs the worker has run so far.
+	JobsProcessed int
+	nolog         bool
+	// TLSConfig, if non-nil, is used to connect to a server serving over
+	// TLS (see DialTLS).
+	TLSConfig *tls.Config
+	// cachehash holds the hash (see File.Hash) of each file in FileCache.
+	cachehash map[string][]byte
+	// Concurrent is the number of jobs the worker fetches and runs at the
+	// same time.  Values less than two run jobs one at a time.  Because CPU
+	// profiling is process wide, per-job profiles (see TraceDir) are only
+	// collected for one job at a time.
+	Concurrent int
+	// mu guards JobsProcessed, ConsecutiveIdle, lastjob, nactive and
+	// nrunning which are shared by the worker's concurrent job slots.
+	// nactive is the number of slots fetching or running a job and nrunning
+	// is the number of fetched jobs not yet pushed back to the server.
+	mu       sync.Mutex
+	nactive  int
+	nrunning int
+	// cachemu guards FileCache and cachehash.
+	cachemu sync.RWMutex
 }
 
 func (w *Worker) Run() error {
@@ -44,6 +88,7 @@ func (w *Worker) Run() error {
 
 	w.lastjob = time.Now()
 	w.FileCache = map[string][]byte{}
+	w.cachehash = map[string][]byte{}
 
 	wd, err := os.Getwd()
 	if err != nil {
@@ -51,46 +96,165 @@ func (w *Worker) Run() error {
 	}
 	os.Setenv("PATH", os.Getenv("PATH")+":"+wd)
 
+	if w.TraceDir != "" {
+		// jobs run in their own working directory
+		w.TraceDir, err = filepath.Abs(w.TraceDir)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(w.TraceDir, 0755); err != nil {
+			return err
+		}
+	}
+
 	if w.Wait == 0 {
 		w.Wait = 10 * time.Second
 	}
 
+	nslots := w.Concurrent
+	if nslots < 1 {
+		nslots = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < nslots; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.runSlot()
+		}()
+	}
+	wg.Wait()
+
+	if w.MaxJobsTotal > 0 && w.JobsProcessed >= w.MaxJobsTotal {
+		log.Printf("processed %v jobs, shutting down", w.JobsProcessed)
+	} else {
+		log.Printf("no jobs received for %v (%v empty polls), shutting down", w.MaxIdle, w.ConsecutiveIdle)
+	}
+	return nil
+}
+
+// runSlot repeatedly fetches and runs one job at a time until the worker
+// has been idle for too long or has run MaxJobsTotal jobs.
+func (w *Worker) runSlot() {
 	for {
+		if done, full := w.reserveSlot(); done {
+			return
+		} else if full {
+			// other slots are running the last allowed jobs
+			<-time.After(w.Wait)
+			continue
+		}
+
 		wait, err := w.dojob()
 		if err != nil {
 			log.Print(err)
 		}
-		if w.MaxIdle > 0 && time.Now().Sub(w.lastjob) > w.MaxIdle {
-			log.Printf("no jobs received for %v, shutting down", w.MaxIdle)
-			return nil
-		}
-		if wait {
+
+		w.mu.Lock()
+		w.nactive--
+		idle := w.MaxIdle > 0 && w.nrunning == 0 && time.Now().Sub(w.lastjob) > w.MaxIdle
+		w.mu.Unlock()
+		if idle {
+			return
+		} else if wait {
 			<-time.After(w.Wait)
 		}
 	}
 }
 
+// reserveSlot marks a slot as active before it fetches a job.  done is true
+// if the worker has run MaxJobsTotal jobs.  full is true if no slot can be
+// reserved because the active slots could run the remaining allowed jobs.
+func (w *Worker) reserveSlot() (done, full bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.MaxJobsTotal > 0 {
+		if w.JobsProcessed >= w.MaxJobsTotal {
+			return true, false
+		} else if w.JobsProcessed+w.nactive >= w.MaxJobsTotal {
+			return false, true
+		}
+	}
+	w.nactive++
+	return false, false
+}
+
+func (w *Worker) dial() (*Client, error) {
+	if w.TLSConfig != nil {
+		return DialTLS(w.ServerAddr, w.TLSConfig)
+	}
+	return Dial(w.ServerAddr)
+}
+
+// addCachedFiles adds precached files to j that it didn't bring its own
+// copy of.
+func (w *Worker) addCachedFiles(j *Job) error {
+	w.cachemu.RLock()
+	defer w.cachemu.RUnlock()
+	for name, data := range w.FileCache {
+		if j.hasInfile(name) {
+			continue
+		}
+		if err := j.AddInfile(name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheFiles caches j's new files needing caching and replaces changed ones.
+func (w *Worker) cacheFiles(j *Job) {
+	w.cachemu.Lock()
+	defer w.cachemu.Unlock()
+	for _, f := range j.Infiles {
+		if _, ok := w.FileCache[f.Name]; f.Cache && (!ok || !bytes.Equal(w.cachehash[f.Name], f.Hash)) {
+			w.FileCache[f.Name] = f.Data
+			w.cachehash[f.Name] = f.Hash
+		}
+	}
+}
+
 func (w *Worker) dojob() (wait bool, err error) {
-	client, err2 := Dial(w.ServerAddr)
+	client, err2 := w.dial()
 	if err2 != nil {
 		return true, err2
 	}
 	defer client.Close()
 
+	// the server enforces the whitelist too so it doesn't hand out jobs
+	// this worker would refuse
+	if len(w.Whitelist) > 0 {
+		if err := client.Register(w); err != nil {
+			return true, err
+		}
+	}
+
 	j, err2 := client.Fetch(w)
 	if err2 == nojoberr {
-		return false, nil
+		w.mu.Lock()
+		w.ConsecutiveIdle++
+		w.mu.Unlock()
+		return true, nil
 	} else if err2 != nil {
 		return true, err2
 	}
 
+	w.mu.Lock()
+	w.lastjob = time.Now()
+	w.ConsecutiveIdle = 0
+	w.nrunning++
+	w.mu.Unlock()
 	defer func() {
 		if err != nil {
 			j.Status = StatusFailed
 			j.Stderr += fmt.Sprintf("\n%v\n", err)
 		}
 		err2 := client.Push(w, j)
+		w.mu.Lock()
 		w.lastjob = time.Now()
+		w.JobsProcessed++
+		w.nrunning--
+		w.mu.Unlock()
 		if err == nil && err2 != nil {
 			err = err2
 		}
@@ -100,19 +264,20 @@ func (w *Worker) dojob() (wait bool, err error) {
 		j.Timeout = w.JobTimeout
 	}
 
-	j.Whitelist(w.Whitelist...)
-
-	// add precached files
-	for name, data := range w.FileCache {
-		j.AddInfile(name, data)
+	if w.MaxInfileSize > 0 {
+		j.MaxInfileSize = w.MaxInfileSize
+	}
+	if err := j.ValidateInfiles(); err != nil {
+		return false, err
 	}
 
-	// cache new files needing caching
-	for _, f := range j.Infiles {
-		if f.Cache {
-			w.FileCache[f.Name] = f.Data
-		}
+	j.Whitelist(w.Whitelist...)
+	j.tracedir = w.TraceDir
+
+	if err := w.addCachedFiles(j); err != nil {
+		return false, err
 	}
+	w.cacheFiles(j)
 
 	done := make(chan struct{})
 	defer close(done)
@@ -126,6 +291,18 @@ func (w *Worker) dojob() (wait bool, err error) {
 	pr, pw := io.Pipe()
 	defer pr.Close()
 
+	// stream stdout to the server while the job runs
+	j.progressOut = make(chan []byte, 16)
+	logdone := make(chan struct{})
+	go func() {
+		defer close(logdone)
+		for data := range j.progressOut {
+			if err := client.AppendLog(j.Id, data); err != nil {
+				log.Printf("failed to send job %v output to server: %v", j.Id, err)
+			}
+		}
+	}()
+
 	rundone := make(chan bool)
 	go func() {
 		j.Execute(kill, pw)
@@ -136,9 +313,11 @@ func (w *Worker) dojob() (wait bool, err error) {
 	err = client.PushOutfile(j.Id, pr)
 	if err != nil {
 		<-rundone
+		<-logdone
 		return false, err
 	}
 	<-rundone
+	<-logdone
 
 	j.WorkerId = w.Id
 	j.Infiles = nil // don't need to send back input files
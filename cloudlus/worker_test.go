@@ -1,6 +1,8 @@
 package cloudlus
 
 import (
+	"fmt"
+	"os"
 	"testing"
 	"time"
 )
@@ -37,3 +39,155 @@ func TestWorkerLive(t *testing.T) {
 	case <-time.After(3 * time.Second):
 	}
 }
+
+func TestWorkerMaxJobs(t *testing.T) {
+	s, testaddr := NewTestServer(t, nil)
+
+	njobs := 5
+	jobs := make([]*Job, njobs)
+	for i := range jobs {
+		jobs[i] = NewJobCmd("echo", "1")
+		s.Start(jobs[i], nil)
+		defer os.Remove(outfileName(jobs[i].Id))
+	}
+
+	maxjobs := 3
+	w := &Worker{MaxJobsTotal: maxjobs, Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+
+	done := make(chan struct{})
+	go func() {
+		w.Run()
+		close(done)
+	}()
+
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatalf("worker failed to die after %v jobs", maxjobs)
+	case <-done:
+	}
+
+	if w.JobsProcessed != maxjobs {
+		t.Errorf("worker processed %v jobs, want %v", w.JobsProcessed, maxjobs)
+	}
+
+	ncomplete := 0
+	for _, j := range jobs {
+		j, err := s.Get(j.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.Status == StatusComplete {
+			ncomplete++
+		}
+	}
+	if ncomplete != maxjobs {
+		t.Errorf("%v jobs completed, want %v", ncomplete, maxjobs)
+	}
+}
+
+func TestWorkerFileCache(t *testing.T) {
+	s, testaddr := NewTestServer(t, nil)
+
+	// the second job relies on the worker's cached copy and the third
+	// replaces it with a changed file
+	j1 := NewJobCmd("cat", "ref.txt")
+	j1.AddInfileCached("ref.txt", []byte("v1"))
+	j2 := NewJobCmd("cat", "ref.txt")
+	j3 := NewJobCmd("cat", "ref.txt")
+	j3.AddInfileCached("ref.txt", []byte("v2"))
+	jobs := []*Job{j1, j2, j3}
+	for _, j := range jobs {
+		s.Start(j, nil)
+		defer os.Remove(outfileName(j.Id))
+	}
+
+	w := &Worker{MaxJobsTotal: len(jobs), Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	done := make(chan struct{})
+	go func() {
+		w.Run()
+		close(done)
+	}()
+
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatalf("worker failed to run %v jobs", len(jobs))
+	case <-done:
+	}
+
+	want := []string{"v1", "v1", "v2"}
+	for i, j := range jobs {
+		j, err := s.Get(j.Id)
+		if err != nil {
+			t.Fatal(err)
+		} else if j.Stdout != want[i] {
+			t.Errorf("job %v stdout is %q, want %q", i+1, j.Stdout, want[i])
+		}
+	}
+}
+
+func TestWorkerConcurrent(t *testing.T) {
+	s, testaddr := NewTestServer(t, nil)
+
+	// each job writes a file in its own directory and reads it back after
+	// the others have started
+	njobs := 3
+	jobs := make([]*Job, njobs)
+	for i := range jobs {
+		jobs[i] = NewJobCmd("sh", "-c", "cat in.txt > out.txt; sleep 1; cat out.txt")
+		jobs[i].AddInfile("in.txt", []byte(fmt.Sprint(i)))
+		s.Start(jobs[i], nil)
+		defer os.Remove(outfileName(jobs[i].Id))
+	}
+
+	w := &Worker{Concurrent: njobs, MaxJobsTotal: njobs, Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		w.Run()
+		close(done)
+	}()
+
+	select {
+	case <-time.After(10 * time.Second):
+		t.Fatalf("worker failed to die after %v jobs", njobs)
+	case <-done:
+	}
+
+	if elapsed := time.Now().Sub(start); elapsed > time.Duration(njobs-1)*time.Second {
+		t.Errorf("%v one second jobs took %v, want them to run concurrently", njobs, elapsed)
+	}
+	if w.JobsProcessed != njobs {
+		t.Errorf("worker processed %v jobs, want %v", w.JobsProcessed, njobs)
+	}
+	for i, j := range jobs {
+		j, err := s.Get(j.Id)
+		if err != nil {
+			t.Fatal(err)
+		} else if want := fmt.Sprint(i); j.Status != StatusComplete || j.Stdout != want {
+			t.Errorf("job %v has status %v and stdout %q, want %v and %q", i, j.Status, j.Stdout, StatusComplete, want)
+		}
+	}
+}
+
+func TestWorkerIdleEmptyQueue(t *testing.T) {
+	_, testaddr := NewTestServer(t, nil)
+
+	maxidle := 1 * time.Second
+	w := &Worker{MaxIdle: maxidle, Wait: 100 * time.Millisecond, ServerAddr: testaddr, nolog: true}
+	done := make(chan struct{})
+	go func() {
+		w.Run()
+		close(done)
+	}()
+
+	select {
+	case <-time.After(5 * time.Second):
+		t.Fatalf("worker polling an empty queue failed to die after %v", maxidle)
+	case <-done:
+	}
+
+	// polls are spaced by Wait
+	if w.ConsecutiveIdle < 2 || w.ConsecutiveIdle > 12 {
+		t.Errorf("got %v consecutive empty polls, want about %v", w.ConsecutiveIdle, int(maxidle/w.Wait))
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
@@ -8,11 +10,14 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/rwcarlsen/cloudlus/cloudlus"
@@ -23,13 +28,20 @@ var addr = flag.String("addr", "127.0.0.1:9875", "network address of dispatch se
 type CmdFunc func(cmd string, args []string)
 
 var cmds = map[string]CmdFunc{
-	"serve":         serve,
-	"work":          work,
-	"submit":        submit,
-	"submit-infile": submitInfile,
-	"retrieve":      retrieve,
-	"pack":          pack,
-	"unpack":        unpack,
+	"serve":           serve,
+	"work":            work,
+	"submit":          submit,
+	"submit-infile":   submitInfile,
+	"retrieve":        retrieve,
+	"list":            list,
+	"cancel":          cancel,
+	"pack":            pack,
+	"unpack":          unpack,
+	"profile":         profile,
+	"resubmit-failed": resubmitFailed,
+	"archive":         archive,
+	"extract":         extract,
+	"db-keys":         dbkeys,
 }
 
 func newFlagSet(cmd, args, desc string) *flag.FlagSet {
@@ -73,17 +85,48 @@ func serve(cmd string, args []string) {
 	rpcaddr := fs.String("rpc", "", "server rpc address (ip:port) for workers")
 	dbpath := fs.String("db", "./jobdb", "path to persistent, leveldb job database")
 	dblimit := fs.Int("dblimit", 8000, "max job db size in MB for disk persistence")
+	maxjobsize := fs.Int("max-job-size", 0, "max size in MB of jobs submitted via the REST api (default is no limit)")
+	maxqueue := fs.Int("max-queue", 0, "queue length at which jobs submitted via the REST api are rejected (default is no limit)")
+	maxperclient := fs.Int("max-per-client", 0, "max number of unfinished jobs submitted via the REST api from a single ip address (default is no limit)")
+	prioritylevels := fs.Int("priority-levels", 0, "number of job priority levels `N` - job priorities are clamped to 0 through N-1 (default is no limit)")
+	resultcache := fs.Bool("result-cache", false, "complete jobs identical to previously completed jobs (same command, infiles and outfiles) with the earlier results instead of running them")
+	cert := fs.String("cert", "", "PEM certificate `FILE` for serving over TLS (requires -key)")
+	key := fs.String("key", "", "PEM private key `FILE` for the -cert certificate")
+	var allowed stringList
+	fs.Var(&allowed, "allow-worker", "ip address or CIDR network (e.g. 10.0.0.0/8) of hosts allowed to fetch jobs (repeatable, default allows all hosts)")
 	fs.Parse(args)
 
+	for _, a := range allowed {
+		if _, _, err := net.ParseCIDR(a); err != nil && net.ParseIP(a) == nil {
+			log.Fatalf("invalid -allow-worker address '%v'", a)
+		}
+	}
+
 	if *rpcaddr == "" {
 		*rpcaddr = *addr
 	}
 
+	opts := []cloudlus.ServerOption{}
+	if *cert != "" || *key != "" {
+		if *cert == "" || *key == "" {
+			log.Fatal("-cert and -key must be used together")
+		}
+		pair, err := tls.LoadX509KeyPair(*cert, *key)
+		fatalif(err)
+		opts = append(opts, cloudlus.WithTLS(&tls.Config{Certificates: []tls.Certificate{pair}}))
+	}
+
 	db, err := cloudlus.NewDB(*dbpath, *dblimit*cloudlus.MB)
 	fatalif(err)
 
-	s := cloudlus.NewServer(*addr, *rpcaddr, db)
+	s := cloudlus.NewServer(*addr, *rpcaddr, db, opts...)
 	s.Host = fulladdr(*host)
+	s.MaxJobSize = int64(*maxjobsize) * cloudlus.MB
+	s.MaxQueueDepth = *maxqueue
+	s.MaxJobsPerClient = *maxperclient
+	s.AllowedWorkerIPs = allowed
+	s.PriorityLevels = *prioritylevels
+	s.ResultCache = *resultcache
 	fmt.Printf("Listening on %v\n", *addr)
 
 	sigs := make(chan os.Signal, 1)
@@ -108,8 +151,17 @@ func work(cmd string, args []string) {
 	maxidle := fs.Duration("maxidle", 0*time.Minute, "idle time at which the worker shuts down (default is infinite)")
 	timeout := fs.Duration("timeout", 0, "maximum run time for jobs before force killed - default is to use each job's custom timeout")
 	whitelist := fs.String("whitelist", "", "comma-separated list of allowed commands for jobs (default allows all commands)")
+	tracedir := fs.String("trace-jobs", "", "directory to write per-job CPU profiles of the worker process (not the job command) to (default is no profiling)")
+	maxjobs := fs.Int("max-jobs", 0, "number of jobs after which the worker shuts down (default is infinite)")
+	maxinfile := fs.Int("max-infile-size", 0, "max size in MB of each job infile - jobs with larger infiles fail (default is no limit)")
+	concurrent := fs.Int("concurrent", 1, "number of jobs `N` to run at the same time")
+	tlscert := fs.String("tls-cert", "", "PEM certificate `FILE` of the server (or its CA) to connect over TLS")
+	tlskey := fs.String("tls-key", "", "PEM private key `FILE` for presenting -tls-cert as a client certificate")
 	fs.Parse(args)
 
+	config, err := workerTLSConfig(*tlscert, *tlskey)
+	fatalif(err)
+
 	wl := strings.Split(*whitelist, ",")
 	cmds := []string{}
 	for _, s := range wl {
@@ -120,20 +172,78 @@ func work(cmd string, args []string) {
 	}
 
 	w := &cloudlus.Worker{
-		ServerAddr: *addr,
-		Wait:       *wait,
-		Whitelist:  cmds,
-		MaxIdle:    *maxidle,
-		JobTimeout: *timeout,
+		ServerAddr:    *addr,
+		Wait:          *wait,
+		Whitelist:     cmds,
+		MaxIdle:       *maxidle,
+		JobTimeout:    *timeout,
+		TraceDir:      *tracedir,
+		MaxJobsTotal:  *maxjobs,
+		MaxInfileSize: int64(*maxinfile) * cloudlus.MB,
+		TLSConfig:     config,
+		Concurrent:    *concurrent,
 	}
 	w.Run()
 }
 
+// workerTLSConfig builds the TLS config for a worker connecting to a server
+// with the certificate in certfile (e.g. a self-signed certificate or the
+// CA that signed it).  If keyfile is also given, the certificate is presented
+// as a client certificate.  It returns nil if certfile is empty.
+func workerTLSConfig(certfile, keyfile string) (*tls.Config, error) {
+	if certfile == "" {
+		if keyfile != "" {
+			return nil, fmt.Errorf("-tls-key requires -tls-cert")
+		}
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(certfile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates found in %v", certfile)
+	}
+	config := &tls.Config{RootCAs: pool}
+
+	if keyfile != "" {
+		pair, err := tls.LoadX509KeyPair(certfile, keyfile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
+
 func submit(cmd string, args []string) {
 	fs := newFlagSet(cmd, "[FILE...]", "submit a job file (may be piped to stdin)")
 	async := fs.Bool("async", false, "true for asynchronous submission")
+	infile := fs.String("stdin-as-infile", "", "create a job with stdin data as an infile named `NAME` instead of reading a job file")
+	jobcmd := fs.String("cmd", "", "command (with space separated args) for jobs created with -stdin-as-infile")
+	var outfiles stringList
+	fs.Var(&outfiles, "outfile", "name of an output file to collect for jobs created with -stdin-as-infile (repeatable)")
+	maxinfile := fs.Int("max-infile-size", 0, "max size in MB of each job infile (default is no limit)")
+	note := fs.String("note", "", "set the note of every submitted job to `TEXT`")
+	maxretries := fs.Int("max-retries", 0, "number of times the server automatically retries failed jobs")
+	var tags stringList
+	fs.Var(&tags, "tag", "add tag `NAME` to every submitted job (repeatable)")
 	fs.Parse(args)
 
+	if *infile != "" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		fatalif(err)
+		j, err := newStdinJob(*infile, data, *jobcmd, outfiles, int64(*maxinfile)*cloudlus.MB)
+		fatalif(err)
+		setNote([]*cloudlus.Job{j}, *note)
+		setMaxRetries([]*cloudlus.Job{j}, *maxretries)
+		addTags([]*cloudlus.Job{j}, tags)
+		run([]*cloudlus.Job{j}, *async)
+		return
+	}
+
 	data := stdin(fs)
 	jobs := []*cloudlus.Job{}
 	if data != nil {
@@ -146,12 +256,83 @@ func submit(cmd string, args []string) {
 		}
 	}
 
+	// check all jobs before submitting any of them
+	for _, j := range jobs {
+		if *maxinfile > 0 {
+			j.MaxInfileSize = int64(*maxinfile) * cloudlus.MB
+		}
+		if err := j.ValidateInfiles(); err != nil {
+			log.Fatalf("job %v: %v", j.Id, err)
+		}
+	}
+
+	setNote(jobs, *note)
+	setMaxRetries(jobs, *maxretries)
+	addTags(jobs, tags)
 	run(jobs, *async)
 }
 
+// addTags adds tags to all jobs.
+func addTags(jobs []*cloudlus.Job, tags []string) {
+	for _, j := range jobs {
+		j.Tags = append(j.Tags, tags...)
+	}
+}
+
+// setMaxRetries sets the max retries of all jobs to n if it is positive.
+func setMaxRetries(jobs []*cloudlus.Job, n int) {
+	if n <= 0 {
+		return
+	}
+	for _, j := range jobs {
+		j.MaxRetries = n
+	}
+}
+
+// setNote sets the note of all jobs to note if it is not empty.
+func setNote(jobs []*cloudlus.Job, note string) {
+	if note == "" {
+		return
+	}
+	for _, j := range jobs {
+		j.Note = note
+	}
+}
+
+// newStdinJob creates a job running cmd with data as an infile named name
+// that collects the given outfiles.  An error is returned if data is larger
+// than maxinfile bytes (zero means no limit).
+func newStdinJob(name string, data []byte, cmd string, outfiles []string, maxinfile int64) (*cloudlus.Job, error) {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("-stdin-as-infile requires a -cmd to run")
+	}
+
+	j := cloudlus.NewJobCmd(args[0], args[1:]...)
+	j.MaxInfileSize = maxinfile
+	if err := j.AddInfile(name, data); err != nil {
+		return nil, err
+	}
+	for _, fname := range outfiles {
+		j.AddOutfile(fname)
+	}
+	return j, nil
+}
+
+// stringList is a flag.Value that collects the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
 func submitInfile(cmd string, args []string) {
 	fs := newFlagSet(cmd, "[FILE...]", "submit a cyclus input file with default run params (may be piped to stdin)")
 	async := fs.Bool("async", false, "true for asynchronous submission")
+	note := fs.String("note", "", "set the note of every submitted job to `TEXT`")
 	fs.Parse(args)
 
 	data := stdin(fs)
@@ -166,6 +347,7 @@ func submitInfile(cmd string, args []string) {
 		}
 	}
 
+	setNote(jobs, *note)
 	run(jobs, *async)
 }
 
@@ -262,66 +444,281 @@ func retrieve(cmd string, args []string) {
 	}
 }
 
+func list(cmd string, args []string) {
+	fs := newFlagSet(cmd, "", "print a table of jobs on the server from most to least recently submitted")
+	status := fs.String("status", "", "only list jobs with this status (queued, running, complete or failed)")
+	tag := fs.String("tag", "", "only list jobs with this tag")
+	limit := fs.Int("limit", 0, "list at most `N` jobs (default is no limit)")
+	offset := fs.Int("offset", 0, "skip the `M` most recently submitted jobs")
+	fs.Parse(args)
+
+	client, err := cloudlus.Dial(*addr)
+	fatalif(err)
+	defer client.Close()
+
+	stats, err := client.ListJobs(*status, *tag, *limit, *offset)
+	fatalif(err)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tSUBMITTED\tTAGS\tCOMMAND")
+	for _, j := range stats {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", j.Id, j.Status, j.Submitted.Format(time.RFC3339), strings.Join(j.Tags, ","), strings.Join(j.Cmd, " "))
+	}
+	fatalif(tw.Flush())
+}
+
+func cancel(cmd string, args []string) {
+	fs := newFlagSet(cmd, "[JOBID...]", "cancel queued or running jobs with the given job ids")
+	fs.Parse(args)
+
+	if len(fs.Args()) == 0 {
+		log.Fatal("no job id specified")
+	}
+
+	client, err := cloudlus.Dial(*addr)
+	fatalif(err)
+	defer client.Close()
+
+	for _, arg := range fs.Args() {
+		jid, err := cloudlus.DecodeJobId(arg)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if err := client.CancelJob(jid); err != nil {
+			log.Println(err)
+			continue
+		}
+		fmt.Printf("cancelled job %v\n", jid)
+	}
+}
+
+func resubmitFailed(cmd string, args []string) {
+	fs := newFlagSet(cmd, "", "requeue failed jobs on the server with cleared output")
+	tag := fs.String("tag", "", "only resubmit jobs with this tag")
+	since := fs.Duration("since", 0, "only resubmit jobs that failed within this duration (default is all failed jobs)")
+	dryrun := fs.Bool("dry-run", false, "print jobs that would be resubmitted without resubmitting them")
+	fs.Parse(args)
+
+	q := cloudlus.ResubmitQuery{Tag: *tag, DryRun: *dryrun}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+
+	client, err := cloudlus.Dial(*addr)
+	fatalif(err)
+	defer client.Close()
+
+	ids, err := client.ResubmitFailed(q)
+	fatalif(err)
+
+	for _, id := range ids {
+		fmt.Println(id)
+	}
+	if *dryrun {
+		fmt.Printf("%v jobs would be resubmitted\n", len(ids))
+	} else {
+		fmt.Printf("resubmitted %v jobs\n", len(ids))
+	}
+}
+
+func dbkeys(cmd string, args []string) {
+	fs := newFlagSet(cmd, "", "print all (hex encoded) keys in a (non-running) server's database")
+	dbpath := fs.String("db", "./jobdb", "path to persistent, leveldb job database")
+	verify := fs.Bool("verify", false, "check for index entries referring to missing jobs instead of printing keys")
+	repair := fs.Bool("repair", false, "delete index entries referring to missing jobs instead of printing keys")
+	fs.Parse(args)
+
+	db, err := cloudlus.NewDB(*dbpath, 0)
+	fatalif(err)
+	defer db.Close()
+
+	if *repair {
+		fatalif(db.Repair())
+		return
+	} else if *verify {
+		fatalif(db.Verify())
+		fmt.Println("database is consistent")
+		return
+	}
+
+	keys, err := db.ListKeys()
+	fatalif(err)
+	for _, k := range keys {
+		fmt.Println(k)
+	}
+}
+
+func archive(cmd string, args []string) {
+	fs := newFlagSet(cmd, "", "move finished jobs from a (non-running) server's database into a tar.gz archive")
+	dbpath := fs.String("db", "./jobdb", "path to persistent, leveldb job database")
+	out := fs.String("out", "jobs.tar.gz", "archive file to create")
+	status := fs.String("status", cloudlus.StatusComplete, "only archive jobs with this status")
+	before := fs.String("before", "", "only archive jobs finished before this RFC3339 time (default is all jobs)")
+	fs.Parse(args)
+
+	var cutoff time.Time
+	if *before != "" {
+		var err error
+		cutoff, err = time.Parse(time.RFC3339, *before)
+		fatalif(err)
+	}
+
+	db, err := cloudlus.NewDB(*dbpath, 0)
+	fatalif(err)
+	defer db.Close()
+
+	all, err := db.QueryByStatus(*status)
+	fatalif(err)
+	jobs := []*cloudlus.Job{}
+	for _, j := range all {
+		if cutoff.IsZero() || j.Finished.Before(cutoff) {
+			jobs = append(jobs, j)
+		}
+	}
+
+	f, err := os.Create(*out)
+	fatalif(err)
+	err = cloudlus.ArchiveJobs(f, jobs...)
+	fatalif(err)
+	fatalif(f.Close())
+
+	for _, j := range jobs {
+		fatalif(db.Remove(j))
+	}
+	fmt.Printf("archived %v jobs to %v\n", len(jobs), *out)
+}
+
+func extract(cmd string, args []string) {
+	fs := newFlagSet(cmd, "ARCHIVE [JOBID...]", "extract jobs (default all) from a job archive into id-named directories")
+	fs.Parse(args)
+
+	if len(fs.Args()) == 0 {
+		log.Fatal("no archive file specified")
+	}
+
+	ids := []cloudlus.JobId{}
+	for _, arg := range fs.Args()[1:] {
+		jid, err := cloudlus.DecodeJobId(arg)
+		fatalif(err)
+		ids = append(ids, jid)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	fatalif(err)
+	defer f.Close()
+
+	extracted, err := cloudlus.ExtractJobs(f, ".", ids...)
+	fatalif(err)
+	for _, id := range extracted {
+		fmt.Println(id)
+	}
+}
+
+func profile(cmd string, args []string) {
+	fs := newFlagSet(cmd, "JOBID", "download the worker CPU profile for a traced job and open it with 'go tool pprof'")
+	fs.Parse(args)
+
+	if len(fs.Args()) != 1 {
+		log.Fatal("must specify exactly one job id")
+	}
+
+	jid, err := cloudlus.DecodeJobId(fs.Arg(0))
+	fatalif(err)
+
+	client, err := cloudlus.Dial(*addr)
+	fatalif(err)
+	defer client.Close()
+
+	rc, err := client.RetrieveProfile(jid)
+	fatalif(err)
+	defer rc.Close()
+
+	fname := fmt.Sprintf("profile-%v.pprof", jid)
+	f, err := os.Create(fname)
+	fatalif(err)
+	_, err = io.Copy(f, rc)
+	f.Close()
+	fatalif(err)
+
+	c := exec.Command("go", "tool", "pprof", fname)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	fatalif(c.Run())
+}
+
 func unpack(cmd string, args []string) {
-	fs := newFlagSet(cmd, "", "unpack all the named job files' output files into id-named directories")
+	fs := newFlagSet(cmd, "", "unpack all the named job files' input and output files into id-named directories")
+	outonly := fs.Bool("outfiles-only", false, "only unpack output files")
+	inonly := fs.Bool("infiles-only", false, "only unpack input files")
+	name := fs.String("file", "", "only unpack the input or output file with this name")
 	fs.Parse(args)
 
+	if *outonly && *inonly {
+		log.Fatal("-outfiles-only and -infiles-only are mutually exclusive")
+	}
+
 	for _, fname := range fs.Args() {
 		data, err := ioutil.ReadFile(fname)
 		fatalif(err)
 		j := loadJob(data)
 
 		dirname := fmt.Sprintf("files-%x", j.Id)
-
-		err = os.MkdirAll(dirname, 0755)
+		err = unpackJob(j, dirname, !*inonly, !*outonly, *name)
 		fatalif(err)
+		fmt.Println(dirname)
+	}
+}
 
-		for _, f := range j.Outfiles {
-			p := filepath.Join(dirname, f.Name)
-			err := ioutil.WriteFile(p, f.Data, 0644)
-			fatalif(err)
+// unpackJob writes j's output files (if outfiles is true) and input files (if
+// infiles is true) into dirname.  If name is not empty, only files with that
+// name are written.
+func unpackJob(j *cloudlus.Job, dirname string, outfiles, infiles bool, name string) error {
+	if err := os.MkdirAll(dirname, 0755); err != nil {
+		return err
+	}
+
+	var files []cloudlus.File
+	if outfiles {
+		files = append(files, j.Outfiles...)
+	}
+	if infiles {
+		files = append(files, j.Infiles...)
+	}
+
+	for _, f := range files {
+		if name != "" && f.Name != name {
+			continue
 		}
-		for _, f := range j.Infiles {
-			p := filepath.Join(dirname, f.Name)
-			err := ioutil.WriteFile(p, f.Data, 0644)
-			fatalif(err)
+		p := filepath.Join(dirname, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		} else if err := ioutil.WriteFile(p, f.Data, 0644); err != nil {
+			return err
 		}
-		fmt.Println(dirname)
 	}
+	return nil
 }
 
 func pack(cmd string, args []string) {
 	fs := newFlagSet(cmd, "", "pack all files in the working directory into a job submit file")
 	fname := fs.String("o", "", "send pack data to file instead of stdout")
+	recursive := fs.Bool("recursive", false, "also pack files in subdirectories using their relative paths as infile names")
+	ignore := fs.String("ignore", "", "don't pack files whose relative path or name matches `GLOB`")
 	fs.Parse(args)
 
-	d, err := os.Open(".")
+	opts := []cloudlus.DirOption{}
+	if *recursive {
+		opts = append(opts, cloudlus.WithRecursive())
+	}
+	if *ignore != "" {
+		opts = append(opts, cloudlus.WithIgnorePattern(*ignore))
+	}
+	j, err := cloudlus.NewJobFromDir(".", opts...)
 	fatalif(err)
-	defer d.Close()
 
-	files, err := d.Readdir(-1)
-	fatalif(err)
-	j := cloudlus.NewJob()
-	for _, info := range files {
-		if info.IsDir() {
-			continue
-		}
-		data, err := ioutil.ReadFile(info.Name())
-		fatalif(err)
-		if info.Name() == "cmd.txt" {
-			err := json.Unmarshal(data, &j.Cmd)
-			fatalif(err)
-		} else if info.Name() == "want.txt" {
-			list := []string{}
-			err := json.Unmarshal(data, &list)
-			fatalif(err)
-			for _, name := range list {
-				j.AddOutfile(name)
-			}
-		} else {
-			j.AddInfile(info.Name(), data)
-		}
-	}
 	data, err := json.Marshal(j)
 	fatalif(err)
 
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/cloudlus/cloudlus"
+)
+
+// workerEnv names the environment variable holding the server address for
+// test worker processes.  Workers must run in a separate process because
+// jobs change the working directory of the process executing them.
+const workerEnv = "CLOUDLUS_TEST_WORKER_ADDR"
+
+func TestMain(m *testing.M) {
+	if addr := os.Getenv(workerEnv); addr != "" {
+		w := &cloudlus.Worker{ServerAddr: addr, Wait: 100 * time.Millisecond, MaxJobsTotal: 1}
+		w.Run()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer starts a server with an in-memory db listening on a free
+// local port and returns its address.  The server is closed when the test
+// finishes.
+func newTestServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	db, err := cloudlus.NewDB("", 1*cloudlus.MB)
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	s := cloudlus.NewServer(addr, addr, db)
+	go s.Serve(l)
+	t.Cleanup(func() {
+		s.Close()
+		l.Close()
+	})
+	return addr
+}
+
+func TestSubmitStdinAsInfile(t *testing.T) {
+	testaddr := newTestServer(t)
+
+	worker := exec.Command(os.Args[0])
+	worker.Env = append(os.Environ(), workerEnv+"="+testaddr)
+	if err := worker.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Process.Kill()
+
+	j, err := newStdinJob("input.txt", []byte("hello"), "cat", []string{"input.txt"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(j.Id.String() + "-outdata.zip")
+
+	client, err := cloudlus.Dial(testaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var result *cloudlus.Job
+	select {
+	case result = <-client.Start(j, nil):
+	case <-time.After(10 * time.Second):
+		t.Fatal("job did not complete")
+	}
+	if err := client.Err(); err != nil {
+		t.Fatal(err)
+	} else if result.Status != cloudlus.StatusComplete {
+		t.Fatalf("job failed: %v", result.Stderr)
+	}
+
+	data, err := client.RetrieveOutfileData(result, "input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); got != "hello" {
+		t.Errorf("got outfile data %q, want %q", got, "hello")
+	}
+}
+
+func TestStdinJobMaxInfileSize(t *testing.T) {
+	if _, err := newStdinJob("input.txt", []byte("hello"), "cat", nil, 4); err == nil {
+		t.Errorf("infile over size limit accepted")
+	}
+	if _, err := newStdinJob("input.txt", []byte("hello"), "cat", nil, 5); err != nil {
+		t.Errorf("infile at size limit rejected: %v", err)
+	}
+}
+
+func TestUnpackSelective(t *testing.T) {
+	j := cloudlus.NewJob()
+	j.AddInfile("input.xml", []byte("<sim/>"))
+	j.Outfiles = append(j.Outfiles,
+		cloudlus.File{Name: "cyclus.sqlite", Data: []byte("db")},
+		cloudlus.File{Name: "log.txt", Data: []byte("log")},
+	)
+	data, err := json.Marshal(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packed := loadJob(data)
+
+	tests := []struct {
+		outfiles, infiles bool
+		name              string
+		want              []string
+	}{
+		{true, true, "", []string{"cyclus.sqlite", "input.xml", "log.txt"}},
+		{true, false, "", []string{"cyclus.sqlite", "log.txt"}},
+		{false, true, "", []string{"input.xml"}},
+		{true, true, "log.txt", []string{"log.txt"}},
+		{false, true, "log.txt", nil},
+	}
+
+	for i, test := range tests {
+		dir, err := ioutil.TempDir("", "cloudlus-unpack")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		dirname := filepath.Join(dir, "files")
+		if err := unpackJob(packed, dirname, test.outfiles, test.infiles, test.name); err != nil {
+			t.Fatalf("case %v: %v", i+1, err)
+		}
+
+		infos, err := ioutil.ReadDir(dirname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, info := range infos {
+			got = append(got, info.Name())
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("case %v: unpacked %v, want %v", i+1, got, test.want)
+		}
+	}
+}
+
+func TestSubmitNote(t *testing.T) {
+	testaddr := newTestServer(t)
+
+	client, err := cloudlus.Dial(testaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	const note = "sweep 42"
+	j := cloudlus.NewJobCmd("echo", "hello")
+	setNote([]*cloudlus.Job{j}, note)
+	if err := client.Submit(j); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := client.Retrieve(j.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Note != note {
+		t.Errorf("got note %q, want %q", got.Note, note)
+	}
+}
@@ -7,15 +7,13 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"text/template"
 
-	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
+	"github.com/rwcarlsen/cloudlus/cmd/internal/sshutil"
 )
 
 var (
@@ -33,6 +31,7 @@ var (
 	cpy     = flag.Bool("copy", false, "true to automatically copy all needed files to submit node")
 	local   = flag.Bool("local", false, "save local copies of generated files")
 	wkflags = flag.String("workflags", "", "flags to be passed straight to cloudlus worker invocation")
+	restart = flag.Int("restart-after", 0, "restart each worker as a fresh condor job after it processes `N` jobs (0 => never)")
 )
 
 type CondorConfig struct {
@@ -43,6 +42,9 @@ type CondorConfig struct {
 	Memory     int
 	ClassAds   string
 	Disk       int
+	// Restart is true if workers should be requeued by condor after
+	// exiting.
+	Restart bool
 }
 
 const condorname = "condor.submit"
@@ -63,6 +65,7 @@ request_memory = {{.Memory}}
 Rank = KFlops
 +is_resumable = true
 requirements = OpSys == "LINUX" && Arch == "x86_64" && (OpSysAndVer =?= "SL6") && (IsDedicated == true) {{.ClassAds}}
+{{if .Restart}}on_exit_remove = false{{end}}
 
 queue {{.N}}
 `
@@ -117,6 +120,7 @@ func main() {
 		NCPU:       *ncpu,
 		Memory:     *mem,
 		Disk:       *disk * 1024,
+		Restart:    *restart > 0,
 	}
 	if *classad != "" {
 		cc.ClassAds = " && " + *classad
@@ -127,7 +131,11 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = runtmpl.Execute(&runbuf, struct{ Runfile, Addr, Flags string }{*run, *addr, *wkflags})
+	flags := *wkflags
+	if *restart > 0 {
+		flags += fmt.Sprintf(" -max-jobs %v", *restart)
+	}
+	err = runtmpl.Execute(&runbuf, struct{ Runfile, Addr, Flags string }{*run, *addr, flags})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -155,46 +163,18 @@ func submitssh(srcs, dsts []string, submitdata, runbuf io.Reader) {
 		return
 	}
 
-	// use ssh agent
-	agentconn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	client, err := sshutil.Dial(*user, *dst, *via)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer agentconn.Close()
-	ag := agent.NewClient(agentconn)
-	config := &ssh.ClientConfig{
-		User: *user,
-		Auth: []ssh.AuthMethod{ssh.PublicKeysCallback(ag.Signers)},
-	}
-
-	// connect to server (with optional hops)
-	var client *ssh.Client
-	if *via != "" {
-		client, err = ssh.Dial("tcp", *via, config)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-
-	if client != nil && *dst != "" {
-		client, err = Hop(client, *dst, config)
-		if err != nil {
-			log.Fatal(err)
-		}
-	} else {
-		client, err = ssh.Dial("tcp", *dst, config)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
 
 	// copy files
-	err = copyFile(client, submitdata, condorname)
+	err = sshutil.CopyFile(client, submitdata, condorname)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = copyFile(client, runbuf, runfilename)
+	err = sshutil.CopyFile(client, runbuf, runfilename)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -206,7 +186,7 @@ func submitssh(srcs, dsts []string, submitdata, runbuf io.Reader) {
 			if err != nil {
 				log.Fatal(err)
 			}
-			err = copyFile(client, f, dsts[i])
+			err = sshutil.CopyFile(client, f, dsts[i])
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -215,57 +195,10 @@ func submitssh(srcs, dsts []string, submitdata, runbuf io.Reader) {
 	}
 
 	if *n > 0 {
-		out, err := combined(client, "condor_submit "+condorname)
+		out, err := sshutil.Combined(client, "condor_submit "+condorname)
 		if err != nil {
 			fmt.Printf("%s\n", out)
 			log.Fatal(err)
 		}
 	}
 }
-
-func copyFile(c *ssh.Client, r io.Reader, path string) error {
-	s, err := c.NewSession()
-	if err != nil {
-		return err
-	}
-	defer s.Close()
-
-	w, err := s.StdinPipe()
-	if err != nil {
-		return err
-	}
-
-	s.Start("tee " + path)
-
-	_, err = io.Copy(w, r)
-	if err != nil {
-		return err
-	}
-	w.Close()
-
-	return s.Wait()
-}
-
-func combined(c *ssh.Client, cmd string) ([]byte, error) {
-	s, err := c.NewSession()
-	if err != nil {
-		return nil, err
-	}
-	defer s.Close()
-
-	return s.CombinedOutput(cmd)
-}
-
-func Hop(through *ssh.Client, toaddr string, c *ssh.ClientConfig) (*ssh.Client, error) {
-	hopconn, err := through.Dial("tcp", toaddr)
-	if err != nil {
-		return nil, err
-	}
-
-	conn, chans, reqs, err := ssh.NewClientConn(hopconn, toaddr, c)
-	if err != nil {
-		return nil, err
-	}
-
-	return ssh.NewClient(conn, chans, reqs), nil
-}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"text/tabwriter"
@@ -29,6 +31,24 @@ var (
 	gen       = flag.Bool("gen", false, "true to just print out job file without submitting")
 	quiet     = flag.Bool("q", false, "don't print job stdout+stderr")
 	obj       = flag.String("obj", "", "(internal) if non-empty, run scenario and store objective in `FILE`")
+	vtk       = flag.String("vtk", "", "write the deployment schedule as a VTK rectilinear grid to `FILE`")
+	vtkcap    = flag.Bool("vtk-capacity", false, "use built capacity instead of number built for -vtk output")
+	filtertag = flag.String("filter-builds", "", "only print builds carrying this tag for -transform")
+	checkfc   = flag.Bool("check-fuel-cycle", false, "check the scenario's cyclus template for unproduced/unconsumed commodities")
+	powhist   = flag.String("power-history", "", "write the deployed power capacity at every time step as csv to `FILE`")
+	costprof  = flag.String("cost-profile", "", "write the per time step discounted costs for -db as csv to `FILE`")
+	preflight = flag.Bool("preflight", false, "exit with an error instead of running if the build schedule violates any hard constraints")
+	cachedir  = flag.String("cache-dir", "", "reuse cyclus output databases stored in `DIR` for identical local simulations")
+	save      = flag.String("save", "", "write the scenario with its final deployment schedule as json to `FILE`")
+	csvout    = flag.String("csv-out", "", "write the final deployment schedule as csv to `FILE`")
+	csvin     = flag.String("csv-in", "", "read the deployment schedule from csv `FILE` written by -csv-out instead of var vals")
+	sensitiv  = flag.String("sensitivity", "", "write finite-difference objective gradients at the passed variables as csv to `FILE`")
+	sensdelta = flag.Float64("sensitivity-delta", 0.01, "variable perturbation size for -sensitivity and -importance")
+	sensconc  = flag.Int("sensitivity-concurrent", 4, "max number of concurrent simulations for -sensitivity and -importance")
+	varimp    = flag.Bool("importance", false, "print the variables ranked by their influence on the objective at the passed variables")
+	bootstrap = flag.Int("bootstrap", 0, "run the scenario `N` times and print the mean and standard deviation of the objective")
+	bootconc  = flag.Int("bootstrap-concurrent", 0, "max number of concurrent simulations for -bootstrap (0 => number of cpus)")
+	paretoobj = flag.String("pareto-obj2", "", "print the pareto frontier of the scenario's objective and objective function `NAME` for the var sets on stdin (one per line)")
 )
 
 var objfile = "cloudlus-cycobj.dat"
@@ -41,18 +61,78 @@ func main() {
 	err := scn.Load(*scenfile)
 	check(err)
 
-	if len(scn.Builds) == 0 && *db == "" {
+	if *costprof != "" && *db == "" {
+		log.Fatal("-cost-profile requires -db")
+	}
+
+	if *checkfc {
+		err := scn.ValidateFuelCycle()
+		check(err)
+		fmt.Println("fuel cycle is valid")
+		return
+	}
+
+	if *sensitiv != "" {
+		writeSensitivity(scn, readVars(), *sensitiv)
+		return
+	} else if *varimp {
+		printImportance(scn, readVars())
+		return
+	} else if *paretoobj != "" {
+		printPareto(scn, parseVarSets(os.Stdin), *paretoobj)
+		return
+	}
+
+	if *csvin != "" {
+		err := scn.ImportCSV(*csvin)
+		check(err)
+	} else if len(scn.Builds) == 0 && *db == "" {
 		parseSchedVars(scn)
 	} else {
 		log.Print("because of pre-existing builds, ignoring any deploy variables/schedule")
 	}
 
+	if *preflight {
+		if violations := scn.CheckBuildConstraints(); len(violations) > 0 {
+			for _, v := range violations {
+				log.Print(v)
+			}
+			log.Fatalf("preflight failed: %v build constraint violations", len(violations))
+		}
+	}
+
+	if *save != "" {
+		err := scn.SaveJSON(*save)
+		check(err)
+	}
+	if *csvout != "" {
+		err := scn.ExportCSV(*csvout)
+		check(err)
+	}
+
 	if *stats {
 		scn.PrintStats()
+	} else if *powhist != "" {
+		writePowerHistory(scn, *powhist)
+	} else if *vtk != "" && *vtkcap {
+		err := scn.ExportVTKCapacity(*vtk)
+		check(err)
+	} else if *vtk != "" {
+		err := scn.ExportVTK(*vtk)
+		check(err)
+	} else if *bootstrap > 0 {
+		scn.BootstrapMaxConcurrent = *bootconc
+		mean, std, err := scn.Bootstrap(*bootstrap, quietObj)
+		check(err)
+		fmt.Printf("mean=%v std=%v n=%v\n", mean, std, *bootstrap)
 	} else if *transform && !*sched {
 		tw := tabwriter.NewWriter(os.Stdout, 4, 4, 1, ' ', 0)
 		fmt.Fprint(tw, "Prototype\tBuildTime\tLifetime\tNumber\n")
-		for _, b := range scn.Builds {
+		builds := scn.Builds
+		if *filtertag != "" {
+			builds = scn.FilterBuilds(*filtertag)
+		}
+		for _, b := range builds {
 			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", b.Proto, b.Time, b.Lifetime(), b.N)
 		}
 		tw.Flush()
@@ -74,6 +154,11 @@ func main() {
 		check(err)
 		defer dbh.Close()
 		simids, err := post.Process(dbh)
+		check(err)
+		if *costprof != "" {
+			writeCostProfile(scn, dbh, simids[0], *costprof)
+			return
+		}
 		val, err := scn.CalcObjective(*db, simids[0])
 		check(err)
 		fmt.Println(val)
@@ -94,6 +179,47 @@ func check(err error) {
 	}
 }
 
+func writePowerHistory(scn *scen.Scenario, fname string) {
+	builds := map[string][]scen.Build{}
+	for _, b := range scn.Builds {
+		builds[b.Proto] = append(builds[b.Proto], b)
+	}
+
+	f, err := os.Create(fname)
+	check(err)
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"time", "power_cap"})
+	for t, pow := range scn.PowerCapHistory(builds) {
+		w.Write([]string{strconv.Itoa(t), fmt.Sprint(pow)})
+	}
+	w.Flush()
+	check(w.Error())
+}
+
+func writeCostProfile(scn *scen.Scenario, db *sql.DB, simid []byte, fname string) {
+	profile, err := scn.CostProfile(db, simid)
+	check(err)
+
+	f, err := os.Create(fname)
+	check(err)
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"Time", "CapitalCost", "OpCost", "WasteCost"})
+	for _, tc := range profile {
+		w.Write([]string{
+			strconv.Itoa(tc.Time),
+			fmt.Sprint(tc.CapitalCost),
+			fmt.Sprint(tc.OpCost),
+			fmt.Sprint(tc.WasteCost),
+		})
+	}
+	w.Flush()
+	check(w.Error())
+}
+
 func parseSched(r io.Reader) []scen.Build {
 	data, err := ioutil.ReadAll(r)
 	check(err)
@@ -138,29 +264,118 @@ func parseVars(r io.Reader) []float64 {
 	return vars
 }
 
+// readVars returns the variable values passed as command line arguments or
+// on stdin if there are no arguments.
+func readVars() []float64 {
+	if flag.NArg() == 0 {
+		return parseVars(os.Stdin)
+	}
+	params := make([]float64, flag.NArg())
+	for i, s := range flag.Args() {
+		var err error
+		params[i], err = strconv.ParseFloat(s, 64)
+		check(err)
+	}
+	return params
+}
+
+// parseVarSets reads sets of variable values from r - one whitespace
+// separated set per line.
+func parseVarSets(r io.Reader) [][]float64 {
+	data, err := ioutil.ReadAll(r)
+	check(err)
+	sets := [][]float64{}
+	for _, l := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
+		vars := make([]float64, len(fields))
+		for i, f := range fields {
+			vars[i], err = strconv.ParseFloat(f, 64)
+			check(err)
+		}
+		sets = append(sets, vars)
+	}
+	return sets
+}
+
+func printPareto(scn *scen.Scenario, points [][]float64, objfunc2 string) {
+	front, err := scn.ParetoFrontier(points, scn.ObjFunc, objfunc2, quietObj)
+	check(err)
+
+	tw := tabwriter.NewWriter(os.Stdout, 4, 4, 1, ' ', 0)
+	fmt.Fprint(tw, "Obj1\tObj2\tVars\n")
+	for _, p := range front {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", p.Obj1, p.Obj2, strings.Trim(fmt.Sprint(p.Vars), "[]"))
+	}
+	tw.Flush()
+}
+
 func parseSchedVars(scn *scen.Scenario) {
 	var err error
 	if *sched {
 		scn.Builds = parseSched(os.Stdin)
 	} else {
-		params := []float64{}
-		if flag.NArg() > 0 {
-			params = make([]float64, flag.NArg())
-			for i, s := range flag.Args() {
-				params[i], err = strconv.ParseFloat(s, 64)
-				check(err)
-			}
-		} else {
-			params = parseVars(os.Stdin)
-		}
-
-		_, err = scn.TransformVars(params)
+		_, err = scn.TransformVars(readVars())
 		check(err)
 	}
 	err = scn.Validate()
 	check(err)
 }
 
+// quietObj computes the objective of a scenario remotely if -addr is set
+// and locally otherwise discarding simulation output.
+func quietObj(s *scen.Scenario) (float64, error) {
+	if *addr != "" {
+		return runscen.Remote(s, nil, nil, *addr)
+	}
+	val, _, dbfile, err := runscen.LocalCache(s, nil, nil, *cachedir)
+	if err == nil {
+		os.Remove(dbfile)
+	}
+	return val, err
+}
+
+func writeSensitivity(scn *scen.Scenario, vars []float64, fname string) {
+	grad, err := scn.SensitivityAnalysis(vars, *sensdelta, *sensconc, quietObj)
+	check(err)
+
+	f, err := os.Create(fname)
+	check(err)
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"Var", "Value", "Gradient"})
+	names := scn.VarNames()
+	for i, g := range grad {
+		w.Write([]string{names[i], fmt.Sprint(vars[i]), fmt.Sprint(g)})
+	}
+	w.Flush()
+	check(w.Error())
+}
+
+// printImportance prints the variables in order of decreasing influence on
+// the objective (see scen.Scenario.VarImportance).
+func printImportance(scn *scen.Scenario, vars []float64) {
+	scores, err := scn.VarImportance(vars, *sensdelta, *sensconc, quietObj)
+	check(err)
+
+	names := scn.VarNames()
+	order := make([]int, len(scores))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+
+	tw := tabwriter.NewWriter(os.Stdout, 4, 4, 1, ' ', 0)
+	fmt.Fprint(tw, "Var\tValue\tImportance\n")
+	for _, i := range order {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", names[i], vars[i], scores[i])
+	}
+	tw.Flush()
+}
+
 func runjob(scen *scen.Scenario, addr string) float64 {
 	var stdout, stderr io.Writer
 	if !*quiet {
@@ -168,8 +383,9 @@ func runjob(scen *scen.Scenario, addr string) float64 {
 	}
 
 	if addr == "" {
-		val, err := runscen.Local(scen, stdout, stderr)
+		val, _, dbfile, err := runscen.LocalCache(scen, stdout, stderr, *cachedir)
 		check(err)
+		os.Remove(dbfile)
 		return val
 	} else {
 		val, err := runscen.Remote(scen, stdout, stderr, addr)
@@ -0,0 +1,88 @@
+// Package sshutil contains the ssh helpers used by the batch system bot
+// deployment commands to reach cluster submit nodes.
+package sshutil
+
+import (
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Dial connects to dst as user authenticating via the running ssh agent.  If
+// via is not empty, the connection to dst is tunneled through an
+// intermediate connection to via.
+func Dial(user, dst, via string) (*ssh.Client, error) {
+	agentconn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	if err != nil {
+		return nil, err
+	}
+	ag := agent.NewClient(agentconn)
+	config := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeysCallback(ag.Signers)},
+	}
+
+	if via == "" {
+		return ssh.Dial("tcp", dst, config)
+	}
+
+	client, err := ssh.Dial("tcp", via, config)
+	if err != nil {
+		return nil, err
+	}
+	return Hop(client, dst, config)
+}
+
+// CopyFile writes the contents of r to path on the remote host.
+func CopyFile(c *ssh.Client, r io.Reader, path string) error {
+	s, err := c.NewSession()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	w, err := s.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	s.Start("tee " + path)
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	w.Close()
+
+	return s.Wait()
+}
+
+// Combined runs cmd on the remote host and returns its combined stdout and
+// stderr.
+func Combined(c *ssh.Client, cmd string) ([]byte, error) {
+	s, err := c.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	return s.CombinedOutput(cmd)
+}
+
+// Hop connects to toaddr through an existing ssh connection.
+func Hop(through *ssh.Client, toaddr string, c *ssh.ClientConfig) (*ssh.Client, error) {
+	hopconn, err := through.Dial("tcp", toaddr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, chans, reqs, err := ssh.NewClientConn(hopconn, toaddr, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.NewClient(conn, chans, reqs), nil
+}
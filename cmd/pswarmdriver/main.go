@@ -11,9 +11,12 @@ import (
 	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/gonum/matrix/mat64"
 	"github.com/rwcarlsen/cloudlus/cloudlus"
 	"github.com/rwcarlsen/cloudlus/runscen"
 	"github.com/rwcarlsen/cloudlus/scen"
@@ -36,8 +39,14 @@ var (
 	timeout      = flag.Duration("timeout", 120*time.Minute, "max time before remote function eval times out")
 	objlog       = flag.String("objlog", "obj.log", "file to log unpenalized objective values")
 	runlog       = flag.String("runlog", "run.log", "file to log local cyclus run output")
-	dbname       = flag.String("db", "pswarm.sqlite", "name for database containing optimizer work")
+	dbname       = flag.String("db", "pswarm.sqlite", "name for database containing optimizer work and cached objective evaluations")
 	restart      = flag.Int("restart", -1, "iteration to restart from (default is no restart)")
+	progressurl  = flag.String("progress-url", "", "url to POST JSON solver progress reports to after each iteration")
+	warmstart    = flag.String("warm-start", "", "JSON `FILE` with an array of variable values to start the first particle at")
+	rolling      = flag.Int("rolling-horizon", 0, "re-optimize deployments after every `STEP` timesteps keeping the best builds so far (0 => single optimization)")
+	restrictfacs = flag.String("restrict-facs", "", "comma separated `PROTOS` to exclude from deployment (without modifying the scenario file)")
+	constrain    = flag.Bool("constrain", false, "project points onto the variable bounds before evaluating them instead of evaluating infeasible points")
+	multistart   = flag.Int("multistart", 0, "run `N` independent optimizations concurrently splitting -maxeval between them and keep the best (0 => single optimization)")
 )
 
 const outfile = "objective.out"
@@ -54,10 +63,14 @@ func init() {
 var db *sql.DB
 var client *cloudlus.Client
 
+// batcher submits objective evaluation jobs from each swarm iteration
+// together when running remotely.
+var batcher *runscen.Batcher
+
 func main() {
 	var err error
 	flag.Parse()
-	optim.Rand = rand.New(rand.NewSource(int64(*seed)))
+	optim.Rand = optim.LockedRng(rand.New(rand.NewSource(int64(*seed))))
 
 	if _, err := os.Stat(*dbname); !os.IsNotExist(err) && *restart < 0 {
 		log.Fatalf("db file '%v' already exists", *dbname)
@@ -71,6 +84,9 @@ func main() {
 		client, err = cloudlus.Dial(*addr)
 		check(err)
 		defer client.Close()
+		batcher, err = runscen.NewBatcher(*addr, *timeout)
+		check(err)
+		defer batcher.Close()
 	}
 
 	params := make([]int, flag.NArg())
@@ -83,6 +99,14 @@ func main() {
 	scen := &scen.Scenario{}
 	err = scen.Load(*scenfile)
 	check(err)
+	if *restrictfacs != "" {
+		err = restrictFacs(scen, strings.Split(*restrictfacs, ","))
+		check(err)
+	}
+	if *warmstart != "" {
+		err = scen.LoadWarmStart(*warmstart)
+		check(err)
+	}
 
 	f1, err := os.Create(*objlog)
 	check(err)
@@ -91,9 +115,83 @@ func main() {
 	check(err)
 	defer f4.Close()
 
-	// create and initialize solver
-	lb := scen.LowerBounds()
-	ub := scen.UpperBounds()
+	if *rolling > 0 && *restart >= 0 {
+		log.Fatal("-rolling-horizon cannot be used with -restart")
+	} else if *multistart > 0 && *restart >= 0 {
+		log.Fatal("-multistart cannot be used with -restart")
+	}
+
+	// this is here so that signals goroutine can close over it
+	var mu sync.Mutex
+	solv := newSolver(scen, f1, f4)
+
+	// handle signals
+	start := time.Now()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		f1.Close()
+		f4.Close()
+		fmt.Println("\n*** optimizer killed early ***")
+		mu.Lock()
+		final(solv, start)
+		os.Exit(1)
+	}()
+
+	solve(solv)
+
+	// re-optimize from each horizon with all builds up to it held fixed
+	for t := scen.BuildOffsetSteps() + *rolling; *rolling > 0 && t+2 <= scen.SimDur-scen.TrailingDurSteps(); t += *rolling {
+		_, err := scen.TransformVars(solv.Best().Pos)
+		check(err)
+		scen = scen.CloneAt(t)
+		scen.WarmStartVars = scen.SpliceVars
+
+		fmt.Printf("*** rolling horizon: re-optimizing deployments after time %v ***\n", t)
+		mu.Lock()
+		solv = newSolver(scen, f1, f4)
+		mu.Unlock()
+		solve(solv)
+	}
+
+	if *rolling > 0 {
+		_, err := scen.TransformVars(solv.Best().Pos)
+		check(err)
+		fmt.Println("best build schedule:")
+		for _, b := range scen.Builds {
+			fmt.Printf("    t=%v %v x%v\n", b.Time, b.Proto, b.N)
+		}
+	}
+
+	mu.Lock()
+	final(solv, start)
+}
+
+// restrictFacs makes the named prototypes of s unavailable for deployment
+// which removes them from the optimizer's variable space.  This is done the
+// same way for restarts because the scenario file is always loaded fresh.
+func restrictFacs(s *scen.Scenario, protos []string) error {
+	for _, proto := range protos {
+		found := false
+		for i := range s.Facs {
+			if s.Facs[i].Proto == proto {
+				s.Facs[i].BuildAfter = -1
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("cannot restrict unknown prototype '%v'", proto)
+		}
+	}
+	return s.Validate()
+}
+
+// newSolver creates a solver for the scenario s logging objective values to
+// objlog (and the db) and simulation output to runlog.
+func newSolver(s *scen.Scenario, objlog, runlog io.Writer) *optim.Solver {
+	lb := s.LowerBounds()
+	ub := s.UpperBounds()
 
 	step := (ub[0] - lb[0]) / 10
 	var it optim.Method
@@ -101,40 +199,53 @@ func main() {
 	if *restart >= 0 {
 		it, step = loadIter(lb, ub, *restart)
 	} else {
-		it = buildIter(lb, ub)
+		it = buildIter(lb, ub, s.WarmStartVars, step)
 	}
 
-	obj := &optim.ObjectiveLogger{Obj: &obj{scen, f4}, W: f1}
-
-	m := &optim.MaxStepMesh{
-		Mesh:    &optim.BoxMesh{Mesh: &optim.InfMesh{StepSize: step}, Lower: lb, Upper: ub},
-		MaxStep: 1.999,
+	var inner optim.Objectiver = &obj{s, runlog}
+	if *constrain {
+		inner = boundsConstraint(inner, lb, ub)
 	}
+	obj := &optim.ObjectiveLogger{Obj: inner, W: objlog, Summary: summarise(s), DB: db}
 
-	// this is here so that signals goroutine can close over it
 	solv := &optim.Solver{
 		Method:       it,
 		Obj:          obj,
-		Mesh:         m,
+		Mesh:         newMesh(lb, ub, step),
 		MaxIter:      *maxiter,
 		MaxEval:      *maxeval,
 		MaxNoImprove: *maxnoimprove,
 	}
+	if *progressurl != "" {
+		solv.Reporter = &optim.HTTPReporter{URL: *progressurl}
+	}
+	return solv
+}
 
-	// handle signals
-	start := time.Now()
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		f1.Close()
-		f4.Close()
-		fmt.Println("\n*** optimizer killed early ***")
-		final(solv, start)
-		os.Exit(1)
-	}()
+func newMesh(lb, ub []float64, step float64) optim.Mesh {
+	return &optim.MaxStepMesh{
+		Mesh:    &optim.BoxMesh{Mesh: &optim.InfMesh{StepSize: step}, Lower: lb, Upper: ub},
+		MaxStep: 1.999,
+	}
+}
+
+// boundsConstraint wraps o so that points are projected onto the box-bounds
+// lb and ub before being evaluated.
+func boundsConstraint(o optim.Objectiver, lb, ub []float64) optim.Objectiver {
+	n := len(lb)
+	ident := mat64.NewDense(n, n, nil)
+	for i := 0; i < n; i++ {
+		ident.Set(i, i, 1)
+	}
+	low := mat64.NewDense(n, 1, append([]float64{}, lb...))
+	up := mat64.NewDense(n, 1, append([]float64{}, ub...))
+	A, b, _ := optim.StackConstr(low, ident, up)
+	return &optim.ObjectiveConstraint{Obj: o, A: A, B: b}
+}
 
-	// solve and print results
+// solve runs solv to completion printing progress after each iteration.
+func solve(solv *optim.Solver) {
+	var err error
 	for solv.Next() {
 		if solv.Err() != nil {
 			log.Print("solver error: ", solv.Err())
@@ -149,10 +260,8 @@ func main() {
 		fmt.Printf("Iter %v (%v evals):  %v\n", solv.Niter(), solv.Neval(), solv.Best())
 	}
 	if solv.Err() != nil {
-		log.Print("solver error:", err)
+		log.Print("solver error:", solv.Err())
 	}
-
-	final(solv, start)
 }
 
 func final(s *optim.Solver, start time.Time) {
@@ -170,7 +279,29 @@ func final(s *optim.Solver, start time.Time) {
 	fmt.Printf("%v objective evaluations\n", s.Neval())
 }
 
-func buildIter(lb, ub []float64) optim.Method {
+// buildIter creates a new solver method.  If init is not empty, the first
+// swarm particle (and initial pattern search point) starts at init.  If
+// -multistart is set, the method runs that many independent methods each
+// with their own mesh created with the given initial step.
+func buildIter(lb, ub, init []float64, step float64) optim.Method {
+	if *multistart <= 0 {
+		return newMethod(lb, ub, init, db)
+	}
+
+	fmt.Printf("running %v independent starts\n", *multistart)
+	return &optim.MultiStartSolver{
+		// starts don't share the db because they run concurrently
+		NewMethod:       func() optim.Method { return newMethod(lb, ub, init, nil) },
+		NewMesh:         func() optim.Mesh { return newMesh(lb, ub, step) },
+		NStarts:         *multistart,
+		MaxEvalPerStart: *maxeval / *multistart,
+		Db:              db,
+	}
+}
+
+// newMethod creates a single pattern search (or swarm only) method recording
+// its progress and caching objective evaluations in dbh if it is not nil.
+func newMethod(lb, ub, init []float64, dbh *sql.DB) optim.Method {
 	mask := make([]bool, len(ub))
 	for i := range mask {
 		mask[i] = lb[i] < ub[i]
@@ -189,13 +320,17 @@ func buildIter(lb, ub []float64) optim.Method {
 	if *addr == "" {
 		ev.NConcurrent = *ncpu
 	}
+	cev := optim.NewCacheEvaler(ev)
+	if dbh != nil {
+		cev = optim.NewCacheSQLiteEvaler(ev, dbh)
+	}
 
-	pop := swarm.NewPopulationRand(n, lb, ub)
+	pop := newPopulation(n, lb, ub, init)
 	swarm := swarm.New(
 		pop,
-		swarm.Evaler(ev),
+		swarm.Evaler(cev),
 		swarm.VmaxBounds(lb, ub),
-		swarm.DB(db),
+		swarm.DB(dbh),
 	)
 
 	if *swarmonly {
@@ -204,14 +339,27 @@ func buildIter(lb, ub []float64) optim.Method {
 		return pattern.New(pop[0].Point,
 			pattern.ResetStep(.01, 1.0),
 			pattern.NsuccessGrow(4),
-			pattern.Evaler(ev),
+			pattern.Evaler(cev),
 			pattern.PollRandNMask(n, mask),
 			pattern.SearchMethod(swarm, pattern.Share),
-			pattern.DB(db),
+			pattern.DB(dbh),
 		)
 	}
 }
 
+// newPopulation creates a population of n randomly positioned particles with
+// the first particle moved to init if it is not empty.
+func newPopulation(n int, lb, ub, init []float64) swarm.Population {
+	pop := swarm.NewPopulationRand(n, lb, ub)
+	if len(init) > 0 {
+		pos := make([]float64, len(init))
+		copy(pos, init)
+		pop[0].Point.Pos = pos
+		pop[0].Best = pop[0].Point.Clone()
+	}
+	return pop
+}
+
 func loadPoint(query string, args ...interface{}) *optim.Point {
 	rows, err := db.Query(query, args...)
 	check(err)
@@ -280,10 +428,11 @@ func loadIter(lb, ub []float64, iter int) (md optim.Method, initstep float64) {
 	if *addr == "" {
 		ev.NConcurrent = runtime.NumCPU()
 	}
+	cev := optim.NewCacheSQLiteEvaler(ev, db)
 
 	swarm := swarm.New(
 		pop,
-		swarm.Evaler(ev),
+		swarm.Evaler(cev),
 		swarm.VmaxBounds(lb, ub),
 		swarm.DB(db),
 		swarm.InitIter(iter+1),
@@ -291,13 +440,26 @@ func loadIter(lb, ub []float64, iter int) (md optim.Method, initstep float64) {
 	return pattern.New(initPoint,
 		pattern.ResetStep(.01, 1.0),
 		pattern.NsuccessGrow(4),
-		pattern.Evaler(ev),
+		pattern.Evaler(cev),
 		pattern.PollRandNMask(npar, mask),
 		pattern.SearchMethod(swarm, pattern.Share),
 		pattern.DB(db),
 	), initstep
 }
 
+// summarise returns a function describing the deployments s would make for
+// a set of optimizer variables.
+func summarise(s *scen.Scenario) func([]float64) string {
+	return func(v []float64) string {
+		scencopyval := *s
+		scencopy := &scencopyval
+		if _, err := scencopy.TransformVars(v); err != nil {
+			return "[invalid]"
+		}
+		return "[" + scencopy.ShortHash() + " " + scencopy.Summarise() + "]"
+	}
+}
+
 type obj struct {
 	s      *scen.Scenario
 	runlog io.Writer
@@ -309,10 +471,13 @@ func (o *obj) Objective(v []float64) (float64, error) {
 	scencopy.TransformVars(v)
 
 	if *addr == "" {
-		val, err := runscen.Local(scencopy, o.runlog, o.runlog)
+		val, _, dbfile, err := runscen.Local(scencopy, o.runlog, o.runlog)
+		if err == nil {
+			os.Remove(dbfile)
+		}
 		return val, err
 	} else {
-		return runscen.RemoteTimeout(scencopy, o.runlog, o.runlog, *addr, *timeout)
+		return batcher.Run(scencopy, o.runlog, o.runlog)
 	}
 }
 
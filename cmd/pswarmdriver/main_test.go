@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rwcarlsen/cloudlus/scen"
+	"github.com/rwcarlsen/optim"
+)
+
+func TestWarmStartPopulation(t *testing.T) {
+	s := &scen.Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []scen.Facility{
+			{Proto: "Proto1", Cap: 1, Life: 0},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{10, 10, 10, 10, 70},
+	}
+
+	dir, err := ioutil.TempDir("", "pswarmdriver-warmstart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "warm.json")
+	if err := ioutil.WriteFile(fname, []byte("[0.1, 0.2, 0.3, 0.4, 0.5]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LoadWarmStart(fname); err != nil {
+		t.Fatal(err)
+	}
+
+	pop := newPopulation(10, s.LowerBounds(), s.UpperBounds(), s.WarmStartVars)
+	want := []float64{0.1, 0.2, 0.3, 0.4, 0.5}
+	if got := pop[0].Pos; !reflect.DeepEqual(got, want) {
+		t.Errorf("first particle position: got %v, want %v", got, want)
+	}
+	if got := pop[0].Best.Pos; !reflect.DeepEqual(got, want) {
+		t.Errorf("first particle best position: got %v, want %v", got, want)
+	}
+	if reflect.DeepEqual(pop[1].Pos, want) {
+		t.Errorf("other particles should not be warm started")
+	}
+}
+
+func TestRestrictFacs(t *testing.T) {
+	s := &scen.Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []scen.Facility{
+			{Proto: "Proto1", Cap: 1, Life: 0},
+			{Proto: "Proto2", Cap: 1, Life: 0},
+			{Proto: "Proto3", Cap: 1, Life: 0},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{10, 10, 10, 10, 70},
+	}
+	if err := restrictFacs(s, []string{"Proto2"}); err != nil {
+		t.Fatal(err)
+	}
+	// 5 build periods each with 1 power var and 1 var for all but one
+	// unrestricted reactor.
+	if got, want := s.NVars(), 10; got != want {
+		t.Errorf("restricted scenario has %v vars, want %v", got, want)
+	}
+
+	optim.Rand = rand.New(rand.NewSource(1))
+	for _, p := range optim.RandPop(50, s.LowerBounds(), s.UpperBounds()) {
+		builds, err := s.TransformVars(p.Pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range builds["Proto2"] {
+			if b.N > 0 {
+				t.Errorf("restricted prototype deployed: %+v", b)
+			}
+		}
+	}
+
+	if err := restrictFacs(s, []string{"Bogus"}); err == nil {
+		t.Errorf("restricting an unknown prototype should fail")
+	}
+}
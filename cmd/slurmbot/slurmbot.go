@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"text/template"
+
+	"github.com/rwcarlsen/cloudlus/cmd/internal/sshutil"
+)
+
+var (
+	addr       = flag.String("addr", "", "ip:port of cloudlus server")
+	run        = flag.String("run", "", "name of script for each worker to run before starting")
+	n          = flag.Int("n", 0, "number of separate slurm jobs to submit")
+	array      = flag.Int("array", 0, "submit a single array job with `N` tasks instead of separate jobs")
+	ntasks     = flag.Int("ntasks", 1, "number of workers (slurm tasks) to run per job")
+	mem        = flag.Int("mem", 1024, "minimum `MiB` of memory required per worker job")
+	walltime   = flag.String("time", "", "slurm wall time limit per job (e.g. '24:00:00')")
+	constraint = flag.String("constraint", "", "literal slurm node feature constraints (e.g. 'haswell')")
+	user       = flag.String("user", "rcarlsen", "slurm (and via node) ssh username")
+	dst        = flag.String("dst", "", "slurm submit node URI")
+	via        = flag.String("via", "", "intermediate server URI (if needed)")
+	cpy        = flag.Bool("copy", false, "true to automatically copy all needed files to submit node")
+	local      = flag.Bool("local", false, "save local copies of generated files")
+	wkflags    = flag.String("workflags", "", "flags to be passed straight to cloudlus worker invocation")
+)
+
+type SlurmConfig struct {
+	Runfile    string
+	NTasks     int
+	Memory     int
+	Time       string
+	Constraint string
+	// Array is the number of tasks in the array job (zero for a plain
+	// job).
+	Array int
+}
+
+const batchname = "slurm.sbatch"
+
+const batchfile = `#!/bin/bash
+#SBATCH --job-name=cloudlus
+#SBATCH --ntasks={{.NTasks}}
+#SBATCH --mem={{.Memory}}M
+{{with .Time}}#SBATCH --time={{.}}
+{{end}}{{with .Constraint}}#SBATCH --constraint={{.}}
+{{end}}{{if .Array}}#SBATCH --array=0-{{dec .Array}}
+#SBATCH --output=worker.%A_%a.output
+#SBATCH --error=worker.%A_%a.error
+{{else}}#SBATCH --output=worker.%j.output
+#SBATCH --error=worker.%j.error
+{{end}}
+srun bash ./{{.Runfile}}
+`
+
+const runfilename = "CLOUDLUS_runfile.sh"
+
+const runfile = `#!/bin/bash
+{{with .Runfile}}bash ./{{.}}{{end}}
+chmod a+x ./cloudlus
+./cloudlus -addr {{.Addr}} work {{.Flags}}
+`
+
+var funcs = template.FuncMap{"dec": func(i int) int { return i - 1 }}
+var batchtmpl = template.Must(template.New("batchfile").Funcs(funcs).Parse(batchfile))
+var runtmpl = template.Must(template.New("runfile").Parse(runfile))
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Println("Usage: slurmbot [FILE...]")
+		fmt.Print("Copy listed files to slurm submit node and possibly submit jobs.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *addr == "" {
+		log.Fatal("must specify server address")
+	} else if *n > 0 && *array > 0 {
+		log.Fatal("-n and -array cannot be used together")
+	}
+
+	// assemble file names to copy over
+	srcfiles := append([]string{}, flag.Args()...)
+
+	path, err := exec.LookPath("cloudlus")
+	if err != nil {
+		log.Fatal(err)
+	}
+	srcfiles = append(srcfiles, path)
+
+	if *run != "" {
+		srcfiles = append(srcfiles, *run)
+	}
+
+	dstfiles := make([]string, len(srcfiles))
+	for i := range srcfiles {
+		dstfiles[i] = filepath.Base(srcfiles[i])
+	}
+
+	// build slurm batch script and worker executable script
+	sc := SlurmConfig{
+		Runfile:    runfilename,
+		NTasks:     *ntasks,
+		Memory:     *mem,
+		Time:       *walltime,
+		Constraint: *constraint,
+		Array:      *array,
+	}
+
+	var batchbuf, runbuf bytes.Buffer
+	err = batchtmpl.Execute(&batchbuf, sc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = runtmpl.Execute(&runbuf, struct{ Runfile, Addr, Flags string }{*run, *addr, *wkflags})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *local {
+		err := ioutil.WriteFile(runfilename, runbuf.Bytes(), 0755)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = ioutil.WriteFile(batchname, batchbuf.Bytes(), 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *dst == "" {
+		log.Fatal("no destination specified")
+	}
+
+	submitssh(srcfiles, dstfiles, &batchbuf, &runbuf)
+}
+
+func submitssh(srcs, dsts []string, batchdata, runbuf io.Reader) {
+	if !*cpy && *n < 1 && *array < 1 {
+		return
+	}
+
+	client, err := sshutil.Dial(*user, *dst, *via)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// copy files
+	err = sshutil.CopyFile(client, batchdata, batchname)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = sshutil.CopyFile(client, runbuf, runfilename)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *cpy {
+		for i, name := range srcs {
+			f, err := os.Open(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = sshutil.CopyFile(client, f, dsts[i])
+			if err != nil {
+				log.Fatal(err)
+			}
+			f.Close()
+		}
+	}
+
+	// an array job is submitted once - otherwise submit n separate jobs
+	nsubmit := *n
+	if *array > 0 {
+		nsubmit = 1
+	}
+	for i := 0; i < nsubmit; i++ {
+		out, err := sshutil.Combined(client, "sbatch "+batchname)
+		if err != nil {
+			fmt.Printf("%s\n", out)
+			log.Fatal(err)
+		}
+		fmt.Printf("%s", out)
+	}
+}
@@ -1,6 +1,7 @@
 package runscen
 
 import (
+	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -9,10 +10,15 @@ import (
 	"io"
 	"io/ioutil"
 	"math"
+	"net/rpc"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
@@ -25,8 +31,16 @@ var objfile = "runsim-obj.dat"
 
 const DefaultTimeout = 2 * time.Hour
 
+// watchInterval is how often the status of remote jobs is polled.
+var watchInterval = 5 * time.Second
+
+// OptimJobTTL is how long the server keeps completed objective evaluation
+// jobs so their output can be retrieved for post-processing.
+const OptimJobTTL = 7 * 24 * time.Hour
+
 // RemoteTimeout is the same as Remote, but with a custom timeout rather than
-// the default.
+// the default.  The timeout only limits how long a job may run once a worker
+// has fetched it; time spent waiting in the server's queue is not bounded.
 func RemoteTimeout(s *scen.Scenario, stdout, stderr io.Writer, addr string, timeout time.Duration) (float64, error) {
 	client, err := cloudlus.Dial(addr)
 	if err != nil {
@@ -41,42 +55,189 @@ func RemoteTimeout(s *scen.Scenario, stdout, stderr io.Writer, addr string, time
 		}
 		j.Timeout = timeout
 
-		// closing this channel might cause a send on a closed channel if the
-		// timeout in the select below fires before the goroutine completes.
-		done := make(chan bool, 1)
-		go func() {
-			j, err = client.Run(j)
-			done <- true
-		}()
-
-		select {
-		case <-done:
-			if err != nil {
-				return math.Inf(1), fmt.Errorf("job execution failed: %v", err)
-			}
-		case <-time.After(j.Timeout + 1*time.Hour):
-			return math.Inf(1), fmt.Errorf("job rpc timeout limit reached")
+		if err := client.Submit(j); err != nil {
+			return math.Inf(1), fmt.Errorf("job submission failed: %v", err)
 		}
+		return awaitObjective(client, j, stdout, stderr)
+	}
 
-		if err := writeLogs(j, stdout, stderr); err != nil {
-			return math.Inf(1), fmt.Errorf("job logging failed: %v", err)
-		}
+	return s.CalcTotalObjective(execfn)
+}
+
+// awaitObjective waits for the submitted job j to complete and returns the
+// objective value it calculated.
+func awaitObjective(client *cloudlus.Client, j *cloudlus.Job, stdout, stderr io.Writer) (float64, error) {
+	// the server fails running jobs that exceed their timeout, but queued
+	// jobs never time out - so this waits for as long as j stays queued.
+	stats, errc, err := client.WatchJob(j.Id, watchInterval)
+	if err != nil {
+		return math.Inf(1), fmt.Errorf("job execution failed: %v", err)
+	}
+	var stat *cloudlus.JobStat
+	for stat = range stats {
+	}
+	if err := <-errc; err != nil {
+		return math.Inf(1), fmt.Errorf("job execution failed: %v", err)
+	} else if !stat.Done() {
+		return math.Inf(1), fmt.Errorf("job execution failed: status %v", stat.Status)
+	}
 
-		data, err := client.RetrieveOutfileData(j, objfile)
+	j, err = client.Retrieve(j.Id)
+	if err != nil {
+		return math.Inf(1), fmt.Errorf("job retrieval failed: %v", err)
+	}
+
+	if err := writeLogs(j, stdout, stderr); err != nil {
+		return math.Inf(1), fmt.Errorf("job logging failed: %v", err)
+	}
+
+	data, err := client.RetrieveOutfileData(j, objfile)
+	if err != nil {
+		return math.Inf(1), fmt.Errorf("couldn't find objective result file: %v", err)
+	}
+
+	val, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		return math.Inf(1), fmt.Errorf("invalid objective string '%s': %v", data, err)
+	}
+	return val, nil
+}
+
+// DefaultBatchWindow is the default amount of time a Batcher waits for more
+// jobs before submitting a batch.
+const DefaultBatchWindow = 500 * time.Millisecond
+
+// Batcher runs scenarios remotely like RemoteTimeout, but jobs from
+// concurrent Run calls (e.g. from a parallel evaler) are collected and
+// submitted to the server together in a single batch.  This avoids one
+// round trip per job and guarantees workers don't start on a batch before
+// the whole batch is queued.  If the connection to the server is lost, the
+// Batcher redials it.  A Batcher is safe for concurrent use.
+type Batcher struct {
+	// Window is how long the batcher waits for more jobs after the first
+	// job of a batch arrives before submitting the batch.
+	Window time.Duration
+	// Timeout is the timeout set on every submitted job.  Like with
+	// RemoteTimeout, it doesn't bound time spent queued.
+	Timeout time.Duration
+
+	addr    string
+	client  *cloudlus.Client
+	mu      sync.Mutex
+	pending []batchReq
+}
+
+type batchReq struct {
+	j    *cloudlus.Job
+	done chan error
+}
+
+// NewBatcher connects to the cloudlus server at addr and returns a Batcher
+// that submits jobs with the given timeout.
+func NewBatcher(addr string, timeout time.Duration) (*Batcher, error) {
+	client, err := cloudlus.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Batcher{Window: DefaultBatchWindow, Timeout: timeout, addr: addr, client: client}, nil
+}
+
+// Close closes the batcher's connection to the server.
+func (b *Batcher) Close() error { return b.conn().Close() }
+
+// conn returns the batcher's current connection to the server.
+func (b *Batcher) conn() *cloudlus.Client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.client
+}
+
+// redial replaces the broken connection old with a new connection to the
+// server and returns it.  If old was already replaced (e.g. by a concurrent
+// flush), the current connection is returned instead.
+func (b *Batcher) redial(old *cloudlus.Client) (*cloudlus.Client, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.client != old {
+		return b.client, nil
+	}
+
+	client, err := cloudlus.Dial(b.addr)
+	if err != nil {
+		return nil, err
+	}
+	old.Close()
+	b.client = client
+	return client, nil
+}
+
+// Run runs scenario s remotely as part of the next batch writing the remote
+// job's standard out and error to stdout and stderr respectively.
+func (b *Batcher) Run(s *scen.Scenario, stdout, stderr io.Writer) (float64, error) {
+	execfn := func(scn *scen.Scenario) (float64, error) {
+		j, err := BuildRemoteJob(scn, objfile)
 		if err != nil {
-			return math.Inf(1), fmt.Errorf("couldn't find objective result file: %v", err)
+			return math.Inf(1), fmt.Errorf("failed to build remote job: %v", err)
 		}
+		j.Timeout = b.Timeout
 
-		val, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
-		if err != nil {
-			return math.Inf(1), fmt.Errorf("invalid objective string '%s': %v", data, err)
+		if err := b.submit(j); err != nil {
+			return math.Inf(1), fmt.Errorf("job submission failed: %v", err)
 		}
-		return val, nil
+		return awaitObjective(b.conn(), j, stdout, stderr)
 	}
 
 	return s.CalcTotalObjective(execfn)
 }
 
+// submit adds j to the pending batch and blocks until the batch has been
+// submitted.
+func (b *Batcher) submit(j *cloudlus.Job) error {
+	done := make(chan error, 1)
+	b.mu.Lock()
+	b.pending = append(b.pending, batchReq{j, done})
+	if len(b.pending) == 1 {
+		time.AfterFunc(b.Window, b.flush)
+	}
+	b.mu.Unlock()
+	return <-done
+}
+
+func (b *Batcher) flush() {
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	jobs := make([]*cloudlus.Job, len(batch))
+	for i, req := range batch {
+		jobs[i] = req.j
+	}
+
+	client := b.conn()
+	_, err := client.BatchSubmit(jobs)
+	if err == rpc.ErrShutdown {
+		// the connection was already broken, so the batch never reached the
+		// server and can be resent.
+		if client, err = b.redial(client); err == nil {
+			_, err = client.BatchSubmit(jobs)
+		}
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the connection broke mid-call - the batch may have been
+		// submitted, so it isn't resent.
+		b.redial(client)
+	}
+
+	berr, _ := err.(*cloudlus.BatchError)
+	for i, req := range batch {
+		if berr != nil {
+			req.done <- berr.Errs[i]
+		} else {
+			req.done <- err
+		}
+	}
+}
+
 // Remote runs scenario s on a remote cloudlus server at addr writing the remote job's
 // standard out and error to stdout and stderr respectively.
 func Remote(s *scen.Scenario, stdout, stderr io.Writer, addr string) (float64, error) {
@@ -86,64 +247,175 @@ func Remote(s *scen.Scenario, stdout, stderr io.Writer, addr string) (float64, e
 // Local runs scenario scn on the local machine connecting the simulation's
 // standard out and error to stdout and stderr respectively.  The file names
 // of the generated cyclus input file and database are returned along with the
-// objective value.
-func Local(scn *scen.Scenario, stdout, stderr io.Writer) (obj float64, err error) {
+// objective value.  If err is nil, the caller is responsible for removing
+// dbfile.  For scenarios whose objective involves multiple simulations, the
+// files of the last simulation to finish are returned (the other databases
+// are removed).
+func Local(scn *scen.Scenario, stdout, stderr io.Writer) (obj float64, infile, dbfile string, err error) {
+	return LocalCache(scn, stdout, stderr, "")
+}
+
+// LocalCache is the same as Local, but reuses cyclus output databases stored
+// in cachedir for simulations with identical input files.  New simulation
+// output is added to the cache.  If cachedir is empty, no caching is done.
+func LocalCache(scn *scen.Scenario, stdout, stderr io.Writer, cachedir string) (obj float64, infile, dbfile string, err error) {
+	var mu sync.Mutex
 	execfn := func(s *scen.Scenario) (float64, error) {
 		// generate cyclus input file and run cyclus
 		ui := uuid.NewRandom()
-		infile := ui.String() + ".cyclus.xml"
-		dbfile := ui.String() + ".sqlite"
+		in := ui.String() + ".cyclus.xml"
+		db := ui.String() + ".sqlite"
 
 		data, err := s.GenCyclusInfile()
 		if err != nil {
 			return math.Inf(1), err
 		}
-		err = ioutil.WriteFile(infile, data, 0644)
+		err = ioutil.WriteFile(in, data, 0644)
 		if err != nil {
 			return math.Inf(1), err
 		}
 
-		cmd := exec.Command("cyclus", infile, "-o", dbfile)
-		cmd.Stdout = stdout
-		cmd.Stderr = stderr
-
-		if err := cmd.Run(); err != nil {
+		err = cachedRun(cachedir, data, in, db, stdout, stderr)
+		if err != nil {
 			return math.Inf(1), err
 		}
-		defer os.Remove(dbfile)
 
-		// post process cyclus output db
-		db, err := sql.Open("sqlite3", dbfile)
+		val, err := calcObjective(s, db)
 		if err != nil {
+			os.Remove(db)
 			return math.Inf(1), err
 		}
-		defer db.Close()
 
-		simids, err := post.Process(db)
-		if err != nil {
-			return math.Inf(1), err
+		// only keep the most recent simulation's files
+		mu.Lock()
+		defer mu.Unlock()
+		if dbfile != "" {
+			os.Remove(dbfile)
 		}
+		infile, dbfile = in, db
+		return val, nil
+	}
 
-		return s.CalcObjective(dbfile, simids[0])
+	obj, err = scn.CalcTotalObjective(execfn)
+	if err != nil {
+		if dbfile != "" {
+			os.Remove(dbfile)
+		}
+		return obj, "", "", err
 	}
-	return scn.CalcTotalObjective(execfn)
+	return obj, infile, dbfile, nil
 }
 
-func BuildRemoteJob(s *scen.Scenario, objfile string) (*cloudlus.Job, error) {
-	scendata, err := json.Marshal(s)
+// calcObjective post-processes the cyclus output database dbfile and
+// computes the single-simulation objective for s from it.
+func calcObjective(s *scen.Scenario, dbfile string) (float64, error) {
+	db, err := sql.Open("sqlite3", dbfile)
 	if err != nil {
-		return nil, err
+		return math.Inf(1), err
 	}
+	defer db.Close()
 
-	tmpldata, err := ioutil.ReadFile(s.CyclusTmpl)
+	simids, err := post.Process(db)
 	if err != nil {
-		return nil, err
+		return math.Inf(1), err
+	}
+
+	return s.CalcObjective(dbfile, simids[0])
+}
+
+// runCyclus runs cyclus for infile writing its output database to dbfile.
+// It is a variable so tests can replace it.
+var runCyclus = func(infile, dbfile string, stdout, stderr io.Writer) error {
+	cmd := exec.Command("cyclus", infile, "-o", dbfile)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+// cachedRun runs cyclus for infile (with contents infiledata) producing
+// dbfile.  If cachedir is non-empty and holds a database named by the sha256
+// hash of infiledata, it is copied to dbfile instead of running cyclus.
+// Otherwise the new (unprocessed) database is copied into cachedir.
+func cachedRun(cachedir string, infiledata []byte, infile, dbfile string, stdout, stderr io.Writer) error {
+	if cachedir == "" {
+		return runCyclus(infile, dbfile, stdout, stderr)
+	}
+
+	cached := filepath.Join(cachedir, fmt.Sprintf("%x.sqlite", sha256.Sum256(infiledata)))
+	if _, err := os.Stat(cached); err == nil {
+		return copyFile(dbfile, cached)
+	}
+
+	if err := runCyclus(infile, dbfile, stdout, stderr); err != nil {
+		return err
+	} else if err := os.MkdirAll(cachedir, 0755); err != nil {
+		return err
+	}
+
+	// copy via a temporary file so concurrent runs never see a partial db
+	tmp := cached + "." + uuid.NewRandom().String()
+	if err := copyFile(tmp, dbfile); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, cached)
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
 	}
+	return out.Close()
+}
 
+// BuildRemoteJob creates a job that runs scenario s remotely with cycobj,
+// storing the objective value in objfile.  If the calling program was given
+// any positional (non-flag) command line arguments, they are joined with
+// spaces to form the job's note.  If the scenario's cyclus template is an
+// http(s) URL, it is downloaded and sent as a cached infile so workers
+// only need to store one copy of it.
+func BuildRemoteJob(s *scen.Scenario, objfile string) (*cloudlus.Job, error) {
 	j := cloudlus.NewJobCmd("cycobj", "-obj", objfile, "-scen", s.File)
 	j.Timeout = 2 * time.Hour
-	j.AddInfile(s.CyclusTmpl, tmpldata)
-	j.AddInfile(s.File, scendata)
+	j.TTL = OptimJobTTL
+
+	if u, err := url.Parse(s.CyclusTmpl); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		// the remote scenario refers to the downloaded template by name
+		name := path.Base(u.Path)
+		if err := j.AddInfileFromURL(name, s.CyclusTmpl); err != nil {
+			return nil, err
+		}
+		remote := *s
+		remote.CyclusTmpl = name
+		s = &remote
+	} else {
+		tmpldata, err := ioutil.ReadFile(s.CyclusTmpl)
+		if err != nil {
+			return nil, err
+		}
+		if err := j.AddInfile(s.CyclusTmpl, tmpldata); err != nil {
+			return nil, err
+		}
+	}
+
+	scendata, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.AddInfile(s.File, scendata); err != nil {
+		return nil, err
+	}
 	j.AddOutfile(objfile)
 
 	if flag.NArg() > 0 {
@@ -0,0 +1,156 @@
+package runscen
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/cloudlus/cloudlus"
+	"github.com/rwcarlsen/cloudlus/scen"
+)
+
+func TestCachedRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "runscen-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cachedir := filepath.Join(dir, "cache")
+
+	nrun := 0
+	orig := runCyclus
+	defer func() { runCyclus = orig }()
+	runCyclus = func(infile, dbfile string, stdout, stderr io.Writer) error {
+		nrun++
+		data, err := ioutil.ReadFile(infile)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dbfile, append([]byte("db for "), data...), 0644)
+	}
+
+	infiledata := []byte("<simulation/>")
+	infile := filepath.Join(dir, "in.xml")
+	if err := ioutil.WriteFile(infile, infiledata, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var dbs [][]byte
+	for i := 0; i < 2; i++ {
+		dbfile := filepath.Join(dir, "out.sqlite")
+		if err := cachedRun(cachedir, infiledata, infile, dbfile, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(dbfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbs = append(dbs, data)
+		os.Remove(dbfile)
+	}
+
+	if nrun != 1 {
+		t.Errorf("cyclus ran %v times, want 1", nrun)
+	}
+	if !bytes.Equal(dbs[0], dbs[1]) {
+		t.Errorf("cached db %q differs from original %q", dbs[1], dbs[0])
+	}
+
+	// a different input file must not hit the cache
+	dbfile := filepath.Join(dir, "out.sqlite")
+	if err := cachedRun(cachedir, []byte("<other/>"), infile, dbfile, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if nrun != 2 {
+		t.Errorf("cyclus ran %v times for new input, want 2", nrun)
+	}
+}
+
+func TestBuildRemoteJobURLTmpl(t *testing.T) {
+	tmpl := []byte("<simulation>{{.SimDur}}</simulation>")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tmpl)
+	}))
+	defer ts.Close()
+
+	tmplurl := ts.URL + "/tmpls/cyclus.xml.in"
+	s := &scen.Scenario{File: "scen.json", CyclusTmpl: tmplurl}
+	j, err := BuildRemoteJob(s, "obj.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.CyclusTmpl != tmplurl {
+		t.Errorf("BuildRemoteJob changed scenario template to %v", s.CyclusTmpl)
+	}
+
+	files := map[string][]byte{}
+	for _, f := range j.Infiles {
+		files[f.Name] = f.Data
+		if f.Name == "cyclus.xml.in" && !f.Cache {
+			t.Errorf("downloaded template is not cached")
+		}
+	}
+	if !bytes.Equal(files["cyclus.xml.in"], tmpl) {
+		t.Errorf("got template infile %q, want %q", files["cyclus.xml.in"], tmpl)
+	}
+
+	remote := &scen.Scenario{}
+	if err := json.Unmarshal(files["scen.json"], remote); err != nil {
+		t.Fatal(err)
+	} else if remote.CyclusTmpl != "cyclus.xml.in" {
+		t.Errorf("remote scenario template is %v, want cyclus.xml.in", remote.CyclusTmpl)
+	}
+}
+
+func TestBatcherRedialAndJobErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+	db, err := cloudlus.NewDB("", 1*cloudlus.MB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := cloudlus.NewServer(addr, addr, db, cloudlus.WithLogger(cloudlus.NewJSONLogger(ioutil.Discard)))
+	go s.Serve(l)
+	defer s.Close()
+
+	b, err := NewBatcher(addr, DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.Window = 50 * time.Millisecond
+
+	// simulate a lost connection
+	b.conn().Close()
+
+	good := cloudlus.NewJobCmd("echo", "good")
+	good.DependsOn = []cloudlus.JobId{cloudlus.NewJob().Id} // never ready to run
+	bad := cloudlus.NewJobCmd("echo", "bad")
+	bad.DependsOn = []cloudlus.JobId{bad.Id}
+
+	errs := make(chan error)
+	go func() { errs <- b.submit(bad) }()
+	goodErr := b.submit(good)
+	badErr := <-errs
+
+	if goodErr != nil {
+		t.Errorf("valid job not submitted after redial: %v", goodErr)
+	} else if _, err := db.Get(good.Id); err != nil {
+		t.Errorf("valid job missing from server: %v", err)
+	}
+	if badErr == nil {
+		t.Errorf("self-dependent job submitted without error")
+	}
+}
@@ -0,0 +1,26 @@
+package scen
+
+import (
+	"errors"
+	"math"
+	"runtime"
+)
+
+// Bootstrap evaluates the scenario objective n times by calling execfn with a
+// clone of s for each evaluation and returns the mean and sample standard
+// deviation of the resulting objective values.  This is useful for
+// estimating the objective uncertainty of scenarios with stochastic
+// simulations.  At most BootstrapMaxConcurrent evaluations run at the same
+// time.
+func (s *Scenario) Bootstrap(n int, execfn ObjExecFunc) (mean, std float64, err error) {
+	if n < 1 {
+		return math.Inf(1), 0, errors.New("bootstrap: number of evaluations must be positive")
+	}
+
+	maxConcurrent := s.BootstrapMaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = runtime.NumCPU()
+	}
+	sample := func() (*Scenario, error) { return s.Clone(), nil }
+	return sampleMean(n, maxConcurrent, sample, execfn)
+}
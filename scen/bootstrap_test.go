@@ -0,0 +1,64 @@
+package scen
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestBootstrap(t *testing.T) {
+	s := &Scenario{
+		SimDur:                 10,
+		BuildPeriod:            2,
+		Facs:                   []Facility{{Proto: "Proto1", Cap: 1, Life: 0}},
+		MaxPower:               []float64{10, 20, 40, 60, 70},
+		MinPower:               []float64{10, 10, 10, 10, 70},
+		BootstrapMaxConcurrent: 2,
+	}
+
+	// each evaluation returns the next value of 1, 2, 3, 4
+	var mu sync.Mutex
+	count, active, maxactive := 0, 0, 0
+	obj := func(scn *Scenario) (float64, error) {
+		if scn == s {
+			t.Error("objective called with the original scenario instead of a clone")
+		}
+		mu.Lock()
+		active++
+		if active > maxactive {
+			maxactive = active
+		}
+		count++
+		val := float64(count)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+		return val, nil
+	}
+
+	mean, std, err := s.Bootstrap(4, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxactive > 2 {
+		t.Errorf("%v objective evaluations ran concurrently, want at most 2", maxactive)
+	}
+	if mean != 2.5 {
+		t.Errorf("got mean %v, want 2.5", mean)
+	}
+	if want := math.Sqrt(5.0 / 3); math.Abs(std-want) > 1e-12 {
+		t.Errorf("got std %v, want %v", std, want)
+	}
+
+	fail := func(scn *Scenario) (float64, error) { return 0, errors.New("sim failed") }
+	if _, _, err := s.Bootstrap(3, fail); err == nil {
+		t.Error("failed evaluations returned no error")
+	}
+	if _, _, err := s.Bootstrap(0, obj); err == nil {
+		t.Error("zero evaluations returned no error")
+	}
+}
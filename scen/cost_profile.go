@@ -0,0 +1,95 @@
+package scen
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/rwcarlsen/cyan/query"
+)
+
+// TimeCost holds the present value (i.e. PV(t=0)) contributions of each cost
+// type incurred at a single time step.
+type TimeCost struct {
+	Time        int
+	CapitalCost float64
+	OpCost      float64
+	WasteCost   float64
+}
+
+// CostProfile returns the time series of discounted capital, operating, and
+// waste costs incurred in the simulation with the given id in db.  Costs are
+// calculated in the same way as for the ans2014 objective using the
+// ANSScenario parameters in the scenario file.
+func (s *Scenario) CostProfile(db *sql.DB, simid []byte) ([]TimeCost, error) {
+	ans := &ANSScenario{}
+	if err := ans.Load(s.File); err != nil {
+		return nil, err
+	}
+	return ans.costProfile(db, simid, false)
+}
+
+// costProfile returns the per time step costs for s.SimDur time steps.  If
+// utilised is true, capital costs are reduced for facilities retired early
+// (see capitalCost).
+func (s *ANSScenario) costProfile(db *sql.DB, simid []byte, utilised bool) ([]TimeCost, error) {
+	profile := make([]TimeCost, s.SimDur)
+	for t := range profile {
+		profile[t].Time = t
+	}
+	at := func(t int) *TimeCost {
+		for len(profile) <= t {
+			profile = append(profile, TimeCost{Time: len(profile)})
+		}
+		return &profile[t]
+	}
+
+	for i := range s.Facs {
+		fac := &s.Facs[i]
+		// calc operating cost
+		opcosts, err := opCosts(db, simid, fac, s.Discount)
+		if err != nil {
+			return nil, err
+		}
+		for t, c := range opcosts {
+			at(t).OpCost += c
+		}
+
+		// calc overnight capital cost
+		capcosts, err := capitalCosts(db, simid, fac, s.Discount, utilised)
+		if err != nil {
+			return nil, err
+		}
+		for t, c := range capcosts {
+			at(t).CapitalCost += c
+		}
+
+		// add in waste penalty
+		ags, err := query.AllAgents(db, simid, fac.Proto)
+		if err != nil {
+			return nil, err
+		}
+
+		// InvAt uses all agents if no ids are passed - so we need to skip
+		// from here
+		if len(ags) == 0 {
+			continue
+		}
+
+		ids := make([]int, len(ags))
+		for i, a := range ags {
+			ids[i] = a.Id
+		}
+
+		for t := 0; t < s.SimDur; t++ {
+			mat, err := query.InvAt(db, simid, t, ids...)
+			if err != nil {
+				return nil, err
+			}
+			for nuc, qty := range mat {
+				nucstr := fmt.Sprint(nuc)
+				at(t).WasteCost += PV(s.NuclideCost[nucstr]*float64(qty)*(1-fac.WasteDiscount), t, s.Discount)
+			}
+		}
+	}
+	return profile, nil
+}
@@ -0,0 +1,102 @@
+package scen
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/rwcarlsen/go-sqlite3"
+)
+
+func TestCostProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scen-costprofile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ans := &ANSScenario{
+		SimDur:      4,
+		NuclideCost: map[string]float64{"922350000": 2},
+		Facs: []ANSFacility{
+			{Proto: "reactor", OpCost: 1, CapitalCost: 10, Life: 4},
+			{Proto: "storage", OpCost: 0.5, CapitalCost: 3, Life: 4, WasteDiscount: 0.5},
+		},
+	}
+	data, err := json.Marshal(ans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scenfile := filepath.Join(dir, "scenario.json")
+	if err := ioutil.WriteFile(scenfile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "test.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	simid := []byte("simid")
+	stmts := []string{
+		"CREATE TABLE Agents (SimId BLOB,AgentId INTEGER,Kind TEXT,Spec TEXT,Prototype TEXT,ParentId INTEGER,EnterTime INTEGER,ExitTime INTEGER,Lifetime INTEGER);",
+		"CREATE TABLE TimeList (SimId BLOB,Time INTEGER);",
+		"CREATE TABLE Inventories (SimId BLOB,AgentId INTEGER,StartTime INTEGER,EndTime INTEGER,QualId INTEGER,Quantity REAL);",
+		"CREATE TABLE Compositions (SimId BLOB,QualId INTEGER,NucId INTEGER,MassFrac REAL);",
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for tm := 0; tm < ans.SimDur; tm++ {
+		if _, err := db.Exec("INSERT INTO TimeList VALUES (?,?);", simid, tm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the reactor operates for the whole simulation and the storage facility
+	// is built at t=2 and holds 3 kg of U235 from then on.
+	inserts := []struct {
+		Sql  string
+		Args []interface{}
+	}{
+		{"INSERT INTO Agents VALUES (?,?,?,?,?,?,?,?,?);", []interface{}{simid, 1, "Facility", ":a:b", "reactor", -1, 0, nil, 4}},
+		{"INSERT INTO Agents VALUES (?,?,?,?,?,?,?,?,?);", []interface{}{simid, 2, "Facility", ":a:b", "storage", -1, 2, nil, 4}},
+		{"INSERT INTO Inventories VALUES (?,?,?,?,?,?);", []interface{}{simid, 2, 2, 4, 7, 3.0}},
+		{"INSERT INTO Compositions VALUES (?,?,?,?);", []interface{}{simid, 7, 922350000, 1.0}},
+	}
+	for _, ins := range inserts {
+		if _, err := db.Exec(ins.Sql, ins.Args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scen := &Scenario{File: scenfile}
+	got, err := scen.CostProfile(db, simid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []TimeCost{
+		{Time: 0, CapitalCost: 10, OpCost: 1},
+		{Time: 1, OpCost: 1},
+		{Time: 2, CapitalCost: 3, OpCost: 1.5, WasteCost: 3},
+		{Time: 3, OpCost: 1.5, WasteCost: 3},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v time steps, want %v", len(got), len(want))
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-10 }
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Time != w.Time || !near(g.CapitalCost, w.CapitalCost) || !near(g.OpCost, w.OpCost) || !near(g.WasteCost, w.WasteCost) {
+			t.Errorf("time %v: got %+v, want %+v", i, g, w)
+		}
+	}
+}
@@ -1,6 +1,54 @@
 package scen
 
-import "sort"
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	InterpLinear = "linear"
+	InterpCubic  = "cubic"
+)
+
+// interpMode selects the interpolation scheme used for generating smooth
+// functions from sample points (e.g. disruption probabilities vs time).
+var interpMode = InterpLinear
+
+// SetInterpolationMode sets the interpolation scheme used when aggregating
+// multi-simulation objectives.  mode must be either "linear" (the default)
+// or "cubic" for natural cubic spline interpolation.
+func SetInterpolationMode(mode string) error {
+	switch mode {
+	case InterpLinear, InterpCubic:
+		interpMode = mode
+		return nil
+	default:
+		return fmt.Errorf("invalid interpolation mode '%v'", mode)
+	}
+}
+
+// interpolator returns the interpolating function generator for the current
+// interpolation mode.
+func interpolator() func([]sample) smoothFn {
+	if interpMode == InterpCubic {
+		return interpolateCubic
+	}
+	return interpolate
+}
+
+// ExtrapMode specifies how an interpolating function behaves outside of the
+// range of its sample points.
+type ExtrapMode int
+
+const (
+	// ExtrapLinear continues the slope of the interpolant at the nearest end
+	// point.
+	ExtrapLinear ExtrapMode = iota
+	// ExtrapConstant holds the value of the nearest end sample.
+	ExtrapConstant
+	// ExtrapZero returns zero outside of the sample range.
+	ExtrapZero
+)
 
 type smoothFn func(x float64) float64
 
@@ -46,6 +94,157 @@ func interpolate(samples []sample) smoothFn {
 	}
 }
 
+// interpolateBatch is a vectorised version of interpolate.  The returned
+// function evaluates the linear interpolant at every point in xs in a single
+// call, locating each point's segment with a binary search rather than the
+// linear scan used by interpolate.  This makes it much faster for large
+// sample counts (e.g. Monte Carlo disruption sampling).
+func interpolateBatch(samples []sample) func(xs []float64) []float64 {
+	ss := make([]sample, len(samples))
+	copy(ss, samples)
+	sort.Sort(sampleSet(ss))
+	n := len(ss)
+
+	return func(xs []float64) []float64 {
+		ys := make([]float64, len(xs))
+		for j, x := range xs {
+			// index of the left end of the segment containing x - points
+			// beyond either end use the nearest segment to extrapolate.
+			i := sort.Search(n-1, func(i int) bool { return x <= ss[i+1].X })
+			if i == n-1 {
+				i = n - 2
+			}
+			left, right := ss[i].X, ss[i+1].X
+			lefty, righty := ss[i].Y, ss[i+1].Y
+			ys[j] = lefty + (x-left)/(right-left)*(righty-lefty)
+		}
+		return ys
+	}
+}
+
+// interpolateWithExtrap generates an interpolating function for samples
+// using the current interpolation mode (see SetInterpolationMode) inside the
+// sample range and the given extrapolation mode outside of it.  With no
+// samples, the returned function is zero everywhere.
+func interpolateWithExtrap(samples []sample, mode ExtrapMode) smoothFn {
+	if len(samples) == 0 {
+		return func(x float64) float64 { return 0 }
+	}
+
+	fn := interpolator()(samples)
+	if mode == ExtrapLinear {
+		return fn
+	}
+
+	first, last := samples[0], samples[0]
+	for _, s := range samples {
+		if s.X < first.X {
+			first = s
+		}
+		if s.X > last.X {
+			last = s
+		}
+	}
+
+	return func(x float64) (y float64) {
+		if x >= first.X && x <= last.X {
+			return fn(x)
+		} else if mode == ExtrapZero {
+			return 0
+		} else if x < first.X {
+			return first.Y
+		}
+		return last.Y
+	}
+}
+
+// interpolateCubic generates a function that interpolates between the X,Y
+// points in samples using a natural cubic spline (i.e. zero second derivative
+// at the end points).  It extrapolates linearly outside of the start and end
+// bounds of the samples using the spline's slope at the nearest end point.
+// The samples do not need to be in any particular order.  Multiple samples at
+// the same X point are not allowed.  With fewer than three samples, this
+// reduces to linear interpolation.
+func interpolateCubic(samples []sample) smoothFn {
+	if len(samples) < 3 {
+		return interpolate(samples)
+	}
+
+	ss := make([]sample, len(samples))
+	copy(ss, samples)
+	sort.Sort(sampleSet(ss))
+
+	n := len(ss)
+	h := make([]float64, n-1)
+	for i := range h {
+		h[i] = ss[i+1].X - ss[i].X
+	}
+
+	// build tridiagonal system for the interior second derivatives
+	nin := n - 2
+	sub := make([]float64, nin)
+	diag := make([]float64, nin)
+	sup := make([]float64, nin)
+	rhs := make([]float64, nin)
+	for i := 0; i < nin; i++ {
+		sub[i] = h[i]
+		diag[i] = 2 * (h[i] + h[i+1])
+		sup[i] = h[i+1]
+		rhs[i] = 6 * ((ss[i+2].Y-ss[i+1].Y)/h[i+1] - (ss[i+1].Y-ss[i].Y)/h[i])
+	}
+
+	// second derivatives - natural boundary conditions leave ends at zero
+	m := make([]float64, n)
+	copy(m[1:n-1], solveTridiag(sub, diag, sup, rhs))
+
+	// slope of segment i evaluated at fraction of the way from its left end
+	slope := func(i int, x float64) float64 {
+		a := (ss[i+1].X - x) / h[i]
+		b := (x - ss[i].X) / h[i]
+		return (ss[i+1].Y-ss[i].Y)/h[i] - (3*a*a-1)/6*h[i]*m[i] + (3*b*b-1)/6*h[i]*m[i+1]
+	}
+
+	return func(x float64) (y float64) {
+		if x < ss[0].X {
+			return ss[0].Y + (x-ss[0].X)*slope(0, ss[0].X)
+		} else if x > ss[n-1].X {
+			return ss[n-1].Y + (x-ss[n-1].X)*slope(n-2, ss[n-1].X)
+		}
+
+		i := sort.Search(n-1, func(i int) bool { return x <= ss[i+1].X })
+		a := (ss[i+1].X - x) / h[i]
+		b := (x - ss[i].X) / h[i]
+		return a*ss[i].Y + b*ss[i+1].Y + ((a*a*a-a)*m[i]+(b*b*b-b)*m[i+1])*h[i]*h[i]/6
+	}
+}
+
+// solveTridiag solves the tridiagonal system of equations with sub-diagonal
+// a, diagonal b, super-diagonal c and right hand side d using the Thomas
+// algorithm.  a[0] and c[len(c)-1] are ignored.
+func solveTridiag(a, b, c, d []float64) []float64 {
+	n := len(d)
+	cp := make([]float64, n)
+	dp := make([]float64, n)
+	x := make([]float64, n)
+	if n == 0 {
+		return x
+	}
+
+	cp[0] = c[0] / b[0]
+	dp[0] = d[0] / b[0]
+	for i := 1; i < n; i++ {
+		denom := b[i] - a[i]*cp[i-1]
+		cp[i] = c[i] / denom
+		dp[i] = (d[i] - a[i]*dp[i-1]) / denom
+	}
+
+	x[n-1] = dp[n-1]
+	for i := n - 2; i >= 0; i-- {
+		x[i] = dp[i] - cp[i]*x[i+1]
+	}
+	return x
+}
+
 func productOf(fn1, fn2 smoothFn) smoothFn {
 	return func(x float64) (y float64) {
 		return fn1(x) * fn2(x)
@@ -63,6 +262,22 @@ func integrateMid(fn smoothFn, x1, x2 float64, ninterval int) float64 {
 	return tot
 }
 
+// integrateMidBatch is identical to integrateMid except that fn is
+// evaluated at all ninterval midpoints in a single call.
+func integrateMidBatch(fn func(xs []float64) []float64, x1, x2 float64, ninterval int) float64 {
+	dx := (x2 - x1) / float64(ninterval)
+	xs := make([]float64, ninterval)
+	for i := range xs {
+		xs[i] = x1 + (float64(i)+0.5)*dx
+	}
+
+	tot := 0.0
+	for _, y := range fn(xs) {
+		tot += y * dx
+	}
+	return tot
+}
+
 func sampleUniformProb(fn smoothFn, x1, x2 float64, nsample, ninterval int) (xs []float64) {
 	totA := integrateMid(fn, x1, x2, ninterval*nsample)
 	sampleA := totA / float64(nsample)
@@ -85,13 +300,16 @@ func zip(disrups []Disruption, objs []float64) []sample {
 		panic("cannot zip slices of unequal length")
 	}
 
-	samples := make([]sample, len(disrups))
+	samples := make([]sample, 0, len(disrups))
 	for i := range disrups {
 		samples = append(samples, sample{float64(disrups[i].Time), objs[i]})
 	}
 	return samples
 }
 
+// extractProbs returns the disruption probability vs time samples for
+// disrups.  Interpolations of these should use ExtrapZero since probability
+// vanishes outside of the defined disruption points.
 func extractProbs(disrups []Disruption) []sample {
 	samples := []sample{}
 	for _, d := range disrups {
@@ -15,12 +15,14 @@ func TestAggregateObj(t *testing.T) {
 	}{
 		// This test is a uniform probability of 0.1 across the simulation
 		// duration with the corresponding 0.6 probability of no disruption.
-		// All points are sample points.
+		// All points except the one defining the distribution start at t=0
+		// are sample points.
 		{
 			Obj:     4.7,
 			SimDur:  8,
 			Subobjs: []float64{1, 2, 7, 9},
 			Disrups: []Disruption{
+				{Time: 0, BuildProto: "foo", Sample: false, Prob: 0.1},
 				{Time: 2, BuildProto: "foo", Sample: true, Prob: 0.1},
 				{Time: 4, BuildProto: "foo", Sample: true, Prob: 0.1},
 				{Time: 6, BuildProto: "foo", Sample: true, Prob: 0.1},
@@ -33,6 +35,7 @@ func TestAggregateObj(t *testing.T) {
 			SimDur:  8,
 			Subobjs: []float64{1, 2, 7, 9},
 			Disrups: []Disruption{
+				{Time: 0, BuildProto: "foo", Sample: false, Prob: 0.1},
 				{Time: 2, BuildProto: "foo", Sample: true, Prob: 0.1},
 				{Time: 3, BuildProto: "foo", Sample: false, Prob: 0.1},
 				{Time: 4, BuildProto: "foo", Sample: true, Prob: 0.1},
@@ -48,6 +51,7 @@ func TestAggregateObj(t *testing.T) {
 			SimDur:  8,
 			Subobjs: []float64{1, 2, 7, 9},
 			Disrups: []Disruption{
+				{Time: 0, BuildProto: "foo", Sample: false, Prob: 0.1},
 				{Time: 2, BuildProto: "foo", Sample: true, Prob: 0.1},
 				{Time: 4, BuildProto: "foo", Sample: true, Prob: 0.1},
 				{Time: 5, BuildProto: "foo", Sample: false, Prob: 0.0},
@@ -154,3 +158,189 @@ func TestInterpolate(t *testing.T) {
 		}
 	}
 }
+
+// check each extrapolation mode outside of the sample range while values
+// inside the range are unaffected.
+func TestInterpolateWithExtrap(t *testing.T) {
+	samples := []sample{
+		{3, 2},
+		{1, 1},
+		{2, 1},
+	}
+
+	tests := []struct {
+		Mode  ExtrapMode
+		X     float64
+		WantY float64
+	}{
+		{ExtrapLinear, 0, 1},
+		{ExtrapLinear, 1.5, 1},
+		{ExtrapLinear, 4, 3},
+		{ExtrapConstant, 0, 1},
+		{ExtrapConstant, 2.5, 1.5},
+		{ExtrapConstant, 4, 2},
+		{ExtrapZero, 0, 0},
+		{ExtrapZero, 1, 1},
+		{ExtrapZero, 3, 2},
+		{ExtrapZero, 4, 0},
+	}
+
+	for i, test := range tests {
+		fn := interpolateWithExtrap(samples, test.Mode)
+		if gotY := fn(test.X); math.Abs(gotY-test.WantY) > 1e-10 {
+			t.Errorf("case %v (mode %v): fn[%v] = %v, want %v", i+1, test.Mode, test.X, gotY, test.WantY)
+		}
+	}
+
+	for _, mode := range []ExtrapMode{ExtrapLinear, ExtrapConstant, ExtrapZero} {
+		if y := interpolateWithExtrap(nil, mode)(1); y != 0 {
+			t.Errorf("mode %v with no samples: fn[1] = %v, want 0", mode, y)
+		}
+	}
+}
+
+// check that the cubic spline passes through all sample points and is
+// continuous in its first and second derivatives at the sample points.
+func TestInterpolateCubic(t *testing.T) {
+	samples := []sample{
+		{1, 1},
+		{2, 2},
+		{3, 3},
+		{4, 3},
+		{5, 4},
+		{6, 7},
+	}
+
+	fn := interpolateCubic(samples)
+
+	for i, s := range samples {
+		if got := fn(s.X); math.Abs(got-s.Y) > 1e-10 {
+			t.Errorf("case %v: fn[%v] = %v, want %v", i+1, s.X, got, s.Y)
+		}
+	}
+
+	const eps = 1e-3
+	const tol = 1e-2
+	for i, s := range samples[1 : len(samples)-1] {
+		x := s.X
+		leftd1 := (fn(x) - fn(x-eps)) / eps
+		rightd1 := (fn(x+eps) - fn(x)) / eps
+		if diff := math.Abs(leftd1 - rightd1); diff > tol {
+			t.Errorf("knot %v (x=%v): first derivative discontinuous: left=%v, right=%v", i+1, x, leftd1, rightd1)
+		}
+
+		leftd2 := (fn(x) - 2*fn(x-eps) + fn(x-2*eps)) / (eps * eps)
+		rightd2 := (fn(x+2*eps) - 2*fn(x+eps) + fn(x)) / (eps * eps)
+		if diff := math.Abs(leftd2 - rightd2); diff > tol {
+			t.Errorf("knot %v (x=%v): second derivative discontinuous: left=%v, right=%v", i+1, x, leftd2, rightd2)
+		}
+	}
+}
+
+// check that cubic interpolation approximates the aggregate objective for a
+// smooth (gaussian) disruption probability distribution better than linear
+// interpolation.
+func TestAggregateObjCubic(t *testing.T) {
+	const simdur = 100
+	mean, sigma := 50.0, 15.0
+	probfn := func(x float64) float64 {
+		return 0.5 / (sigma * math.Sqrt(2*math.Pi)) * math.Exp(-(x-mean)*(x-mean)/(2*sigma*sigma))
+	}
+	objfn := func(x float64) float64 { return 1 + math.Sin(x/simdur*math.Pi) }
+
+	disrups := []Disruption{}
+	subobjs := []float64{}
+	for tm := 0; tm <= simdur; tm += 10 {
+		disrups = append(disrups, Disruption{Time: tm, BuildProto: "foo", Sample: true, Prob: probfn(float64(tm))})
+		subobjs = append(subobjs, objfn(float64(tm)))
+	}
+
+	want := integrateMid(productOf(objfn, probfn), 0, simdur, 10000)
+	want += (1 - integrateMid(probfn, 0, simdur, 10000)) * objfn(simdur)
+
+	defer SetInterpolationMode(InterpLinear)
+
+	if err := SetInterpolationMode(InterpLinear); err != nil {
+		t.Fatal(err)
+	}
+	lin := aggregateObj(simdur, disrups, subobjs)
+
+	if err := SetInterpolationMode(InterpCubic); err != nil {
+		t.Fatal(err)
+	}
+	cubic := aggregateObj(simdur, disrups, subobjs)
+
+	linerr := math.Abs(lin - want)
+	cubicerr := math.Abs(cubic - want)
+	t.Logf("exact=%v, linear=%v (err %v), cubic=%v (err %v)", want, lin, linerr, cubic, cubicerr)
+	if cubicerr >= linerr {
+		t.Errorf("cubic interpolation error %v not smaller than linear error %v", cubicerr, linerr)
+	}
+
+	if err := SetInterpolationMode("bogus"); err == nil {
+		t.Errorf("expected error for invalid interpolation mode")
+	}
+}
+
+// check that batch interpolation and integration match their single-point
+// counterparts, including extrapolation beyond both ends.
+func TestInterpolateBatch(t *testing.T) {
+	samples := []sample{{3, 3}, {1, 1}, {2, 2}, {5, 4}, {4, 3}, {6, 7}}
+	fn := interpolate(samples)
+	batch := interpolateBatch(samples)
+
+	xs := []float64{-1, 0, 1, 1.5, 2, 3.3, 4, 4.9, 6, 7.5}
+	ys := batch(xs)
+	for i, x := range xs {
+		if want := fn(x); math.Abs(ys[i]-want) > 1e-12 {
+			t.Errorf("x=%v: got %v, want %v", x, ys[i], want)
+		}
+	}
+
+	want := integrateMid(fn, 0, 7, 1000)
+	got := integrateMidBatch(batch, 0, 7, 1000)
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("integral: got %v, want %v", got, want)
+	}
+}
+
+func TestZip(t *testing.T) {
+	disrups := []Disruption{{Time: 2}, {Time: 5}, {Time: 9}}
+	objs := []float64{1, 4, 3}
+
+	got := zip(disrups, objs)
+	want := []sample{{2, 1}, {5, 4}, {9, 3}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v samples %v, want %v", len(got), got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("sample %v: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func benchSamples(n int) []sample {
+	samples := make([]sample, n)
+	for i := range samples {
+		x := float64(i)
+		samples[i] = sample{x, math.Sin(x / 5)}
+	}
+	return samples
+}
+
+func BenchmarkIntegrateMid(b *testing.B) {
+	samples := benchSamples(50)
+	fn := interpolate(samples)
+	for i := 0; i < b.N; i++ {
+		integrateMid(fn, 0, 49, 100000)
+	}
+}
+
+func BenchmarkIntegrateMidBatch(b *testing.B) {
+	samples := benchSamples(50)
+	fn := interpolateBatch(samples)
+	for i := 0; i < b.N; i++ {
+		integrateMidBatch(fn, 0, 49, 100000)
+	}
+}
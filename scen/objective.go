@@ -2,7 +2,12 @@ package scen
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"math"
+	"sync"
+
+	"github.com/rwcarlsen/optim"
 )
 
 // ObjExecFunc is a function that, when called, runs a the single simulation
@@ -62,6 +67,28 @@ func doubleMode(s *Scenario, obj ObjExecFunc) (float64, error) {
 //   for the scenario but also inserting a disruption at the specified point
 //   using the Scenario.CustomConfig["disrup-single"]=Disruption{...} with
 //   corresponding disruption points, prototypes to disrupt, etc.
+//
+//   * stochastic-demand: Used to compute the mean objective over
+//   Scenario.CustomConfig["demand-samples"]=N simulations with MinPower and
+//   MaxPower perturbed by normally distributed noise with a standard
+//   deviation of Scenario.CustomConfig["demand-noise-pct"] percent (see
+//   PerturbedScenario).
+//
+//   * multi-region: Used to compute the weighted average objective over one
+//   sub-simulation per region.  Scenario.CustomConfig["regions"] holds a list
+//   of objects whose fields override the corresponding scenario fields (e.g.
+//   SimDur, MinPower, Facs) for each region and
+//   Scenario.CustomConfig["region-weights"] holds the corresponding region
+//   weights which must sum up to 1.0.
+//
+//   * monte-carlo: Used to compute the mean objective over
+//   Scenario.CustomConfig["monte-carlo-n"]=N simulations with scenario
+//   fields randomly sampled from the distributions in
+//   Scenario.CustomConfig["monte-carlo-params"] (see MonteCarloScenario).
+//   Each parameter maps a field name (or "TemplateVars.key") to an object
+//   like {"Dist": "normal", "Mean": 0.05, "Std": 0.01} or {"Dist":
+//   "uniform", "Min": 3, "Max": 5}.  The standard deviation of the sampled
+//   objectives is stored in Scenario.LastMCStddev.
 var Modes = map[string]ModeFunc{
 	"":                  singleMode,
 	"single":            singleMode,
@@ -69,9 +96,213 @@ var Modes = map[string]ModeFunc{
 	"disrup-multi-lin":  disrupModeLin,
 	"disrup-single":     disrupSingleMode,
 	"disrup-single-lin": disrupSingleModeLin,
+	"stochastic-demand": stochasticDemandMode,
+	"multi-region":      multiRegionMode,
+	"monte-carlo":       monteCarloMode,
 	"double":            doubleMode, // for testing
 }
 
+func stochasticDemandMode(s *Scenario, obj ObjExecFunc) (float64, error) {
+	nsamples, ok := s.CustomConfig["demand-samples"].(float64)
+	if !ok || nsamples < 1 {
+		return math.Inf(1), fmt.Errorf("stochastic-demand: 'demand-samples' must be a positive integer")
+	}
+	noisepct, ok := s.CustomConfig["demand-noise-pct"].(float64)
+	if !ok || noisepct < 0 {
+		return math.Inf(1), fmt.Errorf("stochastic-demand: 'demand-noise-pct' must be a non-negative number")
+	}
+
+	sample := func() (*Scenario, error) { return PerturbedScenario(s, noisepct/100), nil }
+	mean, _, err := sampleMean(int(nsamples), 0, sample, obj)
+	if err != nil {
+		return math.Inf(1), err
+	}
+	return mean, nil
+}
+
+// sampleMean computes the objective with obj for n scenarios generated by
+// sample and returns the mean and sample standard deviation of the objective
+// values.  All samples are generated up front so results are reproducible
+// regardless of sub-simulation completion order.  At most maxConcurrent
+// objective evaluations run at the same time - zero means no limit.
+func sampleMean(n, maxConcurrent int, sample func() (*Scenario, error), obj ObjExecFunc) (mean, stddev float64, err error) {
+	samples := make([]*Scenario, n)
+	for i := range samples {
+		samples[i], err = sample()
+		if err != nil {
+			return math.Inf(1), 0, err
+		}
+	}
+
+	objs, err := runSimsLimit(samples, maxConcurrent, obj)
+	if err != nil {
+		return math.Inf(1), 0, fmt.Errorf("remote sub-simulation execution failed: %v", err)
+	}
+
+	for _, val := range objs {
+		mean += val
+	}
+	mean /= float64(len(objs))
+
+	if len(objs) > 1 {
+		ss := 0.0
+		for _, val := range objs {
+			ss += (val - mean) * (val - mean)
+		}
+		stddev = math.Sqrt(ss / float64(len(objs)-1))
+	}
+	return mean, stddev, nil
+}
+
+// runSims computes the objective with obj for each of scns concurrently and
+// returns the values in the same order.  If any evaluations fail, the first
+// error encountered is returned.
+func runSims(scns []*Scenario, obj ObjExecFunc) ([]float64, error) {
+	return runSimsLimit(scns, 0, obj)
+}
+
+// runSimsLimit is the same as runSims, but at most maxConcurrent evaluations
+// run at the same time.  Zero means no limit.
+func runSimsLimit(scns []*Scenario, maxConcurrent int, obj ObjExecFunc) ([]float64, error) {
+	var sem chan struct{}
+	if maxConcurrent > 0 {
+		sem = make(chan struct{}, maxConcurrent)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(scns))
+	var mu sync.Mutex
+	var errinner error
+	objs := make([]float64, len(scns))
+	for i, scn := range scns {
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		go func(i int, scn *Scenario) {
+			defer wg.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			val, err := obj(scn)
+			if err != nil {
+				mu.Lock()
+				if errinner == nil {
+					errinner = err
+				}
+				mu.Unlock()
+				val = math.Inf(1)
+			}
+			objs[i] = val
+		}(i, scn)
+	}
+
+	wg.Wait()
+	return objs, errinner
+}
+
+func multiRegionMode(s *Scenario, obj ObjExecFunc) (float64, error) {
+	iregions, ok := s.CustomConfig["regions"].([]interface{})
+	if !ok || len(iregions) == 0 {
+		return math.Inf(1), fmt.Errorf("multi-region: 'regions' must be a non-empty list of scenario overrides")
+	}
+	iweights, ok := s.CustomConfig["region-weights"].([]interface{})
+	if !ok || len(iweights) != len(iregions) {
+		return math.Inf(1), fmt.Errorf("multi-region: 'region-weights' must have one weight per region")
+	}
+
+	weights := make([]float64, len(iweights))
+	totweight := 0.0
+	for i, iw := range iweights {
+		w, ok := iw.(float64)
+		if !ok || w < 0 {
+			return math.Inf(1), fmt.Errorf("multi-region: region weight %v is not a non-negative number", i)
+		}
+		weights[i] = w
+		totweight += w
+	}
+	if math.Abs(totweight-1) > 1e-6 {
+		return math.Inf(1), fmt.Errorf("multi-region: region weights sum to %v, not 1", totweight)
+	}
+
+	regions := make([]*Scenario, len(iregions))
+	for i, ireg := range iregions {
+		overrides, ok := ireg.(map[string]interface{})
+		if !ok {
+			return math.Inf(1), fmt.Errorf("multi-region: region %v is not an object", i)
+		}
+		scn, err := RegionScenario(s, overrides)
+		if err != nil {
+			return math.Inf(1), fmt.Errorf("multi-region: region %v: %v", i, err)
+		}
+		regions[i] = scn
+	}
+
+	objs, err := runSims(regions, obj)
+	if err != nil {
+		return math.Inf(1), fmt.Errorf("remote sub-simulation execution failed: %v", err)
+	}
+
+	tot := 0.0
+	for i, val := range objs {
+		tot += weights[i] * val
+	}
+	return tot, nil
+}
+
+// RegionScenario returns a clone of s with the scenario fields named in
+// overrides (e.g. "SimDur", "MinPower", "Facs") replaced by the
+// corresponding values.  Values are decoded the same way as fields in a
+// scenario file.  The clone is validated after the overrides are applied.
+func RegionScenario(s *Scenario, overrides map[string]interface{}) (*Scenario, error) {
+	data, err := json.Marshal(overrides)
+	if err != nil {
+		return nil, err
+	}
+	clone := s.Clone()
+	if err := json.Unmarshal(data, clone); err != nil {
+		return nil, err
+	} else if err := clone.Validate(); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// PerturbedScenario returns a clone of s with the MinPower and MaxPower
+// values for each build period multiplied by (1+noiseStd*z) where z is drawn
+// from the standard normal distribution using optim.Rand.  The same draw is
+// used for both the min and max power of a period to keep them ordered.
+// Perturbed power values are never made negative.
+func PerturbedScenario(s *Scenario, noiseStd float64) *Scenario {
+	clone := s.Clone()
+	for i := range clone.MaxPower {
+		mult := math.Max(0, 1+noiseStd*normRand())
+		clone.MaxPower[i] *= mult
+		if i < len(clone.MinPower) {
+			clone.MinPower[i] *= mult
+		}
+	}
+	return clone
+}
+
+// randMu serializes this package's use of optim.Rand which is not safe for
+// concurrent use.
+var randMu sync.Mutex
+
+// randFloat returns optim.Rand.Float64() and is safe for concurrent use.
+func randFloat() float64 {
+	randMu.Lock()
+	defer randMu.Unlock()
+	return optim.Rand.Float64()
+}
+
+// normRand returns a standard normally distributed random number generated
+// from optim.Rand using the Box-Muller transform.
+func normRand() float64 {
+	u1 := 1 - randFloat() // avoid log(0)
+	u2 := randFloat()
+	return math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2)
+}
+
 // ObjFunc computes objective function values for scen using already-generated
 // simulation data for the given simulation id available in db.
 type ObjFunc func(scen *Scenario, db *sql.DB, simid []byte) (float64, error)
@@ -86,6 +317,10 @@ var ObjFuncs = map[string]ObjFunc{
 	"slowvfast-penalty2": ObjSlowVsFastPowerPenaltySquared,
 	"slowvfast-fueled":   ObjSlowVsFastPowerFueled,
 	"ans2014":            ObjANS2014,
+	"cost-utilised":      ObjCostUtilised,
+	"peak-deficit":       ObjPeakDeficit,
+	"cost-plus-deficit":  ObjCostPlusDeficit,
+	"discounted-cost":    ObjDiscountedCost,
 }
 
 // ObjSlowVsFastPower returns:
@@ -238,3 +473,50 @@ func ObjSlowVsFastPowerFueled(scen *Scenario, db *sql.DB, simid []byte) (float64
 
 	return (slowpower + totcap) / (slowpower + fastpower), nil
 }
+
+// ObjPeakDeficit returns the sum over every time step from BuildOffset to
+// SimDur-TrailingDur of the amount by which deployed power capacity falls
+// short of the MinPower requirement for the step's build period.  It only
+// uses the scenario's build schedule - no simulation data is needed, so db
+// and simid are ignored.
+func ObjPeakDeficit(scen *Scenario, db *sql.DB, simid []byte) (float64, error) {
+	if len(scen.MinPower) == 0 {
+		return 0, nil
+	}
+
+	builds := map[string][]Build{}
+	for _, b := range scen.Builds {
+		builds[b.Proto] = append(builds[b.Proto], b)
+	}
+
+	deficit := 0.0
+	for t := scen.BuildOffsetSteps(); t <= scen.SimDur-scen.TrailingDurSteps(); t++ {
+		i := scen.periodOf(t)
+		if i < 0 {
+			i = 0
+		} else if i >= len(scen.MinPower) {
+			i = len(scen.MinPower) - 1
+		}
+		deficit += math.Max(0, scen.MinPower[i]-scen.PowerCap(builds, t))
+	}
+	return deficit, nil
+}
+
+// ObjCostPlusDeficit returns ObjANS2014 plus ObjPeakDeficit multiplied by
+// Scenario.CustomConfig["deficit-weight"] (default 1).
+func ObjCostPlusDeficit(scen *Scenario, db *sql.DB, simid []byte) (float64, error) {
+	weight := 1.0
+	if w, ok := scen.CustomConfig["deficit-weight"].(float64); ok {
+		weight = w
+	}
+
+	cost, err := ObjANS2014(scen, db, simid)
+	if err != nil {
+		return math.Inf(1), err
+	}
+	deficit, err := ObjPeakDeficit(scen, db, simid)
+	if err != nil {
+		return math.Inf(1), err
+	}
+	return cost + weight*deficit, nil
+}
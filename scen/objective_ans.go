@@ -29,6 +29,11 @@ type ANSFacility struct {
 	// WasteDiscount represents the fraction is discounted from the waste cost
 	// for this facility.
 	WasteDiscount float64
+	// CapitalUtilisation is the mean fraction of Life that built facilities
+	// of this prototype operated for before retiring (capped at 1).  It is
+	// computed by the cost-utilised objective and does not need to be
+	// specified by the user.
+	CapitalUtilisation float64
 }
 
 type ANSScenario struct {
@@ -67,93 +72,173 @@ func (s *ANSScenario) Load(fname string) error {
 }
 
 func ObjANS2014(scen *Scenario, db *sql.DB, simid []byte) (float64, error) {
+	return objANS(scen, db, simid, false)
+}
+
+// ObjCostUtilised is the same as ObjANS2014 except each facility's capital
+// cost is multiplied by min(1, actual lifetime / scheduled lifetime) - i.e.
+// capital for facilities retired early is only partially charged.
+func ObjCostUtilised(scen *Scenario, db *sql.DB, simid []byte) (float64, error) {
+	return objANS(scen, db, simid, true)
+}
+
+func objANS(scen *Scenario, db *sql.DB, simid []byte, utilised bool) (float64, error) {
 	s := &ANSScenario{}
 	err := s.Load(scen.File)
 	if err != nil {
 		return math.Inf(1), err
 	}
 
-	// add up overnight and operating costs converted to PV(t=0)
-	q1 := `
+	// add up overnight, operating, and waste costs converted to PV(t=0)
+	profile, err := s.costProfile(db, simid, utilised)
+	if err != nil {
+		return math.Inf(1), err
+	}
+	totcost := 0.0
+	for _, tc := range profile {
+		totcost += tc.CapitalCost + tc.OpCost + tc.WasteCost
+	}
+
+	return costPerEnergy(db, simid, s.SimDur, totcost)
+}
+
+// ObjDiscountedCost returns the total capital and operating cost of all
+// facilities converted to PV(t=0) using the scenario's Discount rate and
+// normalized by the total energy produced.  Costs are taken from the
+// CapitalCost and OpCost fields of the scenario's Facs.
+func ObjDiscountedCost(scen *Scenario, db *sql.DB, simid []byte) (float64, error) {
+	totcost, err := discountedCost(scen, db, simid)
+	if err != nil {
+		return math.Inf(1), err
+	}
+	return costPerEnergy(db, simid, scen.SimDur, totcost)
+}
+
+// discountedCost returns the PV(t=0) sum of capital and operating costs for
+// all of scen's facilities.
+func discountedCost(scen *Scenario, db *sql.DB, simid []byte) (float64, error) {
+	totcost := 0.0
+	for _, f := range scen.Facs {
+		fac := &ANSFacility{Proto: f.Proto, Cap: f.Cap, OpCost: f.OpCost, CapitalCost: f.CapitalCost, Life: f.Life}
+		capcost, err := capitalCost(db, simid, fac, scen.Discount, false)
+		if err != nil {
+			return 0, err
+		}
+		opcosts, err := opCosts(db, simid, fac, scen.Discount)
+		if err != nil {
+			return 0, err
+		}
+
+		totcost += capcost
+		for _, c := range opcosts {
+			totcost += c
+		}
+	}
+	return totcost, nil
+}
+
+// costPerEnergy normalizes totcost to the energy produced over the first
+// simdur time steps of the simulation.
+func costPerEnergy(db *sql.DB, simid []byte, simdur int, totcost float64) (float64, error) {
+	joules, err := query.EnergyProduced(db, simid, 0, simdur)
+	if err != nil {
+		return math.Inf(1), err
+	}
+	mwh := joules / nuc.MWh
+	mult := 1e6 // to get the objective around 0.1 same magnitude as constraint penalties
+	return totcost / (mwh + 1e-30) * mult, nil
+}
+
+// opCosts returns the operating costs converted to PV(t=0) for all
+// facilities of fac's prototype keyed by the time step they were incurred
+// at.
+func opCosts(db *sql.DB, simid []byte, fac *ANSFacility, discount float64) (map[int]float64, error) {
+	q := `
 		SELECT tl.Time FROM TimeList AS tl
 		INNER JOIN Agents As a ON a.EnterTime <= tl.Time AND (a.ExitTime >= tl.Time OR a.ExitTime IS NULL)
 		WHERE
 			a.SimId = tl.SimId AND a.SimId = ?
 			AND a.Prototype = ?;
 		`
-	q2 := `SELECT EnterTime FROM Agents WHERE SimId = ? AND Prototype = ?`
+	rows, err := db.Query(q, simid, fac.Proto)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	totcost := 0.0
-	for _, fac := range s.Facs {
-		// calc total operating cost
-		rows, err := db.Query(q1, simid, fac.Proto)
-		if err != nil {
-			return math.Inf(1), err
-		}
-		for rows.Next() {
-			var t int
-			if err := rows.Scan(&t); err != nil {
-				return math.Inf(1), err
-			}
-			totcost += PV(fac.OpCost, t, s.Discount)
-		}
-		if err := rows.Err(); err != nil {
-			return math.Inf(1), err
+	costs := map[int]float64{}
+	for rows.Next() {
+		var t int
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
 		}
+		costs[t] += PV(fac.OpCost, t, discount)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return costs, nil
+}
 
-		// calc overnight capital cost
-		rows, err = db.Query(q2, simid, fac.Proto)
-		if err != nil {
-			return math.Inf(1), err
-		}
-		for rows.Next() {
-			var t int
-			if err := rows.Scan(&t); err != nil {
-				return math.Inf(1), err
-			}
-			totcost += PV(fac.CapitalCost, t, s.Discount)
-		}
-		if err := rows.Err(); err != nil {
-			return math.Inf(1), err
-		}
+// capitalCost returns the total overnight capital cost converted to PV(t=0)
+// for all built facilities of fac's prototype.  If utilised is true, each
+// facility's cost is multiplied by min(1, actual lifetime / fac.Life).
+// Facilities still operating at the end of the simulation are considered
+// fully utilised.  fac.CapitalUtilisation is updated to the mean utilisation
+// fraction.
+func capitalCost(db *sql.DB, simid []byte, fac *ANSFacility, discount float64, utilised bool) (float64, error) {
+	costs, err := capitalCosts(db, simid, fac, discount, utilised)
+	if err != nil {
+		return 0, err
+	}
+	tot := 0.0
+	for _, c := range costs {
+		tot += c
+	}
+	return tot, nil
+}
 
-		// add in waste penalty
-		ags, err := query.AllAgents(db, simid, fac.Proto)
-		if err != nil {
-			return math.Inf(1), err
-		}
+// capitalCosts is the same as capitalCost except costs are returned keyed by
+// the time step they were incurred at.
+func capitalCosts(db *sql.DB, simid []byte, fac *ANSFacility, discount float64, utilised bool) (map[int]float64, error) {
+	q := `SELECT EnterTime,ExitTime FROM Agents WHERE SimId = ? AND Prototype = ?`
+	rows, err := db.Query(q, simid, fac.Proto)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		// InvAt uses all agents if no ids are passed - so we need to skip
-		// from here
-		if len(ags) == 0 {
-			continue
+	costs := map[int]float64{}
+	totfrac := 0.0
+	n := 0
+	for rows.Next() {
+		var enter int
+		var exit sql.NullInt64
+		if err := rows.Scan(&enter, &exit); err != nil {
+			return nil, err
 		}
 
-		ids := make([]int, len(ags))
-		for i, a := range ags {
-			ids[i] = a.Id
+		frac := 1.0
+		if exit.Valid && fac.Life > 0 {
+			frac = math.Min(1, float64(int(exit.Int64)-enter)/float64(fac.Life))
 		}
+		totfrac += frac
+		n++
 
-		for t := 0; t < s.SimDur; t++ {
-			mat, err := query.InvAt(db, simid, t, ids...)
-			if err != nil {
-				return math.Inf(1), err
-			}
-			for nuc, qty := range mat {
-				nucstr := fmt.Sprint(nuc)
-				totcost += PV(s.NuclideCost[nucstr]*float64(qty)*(1-fac.WasteDiscount), t, s.Discount)
-			}
+		if !utilised {
+			frac = 1
 		}
+		costs[enter] += frac * PV(fac.CapitalCost, enter, discount)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	// normalize to energy produced
-	joules, err := query.EnergyProduced(db, simid, 0, s.SimDur)
-	if err != nil {
-		return math.Inf(1), err
+	fac.CapitalUtilisation = 1
+	if n > 0 {
+		fac.CapitalUtilisation = totfrac / float64(n)
 	}
-	mwh := joules / nuc.MWh
-	mult := 1e6 // to get the objective around 0.1 same magnitude as constraint penalties
-	return totcost / (mwh + 1e-30) * mult, nil
+	return costs, nil
 }
 
 func PV(amt float64, nt int, rate float64) float64 {
@@ -0,0 +1,142 @@
+package scen
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/rwcarlsen/go-sqlite3"
+)
+
+func TestCapitalCostUtilised(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scen-capcost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "test.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	simid := []byte("simid")
+	_, err = db.Exec("CREATE TABLE Agents (SimId BLOB,Prototype TEXT,EnterTime INTEGER,ExitTime INTEGER);")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one reactor runs its full lifetime, one retires after a quarter of its
+	// lifetime, and one is still running at the end of the simulation.
+	agents := []struct {
+		Enter int
+		Exit  interface{}
+	}{
+		{0, 100},
+		{0, 25},
+		{10, nil},
+	}
+	for _, a := range agents {
+		_, err := db.Exec("INSERT INTO Agents VALUES (?,?,?,?);", simid, "reactor", a.Enter, a.Exit)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		Utilised bool
+		Want     float64
+	}{
+		{false, 3},
+		{true, 2.25},
+	}
+
+	for _, test := range tests {
+		fac := &ANSFacility{Proto: "reactor", CapitalCost: 1, Life: 100}
+		got, err := capitalCost(db, simid, fac, 0, test.Utilised)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(got-test.Want) > 1e-10 {
+			t.Errorf("utilised=%v: got capital cost %v, want %v", test.Utilised, got, test.Want)
+		}
+		if want := 2.25 / 3; math.Abs(fac.CapitalUtilisation-want) > 1e-10 {
+			t.Errorf("utilised=%v: got utilisation %v, want %v", test.Utilised, fac.CapitalUtilisation, want)
+		}
+	}
+}
+
+func TestDiscountedCost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scen-discost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "test.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	simid := []byte("simid")
+	stmts := []string{
+		"CREATE TABLE Agents (SimId BLOB,Prototype TEXT,EnterTime INTEGER,ExitTime INTEGER);",
+		"CREATE TABLE TimeList (SimId BLOB,Time INTEGER);",
+	}
+	for _, s := range stmts {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for tm := 0; tm < 4; tm++ {
+		if _, err := db.Exec("INSERT INTO TimeList VALUES (?,?);", simid, tm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a reactor operating for time steps 0-3 and a storage facility
+	// operating for time steps 2-3.
+	agents := []struct {
+		Proto string
+		Enter int
+		Exit  interface{}
+	}{
+		{"reactor", 0, nil},
+		{"storage", 2, 3},
+	}
+	for _, a := range agents {
+		_, err := db.Exec("INSERT INTO Agents VALUES (?,?,?,?);", simid, a.Proto, a.Enter, a.Exit)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scn := &Scenario{
+		SimDur:   4,
+		Discount: 0.12,
+		Facs: []Facility{
+			{Proto: "reactor", CapitalCost: 10, OpCost: 1},
+			{Proto: "storage", CapitalCost: 3, OpCost: 0.5},
+		},
+	}
+	got, err := discountedCost(scn, db, simid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := PV(10, 0, 0.12) + PV(3, 2, 0.12)
+	for tm := 0; tm < 4; tm++ {
+		want += PV(1, tm, 0.12)
+	}
+	for tm := 2; tm < 4; tm++ {
+		want += PV(0.5, tm, 0.12)
+	}
+	if math.Abs(got-want) > 1e-10 {
+		t.Errorf("got discounted cost %v, want %v", got, want)
+	}
+}
@@ -1,10 +1,10 @@
 package scen
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
-	"sync"
 )
 
 type Disruption struct {
@@ -42,6 +42,9 @@ type Disruption struct {
 	// disrup-multi-lin mode.  Linear interpolation is performed between the
 	// KnownBests of disruptoin points with Sample=true.
 	KnownBest float64
+	// RecoveryBuilds are replacement builds scheduled when the disruption
+	// occurs.  Each build's Time is an offset from the disruption Time.
+	RecoveryBuilds []Build
 }
 
 type disrupOpt int
@@ -55,7 +58,7 @@ const (
 func disrupSingleModeLin(s *Scenario, obj ObjExecFunc) (float64, error) {
 	idisrup := s.CustomConfig["disrup-single"].(map[string]interface{})
 	disrup := Disruption{}
-	disrup, err := parseDisrup(idisrup, optKnownBest)
+	disrup, err := parseDisrup(s, idisrup, optKnownBest)
 	if err != nil {
 		return math.Inf(1), fmt.Errorf("disrup-single-lin: %v", err)
 	}
@@ -77,7 +80,7 @@ func disrupSingleModeLin(s *Scenario, obj ObjExecFunc) (float64, error) {
 
 func disrupSingleMode(s *Scenario, obj ObjExecFunc) (float64, error) {
 	idisrup := s.CustomConfig["disrup-single"].(map[string]interface{})
-	disrup, err := parseDisrup(idisrup, optNone)
+	disrup, err := parseDisrup(s, idisrup, optNone)
 	if err != nil {
 		return math.Inf(1), fmt.Errorf("disrup-single: %v", err)
 	}
@@ -101,11 +104,28 @@ func modForDisrup(s *Scenario, d Disruption) (clone *Scenario) {
 		for i, b := range clone.Builds {
 			clone.Builds[i] = modBuildForDisrup(clone, d, b)
 		}
+		clone.Builds = append(clone.Builds, recoveryBuilds(clone, d)...)
 	}
 
 	return clone
 }
 
+// recoveryBuilds returns disrup's recovery builds with their times shifted
+// to be relative to the start of the simulation.
+func recoveryBuilds(s *Scenario, disrup Disruption) []Build {
+	builds := make([]Build, 0, len(disrup.RecoveryBuilds))
+	for _, b := range disrup.RecoveryBuilds {
+		fac, err := s.Prototype(b.Proto)
+		if err != nil {
+			panic("prototype " + b.Proto + " not found")
+		}
+		b.Time += disrup.Time
+		b.fac = fac
+		builds = append(builds, b)
+	}
+	return builds
+}
+
 func buildsForDisrup(s *Scenario, disrup Disruption) []Build {
 	if disrup.Time < 0 || disrup.BuildProto == "" {
 		return []Build{}
@@ -149,7 +169,7 @@ func disrupModeLin(s *Scenario, obj ObjExecFunc) (float64, error) {
 	disrups := make([]Disruption, len(idisrup))
 	for i, td := range idisrup {
 		m := td.(map[string]interface{})
-		d, err := parseDisrup(m, optProb|optKnownBest)
+		d, err := parseDisrup(s, m, optProb|optKnownBest)
 		if err != nil {
 			return math.Inf(1), fmt.Errorf("disrup-multi-lin: %v", err)
 		}
@@ -181,7 +201,7 @@ func disrupMode(s *Scenario, obj ObjExecFunc) (float64, error) {
 	disrups := make([]Disruption, len(idisrup))
 	for i, td := range idisrup {
 		m := td.(map[string]interface{})
-		d, err := parseDisrup(m, optProb)
+		d, err := parseDisrup(s, m, optProb)
 		if err != nil {
 			return math.Inf(1), fmt.Errorf("disrup-multi: %v", err)
 		}
@@ -211,8 +231,9 @@ func aggregateObj(simdur int, disrups []Disruption, subobjs []float64) float64 {
 		}
 	}
 
-	objVsTime := interpolate(zip(sampled, subobjs))
-	probVsTime := interpolate(extractProbs(disrups))
+	interp := interpolator()
+	objVsTime := interp(zip(sampled, subobjs))
+	probVsTime := interpolateWithExtrap(extractProbs(disrups), ExtrapZero)
 
 	t0 := 0.0
 	tend := float64(simdur)
@@ -225,11 +246,11 @@ func aggregateObj(simdur int, disrups []Disruption, subobjs []float64) float64 {
 	return objval
 }
 
-func parseDisrup(disrup map[string]interface{}, opts disrupOpt) (Disruption, error) {
+func parseDisrup(s *Scenario, disrup map[string]interface{}, opts disrupOpt) (Disruption, error) {
 	d := Disruption{}
 
-	if s, ok := disrup["Sample"]; ok {
-		d.Sample = s.(float64) != 0
+	if v, ok := disrup["Sample"]; ok {
+		d.Sample = v.(float64) != 0
 	}
 
 	if t, ok := disrup["Time"]; ok {
@@ -261,6 +282,23 @@ func parseDisrup(disrup map[string]interface{}, opts disrupOpt) (Disruption, err
 	} else if opts&optKnownBest > 0 && d.Sample {
 		return Disruption{}, errors.New("disruption config missing 'KnownBest' param")
 	}
+
+	if v, ok := disrup["RecoveryBuilds"]; ok {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return Disruption{}, err
+		}
+		if err := json.Unmarshal(data, &d.RecoveryBuilds); err != nil {
+			return Disruption{}, fmt.Errorf("invalid 'RecoveryBuilds' param: %v", err)
+		}
+		for _, b := range d.RecoveryBuilds {
+			if b.Time < 0 || b.N < 1 {
+				return Disruption{}, fmt.Errorf("recovery build of %v needs a non-negative Time offset and positive N", b.Proto)
+			} else if _, err := s.Prototype(b.Proto); err != nil {
+				return Disruption{}, fmt.Errorf("invalid recovery build: %v", err)
+			}
+		}
+	}
 	return d, nil
 }
 
@@ -275,29 +313,15 @@ func runDisrupSims(s *Scenario, obj ObjExecFunc, disrups []Disruption) (objs []f
 		}
 	}
 
-	// fire off concurrent sub-simulation objective evaluations
-	var wg sync.WaitGroup
-	wg.Add(len(sampled))
-	objs = make([]float64, len(sampled))
-	var errinner error
+	// set separations plant to die disruption time.
+	scns := make([]*Scenario, len(sampled))
 	for i, d := range sampled {
-		// set separations plant to die disruption time.
-		clone := modForDisrup(s, d)
-
-		go func(i int, scn *Scenario) {
-			defer wg.Done()
-			val, err := obj(scn)
-			if err != nil {
-				errinner = err
-				val = math.Inf(1)
-			}
-			objs[i] = val
-		}(i, clone)
+		scns[i] = modForDisrup(s, d)
 	}
 
-	wg.Wait()
-	if errinner != nil {
-		return nil, fmt.Errorf("remote sub-simulation execution failed: %v", errinner)
+	objs, err = runSims(scns, obj)
+	if err != nil {
+		return nil, fmt.Errorf("remote sub-simulation execution failed: %v", err)
 	}
 	return objs, nil
 }
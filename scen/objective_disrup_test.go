@@ -0,0 +1,61 @@
+package scen
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDisrupRecoveryBuilds(t *testing.T) {
+	s := &Scenario{
+		SimDur:      100,
+		BuildPeriod: 10,
+		Facs: []Facility{
+			{Proto: "reactor", Cap: 1, Life: 50},
+			{Proto: "newreactor", Cap: 2, Life: 40},
+		},
+		Builds: []Build{{Time: 10, Proto: "reactor", N: 2}},
+	}
+
+	// config is parsed the same way as CustomConfig from a scenario file
+	var config map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"Time": 30,
+		"KillProto": "reactor",
+		"RecoveryBuilds": [{"Time": 5, "Proto": "newreactor", "N": 2}]
+	}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := parseDisrup(s, config, optNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone := modForDisrup(s, d)
+	got := make([]Build, len(clone.Builds))
+	for i, b := range clone.Builds {
+		b.fac = Facility{}
+		got[i] = b
+	}
+	want := []Build{
+		{Time: 10, Proto: "reactor", N: 2, Life: 20},
+		{Time: 35, Proto: "newreactor", N: 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("disrupted builds:\n got %+v\nwant %+v", got, want)
+	}
+	if lt := clone.Builds[1].Lifetime(); lt != 40 {
+		t.Errorf("recovery build lifetime: got %v, want 40", lt)
+	}
+
+	config["RecoveryBuilds"] = []interface{}{map[string]interface{}{"Time": -1.0, "Proto": "newreactor", "N": 1.0}}
+	if _, err := parseDisrup(s, config, optNone); err == nil {
+		t.Errorf("recovery build with negative time offset was accepted")
+	}
+
+	config["RecoveryBuilds"] = []interface{}{map[string]interface{}{"Time": 1.0, "Proto": "nosuchreactor", "N": 1.0}}
+	if _, err := parseDisrup(s, config, optNone); err == nil {
+		t.Errorf("recovery build of unknown prototype was accepted")
+	}
+}
@@ -0,0 +1,106 @@
+package scen
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// MCParam is the sampling distribution of a single monte-carlo mode
+// parameter.
+type MCParam struct {
+	// Dist is the distribution type: "normal" (using Mean and Std) or
+	// "uniform" (between Min and Max).
+	Dist      string
+	Mean, Std float64
+	Min, Max  float64
+}
+
+func (p MCParam) sample() float64 {
+	if p.Dist == "uniform" {
+		return p.Min + (p.Max-p.Min)*randFloat()
+	}
+	return p.Mean + p.Std*normRand()
+}
+
+func parseMCParams(iparams map[string]interface{}) (map[string]MCParam, error) {
+	params := map[string]MCParam{}
+	for name, ip := range iparams {
+		m, ok := ip.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("param '%v' is not an object", name)
+		}
+		p := MCParam{}
+		p.Dist, _ = m["Dist"].(string)
+		p.Mean, _ = m["Mean"].(float64)
+		p.Std, _ = m["Std"].(float64)
+		p.Min, _ = m["Min"].(float64)
+		p.Max, _ = m["Max"].(float64)
+		if p.Dist != "normal" && p.Dist != "uniform" {
+			return nil, fmt.Errorf("param '%v' has invalid Dist '%v' (want normal or uniform)", name, p.Dist)
+		} else if p.Std < 0 || p.Max < p.Min {
+			return nil, fmt.Errorf("param '%v' has an invalid distribution range", name)
+		}
+		params[name] = p
+	}
+	return params, nil
+}
+
+// MonteCarloScenario returns a clone of s with the scenario fields named in
+// params set to values drawn from their distributions using optim.Rand.
+// Names of the form "TemplateVars.key" set individual template variables.
+// Parameters are sampled in name order so results are reproducible for a
+// given random seed.
+func MonteCarloScenario(s *Scenario, params map[string]MCParam) (*Scenario, error) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	overrides := map[string]interface{}{}
+	tmplvars := map[string]interface{}{}
+	for k, v := range s.TemplateVars {
+		tmplvars[k] = v
+	}
+	for _, name := range names {
+		val := params[name].sample()
+		if strings.HasPrefix(name, "TemplateVars.") {
+			tmplvars[strings.TrimPrefix(name, "TemplateVars.")] = val
+			overrides["TemplateVars"] = tmplvars
+		} else {
+			overrides[name] = val
+		}
+	}
+	return RegionScenario(s, overrides)
+}
+
+func monteCarloMode(s *Scenario, obj ObjExecFunc) (float64, error) {
+	n, ok := s.CustomConfig["monte-carlo-n"].(float64)
+	if !ok || n < 1 {
+		return math.Inf(1), fmt.Errorf("monte-carlo: 'monte-carlo-n' must be a positive integer")
+	}
+	iparams, ok := s.CustomConfig["monte-carlo-params"].(map[string]interface{})
+	if !ok {
+		return math.Inf(1), fmt.Errorf("monte-carlo: 'monte-carlo-params' must be an object of parameter distributions")
+	}
+	params, err := parseMCParams(iparams)
+	if err != nil {
+		return math.Inf(1), fmt.Errorf("monte-carlo: %v", err)
+	}
+
+	sample := func() (*Scenario, error) {
+		scn, err := MonteCarloScenario(s, params)
+		if err != nil {
+			return nil, fmt.Errorf("monte-carlo: %v", err)
+		}
+		return scn, nil
+	}
+	mean, stddev, err := sampleMean(int(n), 0, sample, obj)
+	if err != nil {
+		return math.Inf(1), err
+	}
+	s.LastMCStddev = stddev
+	return mean, nil
+}
@@ -0,0 +1,218 @@
+package scen
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestRunSims(t *testing.T) {
+	scns := make([]*Scenario, 20)
+	for i := range scns {
+		scns[i] = &Scenario{SimDur: i}
+	}
+
+	objs, err := runSims(scns, func(s *Scenario) (float64, error) { return float64(s.SimDur), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, val := range objs {
+		if val != float64(i) {
+			t.Errorf("objective %v: got %v, want %v", i, val, i)
+		}
+	}
+
+	failed := errors.New("failed")
+	_, err = runSims(scns, func(s *Scenario) (float64, error) {
+		if s.SimDur%2 == 0 {
+			return 0, failed
+		}
+		return 1, nil
+	})
+	if err != failed {
+		t.Errorf("got error %v, want %v", err, failed)
+	}
+}
+
+func TestStochasticDemandZeroNoise(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1, Life: 0},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{10, 10, 10, 10, 70},
+		CustomConfig: map[string]interface{}{
+			"demand-samples":   4.0,
+			"demand-noise-pct": 0.0,
+		},
+	}
+
+	// objective depends on the demand curve so perturbations would show up
+	obj := func(scn *Scenario) (float64, error) {
+		tot := 0.0
+		for i := range scn.MaxPower {
+			tot += scn.MaxPower[i] + 2*scn.MinPower[i]
+		}
+		return tot, nil
+	}
+
+	want, err := singleMode(s, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.ObjMode = "stochastic-demand"
+	got, err := s.CalcTotalObjective(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestObjPeakDeficit(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 1,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 100, Life: 0},
+		},
+		MaxPower: []float64{500, 500, 500, 500, 500, 500, 500, 500, 500},
+		MinPower: []float64{200, 200, 200, 200, 300, 200, 200, 200, 200},
+		Builds: []Build{
+			{Time: 0, Proto: "Proto1", N: 2},
+		},
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ObjPeakDeficit(s, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 100 {
+		t.Errorf("got deficit %v, want 100", got)
+	}
+
+	s.Builds = append(s.Builds, Build{Time: 5, Proto: "Proto1", N: 1})
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ObjPeakDeficit(s, nil, nil); got != 0 {
+		t.Errorf("got deficit %v for schedule meeting MinPower, want 0", got)
+	}
+}
+
+func TestMultiRegionMode(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		ObjMode:     "multi-region",
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1, Life: 0},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{10, 10, 10, 10, 70},
+		CustomConfig: map[string]interface{}{
+			"regions": []interface{}{
+				map[string]interface{}{"Handle": "east"},
+				map[string]interface{}{
+					"Handle":      "west",
+					"SimDur":      20.0,
+					"BuildPeriod": 4.0,
+					"Facs":        []interface{}{map[string]interface{}{"Proto": "Proto1", "Cap": 10.0}},
+				},
+			},
+			"region-weights": []interface{}{0.25, 0.75},
+		},
+	}
+
+	// region objectives are known constants
+	objs := map[string]float64{"east": 1, "west": 3}
+	obj := func(scn *Scenario) (float64, error) {
+		if scn.Handle == "west" && scn.SimDur != 20 {
+			t.Errorf("west region SimDur override not applied: got %v", scn.SimDur)
+		} else if scn.Handle == "east" && scn.SimDur != 10 {
+			t.Errorf("east region SimDur changed to %v", scn.SimDur)
+		}
+
+		want := 1.0
+		if scn.Handle == "west" {
+			want = 10
+		}
+		if fac, err := scn.Prototype("Proto1"); err != nil {
+			t.Error(err)
+		} else if fac.Cap != want {
+			t.Errorf("%v region: got Proto1 capacity %v, want %v", scn.Handle, fac.Cap, want)
+		}
+		return objs[scn.Handle], nil
+	}
+
+	got, err := s.CalcTotalObjective(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 0.25*1 + 0.75*3; got != want {
+		t.Errorf("got weighted objective %v, want %v", got, want)
+	}
+
+	s.CustomConfig["region-weights"] = []interface{}{0.5, 0.75}
+	if _, err := s.CalcTotalObjective(obj); err == nil {
+		t.Errorf("region weights not summing to 1 were accepted")
+	}
+}
+
+func TestMonteCarloMode(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		ObjMode:     "monte-carlo",
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1, Life: 0},
+		},
+		MaxPower:     []float64{10, 20, 40, 60, 70},
+		MinPower:     []float64{10, 10, 10, 10, 70},
+		TemplateVars: map[string]interface{}{"fixed": "a"},
+		CustomConfig: map[string]interface{}{
+			"monte-carlo-n": 50.0,
+			"monte-carlo-params": map[string]interface{}{
+				"Discount":            map[string]interface{}{"Dist": "uniform", "Min": 0.1, "Max": 0.2},
+				"TemplateVars.enrich": map[string]interface{}{"Dist": "normal", "Mean": 4.0, "Std": 0.0},
+			},
+		},
+	}
+
+	obj := func(scn *Scenario) (float64, error) {
+		if scn.Discount < 0.1 || scn.Discount > 0.2 {
+			t.Errorf("sampled Discount %v outside of [0.1, 0.2]", scn.Discount)
+		}
+		if scn.TemplateVars["enrich"] != 4.0 || scn.TemplateVars["fixed"] != "a" {
+			t.Errorf("bad sampled template vars %v", scn.TemplateVars)
+		}
+		return 100 * scn.Discount, nil
+	}
+
+	got, err := s.CalcTotalObjective(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// uniform on [10, 20] has mean 15 and stddev 10/sqrt(12)
+	if math.Abs(got-15) > 2 {
+		t.Errorf("got mean objective %v, want about 15", got)
+	}
+	if want := 10 / math.Sqrt(12); math.Abs(s.LastMCStddev-want) > 1 {
+		t.Errorf("got objective stddev %v, want about %v", s.LastMCStddev, want)
+	}
+
+	s.CustomConfig["monte-carlo-params"] = map[string]interface{}{
+		"Discount": map[string]interface{}{"Dist": "lognormal"},
+	}
+	if _, err := s.CalcTotalObjective(obj); err == nil {
+		t.Errorf("invalid distribution type was accepted")
+	}
+}
@@ -0,0 +1,85 @@
+package scen
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ParetoPoint holds the values of two competing objectives for a set of
+// scenario variables.
+type ParetoPoint struct {
+	Vars []float64
+	Obj1 float64
+	Obj2 float64
+}
+
+// dominates returns true if p is at least as good as q (i.e. lower) for both
+// objectives and strictly better for at least one.
+func (p *ParetoPoint) dominates(q *ParetoPoint) bool {
+	return p.Obj1 <= q.Obj1 && p.Obj2 <= q.Obj2 && (p.Obj1 < q.Obj1 || p.Obj2 < q.Obj2)
+}
+
+// ParetoFrontier evaluates the two objective functions named objfunc1 and
+// objfunc2 (keys in ObjFuncs) for each of the variable sets in points and
+// returns the non-dominated (Pareto optimal) points sorted by Obj1.  Both
+// objectives are minimized.  Objectives are computed by calling obj (e.g. a
+// wrapper around runscen.Local) with a clone of s transformed using the
+// point's variables (see TransformVars) and its ObjFunc set to the
+// corresponding objective function name.  All evaluations run concurrently.
+func (s *Scenario) ParetoFrontier(points [][]float64, objfunc1, objfunc2 string, obj func(s *Scenario) (float64, error)) ([]*ParetoPoint, error) {
+	for _, name := range []string{objfunc1, objfunc2} {
+		if _, ok := ObjFuncs[name]; !ok {
+			return nil, fmt.Errorf("invalid objective function name '%v'", name)
+		}
+	}
+
+	// one evaluation per objective per point
+	scns := make([]*Scenario, 0, 2*len(points))
+	for _, vars := range points {
+		for _, name := range []string{objfunc1, objfunc2} {
+			clone := s.Clone()
+			clone.ObjFunc = name
+			if _, err := clone.TransformVars(vars); err != nil {
+				return nil, err
+			}
+			scns = append(scns, clone)
+		}
+	}
+
+	objs, err := runSims(scns, obj)
+	if err != nil {
+		return nil, fmt.Errorf("objective evaluation failed: %v", err)
+	}
+
+	all := make([]*ParetoPoint, len(points))
+	for i, vars := range points {
+		all[i] = &ParetoPoint{Vars: vars, Obj1: objs[2*i], Obj2: objs[2*i+1]}
+	}
+	return nondominated(all), nil
+}
+
+// nondominated returns the points not dominated by any other point sorted
+// by Obj1 (and then Obj2).
+func nondominated(points []*ParetoPoint) []*ParetoPoint {
+	front := []*ParetoPoint{}
+	for _, p := range points {
+		dominated := false
+		for _, q := range points {
+			if q.dominates(p) {
+				dominated = true
+				break
+			}
+		}
+		if !dominated {
+			front = append(front, p)
+		}
+	}
+
+	sort.SliceStable(front, func(i, j int) bool {
+		if front[i].Obj1 != front[j].Obj1 {
+			return front[i].Obj1 < front[j].Obj1
+		}
+		return front[i].Obj2 < front[j].Obj2
+	})
+	return front
+}
@@ -0,0 +1,78 @@
+package scen
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNondominated(t *testing.T) {
+	points := []*ParetoPoint{
+		{Obj1: 3, Obj2: 1},
+		{Obj1: 1, Obj2: 3},
+		{Obj1: 2, Obj2: 2},
+		{Obj1: 3, Obj2: 3}, // dominated by all of the above
+		{Obj1: 2, Obj2: 4}, // dominated by {1, 3} and {2, 2}
+	}
+
+	got := []float64{}
+	for _, p := range nondominated(points) {
+		got = append(got, p.Obj1, p.Obj2)
+	}
+	want := []float64{1, 3, 2, 2, 3, 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got front %v, want %v", got, want)
+	}
+}
+
+func TestParetoFrontier(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1, Life: 0},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{10, 10, 10, 10, 70},
+	}
+
+	// objective 1 rewards building early and objective 2 rewards building
+	// late so that every schedule with a different total trades them off.
+	obj := func(scn *Scenario) (float64, error) {
+		early, late := 0.0, 0.0
+		for _, b := range scn.Builds {
+			early += float64(b.N * b.Time)
+			late += float64(b.N * (scn.SimDur - b.Time))
+		}
+		if scn.ObjFunc == "peak-deficit" {
+			return early, nil
+		}
+		return late, nil
+	}
+
+	points := [][]float64{
+		{0, 0, 0, 0, 0},
+		{1, 1, 1, 1, 1},
+		{.5, .5, .5, .5, .5},
+	}
+	front, err := s.ParetoFrontier(points, "peak-deficit", "ans2014", obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(front) == 0 || len(front) > len(points) {
+		t.Fatalf("got %v frontier points from %v points", len(front), len(points))
+	}
+	for i, p := range front {
+		for _, q := range front {
+			if q.dominates(p) {
+				t.Errorf("frontier point %+v is dominated by %+v", p, q)
+			}
+		}
+		if i > 0 && p.Obj1 < front[i-1].Obj1 {
+			t.Errorf("frontier is not sorted by Obj1")
+		}
+	}
+
+	if _, err := s.ParetoFrontier(points, "peak-deficit", "no-such-obj", obj); err == nil {
+		t.Error("invalid objective function name was accepted")
+	}
+}
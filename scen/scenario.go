@@ -1,14 +1,24 @@
 package scen
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"text/template"
 )
 
@@ -29,6 +39,12 @@ type Facility struct {
 	// FracOfProto names a prototype that build fractions of this prototype
 	// are a portion of.
 	FracOfProtos []string
+	// CapitalCost is the overnight cost for building one facility.  It is
+	// used by the discounted-cost objective.
+	CapitalCost float64
+	// OpCost is the per timestep operating cost for one facility.  It is
+	// used by the discounted-cost objective.
+	OpCost float64
 }
 
 // Alive returns whether or not a facility built at the specified time is
@@ -45,7 +61,20 @@ type Build struct {
 	Proto string
 	N     int
 	Life  int
-	fac   Facility
+	// Tags holds optional user annotations (e.g. the experiment the build
+	// came from) that builds can be filtered by.
+	Tags []string
+	fac  Facility
+}
+
+// HasTag returns true if tag is one of b's tags.
+func (b Build) HasTag(tag string) bool {
+	for _, t := range b.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
 }
 
 // Alive returns whether or not the facility is still operabing/active at t.
@@ -61,6 +90,28 @@ func (b Build) Lifetime() int {
 	}
 }
 
+// BuildConstraint limits the number of facilities of a prototype the
+// optimizer may deploy in each build period.  MinN only applies to periods in
+// which the prototype is available.  A MaxN of zero (or less) means there is
+// no upper limit - use Facility.BuildAfter to prevent a prototype from being
+// built at all.
+type BuildConstraint struct {
+	Proto string
+	MinN  int
+	MaxN  int
+}
+
+// Clamp returns n restricted to the range [MinN, MaxN].
+func (c BuildConstraint) Clamp(n int) int {
+	if n < c.MinN {
+		n = c.MinN
+	}
+	if c.MaxN > 0 && n > c.MaxN {
+		n = c.MaxN
+	}
+	return n
+}
+
 // Alive returns whether or not a facility with the given lifetime and built
 // at the specified time is still operating/active at t.
 func Alive(built, t, life int) bool {
@@ -74,9 +125,17 @@ type Scenario struct {
 	// deployments actually begin.  This allows facilities and other initial
 	// conditions to be set up and run before the deploying begins.
 	BuildOffset int
+	// BuildOffsetFrac is an alternative to BuildOffset specifying the offset
+	// as a fraction (0.0-1.0) of SimDur.  At most one of BuildOffset and
+	// BuildOffsetFrac may be nonzero.
+	BuildOffsetFrac float64
 	// TrailingDur is the number of timesteps of the simulation duration that
 	// are reserved for wind-down - no new deployments will be made.
 	TrailingDur int
+	// TrailingDurFrac is an alternative to TrailingDur specifying the
+	// wind-down duration as a fraction (0.0-1.0) of SimDur.  At most one of
+	// TrailingDur and TrailingDurFrac may be nonzero.
+	TrailingDurFrac float64
 	// CyclusTmpl is the relative path to the text templated cyclus input file
 	// rooted from the directory of the scenario file.
 	CyclusTmpl string
@@ -107,6 +166,11 @@ type Scenario struct {
 	// SpliceTime is the time before which SpliceVars (if defined) are used
 	// instead of the actual passed variables for TransformVars.
 	SpliceTime int
+	// WarmStartVars holds an optional complete set of variable values (e.g.
+	// the best point from a previous optimization run) used to initialize
+	// optimizers.  To build a scenario from them, pass them to TransformVars
+	// explicitly.
+	WarmStartVars []float64
 	// SingleCalc is for internal usage (not users) and is marked true for
 	// multi-sim scenarios where the current simulation being run is a
 	// sub-[scenario/simulation] and CalcObjective should be called instead of
@@ -131,6 +195,10 @@ type Scenario struct {
 	// MaxPower is a series of max deployed power capacity requirements that
 	// must be maintained for each build period.
 	MaxPower []float64
+	// BuildConstraints holds optional per-prototype limits on the number of
+	// facilities deployed in each build period.  TransformVars clamps the
+	// number of facilities it builds to these limits.
+	BuildConstraints []BuildConstraint
 	// StartBuilds holds the set of build schedule values for all agents
 	// initially in the scenario (not added/deployed by optimizer).
 	StartBuilds []Build
@@ -144,18 +212,83 @@ type Scenario struct {
 	// input file in i.e. the '<simhandle>' tag in the simulation control
 	// param section.
 	Handle string
+	// TemplateVars holds extra user-defined parameters (e.g. enrichment
+	// levels) for the templated cyclus input file.  They are accessible in
+	// the template as e.g. '{{.TemplateVars.enrichment_level}}'.  Templates
+	// referencing keys missing from TemplateVars fail validation.
+	TemplateVars map[string]interface{}
+	// TemplateFuncs holds extra functions for the templated cyclus input
+	// file in addition to the default helpers (see TemplateFuncExamples).
+	// Functions referenced by the template must be set before it is parsed
+	// (i.e. before Load or Validate).  They override default helpers with
+	// the same name.
+	TemplateFuncs template.FuncMap `json:"-"`
+	// SkipFeasibilityCheck disables the Validate check that every MinPower
+	// constraint can be met by the available facilities.
+	SkipFeasibilityCheck bool
+	// BootstrapMaxConcurrent is the maximum number of simulations Bootstrap
+	// runs at the same time.  Zero means runtime.NumCPU().
+	BootstrapMaxConcurrent int
+	// LastMCStddev holds the standard deviation of the sub-simulation
+	// objectives from the most recent monte-carlo mode objective calculation.
+	LastMCStddev float64
 	// tmpl is a cache for the templated cyclus input file
 	tmpl *template.Template
+	// facmap is a cache of Facs keyed by prototype name (see FacilityMap).
+	facmap map[string]Facility
 }
 
 func (s *Scenario) Clone() *Scenario {
 	data, _ := json.Marshal(s)
-	clone := &Scenario{}
+	clone := &Scenario{TemplateFuncs: s.TemplateFuncs}
 	json.Unmarshal(data, &clone)
 	clone.Validate()
 	return clone
 }
 
+// CloneAt creates a clone of s for re-optimizing deployments after
+// spliceTime (e.g. for rolling horizon optimization).  All of s's Builds
+// deployed at or before spliceTime become fixed StartBuilds of the clone and
+// deployments in the clone begin after spliceTime.  Builds still alive at
+// spliceTime have their lifetime resolved explicitly so they are retired at
+// the same time as in s.  The clone's power constraints are those of the
+// corresponding build periods in s, and its SpliceVars hold s's build
+// schedule for the remaining periods as computed by TransformSched.
+func (s *Scenario) CloneAt(spliceTime int) *Scenario {
+	clone := s.Clone()
+	delete(clone.CustomConfig, "build-tag-filter")
+
+	clone.StartBuilds = nil
+	for _, b := range clone.Builds {
+		if b.Time > spliceTime {
+			continue
+		} else if b.Alive(spliceTime) && b.Lifetime() > 0 {
+			b.Life = b.Lifetime()
+		}
+		clone.StartBuilds = append(clone.StartBuilds, b)
+	}
+
+	clone.BuildOffset = spliceTime
+	clone.BuildOffsetFrac = 0
+	clone.MinPower, clone.MaxPower = nil, nil
+	for _, t := range clone.periodTimes() {
+		i := s.periodOf(t)
+		if i >= len(s.MinPower) {
+			i = len(s.MinPower) - 1
+		}
+		if i < 0 {
+			i = 0
+		}
+		clone.MinPower = append(clone.MinPower, s.MinPower[i])
+		clone.MaxPower = append(clone.MaxPower, s.MaxPower[i])
+	}
+
+	clone.SpliceVars, _ = clone.TransformSched()
+	clone.SpliceTime = spliceTime
+	clone.WarmStartVars = nil
+	return clone
+}
+
 func (s *Scenario) reactors() []Facility {
 	rs := []Facility{}
 	for _, fac := range s.Facs {
@@ -177,14 +310,25 @@ func (s *Scenario) notreactors() []Facility {
 }
 
 func (s *Scenario) Prototype(proto string) (Facility, error) {
-	for _, fac := range s.Facs {
-		if fac.Proto == proto {
-			return fac, nil
-		}
+	if fac, ok := s.FacilityMap()[proto]; ok {
+		return fac, nil
 	}
 	return Facility{}, fmt.Errorf("no prototype named '%v'", proto)
 }
 
+// FacilityMap returns the scenario's facilities keyed by prototype name.  The
+// map is built on first use and cached - Validate must be called again
+// after modifying Facs to invalidate it.
+func (s *Scenario) FacilityMap() map[string]Facility {
+	if s.facmap == nil {
+		s.facmap = make(map[string]Facility, len(s.Facs))
+		for _, fac := range s.Facs {
+			s.facmap[fac.Proto] = fac
+		}
+	}
+	return s.facmap
+}
+
 func (s *Scenario) NVars() int { return s.NVarsPerPeriod() * s.nperiods() }
 
 func (s *Scenario) NVarsPerPeriod() int {
@@ -230,6 +374,250 @@ func (s *Scenario) PrintStats() {
 	}
 }
 
+// Summarise returns a one-line human-readable description of the scenario's
+// deployments: the number of facilities built, the simulation duration, the
+// total power capacity built and the three most built prototypes.  Builds
+// are taken from Builds if TransformVars has been called and from
+// StartBuilds otherwise.
+func (s *Scenario) Summarise() string {
+	builds := s.Builds
+	if builds == nil {
+		builds = s.StartBuilds
+	}
+
+	nfacs := 0
+	totpower := 0.0
+	counts := map[string]int{}
+	for _, b := range builds {
+		nfacs += b.N
+		counts[b.Proto] += b.N
+		if fac, err := s.Prototype(b.Proto); err == nil {
+			totpower += float64(b.N) * fac.Cap
+		}
+	}
+
+	protos := make([]string, 0, len(counts))
+	for proto := range counts {
+		protos = append(protos, proto)
+	}
+	sort.Slice(protos, func(i, j int) bool {
+		if counts[protos[i]] != counts[protos[j]] {
+			return counts[protos[i]] > counts[protos[j]]
+		}
+		return protos[i] < protos[j]
+	})
+	if len(protos) > 3 {
+		protos = protos[:3]
+	}
+	top := make([]string, len(protos))
+	for i, proto := range protos {
+		top[i] = fmt.Sprintf("%v=%v", proto, counts[proto])
+	}
+
+	summary := fmt.Sprintf("%v facilities, %v timesteps, %v power built, top: %v", nfacs, s.SimDur, totpower, strings.Join(top, " "))
+	if s.CyclusTmpl != "" {
+		name := filepath.Base(s.CyclusTmpl)
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+		summary = name + ": " + summary
+	}
+	return summary
+}
+
+// ShortHash returns a short stable identifier (the hex encoded first 4 bytes
+// of the sha256 hash of the JSON encoded scenario) useful for tracking
+// experiments.
+func (s *Scenario) ShortHash() string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:4])
+}
+
+// ExportVTK writes the scenario's deployment schedule to fname as an ASCII
+// VTK legacy format rectilinear grid for visualization (e.g. with ParaView).
+// Build periods are on the x-axis, prototypes (indexed in Facs order) are on
+// the y-axis, and the number of facilities built is the point data.
+func (s *Scenario) ExportVTK(fname string) error { return s.exportVTKFile(fname, false) }
+
+// ExportVTKCapacity is the same as ExportVTK except the point data is the
+// built capacity (Cap*N) instead of the number of facilities built.
+func (s *Scenario) ExportVTKCapacity(fname string) error { return s.exportVTKFile(fname, true) }
+
+func (s *Scenario) exportVTKFile(fname string, capacity bool) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := s.exportVTK(f, capacity); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (s *Scenario) exportVTK(w io.Writer, capacity bool) error {
+	err := s.Validate()
+	if err != nil {
+		return err
+	}
+
+	times := s.periodTimes()
+	protoindex := map[string]int{}
+	for i, fac := range s.Facs {
+		protoindex[fac.Proto] = i
+	}
+
+	// vals is indexed [proto][period]
+	vals := make([][]float64, len(s.Facs))
+	for i := range vals {
+		vals[i] = make([]float64, len(times))
+	}
+	for _, b := range s.Builds {
+		period := s.periodOf(b.Time)
+		if period < 0 || period >= len(times) || b.Time != times[period] {
+			continue
+		}
+		i := protoindex[b.Proto]
+		if capacity {
+			vals[i][period] += float64(b.N) * b.fac.Cap
+		} else {
+			vals[i][period] += float64(b.N)
+		}
+	}
+
+	name := "N"
+	if capacity {
+		name = "Capacity"
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# vtk DataFile Version 3.0\n")
+	fmt.Fprintf(bw, "deployment schedule %v\n", s.Handle)
+	fmt.Fprintf(bw, "ASCII\n")
+	fmt.Fprintf(bw, "DATASET RECTILINEAR_GRID\n")
+	fmt.Fprintf(bw, "DIMENSIONS %v %v 1\n", len(times), len(s.Facs))
+	fmt.Fprintf(bw, "X_COORDINATES %v float\n", len(times))
+	for _, t := range times {
+		fmt.Fprintf(bw, "%v\n", t)
+	}
+	fmt.Fprintf(bw, "Y_COORDINATES %v float\n", len(s.Facs))
+	for i := range s.Facs {
+		fmt.Fprintf(bw, "%v\n", i)
+	}
+	fmt.Fprintf(bw, "Z_COORDINATES 1 float\n0\n")
+	fmt.Fprintf(bw, "POINT_DATA %v\n", len(times)*len(s.Facs))
+	fmt.Fprintf(bw, "SCALARS %v float 1\n", name)
+	fmt.Fprintf(bw, "LOOKUP_TABLE default\n")
+	for i := range s.Facs {
+		for _, v := range vals[i] {
+			fmt.Fprintf(bw, "%v\n", v)
+		}
+	}
+	return bw.Flush()
+}
+
+// csvHeader holds the column names of the build rows written by ExportCSV.
+var csvHeader = []string{"Proto", "Time", "N", "Life", "CapBuilt"}
+
+// ExportCSV writes the scenario's deployment schedule as csv to fname.  The
+// first two rows hold the MinPower and MaxPower constraints for each build
+// period followed by a header row and one row per build with columns Proto,
+// Time, N, Life, and CapBuilt (i.e. N*Cap).
+func (s *Scenario) ExportCSV(fname string) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := s.exportCSV(f); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (s *Scenario) exportCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	powrow := func(name string, vals []float64) []string {
+		row := []string{name}
+		for _, v := range vals {
+			row = append(row, fmt.Sprint(v))
+		}
+		return row
+	}
+	cw.Write(powrow("MinPower", s.MinPower))
+	cw.Write(powrow("MaxPower", s.MaxPower))
+
+	cw.Write(csvHeader)
+	for _, b := range s.Builds {
+		fac, err := s.Prototype(b.Proto)
+		if err != nil {
+			return err
+		}
+		cw.Write([]string{
+			b.Proto,
+			strconv.Itoa(b.Time),
+			strconv.Itoa(b.N),
+			strconv.Itoa(b.Life),
+			fmt.Sprint(float64(b.N) * fac.Cap),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ImportCSV replaces the scenario's Builds with those in the csv file fname
+// previously written by ExportCSV.  The power constraint and CapBuilt
+// columns are ignored.
+func (s *Scenario) ImportCSV(fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.importCSV(f)
+}
+
+func (s *Scenario) importCSV(r io.Reader) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	records, err := cr.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	builds := []Build{}
+	for i, rec := range records {
+		if len(rec) == 0 {
+			continue
+		}
+		switch rec[0] {
+		case "MinPower", "MaxPower", csvHeader[0]:
+			continue
+		}
+		if len(rec) != len(csvHeader) {
+			return fmt.Errorf("csv row %v has %v columns, want %v", i+1, len(rec), len(csvHeader))
+		}
+
+		fac, err := s.Prototype(rec[0])
+		if err != nil {
+			return fmt.Errorf("csv row %v: %v", i+1, err)
+		}
+		b := Build{Proto: rec[0], fac: fac}
+		for j, dst := range []*int{&b.Time, &b.N, &b.Life} {
+			if *dst, err = strconv.Atoi(rec[j+1]); err != nil {
+				return fmt.Errorf("csv row %v: invalid %v '%v'", i+1, csvHeader[j+1], rec[j+1])
+			}
+		}
+		builds = append(builds, b)
+	}
+	s.Builds = builds
+	return nil
+}
+
 func (s *Scenario) TransformSched() ([]float64, error) {
 	err := s.Validate()
 	if err != nil {
@@ -322,6 +710,30 @@ func (s *Scenario) CapBuilt(builds []Build, t int) float64 {
 	return tot
 }
 
+// LoadWarmStart reads a JSON array of variable values from fname into
+// WarmStartVars.  Values outside the scenario's variable bounds are clamped
+// to the nearest bound.
+func (s *Scenario) LoadWarmStart(fname string) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+
+	vars := []float64{}
+	if err := json.Unmarshal(data, &vars); err != nil {
+		return fmt.Errorf("%v: %v", fname, err)
+	} else if len(vars) != s.NVars() {
+		return fmt.Errorf("%v: wrong number of warm start vars: want %v, got %v", fname, s.NVars(), len(vars))
+	}
+
+	low, up := s.LowerBounds(), s.UpperBounds()
+	for i, v := range vars {
+		vars[i] = math.Min(math.Max(v, low[i]), up[i])
+	}
+	s.WarmStartVars = vars
+	return nil
+}
+
 func (s *Scenario) splice(origvars []float64) []float64 {
 	vars := make([]float64, len(origvars))
 	copy(vars, origvars)
@@ -359,11 +771,16 @@ outer:
 // fraction like this (1-(react1frac + (1-react1frac) * react2frac)) *
 // react3frac).  The last reactor type fraction is simply the remainining
 // unsatisfied power capacity.
+//
+// If CustomConfig["build-tag-filter"] is set, only StartBuilds carrying that
+// tag are applied.
 func (s *Scenario) TransformVars(vars []float64) (map[string][]Build, error) {
 	err := s.Validate()
 	if err != nil {
 		return nil, err
-	} else if len(vars) != s.NVars() {
+	}
+
+	if len(vars) != s.NVars() {
 		return nil, fmt.Errorf("wrong number of vars: want %v, got %v", s.NVars(), len(vars))
 	}
 
@@ -380,8 +797,12 @@ func (s *Scenario) TransformVars(vars []float64) (map[string][]Build, error) {
 		}
 	}
 
+	tagfilter, _ := s.CustomConfig["build-tag-filter"].(string)
 	builds := map[string][]Build{}
 	for _, b := range s.StartBuilds {
+		if tagfilter != "" && !b.HasTag(tagfilter) {
+			continue
+		}
 		builds[b.Proto] = append(builds[b.Proto], b)
 	}
 
@@ -406,6 +827,7 @@ func (s *Scenario) TransformVars(vars []float64) (map[string][]Build, error) {
 			if fac.Cap > 0 && fac.Available(t) {
 				wantcap := val * capleft
 				nbuild := int(math.Max(0, math.Floor(wantcap/fac.Cap+0.5)))
+				nbuild = s.clampBuild(fac.Proto, nbuild)
 				capleft -= float64(nbuild) * fac.Cap
 
 				if nbuild > 0 {
@@ -427,6 +849,7 @@ func (s *Scenario) TransformVars(vars []float64) (map[string][]Build, error) {
 		if fac.Available(t) {
 			wantcap := capleft
 			nbuild := int(math.Max(0, math.Floor(wantcap/fac.Cap+0.5)))
+			nbuild = s.clampBuild(fac.Proto, nbuild)
 
 			if nbuild > 0 {
 				builds[fac.Proto] = append(builds[fac.Proto], Build{
@@ -449,7 +872,7 @@ func (s *Scenario) TransformVars(vars []float64) (map[string][]Build, error) {
 			haven := float64(s.naliveproto(builds, t, fac.Proto))
 			needn := facfrac * float64(s.naliveproto(builds, t, fac.FracOfProtos...))
 			wantn := math.Max(0, needn-haven)
-			nbuild := int(math.Floor(wantn + 0.5))
+			nbuild := s.clampBuild(fac.Proto, int(math.Floor(wantn+0.5)))
 			if nbuild > 0 {
 				builds[fac.Proto] = append(builds[fac.Proto], Build{
 					Time:  t,
@@ -469,9 +892,104 @@ func (s *Scenario) TransformVars(vars []float64) (map[string][]Build, error) {
 		}
 	}
 
+	for _, v := range s.CheckBuildConstraints() {
+		log.Printf("warning: build constraint violated: %v", v)
+	}
+
 	return builds, nil
 }
 
+// clampBuild restricts the number of facilities n of proto deployed in a
+// single build period to the scenario's BuildConstraints.
+func (s *Scenario) clampBuild(proto string, n int) int {
+	for _, c := range s.BuildConstraints {
+		if c.Proto == proto {
+			n = c.Clamp(n)
+		}
+	}
+	return n
+}
+
+// CheckBuildConstraints returns a human-readable description of every hard
+// constraint violated by the scenario's Builds.  Builds must reference known
+// prototypes, deploy a positive number of facilities, and (except for
+// StartBuilds) only deploy prototypes after their BuildAfter time.  The
+// deployed power capacity at each build period must also lie between the
+// period's MinPower and MaxPower, and the number of facilities deployed in
+// each build period must satisfy BuildConstraints.  This does not require
+// running a simulation.
+func (s *Scenario) CheckBuildConstraints() []string {
+	violations := []string{}
+
+	start := map[string]bool{}
+	for _, b := range s.StartBuilds {
+		start[fmt.Sprintf("%v-%v-%v", b.Proto, b.Time, b.N)] = true
+	}
+
+	builds := map[string][]Build{}
+	for _, b := range s.Builds {
+		builds[b.Proto] = append(builds[b.Proto], b)
+
+		fac, err := s.Prototype(b.Proto)
+		if err != nil {
+			violations = append(violations, fmt.Sprintf("%v built at t=%v: unknown prototype", b.Proto, b.Time))
+			continue
+		}
+		if b.N <= 0 {
+			violations = append(violations, fmt.Sprintf("%v built at t=%v: non-positive number of facilities %v", b.Proto, b.Time, b.N))
+		}
+		if !start[fmt.Sprintf("%v-%v-%v", b.Proto, b.Time, b.N)] && !fac.Available(b.Time) {
+			violations = append(violations, fmt.Sprintf("%v built at t=%v: prototype not available (BuildAfter=%v)", b.Proto, b.Time, fac.BuildAfter))
+		}
+	}
+
+	for i, t := range s.periodTimes() {
+		if i >= len(s.MinPower) || i >= len(s.MaxPower) {
+			break
+		}
+		pow := s.PowerCap(builds, t)
+		if pow < s.MinPower[i] {
+			violations = append(violations, fmt.Sprintf("t=%v: deployed capacity %v below MinPower %v", t, pow, s.MinPower[i]))
+		} else if pow > s.MaxPower[i] {
+			violations = append(violations, fmt.Sprintf("t=%v: deployed capacity %v above MaxPower %v", t, pow, s.MaxPower[i]))
+		}
+	}
+
+	for _, c := range s.BuildConstraints {
+		fac, err := s.Prototype(c.Proto)
+		if err != nil {
+			continue
+		}
+		for _, t := range s.periodTimes() {
+			n := 0
+			for _, b := range builds[c.Proto] {
+				if b.Time == t && !start[fmt.Sprintf("%v-%v-%v", b.Proto, b.Time, b.N)] {
+					n += b.N
+				}
+			}
+			if fac.Available(t) && c.Clamp(n) != n {
+				rng := fmt.Sprintf("[%v, %v]", c.MinN, c.MaxN)
+				if c.MaxN <= 0 {
+					rng = fmt.Sprintf("[%v, inf)", c.MinN)
+				}
+				violations = append(violations, fmt.Sprintf("t=%v: %v %v built outside of BuildConstraint range %v", t, n, c.Proto, rng))
+			}
+		}
+	}
+	return violations
+}
+
+// FilterBuilds returns the scenario's builds that are tagged with tag.
+func (s *Scenario) FilterBuilds(tag string) []Build {
+	filtered := []Build{}
+	for _, b := range s.Builds {
+		if b.HasTag(tag) {
+			filtered = append(filtered, b)
+		}
+	}
+	return filtered
+}
+
 func (s *Scenario) naliveproto(facs map[string][]Build, t int, protos ...string) int {
 	count := 0
 	for _, proto := range protos {
@@ -497,6 +1015,36 @@ func (s *Scenario) PowerCap(builds map[string][]Build, t int) float64 {
 	return pow
 }
 
+// PowerCapHistory returns the deployed power capacity of builds at every
+// time step from 0 to SimDur-1.
+func (s *Scenario) PowerCapHistory(builds map[string][]Build) []float64 {
+	hist := make([]float64, s.SimDur)
+	for t := range hist {
+		hist[t] = s.PowerCap(builds, t)
+	}
+	return hist
+}
+
+// CapacityFactor returns the time integrated power capacity of the
+// scenario's builds divided by the capacity that would be deployed
+// operating at the final MaxPower for the entire simulation.
+func (s *Scenario) CapacityFactor() float64 {
+	if len(s.MaxPower) == 0 || s.SimDur == 0 {
+		return 0
+	}
+
+	builds := map[string][]Build{}
+	for _, b := range s.Builds {
+		builds[b.Proto] = append(builds[b.Proto], b)
+	}
+
+	tot := 0.0
+	for _, pow := range s.PowerCapHistory(builds) {
+		tot += pow
+	}
+	return tot / (s.MaxPower[len(s.MaxPower)-1] * float64(s.SimDur))
+}
+
 func (s *Scenario) CyclusTmplPath() string {
 	return filepath.Join(filepath.Dir(s.File), s.CyclusTmpl)
 }
@@ -508,20 +1056,32 @@ func (s *Scenario) Validate() error {
 	}
 
 	var err error
-	if s.tmpl == nil && s.CyclusTmpl != "" {
-		s.tmpl, err = template.ParseFiles(s.CyclusTmplPath())
+	newtmpl := s.tmpl == nil && s.CyclusTmpl != ""
+	if newtmpl {
+		s.tmpl, err = s.parseTmpl()
 		if err != nil {
 			return err
 		}
 	}
 
+	if s.BuildOffset != 0 && s.BuildOffsetFrac != 0 {
+		return fmt.Errorf("only one of BuildOffset and BuildOffsetFrac may be nonzero")
+	} else if s.TrailingDur != 0 && s.TrailingDurFrac != 0 {
+		return fmt.Errorf("only one of TrailingDur and TrailingDurFrac may be nonzero")
+	} else if s.BuildOffsetFrac < 0 || s.BuildOffsetFrac > 1 {
+		return fmt.Errorf("BuildOffsetFrac %v is not in [0,1]", s.BuildOffsetFrac)
+	} else if s.TrailingDurFrac < 0 || s.TrailingDurFrac > 1 {
+		return fmt.Errorf("TrailingDurFrac %v is not in [0,1]", s.TrailingDurFrac)
+	}
+
 	np := s.nperiods()
 	lmin := len(s.MinPower)
 	if np != lmin {
 		return fmt.Errorf("number power constraints %v != number build periods %v", lmin, np)
 	}
 
-	protos := map[string]Facility{}
+	s.facmap = nil
+	protos := s.FacilityMap()
 	havereactor := false
 	for _, fac := range s.Facs {
 		if fac.Cap > 0 {
@@ -530,12 +1090,25 @@ func (s *Scenario) Validate() error {
 		if fac.Cap == 0 && len(fac.FracOfProtos) == 0 && fac.BuildAfter >= 0 {
 			return fmt.Errorf("prototype %v needs at least one prototype defined in FracOfProtos", fac.Proto)
 		}
-		protos[fac.Proto] = fac
 	}
 	if !havereactor {
 		return fmt.Errorf("scenario has no nonzero capacity (i.e. reactor) prototypes")
 	}
 
+	constrained := map[string]bool{}
+	for _, c := range s.BuildConstraints {
+		if _, ok := protos[c.Proto]; !ok {
+			return fmt.Errorf("BuildConstraint prototype '%v' is not defined in Facs", c.Proto)
+		} else if constrained[c.Proto] {
+			return fmt.Errorf("prototype %v has more than one BuildConstraint", c.Proto)
+		} else if c.MinN < 0 {
+			return fmt.Errorf("BuildConstraint for %v has negative MinN %v", c.Proto, c.MinN)
+		} else if c.MaxN > 0 && c.MaxN < c.MinN {
+			return fmt.Errorf("BuildConstraint for %v has MaxN %v < MinN %v", c.Proto, c.MaxN, c.MinN)
+		}
+		constrained[c.Proto] = true
+	}
+
 	for i, p := range s.StartBuilds {
 		fac, ok := protos[p.Proto]
 		if !ok {
@@ -552,9 +1125,184 @@ func (s *Scenario) Validate() error {
 		s.Builds[i].fac = fac
 	}
 
+	if !s.SkipFeasibilityCheck {
+		if err := s.checkFeasibility(); err != nil {
+			return err
+		}
+	}
+
+	if newtmpl {
+		// dry run the template to catch e.g. missing TemplateVars keys
+		handle := s.Handle
+		_, err = s.GenCyclusInfile()
+		s.Handle = handle
+		return err
+	}
+	return nil
+}
+
+// checkFeasibility returns an error if the MinPower constraint of any build
+// period exceeds the maximum buildable capacity.  Any number of facilities
+// can be deployed once a nonzero capacity prototype becomes available, so
+// only periods before then are limited - to the capacity of the StartBuilds.
+func (s *Scenario) checkFeasibility() error {
+	start := map[string][]Build{}
+	for _, b := range s.StartBuilds {
+		start[b.Proto] = append(start[b.Proto], b)
+	}
+
+	for i, t := range s.periodTimes() {
+		buildable := false
+		for _, fac := range s.Facs {
+			if fac.Cap > 0 && fac.Available(t) {
+				buildable = true
+				break
+			}
+		}
+		if buildable {
+			continue
+		}
+
+		if maxcap := s.PowerCap(start, t); s.MinPower[i] > maxcap {
+			return fmt.Errorf("MinPower %v of build period %v (time %v) exceeds the max buildable capacity %v", s.MinPower[i], i, t, maxcap)
+		}
+	}
+	return nil
+}
+
+// FuelCycleError lists the commodity flow problems found in a scenario's
+// templated cyclus input file.
+type FuelCycleError struct {
+	Violations []string
+}
+
+func (e *FuelCycleError) Error() string {
+	return "invalid fuel cycle: " + strings.Join(e.Violations, "; ")
+}
+
+// ValidateFuelCycle checks that the facility prototypes in the scenario's
+// cyclus template form a closed commodity graph - i.e. every commodity
+// consumed by some prototype is produced by another and vice versa.  A
+// *FuelCycleError listing all violations is returned if the check fails.
+// Commodities are recognized by archetype config tag name only, so this is a
+// heuristic and is not part of Validate.
+func (s *Scenario) ValidateFuelCycle() error {
+	handle := s.Handle
+	data, err := s.GenCyclusInfile()
+	s.Handle = handle
+	if err != nil {
+		return err
+	}
+
+	sim := struct {
+		Protos []cycProto `xml:"prototype"`
+		Facs   []cycProto `xml:"facility"`
+	}{}
+	if err := xml.Unmarshal(data, &sim); err != nil {
+		return fmt.Errorf("failed to parse generated cyclus input file: %v", err)
+	}
+
+	producers := map[string][]string{}
+	consumers := map[string][]string{}
+	for _, p := range append(sim.Protos, sim.Facs...) {
+		in, out := map[string]bool{}, map[string]bool{}
+		p.Config.commods(in, out)
+		for c := range in {
+			consumers[c] = append(consumers[c], p.Name)
+		}
+		for c := range out {
+			producers[c] = append(producers[c], p.Name)
+		}
+	}
+
+	violations := []string{}
+	for c, protos := range consumers {
+		if _, ok := producers[c]; !ok {
+			violations = append(violations, fmt.Sprintf("commodity '%v' consumed by %v is never produced", c, protos))
+		}
+	}
+	for c, protos := range producers {
+		if _, ok := consumers[c]; !ok {
+			violations = append(violations, fmt.Sprintf("commodity '%v' produced by %v is never consumed", c, protos))
+		}
+	}
+
+	if len(violations) > 0 {
+		sort.Strings(violations)
+		return &FuelCycleError{Violations: violations}
+	}
 	return nil
 }
 
+// inCommodTags and outCommodTags hold the archetype config element names
+// (for the common agents and cycamore archetypes) that name input and output
+// commodities respectively.
+var (
+	inCommodTags = map[string]bool{
+		"in_commods":     true,
+		"in_commod":      true,
+		"incommod":       true,
+		"incommods":      true,
+		"feed_commod":    true,
+		"feed_commods":   true,
+		"fill_commods":   true,
+		"fiss_commods":   true,
+		"topup_commod":   true,
+		"fuel_incommods": true,
+	}
+	outCommodTags = map[string]bool{
+		"out_commods":     true,
+		"out_commod":      true,
+		"outcommod":       true,
+		"outcommods":      true,
+		"product_commod":  true,
+		"tails_commod":    true,
+		"leftover_commod": true,
+		"fuel_outcommods": true,
+	}
+)
+
+type cycProto struct {
+	Name   string  `xml:"name"`
+	Config xmlNode `xml:"config"`
+}
+
+type xmlNode struct {
+	XMLName xml.Name
+	Content string    `xml:",chardata"`
+	Nodes   []xmlNode `xml:",any"`
+}
+
+// commods walks the node tree collecting named input and output commodities
+// into in and out.
+func (n xmlNode) commods(in, out map[string]bool) {
+	name := n.XMLName.Local
+	var dst map[string]bool
+	if inCommodTags[name] {
+		dst = in
+	} else if outCommodTags[name] {
+		dst = out
+	}
+
+	if dst == nil {
+		for _, child := range n.Nodes {
+			child.commods(in, out)
+		}
+		return
+	}
+
+	if len(n.Nodes) == 0 {
+		if c := strings.TrimSpace(n.Content); c != "" {
+			dst[c] = true
+		}
+	}
+	for _, child := range n.Nodes {
+		if c := strings.TrimSpace(child.Content); c != "" {
+			dst[c] = true
+		}
+	}
+}
+
 func (s *Scenario) Load(fname string) error {
 	if s == nil {
 		s = &Scenario{}
@@ -575,6 +1323,16 @@ func (s *Scenario) Load(fname string) error {
 	return s.Validate()
 }
 
+// SaveJSON writes the scenario, including its current Builds, to fname as
+// indented JSON that can be read back with Load.
+func (s *Scenario) SaveJSON(fname string) error {
+	data, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, append(data, '\n'), 0644)
+}
+
 func (s *Scenario) CalcTotalObjective(execfn ObjExecFunc) (float64, error) {
 	if s.SingleCalc {
 		return execfn(s)
@@ -612,17 +1370,72 @@ func (s *Scenario) GenCyclusInfile() ([]byte, error) {
 	}
 
 	if s.tmpl == nil {
-		s.tmpl = template.Must(template.ParseFiles(s.CyclusTmplPath()))
+		s.tmpl = template.Must(s.parseTmpl())
 	}
 
-	var buf bytes.Buffer
-	err := s.tmpl.Execute(&buf, s)
+	// copies of s (e.g. from dereferencing) share s.tmpl, so the helpers
+	// bound to the scenario being rendered (and any TemplateFuncs replaced
+	// since parsing) are set on a clone rather than the shared template.
+	tmpl, err := s.tmpl.Clone()
 	if err != nil {
 		return nil, err
 	}
+	tmpl.Funcs(s.templateFuncs())
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, s); err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
+// TemplateFuncExamples documents the helper functions available to every
+// templated cyclus input file.  Timesteps are months.
+var TemplateFuncExamples = []string{
+	`{{tsToYear 120 2000}} is the calendar year of timestep 120 for a simulation starting in 2000 (i.e. 2010)`,
+	`{{nBuiltAt "reactor" 24}} is the number of "reactor" facilities deployed at timestep 24`,
+	`{{powerCapAt 24}} is the total power capacity alive at timestep 24`,
+}
+
+// templateFuncs returns the default helper functions for the templated
+// cyclus input file (see TemplateFuncExamples) merged with TemplateFuncs.
+func (s *Scenario) templateFuncs() template.FuncMap {
+	funcs := template.FuncMap{
+		"tsToYear": func(ts, startYear int) int { return startYear + ts/12 },
+		"nBuiltAt": func(proto string, t int) int {
+			n := 0
+			for _, b := range s.Builds {
+				if b.Proto == proto && b.Time == t {
+					n += b.N
+				}
+			}
+			return n
+		},
+		"powerCapAt": func(t int) float64 {
+			builds := map[string][]Build{}
+			for _, b := range s.Builds {
+				builds[b.Proto] = append(builds[b.Proto], b)
+			}
+			return s.PowerCap(builds, t)
+		},
+	}
+	for name, fn := range s.TemplateFuncs {
+		funcs[name] = fn
+	}
+	return funcs
+}
+
+// parseTmpl parses the scenario's templated cyclus input file.  Executing
+// the template fails if it references a TemplateVars key that isn't set.
+func (s *Scenario) parseTmpl() (*template.Template, error) {
+	path := s.CyclusTmplPath()
+	tmpl, err := template.New(filepath.Base(path)).Funcs(s.templateFuncs()).ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl.Option("missingkey=error"), nil
+}
+
 func (s *Scenario) VarNames() []string {
 	names := make([]string, 0, s.NVars())
 	varfacs, _ := s.periodFacOrder()
@@ -634,10 +1447,16 @@ func (s *Scenario) VarNames() []string {
 	return names
 }
 
+// LowerBounds returns the lower bound of each optimization variable (always
+// zero).  BuildConstraints MinN limits are enforced by TransformVars rather
+// than by the variable bounds.
 func (s *Scenario) LowerBounds() []float64 {
 	return make([]float64, s.NVars())
 }
 
+// UpperBounds returns the upper bound of each optimization variable.
+// Variables for prototypes that can't be built in a period (i.e. not yet
+// available) are fixed at zero.
 func (s *Scenario) UpperBounds() []float64 {
 	facs, _ := s.periodFacOrder()
 	up := make([]float64, 0, s.NVars())
@@ -657,12 +1476,30 @@ func (s *Scenario) UpperBounds() []float64 {
 	return up
 }
 
+// BuildOffsetSteps returns the build offset in timesteps - computed from
+// BuildOffsetFrac if it is nonzero and BuildOffset otherwise.
+func (s *Scenario) BuildOffsetSteps() int {
+	if s.BuildOffsetFrac != 0 {
+		return int(math.Round(float64(s.SimDur) * s.BuildOffsetFrac))
+	}
+	return s.BuildOffset
+}
+
+// TrailingDurSteps returns the wind-down duration in timesteps - computed
+// from TrailingDurFrac if it is nonzero and TrailingDur otherwise.
+func (s *Scenario) TrailingDurSteps() int {
+	if s.TrailingDurFrac != 0 {
+		return int(math.Round(float64(s.SimDur) * s.TrailingDurFrac))
+	}
+	return s.TrailingDur
+}
+
 func (s *Scenario) timeOf(period int) int {
-	return period*s.BuildPeriod + 1 + s.BuildOffset
+	return period*s.BuildPeriod + 1 + s.BuildOffsetSteps()
 }
 
 func (s *Scenario) periodOf(time int) int {
-	return (time - s.BuildOffset - 1) / s.BuildPeriod
+	return (time - s.BuildOffsetSteps() - 1) / s.BuildPeriod
 }
 
 func (s *Scenario) periodTimes() []int {
@@ -674,7 +1511,7 @@ func (s *Scenario) periodTimes() []int {
 }
 
 func (s *Scenario) nperiods() int {
-	return (s.SimDur-s.BuildOffset-s.TrailingDur-2)/s.BuildPeriod + 1
+	return (s.SimDur-s.BuildOffsetSteps()-s.TrailingDurSteps()-2)/s.BuildPeriod + 1
 }
 
 func findLine(data []byte, pos int64) (line, col int) {
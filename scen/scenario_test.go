@@ -1,6 +1,19 @@
 package scen
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+)
 
 type alivetest struct {
 	Built    int
@@ -64,6 +77,34 @@ func TestPeriodTimes(t *testing.T) {
 	}
 }
 
+func TestDurationFracs(t *testing.T) {
+	// offset 12, trailing 24
+	frac := &Scenario{SimDur: 120, BuildPeriod: 12, BuildOffsetFrac: 0.1, TrailingDurFrac: 0.2}
+	abs := &Scenario{SimDur: 120, BuildPeriod: 12, BuildOffset: 12, TrailingDur: 24}
+	if got, want := frac.periodTimes(), abs.periodTimes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("period times: got %v, want %v", got, want)
+	}
+
+	// proportions are kept when the duration changes
+	frac.SimDur, frac.BuildPeriod = 240, 24
+	if got, want := frac.timeOf(0), 25; got != want {
+		t.Errorf("first build time for SimDur=240: got %v, want %v", got, want)
+	}
+	if got, want := frac.nperiods(), abs.nperiods(); got != want {
+		t.Errorf("nperiods for SimDur=240: got %v, want %v", got, want)
+	}
+
+	both := []*Scenario{
+		{BuildOffset: 1, BuildOffsetFrac: 0.1},
+		{TrailingDur: 1, TrailingDurFrac: 0.1},
+	}
+	for _, s := range both {
+		if err := s.Validate(); err == nil || !strings.Contains(err.Error(), "only one of") {
+			t.Errorf("validation of %+v: got err %v, want integer/fraction conflict", s, err)
+		}
+	}
+}
+
 func TestTransformVars(tt *testing.T) {
 	tests := []struct {
 		Scen     *Scenario
@@ -269,6 +310,395 @@ func TestTransformVars(tt *testing.T) {
 	}
 }
 
+func TestPowerCapHistory(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1, Life: 0},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{10, 10, 10, 10, 70},
+	}
+	powerexp := []float64{10, 15, 28, 44, 70}
+
+	builds, err := s.TransformVars([]float64{.5, .5, .5, .5, .5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hist := s.PowerCapHistory(builds)
+	if len(hist) != s.SimDur {
+		t.Fatalf("got history length %v, want %v", len(hist), s.SimDur)
+	}
+	for n, tm := range s.periodTimes() {
+		if hist[tm] != powerexp[n] {
+			t.Errorf("period %v (t=%v): got power cap %v, want %v", n, tm, hist[tm], powerexp[n])
+		}
+	}
+
+	tot := 0.0
+	for _, pow := range hist {
+		tot += pow
+	}
+	want := tot / (70 * 10)
+	if got := s.CapacityFactor(); got != want {
+		t.Errorf("got capacity factor %v, want %v", got, want)
+	}
+}
+
+func TestLoadWarmStart(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1, Life: 0},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{10, 10, 10, 10, 70},
+	}
+
+	dir, err := ioutil.TempDir("", "scen-warmstart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "warm.json")
+	if err := ioutil.WriteFile(fname, []byte("[0.5, -1, 0.25, 2, 0.75]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.LoadWarmStart(fname); err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{0.5, 0, 0.25, 1, 0.75}
+	if !reflect.DeepEqual(s.WarmStartVars, want) {
+		t.Errorf("got warm start vars %v, want %v", s.WarmStartVars, want)
+	}
+
+	if _, err := s.TransformVars(nil); err == nil {
+		t.Errorf("TransformVars(nil) fell back to warm start vars instead of failing")
+	}
+	if _, err := s.TransformVars(s.WarmStartVars); err != nil {
+		t.Errorf("TransformVars rejected warm start vars: %v", err)
+	}
+}
+
+func TestFilterBuilds(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1, Life: 0},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{10, 10, 10, 10, 70},
+		StartBuilds: []Build{
+			{Time: 0, Proto: "Proto1", N: 1, Tags: []string{"expA"}},
+			{Time: 0, Proto: "Proto1", N: 2, Tags: []string{"expB"}},
+			{Time: 0, Proto: "Proto1", N: 4, Tags: []string{"expA", "expB"}},
+			{Time: 0, Proto: "Proto1", N: 8},
+		},
+	}
+
+	// tags must survive json round trips
+	clone := s.Clone()
+	if !reflect.DeepEqual(clone.StartBuilds[2].Tags, []string{"expA", "expB"}) {
+		t.Errorf("build tags lost in json round trip: got %v", clone.StartBuilds[2].Tags)
+	}
+
+	vars := []float64{0, 0, 0, 0, 0}
+	if _, err := s.TransformVars(vars); err != nil {
+		t.Fatal(err)
+	}
+	got := s.FilterBuilds("expA")
+	if len(got) != 2 || got[0].N != 1 || got[1].N != 4 {
+		t.Errorf("FilterBuilds(expA): got %+v, want builds with N=1 and N=4", got)
+	}
+
+	s.CustomConfig = map[string]interface{}{"build-tag-filter": "expB"}
+	builds, err := s.TransformVars(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range s.Builds {
+		if b.Time == 0 && !b.HasTag("expB") {
+			t.Errorf("start build %+v without filter tag was applied", b)
+		}
+	}
+	if got := s.PowerCap(builds, 0); got != 6 {
+		t.Errorf("got filtered start build power %v, want 6", got)
+	}
+}
+
+func TestCloneAt(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1, Life: 4},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{10, 10, 10, 10, 70},
+		StartBuilds: []Build{
+			{Time: 0, Proto: "Proto1", N: 2},
+		},
+	}
+
+	vars := []float64{.5, .5, .5, .5, .5}
+	origbuilds, err := s.TransformVars(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const splice = 4
+	clone := s.CloneAt(splice)
+
+	want := []Build{}
+	for _, b := range s.Builds {
+		if b.Time <= splice {
+			want = append(want, b)
+		}
+	}
+	if len(clone.StartBuilds) != len(want) {
+		t.Fatalf("got %v start builds, want %v", len(clone.StartBuilds), len(want))
+	}
+	for i, b := range clone.StartBuilds {
+		w := want[i]
+		if b.Time != w.Time || b.Proto != w.Proto || b.N != w.N || b.Lifetime() != w.Lifetime() {
+			t.Errorf("start build %v: got %+v, want %+v", i, b, w)
+		}
+		if b.Alive(splice) != w.Alive(splice) {
+			t.Errorf("start build %v: alive at splice time = %v, want %v", i, b.Alive(splice), w.Alive(splice))
+		}
+	}
+
+	if clone.BuildOffset != splice {
+		t.Errorf("got BuildOffset %v, want %v", clone.BuildOffset, splice)
+	}
+	if err := clone.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(clone.SpliceVars) != clone.NVars() {
+		t.Errorf("got %v splice vars, want %v", len(clone.SpliceVars), clone.NVars())
+	}
+
+	// re-optimizing with the original schedule reproduces the original builds
+	builds, err := clone.TransformVars(clone.SpliceVars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := clone.PowerCapHistory(builds), s.PowerCapHistory(origbuilds); !reflect.DeepEqual(got, want) {
+		t.Errorf("got power history %v, want %v", got, want)
+	}
+}
+
+func TestCheckBuildConstraints(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1, Life: 0},
+			{Proto: "Proto2", Cap: 1, Life: 0, BuildAfter: 6},
+			{Proto: "Init", Cap: 1, Life: 0, BuildAfter: -1},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{2, 2, 2, 2, 2},
+		StartBuilds: []Build{
+			{Time: 0, Proto: "Init", N: 5},
+		},
+	}
+	s.Builds = []Build{
+		{Time: 0, Proto: "Init", N: 5},
+		{Time: 1, Proto: "Proto1", N: 20},
+		{Time: 3, Proto: "Proto2", N: 1},
+		{Time: 5, Proto: "Bogus", N: 1},
+		{Time: 7, Proto: "Proto1", N: 0},
+	}
+	if err := s.Validate(); err == nil {
+		t.Fatal("expected validation error for unknown build prototype")
+	}
+
+	want := []string{
+		"Proto2 built at t=3: prototype not available (BuildAfter=6)",
+		"Bogus built at t=5: unknown prototype",
+		"Proto1 built at t=7: non-positive number of facilities 0",
+		"t=1: deployed capacity 25 above MaxPower 10",
+		"t=3: deployed capacity 26 above MaxPower 20",
+	}
+	got := s.CheckBuildConstraints()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got violations\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// a schedule below MinPower
+	s.Builds = []Build{{Time: 0, Proto: "Init", N: 5}}
+	s.MinPower = []float64{6, 6, 6, 6, 6}
+	s.Validate()
+	got = s.CheckBuildConstraints()
+	if len(got) != 5 || got[0] != "t=1: deployed capacity 5 below MinPower 6" {
+		t.Errorf("got violations %v, want 5 below MinPower", got)
+	}
+
+	// schedules from TransformVars within bounds have no violations
+	s.Builds = nil
+	if _, err := s.TransformVars([]float64{0, 0, 0, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.CheckBuildConstraints(); len(got) != 0 {
+		t.Errorf("got violations for transformed schedule: %v", got)
+	}
+}
+
+func TestBuildConstraints(t *testing.T) {
+	newScen := func(c BuildConstraint) *Scenario {
+		return &Scenario{
+			SimDur:      10,
+			BuildPeriod: 2,
+			Facs: []Facility{
+				{Proto: "Proto1", Cap: 1, Life: 0},
+				{Proto: "Proto2", Cap: 1, Life: 0},
+			},
+			MaxPower:         []float64{10, 20, 40, 60, 70},
+			MinPower:         []float64{10, 10, 10, 10, 70},
+			BuildConstraints: []BuildConstraint{c},
+		}
+	}
+	counts := func(s *Scenario, vars []float64) map[string][]int {
+		builds, err := s.TransformVars(vars)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string][]int{}
+		for proto, blds := range builds {
+			for _, b := range blds {
+				got[proto] = append(got[proto], b.N)
+			}
+		}
+		return got
+	}
+
+	// Proto2 wants to satisfy all new capacity but is capped at 3
+	s := newScen(BuildConstraint{Proto: "Proto2", MinN: 0, MaxN: 3})
+	got := counts(s, []float64{.5, 1, .5, 1, .5, 1, .5, 1, .5, 1})
+	want := map[string][]int{"Proto1": {7, 2, 10, 13, 23}, "Proto2": {3, 3, 3, 3, 3}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MaxN: got builds %v, want %v", got, want)
+	}
+	if v := s.CheckBuildConstraints(); len(v) != 0 {
+		t.Errorf("MaxN: got violations %v", v)
+	}
+
+	// Proto2 wants nothing but must build at least 1
+	s = newScen(BuildConstraint{Proto: "Proto2", MinN: 1})
+	got = counts(s, []float64{.5, 0, .5, 0, .5, 0, .5, 0, .5, 0})
+	want = map[string][]int{"Proto1": {9, 4, 12, 15, 25}, "Proto2": {1, 1, 1, 1, 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MinN: got builds %v, want %v", got, want)
+	}
+
+	s.Builds = append(s.Builds, Build{Time: 3, Proto: "Proto2", N: 2})
+	s.BuildConstraints[0].MaxN = 2
+	if v := s.CheckBuildConstraints(); len(v) != 1 || v[0] != "t=3: 3 Proto2 built outside of BuildConstraint range [1, 2]" {
+		t.Errorf("got violations %v, want one for t=3", v)
+	}
+
+	// a MaxN of zero means no upper limit
+	s = newScen(BuildConstraint{Proto: "Proto2", MinN: 2})
+	if up := s.UpperBounds(); !reflect.DeepEqual(up, []float64{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}) {
+		t.Errorf("got upper bounds %v with MaxN=0", up)
+	}
+	if n := s.BuildConstraints[0].Clamp(100); n != 100 {
+		t.Errorf("MaxN=0 clamped 100 builds to %v", n)
+	}
+	if err := s.Validate(); err != nil {
+		t.Errorf("MinN without MaxN failed validation: %v", err)
+	}
+
+	invalid := []BuildConstraint{
+		{Proto: "Bogus", MinN: 0, MaxN: 1},
+		{Proto: "Proto2", MinN: -1, MaxN: 1},
+		{Proto: "Proto2", MinN: 3, MaxN: 2},
+	}
+	for _, c := range invalid {
+		if err := newScen(c).Validate(); err == nil {
+			t.Errorf("invalid constraint %+v passed validation", c)
+		}
+	}
+	s = newScen(BuildConstraint{Proto: "Proto2", MinN: 0, MaxN: 2})
+	s.BuildConstraints = append(s.BuildConstraints, s.BuildConstraints[0])
+	if err := s.Validate(); err == nil {
+		t.Errorf("duplicate constraints passed validation")
+	}
+}
+
+func TestSummarise(t *testing.T) {
+	s := &Scenario{
+		SimDur:     10,
+		CyclusTmpl: "tmpls/once-through.xml",
+		Facs: []Facility{
+			{Proto: "LWR", Cap: 1000},
+			{Proto: "SFR", Cap: 400},
+			{Proto: "Sink", Cap: 0},
+			{Proto: "Mox", Cap: 200},
+		},
+		Builds: []Build{
+			{Time: 0, Proto: "LWR", N: 5},
+			{Time: 1, Proto: "SFR", N: 2},
+			{Time: 2, Proto: "Sink", N: 1},
+			{Time: 3, Proto: "Mox", N: 1},
+			{Time: 4, Proto: "LWR", N: 1},
+		},
+	}
+
+	got := s.Summarise()
+	want := "once-through: 10 facilities, 10 timesteps, 7000 power built, top: LWR=6 SFR=2 Mox=1"
+	if got != want {
+		t.Errorf("got summary %q, want %q", got, want)
+	}
+	hash := s.ShortHash()
+	if len(hash) != 8 {
+		t.Errorf("got short hash %q, want 8 hex digits", hash)
+	}
+
+	s.Builds = append(s.Builds, Build{Time: 5, Proto: "SFR", N: 1})
+	if s.Summarise() == got {
+		t.Errorf("summary %q did not change with the scenario", got)
+	}
+	if s.ShortHash() == hash {
+		t.Errorf("short hash %q did not change with the scenario", hash)
+	}
+}
+
+func TestFacilityMap(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs:        []Facility{{Proto: "Proto1", Cap: 1}},
+		MaxPower:    []float64{10, 20, 40, 60, 70},
+		MinPower:    []float64{10, 10, 10, 10, 70},
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Prototype("Proto1"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Facs = append(s.Facs, Facility{Proto: "Proto2", Cap: 2})
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if fac, err := s.Prototype("Proto2"); err != nil {
+		t.Errorf("added prototype not found after revalidating: %v", err)
+	} else if fac.Cap != 2 {
+		t.Errorf("got Proto2 cap %v, want 2", fac.Cap)
+	}
+	if n := len(s.FacilityMap()); n != 2 {
+		t.Errorf("got %v facilities in map, want 2", n)
+	}
+}
+
 func TestVarNames(t *testing.T) {
 	facs := []Facility{
 		Facility{Proto: "Proto1", Cap: 1},
@@ -298,3 +728,511 @@ func TestVarNames(t *testing.T) {
 	t.Logf("LowerBounds:\n%v", s.LowerBounds())
 	t.Logf("UpperBounds:\n%v", s.UpperBounds())
 }
+
+func TestValidateFeasibility(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1, Life: 0, BuildAfter: 5},
+			{Proto: "Old", Cap: 2, Life: 0, BuildAfter: -1},
+		},
+		StartBuilds: []Build{{Time: 0, Proto: "Old", N: 5}},
+		MaxPower:    []float64{10, 20, 40, 60, 70},
+		MinPower:    []float64{10, 10, 10, 10, 70},
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatalf("feasible scenario failed validation: %v", err)
+	}
+
+	// Proto1 isn't buildable until time 5 and the start builds provide 10
+	s.MinPower[1] = 11
+	if err := s.Validate(); err == nil {
+		t.Error("infeasible MinPower passed validation")
+	}
+
+	s.SkipFeasibilityCheck = true
+	if err := s.Validate(); err != nil {
+		t.Errorf("validation with SkipFeasibilityCheck failed: %v", err)
+	}
+}
+
+func TestSaveJSON(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1, Life: 0},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{10, 10, 10, 10, 70},
+	}
+	if _, err := s.TransformVars([]float64{.5, .5, .5, .5, .5}); err != nil {
+		t.Fatal(err)
+	} else if len(s.Builds) == 0 {
+		t.Fatal("TransformVars created no builds")
+	}
+
+	dir, err := ioutil.TempDir("", "scen-save")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "saved.json")
+	if err := s.SaveJSON(fname); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := &Scenario{}
+	if err := json.Unmarshal(data, saved); err != nil {
+		t.Fatal(err)
+	}
+	want := []Build{}
+	for _, b := range s.Builds {
+		b.fac = Facility{} // not serialized
+		want = append(want, b)
+	}
+	if !reflect.DeepEqual(saved.Builds, want) {
+		t.Errorf("saved builds %v, want %v", saved.Builds, want)
+	}
+	if saved.SimDur != s.SimDur || !reflect.DeepEqual(saved.MaxPower, s.MaxPower) {
+		t.Errorf("saved scenario fields differ from original")
+	}
+}
+
+func TestExportVTK(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 2, Life: 0},
+			{Proto: "Proto2", Cap: 0, Life: 0, FracOfProtos: []string{"Proto1"}},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{10, 10, 10, 10, 70},
+	}
+
+	_, err := s.TransformVars([]float64{.5, .5, .5, .5, .5, .5, .5, .5, .5, .5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "scen-vtk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		Capacity bool
+		// WantFirst is the data value for the first build period of Proto1.
+		WantFirst float64
+	}{
+		{false, 5},
+		{true, 10},
+	}
+
+	for _, test := range tests {
+		fname := filepath.Join(dir, "sched.vtk")
+		if test.Capacity {
+			err = s.ExportVTKCapacity(fname)
+		} else {
+			err = s.ExportVTK(fname)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(data), "\n")
+
+		var nx, ny, nz int
+		first := math.NaN()
+		for i, l := range lines {
+			if strings.HasPrefix(l, "DIMENSIONS") {
+				fmt.Sscanf(l, "DIMENSIONS %d %d %d", &nx, &ny, &nz)
+			} else if strings.HasPrefix(l, "LOOKUP_TABLE") {
+				first, err = strconv.ParseFloat(lines[i+1], 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		if nx != s.nperiods() || ny != len(s.Facs) || nz != 1 {
+			t.Errorf("capacity=%v: wrong grid dims: got %vx%vx%v, want %vx%vx1", test.Capacity, nx, ny, nz, s.nperiods(), len(s.Facs))
+		}
+		if first != test.WantFirst {
+			t.Errorf("capacity=%v: wrong first data point: got %v, want %v", test.Capacity, first, test.WantFirst)
+		}
+	}
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 2, Life: 0},
+			{Proto: "Proto2", Cap: 0, Life: 0, FracOfProtos: []string{"Proto1"}},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{10, 10, 10, 10, 70},
+	}
+
+	_, err := s.TransformVars([]float64{.5, .5, .5, .5, .5, .5, .5, .5, .5, .5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.exportCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if want := "MinPower,10,10,10,10,70"; lines[0] != want {
+		t.Errorf("first row: got %q, want %q", lines[0], want)
+	}
+	if want := "Proto1,1,5,0,10"; lines[3] != want {
+		t.Errorf("first build row: got %q, want %q", lines[3], want)
+	}
+
+	want := s.Builds
+	s.Builds = nil
+	if err := s.importCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.Builds, want) {
+		t.Errorf("imported builds:\n got %+v\nwant %+v", s.Builds, want)
+	}
+
+	if err := s.importCSV(strings.NewReader("Unknown,1,1,0,0\n")); err == nil {
+		t.Errorf("importing a build with an undefined prototype succeeded")
+	}
+}
+
+const fuelCycleTmpl = `<simulation>
+  <control><simhandle>{{.Handle}}</simhandle></control>
+  <prototype>
+    <name>mine</name>
+    <config><Source><outcommod>natl_u</outcommod></Source></config>
+  </prototype>
+  <prototype>
+    <name>enrich</name>
+    <config>
+      <Enrichment>
+        <feed_commod>natl_u</feed_commod>
+        <product_commod>uox</product_commod>
+        <tails_commod>tails</tails_commod>
+      </Enrichment>
+    </config>
+  </prototype>
+  <prototype>
+    <name>reactor</name>
+    <config>
+      <Reactor>
+        <fuel_incommods><val>{{.Handle}}</val></fuel_incommods>
+        <fuel_outcommods><val>spent</val></fuel_outcommods>
+      </Reactor>
+    </config>
+  </prototype>
+  <prototype>
+    <name>repo</name>
+    <config><Sink><in_commods><val>spent</val><val>tails</val></in_commods></Sink></config>
+  </prototype>
+</simulation>
+`
+
+func TestTemplateVars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scen-tmplvars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpl := "<simulation><control><enrichment>{{.TemplateVars.foo}}</enrichment></control></simulation>"
+	err = ioutil.WriteFile(filepath.Join(dir, "tmpl.xml"), []byte(tmpl), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newScen := func(vars map[string]interface{}) *Scenario {
+		return &Scenario{
+			File:         filepath.Join(dir, "scenario.json"),
+			CyclusTmpl:   "tmpl.xml",
+			SimDur:       10,
+			BuildPeriod:  2,
+			Facs:         []Facility{{Proto: "Proto1", Cap: 1}},
+			MaxPower:     []float64{10, 20, 40, 60, 70},
+			MinPower:     []float64{10, 10, 10, 10, 70},
+			TemplateVars: vars,
+		}
+	}
+
+	s := newScen(map[string]interface{}{"foo": 4.5})
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.GenCyclusInfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<enrichment>4.5</enrichment>"; !strings.Contains(string(data), want) {
+		t.Errorf("generated input file %q does not contain %q", data, want)
+	}
+
+	clone := s.Clone()
+	clone.TemplateVars["foo"] = 1.0
+	if s.TemplateVars["foo"] != 4.5 {
+		t.Errorf("modifying clone TemplateVars changed original")
+	}
+
+	if err := newScen(map[string]interface{}{"bar": 1}).Validate(); err == nil {
+		t.Errorf("template referencing missing TemplateVars key passed validation")
+	}
+	if err := newScen(nil).Validate(); err == nil {
+		t.Errorf("template referencing nil TemplateVars passed validation")
+	}
+}
+
+const cloneScenJSON = `{
+    "SimDur": 10,
+    "BuildPeriod": 2,
+    "CyclusTmpl": "tmpl.xml",
+    "Handle": "orig",
+    "NuclideCost": {"922350000": 1.5},
+    "CustomConfig": {"foo": "bar"},
+    "TemplateVars": {"enrichment": 4.5},
+    "Facs": [{"Proto": "Proto1", "Cap": 1, "Life": 6}],
+    "MinPower": [0, 0, 0, 0, 0],
+    "MaxPower": [10, 20, 40, 60, 70],
+    "BuildConstraints": [{"Proto": "Proto1", "MinN": 0, "MaxN": 5}],
+    "StartBuilds": [{"Proto": "Proto1", "Time": 0, "N": 1, "Tags": ["init"]}],
+    "Builds": [{"Proto": "Proto1", "Time": 0, "N": 1, "Tags": ["init"]}],
+    "SpliceVars": [0.1, 0.2, 0.3, 0.4, 0.5],
+    "WarmStartVars": [0.5, 0.4, 0.3, 0.2, 0.1]
+}`
+
+func TestScenarioClone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scen-clone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpl := "<simulation><handle>{{.Handle}}</handle><enrichment>{{.TemplateVars.enrichment}}</enrichment></simulation>"
+	if err := ioutil.WriteFile(filepath.Join(dir, "tmpl.xml"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(dir, "scenario.json")
+	if err := ioutil.WriteFile(fname, []byte(cloneScenJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scenario{}
+	if err := s.Load(fname); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(s)
+
+	clone := s.Clone()
+	if err := clone.Validate(); err != nil {
+		t.Fatalf("clone failed validation: %v", err)
+	} else if clone.tmpl == nil {
+		t.Errorf("clone template was not reloaded")
+	}
+	if got, want := clone.periodTimes(), s.periodTimes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("clone period times %v != original %v", got, want)
+	}
+	for i := range s.StartBuilds {
+		if got, want := clone.StartBuilds[i].fac, s.StartBuilds[i].fac; !reflect.DeepEqual(got, want) {
+			t.Errorf("clone StartBuild %v has facility %+v, want %+v", i, got, want)
+		}
+	}
+	data, err := clone.GenCyclusInfile()
+	if err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(string(data), "<handle>orig</handle>") {
+		t.Errorf("clone generated unexpected input file %q", data)
+	}
+
+	// mutate nested slices and then every exported slice and map field of
+	// the clone
+	clone.Builds[0].Tags[0] = "changed"
+	clone.StartBuilds[0].Tags[0] = "changed"
+	v := reflect.ValueOf(clone).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, f := v.Type().Field(i).Name, v.Field(i)
+		if !f.CanSet() || name == "TemplateFuncs" { // functions are shared
+			continue
+		}
+		switch f.Kind() {
+		case reflect.Slice:
+			if f.Len() == 0 {
+				t.Errorf("test scenario field %v is empty and can't detect shared data", name)
+				continue
+			}
+			f.Index(0).Set(reflect.Zero(f.Type().Elem()))
+		case reflect.Map:
+			if f.Len() == 0 {
+				t.Errorf("test scenario field %v is empty and can't detect shared data", name)
+				continue
+			}
+			for _, key := range f.MapKeys() {
+				f.SetMapIndex(key, reflect.Zero(f.Type().Elem()))
+			}
+		}
+	}
+
+	if got, _ := json.Marshal(s); !bytes.Equal(got, want) {
+		t.Errorf("mutating the clone changed the original:\ngot  %s\nwant %s", got, want)
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scen-tmplfuncs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpl := `<year>{{tsToYear 30 2000}}</year><n>{{nBuiltAt "Proto1" 4}}</n><cap>{{powerCapAt 4}}</cap><x>{{double 2}}</x>`
+	err = ioutil.WriteFile(filepath.Join(dir, "tmpl.xml"), []byte(tmpl), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Scenario{
+		File:          filepath.Join(dir, "scenario.json"),
+		CyclusTmpl:    "tmpl.xml",
+		SimDur:        10,
+		BuildPeriod:   2,
+		Facs:          []Facility{{Proto: "Proto1", Cap: 1.5}},
+		MaxPower:      []float64{10, 20, 40, 60, 70},
+		MinPower:      []float64{0, 0, 0, 0, 0},
+		StartBuilds:   []Build{{Proto: "Proto1", Time: 0, N: 1}},
+		Builds:        []Build{{Proto: "Proto1", Time: 0, N: 1}, {Proto: "Proto1", Time: 4, N: 3}},
+		TemplateFuncs: template.FuncMap{"double": func(x int) int { return 2 * x }},
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "<year>2002</year><n>3</n><cap>6</cap><x>4</x>"
+	for _, scn := range []*Scenario{s, s.Clone()} {
+		data, err := scn.GenCyclusInfile()
+		if err != nil {
+			t.Fatal(err)
+		} else if string(data) != want {
+			t.Errorf("got generated input file %q, want %q", data, want)
+		}
+	}
+
+	// a shallow copy shares the parsed template but renders its own builds
+	cp := *s
+	cp.Builds = s.Builds[:1]
+	want = "<year>2002</year><n>0</n><cap>1.5</cap><x>4</x>"
+	if data, err := cp.GenCyclusInfile(); err != nil {
+		t.Fatal(err)
+	} else if string(data) != want {
+		t.Errorf("copy: got generated input file %q, want %q", data, want)
+	}
+	if data, err := s.GenCyclusInfile(); err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(string(data), "<n>3</n>") {
+		t.Errorf("rendering a copy changed the original's output to %q", data)
+	}
+
+	s.tmpl = nil
+	s.TemplateFuncs = nil
+	if err := s.Validate(); err == nil {
+		t.Errorf("template referencing an undefined function passed validation")
+	}
+}
+
+func TestValidateFuelCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scen-fuelcycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "tmpl.xml"), []byte(fuelCycleTmpl), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the template uses the scenario handle as the reactor fuel commodity so
+	// each case can vary the graph.
+	tests := []struct {
+		Handle string
+		Want   []string
+	}{
+		{"uox", nil},
+		{"mox", []string{
+			"commodity 'mox' consumed by [reactor] is never produced",
+			"commodity 'uox' produced by [enrich] is never consumed",
+		}},
+	}
+
+	for i, test := range tests {
+		s := &Scenario{
+			File:       filepath.Join(dir, "scenario.json"),
+			CyclusTmpl: "tmpl.xml",
+			Handle:     test.Handle,
+		}
+
+		err := s.ValidateFuelCycle()
+		if test.Want == nil {
+			if err != nil {
+				t.Errorf("case %v: unexpected error: %v", i, err)
+			}
+			continue
+		}
+
+		fcerr, ok := err.(*FuelCycleError)
+		if !ok {
+			t.Errorf("case %v: got error %v, want *FuelCycleError", i, err)
+			continue
+		}
+		if got := strings.Join(fcerr.Violations, "\n"); got != strings.Join(test.Want, "\n") {
+			t.Errorf("case %v: got violations\n%v\nwant\n%v", i, got, strings.Join(test.Want, "\n"))
+		}
+	}
+}
+
+func benchmarkTransformVars(b *testing.B, nfacs int) {
+	s := &Scenario{SimDur: 120, BuildPeriod: 2}
+	for i := 0; i < nfacs; i++ {
+		s.Facs = append(s.Facs, Facility{Proto: fmt.Sprintf("Proto%v", i), Cap: 1, Life: 40})
+	}
+	for _, t := range s.periodTimes() {
+		s.MinPower = append(s.MinPower, 0)
+		s.MaxPower = append(s.MaxPower, float64(10*t))
+	}
+	if err := s.Validate(); err != nil {
+		b.Fatal(err)
+	}
+
+	vars := make([]float64, s.NVars())
+	for i := range vars {
+		vars[i] = 0.5
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.TransformVars(vars); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTransformVars1Fac(b *testing.B)  { benchmarkTransformVars(b, 1) }
+func BenchmarkTransformVars10Fac(b *testing.B) { benchmarkTransformVars(b, 10) }
@@ -0,0 +1,147 @@
+package scen
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// SensitivityAnalysis returns the central finite-difference gradient of the
+// scenario objective with respect to each of the variables at vars:
+//
+//	(f(vars + delta*e_i) - f(vars - delta*e_i)) / (2*delta)
+//
+// f is computed by calling obj (e.g. a wrapper around runscen.Local) with a
+// clone of s transformed using the perturbed variables (see TransformVars).
+// At most maxConcurrent objective evaluations run at the same time - zero or
+// less means no limit.
+func (s *Scenario) SensitivityAnalysis(vars []float64, delta float64, maxConcurrent int, obj func(s *Scenario) (float64, error)) ([]float64, error) {
+	if len(vars) != s.NVars() {
+		return nil, fmt.Errorf("wrong number of vars: want %v, got %v", s.NVars(), len(vars))
+	} else if delta <= 0 {
+		return nil, errors.New("sensitivity delta must be positive")
+	}
+
+	// objs[2*i] and objs[2*i+1] hold the objective for the forward and
+	// backward perturbations of variable i.
+	n := 2 * len(vars)
+	objs := make([]float64, n)
+	errs := make([]error, n)
+	if maxConcurrent <= 0 || maxConcurrent > n {
+		maxConcurrent = n
+	}
+	sem := make(chan struct{}, maxConcurrent)
+
+	var wg sync.WaitGroup
+	for k := 0; k < n; k++ {
+		perturbed := append([]float64{}, vars...)
+		if k%2 == 0 {
+			perturbed[k/2] += delta
+		} else {
+			perturbed[k/2] -= delta
+		}
+		clone := s.Clone()
+		if _, err := clone.TransformVars(perturbed); err != nil {
+			wg.Wait()
+			return nil, err
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(k int, scn *Scenario) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			objs[k], errs[k] = obj(scn)
+		}(k, clone)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	grad := make([]float64, len(vars))
+	for i := range grad {
+		grad[i] = (objs[2*i] - objs[2*i+1]) / (2 * delta)
+	}
+	return grad, nil
+}
+
+// VarImportance returns a score for how strongly each variable at vars
+// influences the scenario objective - the absolute forward finite
+// difference scaled by the variable's range (see LowerBounds and
+// UpperBounds):
+//
+//	|f(vars + delta*e_i) - f(vars)| / delta * (ub[i] - lb[i])
+//
+// Variables that would be pushed past their upper bound are perturbed
+// backward instead.  Fixed variables (i.e. with a zero range) are not
+// evaluated and always score zero, so they can be identified as candidates
+// for removal from the problem.  f is computed as for SensitivityAnalysis
+// with at most maxConcurrent evaluations running at the same time - zero or
+// less means no limit.
+func (s *Scenario) VarImportance(vars []float64, delta float64, maxConcurrent int, execfn ObjExecFunc) ([]float64, error) {
+	if len(vars) != s.NVars() {
+		return nil, fmt.Errorf("wrong number of vars: want %v, got %v", s.NVars(), len(vars))
+	} else if delta <= 0 {
+		return nil, errors.New("importance delta must be positive")
+	}
+
+	lb, ub := s.LowerBounds(), s.UpperBounds()
+
+	// objs[0] holds the objective at vars and objs[i+1] the objective for
+	// the perturbation of variable i.
+	objs := make([]float64, len(vars)+1)
+	errs := make([]error, len(vars)+1)
+	if maxConcurrent <= 0 || maxConcurrent > len(objs) {
+		maxConcurrent = len(objs)
+	}
+	sem := make(chan struct{}, maxConcurrent)
+
+	var wg sync.WaitGroup
+	for k := range objs {
+		perturbed := append([]float64{}, vars...)
+		if k > 0 {
+			i := k - 1
+			if ub[i] == lb[i] {
+				continue
+			} else if perturbed[i]+delta > ub[i] {
+				perturbed[i] -= delta
+			} else {
+				perturbed[i] += delta
+			}
+		}
+		clone := s.Clone()
+		if _, err := clone.TransformVars(perturbed); err != nil {
+			wg.Wait()
+			return nil, err
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(k int, scn *Scenario) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			objs[k], errs[k] = execfn(scn)
+		}(k, clone)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	scores := make([]float64, len(vars))
+	for i := range scores {
+		if ub[i] == lb[i] {
+			continue
+		}
+		scores[i] = math.Abs(objs[i+1]-objs[0]) / delta * (ub[i] - lb[i])
+	}
+	return scores, nil
+}
@@ -0,0 +1,154 @@
+package scen
+
+import (
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestSensitivityAnalysis(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1, Life: 0},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{10, 10, 10, 10, 70},
+	}
+
+	// the objective is the time integrated number of facilities built
+	var mu sync.Mutex
+	active, maxactive := 0, 0
+	obj := func(scn *Scenario) (float64, error) {
+		mu.Lock()
+		active++
+		if active > maxactive {
+			maxactive = active
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+
+		val := 0.0
+		for _, b := range scn.Builds {
+			val += float64(b.N * (scn.SimDur - b.Time))
+		}
+		return val, nil
+	}
+
+	vars := []float64{.5, .5, .5, .5, .5}
+	const delta = 0.25
+	grad, err := s.SensitivityAnalysis(vars, delta, 2, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxactive > 2 {
+		t.Errorf("%v objective evaluations ran concurrently, want at most 2", maxactive)
+	}
+
+	for i := range vars {
+		up := append([]float64{}, vars...)
+		up[i] += delta
+		down := append([]float64{}, vars...)
+		down[i] -= delta
+
+		fup, fdown := s.Clone(), s.Clone()
+		if _, err := fup.TransformVars(up); err != nil {
+			t.Fatal(err)
+		} else if _, err := fdown.TransformVars(down); err != nil {
+			t.Fatal(err)
+		}
+		vup, _ := obj(fup)
+		vdown, _ := obj(fdown)
+		if want := (vup - vdown) / (2 * delta); math.Abs(grad[i]-want) > 1e-9 {
+			t.Errorf("var %v: got gradient %v, want %v", i, grad[i], want)
+		}
+	}
+
+	if _, err := s.SensitivityAnalysis(vars[:2], delta, 2, obj); err == nil {
+		t.Error("wrong number of vars didn't cause an error")
+	}
+}
+
+func TestVarImportance(t *testing.T) {
+	s := &Scenario{
+		SimDur:      10,
+		BuildPeriod: 2,
+		Facs: []Facility{
+			{Proto: "Proto1", Cap: 1, Life: 0},
+			{Proto: "Proto2", Cap: 1, Life: 0, BuildAfter: 5},
+		},
+		MaxPower: []float64{10, 20, 40, 60, 70},
+		MinPower: []float64{10, 10, 10, 10, 70},
+	}
+
+	var mu sync.Mutex
+	nevals := 0
+	obj := func(scn *Scenario) (float64, error) {
+		mu.Lock()
+		nevals++
+		mu.Unlock()
+		val := 0.0
+		for _, b := range scn.Builds {
+			val += float64(b.N * (scn.SimDur - b.Time))
+		}
+		return val, nil
+	}
+
+	vars := make([]float64, s.NVars())
+	for i := range vars {
+		vars[i] = 1
+	}
+	const delta = 0.25
+	scores, err := s.VarImportance(vars, delta, 2, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ub := s.UpperBounds()
+	nfree := 0
+	for i := range vars {
+		if ub[i] != 0 {
+			nfree++
+		}
+	}
+	if nfree == len(vars) {
+		t.Fatal("test scenario has no fixed vars")
+	} else if nevals != nfree+1 {
+		t.Errorf("got %v objective evaluations, want %v", nevals, nfree+1)
+	}
+
+	base, _ := obj(transformed(t, s, vars))
+	for i := range vars {
+		if ub[i] == 0 {
+			if scores[i] != 0 {
+				t.Errorf("fixed var %v: got importance %v, want 0", i, scores[i])
+			}
+			continue
+		}
+
+		// vars at their upper bound are perturbed backward
+		down := append([]float64{}, vars...)
+		down[i] -= delta
+		val, _ := obj(transformed(t, s, down))
+		if want := math.Abs(val-base) / delta; math.Abs(scores[i]-want) > 1e-9 {
+			t.Errorf("var %v: got importance %v, want %v", i, scores[i], want)
+		}
+	}
+	if _, err := s.VarImportance(vars, 0, 2, obj); err == nil {
+		t.Error("zero delta didn't cause an error")
+	}
+}
+
+// transformed returns a clone of s transformed using vars.
+func transformed(t *testing.T, s *Scenario, vars []float64) *Scenario {
+	clone := s.Clone()
+	if _, err := clone.TransformVars(vars); err != nil {
+		t.Fatal(err)
+	}
+	return clone
+}